@@ -1,23 +1,39 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/rusik69/shortener/internal/config"
 	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/export"
+	"github.com/rusik69/shortener/internal/service"
+	"github.com/rusik69/shortener/internal/shortcode"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run cmd/migrate/main.go [migrate|seed|reset]")
+		fmt.Println("Usage: go run cmd/migrate/main.go [up|down N|status|goto V|create [-dir DIR] NAME|migrate|seed|reset|create-service-user NAME|import-csv [-owner NAME] [-atomic] [-domain HOST] FILE|set-domain [-redirect-type N] [-not-found-url URL] [-root-url URL] HOST|list-domains|remove-domain HOST|export [-dataset links|clicks] [-format csv|ndjson|parquet] [-gzip] [-from TIME] [-to TIME] [-user NAME] [-include-bots] [-o FILE]]")
 		os.Exit(1)
 	}
 
 	command := os.Args[1]
 
+	// Creating a migration only writes files
+	if command == "create" {
+		if err := createMigration(os.Args[2:]); err != nil {
+			log.Fatal("Creating migration failed:", err)
+		}
+		return
+	}
+
 	// Initialize database connection
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
@@ -39,12 +55,45 @@ func main() {
 	}
 
 	switch command {
-	case "migrate":
+	case "up", "migrate":
 		if err := db.MigrateDatabase(dbConn); err != nil {
 			log.Fatal("Migration failed:", err)
 		}
 		fmt.Println("✅ Database migration completed successfully")
 
+	case "down":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: go run cmd/migrate/main.go down N")
+		}
+		n, err := strconv.Atoi(os.Args[2])
+		if err != nil || n < 1 {
+			log.Fatal("Usage: go run cmd/migrate/main.go down N")
+		}
+		rolledBack, err := migrateDown(dbConn, n)
+		if err != nil {
+			log.Fatal("Rollback failed:", err)
+		}
+		fmt.Printf("✅ Rolled back %d migration(s)\n", rolledBack)
+
+	case "goto":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: go run cmd/migrate/main.go goto V")
+		}
+		version, err := strconv.ParseInt(os.Args[2], 10, 64)
+		if err != nil || version < 0 {
+			log.Fatal("Usage: go run cmd/migrate/main.go goto V")
+		}
+		ran, err := migrateTo(dbConn, version)
+		if err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		fmt.Printf("✅ Database at version %d (%d migration(s) run)\n", version, ran)
+
+	case "status":
+		if err := migrationStatus(dbConn); err != nil {
+			log.Fatal("Reading migration status failed:", err)
+		}
+
 	case "seed":
 		if err := db.SeedDatabase(dbConn); err != nil {
 			log.Fatal("Seeding failed:", err)
@@ -57,9 +106,51 @@ func main() {
 		}
 		fmt.Println("✅ Database reset completed successfully")
 
+	case "create-service-user":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: go run cmd/migrate/main.go create-service-user NAME")
+		}
+		key, err := createServiceUser(dbConn, os.Args[2])
+		if err != nil {
+			log.Fatal("Creating service user failed:", err)
+		}
+		fmt.Printf("✅ Service user %s created\n", os.Args[2])
+		fmt.Printf("API key (shown only once): %s\n", key)
+
+	case "import-csv":
+		if err := importCSV(dbConn, os.Args[2:]); err != nil {
+			log.Fatal("Import failed:", err)
+		}
+
+	case "set-domain":
+		domain, err := setDomain(dbConn, os.Args[2:])
+		if err != nil {
+			log.Fatal("Setting domain failed:", err)
+		}
+		fmt.Printf("✅ Domain %s saved\n", domain.Host)
+
+	case "list-domains":
+		if err := listDomains(dbConn); err != nil {
+			log.Fatal("Listing domains failed:", err)
+		}
+
+	case "remove-domain":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: go run cmd/migrate/main.go remove-domain HOST")
+		}
+		if err := service.NewService(db.NewRepository(dbConn)).RemoveDomain(os.Args[2]); err != nil {
+			log.Fatal("Removing domain failed:", err)
+		}
+		fmt.Printf("✅ Domain %s removed\n", os.Args[2])
+
+	case "export":
+		if err := exportData(dbConn, os.Args[2:]); err != nil {
+			log.Fatal("Export failed:", err)
+		}
+
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
-		fmt.Println("Available commands: migrate, seed, reset")
+		fmt.Println("Available commands: up, down, status, goto, create, migrate, seed, reset, create-service-user, import-csv, set-domain, list-domains, remove-domain, export")
 		os.Exit(1)
 	}
 }
@@ -71,9 +162,14 @@ func resetDatabase(dbConn *sql.DB) error {
 	tables := []string{
 		"captcha_attempts",
 		"rate_limits",
+		"webhook_deliveries",
+		"webhooks",
 		"clicks",
 		"short_urls",
+		"domains",
+		"api_keys",
 		"users",
+		"schema_migrations",
 	}
 
 	for _, table := range tables {
@@ -86,3 +182,272 @@ func resetDatabase(dbConn *sql.DB) error {
 	log.Println("Running migrations...")
 	return db.MigrateDatabase(dbConn)
 }
+
+// migrator returns a migrator for the migrations built into this binary
+func migrator(dbConn *sql.DB) (*db.Migrator, error) {
+	migrations, err := db.EmbeddedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return db.NewMigrator(dbConn, migrations), nil
+}
+
+// migrateDown rolls back the n most recently applied migrations
+func migrateDown(dbConn *sql.DB, n int) (int, error) {
+	m, err := migrator(dbConn)
+	if err != nil {
+		return 0, err
+	}
+	return m.Down(context.Background(), n)
+}
+
+// migrateTo applies or rolls back migrations to reach version
+func migrateTo(dbConn *sql.DB, version int64) (int, error) {
+	m, err := migrator(dbConn)
+	if err != nil {
+		return 0, err
+	}
+	return m.Goto(context.Background(), version)
+}
+
+// migrationStatus prints every migration and when it was applied
+func migrationStatus(dbConn *sql.DB) error {
+	m, err := migrator(dbConn)
+	if err != nil {
+		return err
+	}
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedAt != nil {
+			applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+		} else {
+			pending++
+		}
+		if status.Unknown {
+			applied += " (unknown to this binary)"
+		}
+		fmt.Printf("%04d\t%s\t%s\n", status.Version, status.Name, applied)
+	}
+	fmt.Printf("%d migration(s), %d pending\n", len(statuses), pending)
+	return nil
+}
+
+// createMigration writes empty up and down files for a new migration
+func createMigration(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	dir := flags.String("dir", "internal/db/migrations", "directory holding the migrations")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: create [-dir DIR] NAME")
+	}
+
+	up, down, err := db.CreateMigration(*dir, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Created %s and %s\n", up, down)
+	return nil
+}
+
+// createServiceUser creates a password-less account for internal tools and
+// returns its first API key
+func createServiceUser(dbConn *sql.DB, name string) (string, error) {
+	svc := service.NewService(db.NewRepository(dbConn))
+
+	user, err := svc.CreateServiceUser(name)
+	if err != nil {
+		return "", err
+	}
+
+	key, _, err := svc.CreateAPIKey(user.ID, "default")
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// importCSV loads links from a CSV file (url, custom_code, expiry) in one
+// transaction and prints a per-row report
+func importCSV(dbConn *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("import-csv", flag.ExitOnError)
+	owner := flags.String("owner", "", "username that will own the imported links")
+	atomic := flags.Bool("atomic", false, "import nothing unless every row succeeds")
+	domain := flags.String("domain", "", "host whose namespace the links go in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import-csv [-owner NAME] [-atomic] [-domain HOST] FILE")
+	}
+
+	repo := db.NewRepository(dbConn)
+
+	// Use the same short code and destination rules as the server
+	generator, err := shortcode.New(shortcode.Config{
+		Strategy: os.Getenv("SHORTCODE_STRATEGY"),
+		Length:   config.Int("SHORTCODE_LENGTH", 0),
+		Salt:     os.Getenv("SHORTCODE_SALT"),
+	}, repo.NextShortCodeID)
+	if err != nil {
+		return err
+	}
+	codes, err := config.CodePolicy()
+	if err != nil {
+		return fmt.Errorf("invalid short code policy: %v", err)
+	}
+	urls, err := config.URLPolicy()
+	if err != nil {
+		return fmt.Errorf("invalid URL policy: %v", err)
+	}
+	svc := service.NewService(repo,
+		service.WithCodeGenerator(generator),
+		service.WithCodePolicy(codes),
+		service.WithURLPolicy(urls),
+	)
+
+	opts := service.BatchOptions{Atomic: *atomic, Host: *domain}
+	if *owner != "" {
+		user, err := repo.GetUserByUsername(*owner)
+		if err != nil {
+			return fmt.Errorf("failed to find owner %s: %v", *owner, err)
+		}
+		opts.OwnerID = &user.ID
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	results, err := svc.ImportCSV(file, opts)
+	if err != nil {
+		return err
+	}
+
+	created := 0
+	for _, result := range results {
+		if result.Error != "" {
+			fmt.Printf("row %d: %s: %s\n", result.Row, result.URL, result.Error)
+			continue
+		}
+		created++
+		fmt.Printf("row %d: %s -> %s\n", result.Row, result.URL, result.ShortCode)
+	}
+	fmt.Printf("✅ Imported %d of %d rows\n", created, len(results))
+	return nil
+}
+
+// setDomain gives a host its own code namespace or changes its settings
+func setDomain(dbConn *sql.DB, args []string) (*db.Domain, error) {
+	flags := flag.NewFlagSet("set-domain", flag.ExitOnError)
+	redirectType := flags.Int("redirect-type", 0, "redirect type of new links: 301, 302, 307 or 308 (default: server setting)")
+	notFoundURL := flags.String("not-found-url", "", "where unknown codes redirect instead of the 404 page")
+	rootURL := flags.String("root-url", "", "where / redirects instead of the web frontend")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 1 {
+		return nil, fmt.Errorf("usage: set-domain [-redirect-type N] [-not-found-url URL] [-root-url URL] HOST")
+	}
+
+	svc := service.NewService(db.NewRepository(dbConn))
+	return svc.SetDomain(db.Domain{
+		Host:         flags.Arg(0),
+		RedirectType: *redirectType,
+		NotFoundURL:  *notFoundURL,
+		RootURL:      *rootURL,
+	})
+}
+
+// listDomains prints every configured domain with its settings
+func listDomains(dbConn *sql.DB) error {
+	domains, err := service.NewService(db.NewRepository(dbConn)).ListDomains()
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		redirectType := "default"
+		if d.RedirectType != 0 {
+			redirectType = strconv.Itoa(d.RedirectType)
+		}
+		fmt.Printf("%s\tredirect_type=%s\tnot_found_url=%s\troot_url=%s\n", d.Host, redirectType, d.NotFoundURL, d.RootURL)
+	}
+	fmt.Printf("%d domain(s)\n", len(domains))
+	return nil
+}
+
+// exportData streams links or clicks to a file or stdout. Progress goes to
+// stderr so stdout can be piped.
+func exportData(dbConn *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dataset := flags.String("dataset", service.DatasetClicks, "what to export: links or clicks")
+	format := flags.String("format", string(export.CSV), "file format: csv, ndjson or parquet")
+	compress := flags.Bool("gzip", false, "compress the output with gzip")
+	from := flags.String("from", "", "only rows created at or after this RFC 3339 time")
+	to := flags.String("to", "", "only rows created before this RFC 3339 time (default: now)")
+	owner := flags.String("user", "", "only this user's links (default: every user's)")
+	includeBots := flags.Bool("include-bots", false, "export clicks from bots too")
+	output := flags.String("o", "", "file to write (default: stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: export [-dataset links|clicks] [-format csv|ndjson|parquet] [-gzip] [-from TIME] [-to TIME] [-user NAME] [-include-bots] [-o FILE]")
+	}
+
+	opts := service.ExportOptions{Dataset: *dataset, Format: export.Format(*format), Gzip: *compress, IncludeBots: *includeBots}
+	var err error
+	if *from != "" {
+		if opts.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fmt.Errorf("invalid -from: %v", err)
+		}
+	}
+	if *to != "" {
+		if opts.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("invalid -to: %v", err)
+		}
+	}
+
+	repo := db.NewRepository(dbConn)
+	var ownerID *int64
+	if *owner != "" {
+		user, err := repo.GetUserByUsername(*owner)
+		if err != nil {
+			return fmt.Errorf("failed to find user %s: %v", *owner, err)
+		}
+		ownerID = &user.ID
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		out = file
+	}
+
+	if err := service.NewService(repo).Export(context.Background(), ownerID, opts, out); err != nil {
+		return err
+	}
+	if *output != "" {
+		if err := out.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "✅ Exported %s to %s\n", opts.Dataset, *output)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rusik69/shortener/internal/cache"
+	"github.com/rusik69/shortener/internal/config"
+	"github.com/rusik69/shortener/internal/db"
+)
+
+// newRedisClient connects to REDIS_URL, e.g. redis://localhost:6379/0
+func newRedisClient() (*redis.Client, error) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return nil, fmt.Errorf("REDIS_URL is not set")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// withLookupCache wraps repo in the short code cache selected by
+// CACHE_BACKEND: "memory" (default), "redis" or "none"
+func withLookupCache(repo db.Repository) (db.Repository, error) {
+	var store cache.Store
+	backend := os.Getenv("CACHE_BACKEND")
+	switch backend {
+	case "", "memory":
+		backend = "memory"
+		store = cache.NewLRU(config.Int("CACHE_SIZE", cache.DefaultSize))
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		store = cache.NewRedis(client, "shortener:")
+	case "none":
+		return repo, nil
+	default:
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %q", backend)
+	}
+
+	negativeTTL := config.Duration("CACHE_NEGATIVE_TTL", cache.DefaultNegativeTTL)
+	if negativeTTL == 0 {
+		negativeTTL = -1 // zero disables negative caching
+	}
+
+	log.Printf("Caching short code lookups in %s", backend)
+	return cache.NewRepository(repo, store, cache.Config{
+		TTL:         config.Duration("CACHE_TTL", cache.DefaultTTL),
+		NegativeTTL: negativeTTL,
+	}), nil
+}
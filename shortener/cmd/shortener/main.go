@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/rusik69/shortener/internal/api"
+	"github.com/rusik69/shortener/internal/challenge"
+	"github.com/rusik69/shortener/internal/config"
 	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/geoip"
+	"github.com/rusik69/shortener/internal/ingest"
 	"github.com/rusik69/shortener/internal/service"
+	"github.com/rusik69/shortener/internal/shortcode"
+	"github.com/rusik69/shortener/internal/urlpolicy"
+	"github.com/rusik69/shortener/internal/webhook"
 )
 
 // InitDatabase initializes the database connection
@@ -50,13 +63,134 @@ func main() {
 
 	// Create repository and service
 	repo := db.NewRepository(dbConn)
-	service := service.NewService(repo)
+
+	generator, err := shortcode.New(shortcode.Config{
+		Strategy: os.Getenv("SHORTCODE_STRATEGY"),
+		Length:   config.Int("SHORTCODE_LENGTH", 0),
+		Salt:     os.Getenv("SHORTCODE_SALT"),
+	}, repo.NextShortCodeID)
+	if err != nil {
+		log.Fatal("Invalid short code configuration:", err)
+	}
+
+	policy, err := config.CodePolicy()
+	if err != nil {
+		log.Fatal("Invalid short code policy:", err)
+	}
+
+	urls, err := config.URLPolicy()
+	if err != nil {
+		log.Fatal("Invalid URL policy:", err)
+	}
+
+	redirectType := config.Int("REDIRECT_TYPE", service.DefaultRedirectType)
+	if !service.ValidRedirectType(redirectType) {
+		log.Fatalf("Invalid REDIRECT_TYPE %d: must be 301, 302, 307 or 308", redirectType)
+	}
+
+	options := []service.Option{
+		service.WithCodeGenerator(generator),
+		service.WithCodePolicy(policy),
+		service.WithURLPolicy(urls),
+		service.WithUnlockSecret([]byte(os.Getenv("UNLOCK_SECRET")), config.Duration("UNLOCK_TTL", service.DefaultUnlockTTL)),
+		service.WithDefaultRedirectType(redirectType),
+	}
+
+	// Locate visitors from local GeoIP databases, if configured
+	var geo *geoip.DB
+	if paths := config.List("GEOIP_DATABASE"); len(paths) > 0 {
+		geo, err = geoip.Open(paths...)
+		if err != nil {
+			log.Fatal("Failed to open GeoIP database:", err)
+		}
+		defer func() {
+			_ = geo.Close()
+		}()
+		options = append(options, service.WithGeoResolver(geo))
+	}
+
+	// Write clicks in batches off the redirect path unless CLICK_INGEST=sync
+	var clicks *ingest.Pipeline
+	switch mode := os.Getenv("CLICK_INGEST"); mode {
+	case "", "async":
+		clicks = ingest.New(repo, ingest.Config{
+			BufferSize:    config.Int("CLICK_BUFFER_SIZE", ingest.DefaultBufferSize),
+			BatchSize:     config.Int("CLICK_BATCH_SIZE", ingest.DefaultBatchSize),
+			FlushInterval: config.Duration("CLICK_FLUSH_INTERVAL", ingest.DefaultFlushInterval),
+		})
+		options = append(options, service.WithClickRecorder(clicks))
+	case "sync":
+	default:
+		log.Fatalf("Unknown CLICK_INGEST %q", mode)
+	}
+
+	// Serve redirects from a cache in front of the database
+	cachedRepo, err := withLookupCache(repo)
+	if err != nil {
+		log.Fatal("Invalid cache configuration:", err)
+	}
+
+	service := service.NewService(cachedRepo, options...)
+
+	limiter, err := newLimiter(repo)
+	if err != nil {
+		log.Fatal("Invalid rate limit configuration:", err)
+	}
+	limits, err := loadRateLimits()
+	if err != nil {
+		log.Fatal("Invalid rate limit configuration:", err)
+	}
+	guard, err := newGuard(limiter, repo)
+	if err != nil {
+		log.Fatal("Invalid challenge configuration:", err)
+	}
 
 	// Create Gin router
 	router := gin.Default()
 
 	// Setup routes
-	api.SetupRoutes(router, service)
+	api.SetupRoutes(router, service,
+		api.WithLimiter(limiter),
+		api.WithRateLimits(limits),
+		api.WithChallenge(guard),
+		api.WithCodePolicy(policy),
+	)
+
+	if clicks != nil {
+		api.RegisterMetrics(router, clicks.Stats)
+	}
+
+	// Keep custom codes from shadowing routes
+	policy.Reserve(api.RouteSegments(router)...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if geo != nil {
+		go geo.Watch(ctx, config.Duration("GEOIP_RELOAD_INTERVAL", geoip.DefaultReloadInterval))
+	}
+
+	go urls.Watch(ctx, config.Duration("URL_BLOCKLIST_RELOAD_INTERVAL", urlpolicy.DefaultReloadInterval))
+
+	// Purge expired links in the background
+	go runExpiryReaper(ctx, repo, config.Duration("EXPIRY_REAPER_INTERVAL", defaultReaperInterval), retentions{
+		expired:    config.Duration("EXPIRY_RETENTION", defaultExpiryRetention),
+		deliveries: config.Duration("WEBHOOK_DELIVERY_RETENTION", defaultDeliveryRetention),
+		// Answers must outlive their challenge to block replays
+		captchaAttempts: max(config.Duration("CHALLENGE_ATTEMPT_RETENTION", defaultCaptchaRetention), config.Duration("CHALLENGE_TTL", challenge.DefaultTTL)),
+	})
+
+	// Post queued webhook deliveries; replicas skip each other's claims
+	go webhook.New(repo, webhook.Config{
+		Interval:    config.Duration("WEBHOOK_POLL_INTERVAL", webhook.DefaultInterval),
+		Timeout:     config.Duration("WEBHOOK_TIMEOUT", webhook.DefaultTimeout),
+		MaxAttempts: config.Int("WEBHOOK_MAX_ATTEMPTS", webhook.DefaultMaxAttempts),
+		BaseBackoff: config.Duration("WEBHOOK_BACKOFF", webhook.DefaultBaseBackoff),
+		MaxBackoff:  config.Duration("WEBHOOK_MAX_BACKOFF", webhook.DefaultMaxBackoff),
+		// Receivers are user-supplied; only trusted setups may reach
+		// internal addresses
+		AllowInternal: config.Bool("WEBHOOK_ALLOW_INTERNAL", false),
+	}).Run(ctx)
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -64,8 +198,31 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: router,
+	}
+
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown error: %v", err)
+	}
+
+	// Flush clicks still in the buffer
+	if clicks != nil {
+		if err := clicks.Close(shutdownCtx); err != nil {
+			log.Printf("Click buffer not fully flushed: %v", err)
+		}
 	}
 }
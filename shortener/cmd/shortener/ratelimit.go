@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/rusik69/shortener/internal/api"
+	"github.com/rusik69/shortener/internal/challenge"
+	"github.com/rusik69/shortener/internal/config"
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/ratelimit"
+)
+
+// newLimiter builds the rate limiter selected by RATE_LIMIT_BACKEND:
+// "memory" (default, per process), "postgres" or "redis" (shared by all
+// replicas)
+func newLimiter(repo db.Repository) (ratelimit.Limiter, error) {
+	backend := os.Getenv("RATE_LIMIT_BACKEND")
+	switch backend {
+	case "", "memory":
+		return ratelimit.NewMemory(), nil
+	case "postgres":
+		log.Printf("Keeping rate limits in Postgres")
+		return ratelimit.NewPostgres(repo), nil
+	case "redis":
+		client, err := newRedisClient()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Keeping rate limits in Redis")
+		return ratelimit.NewRedis(client, "shortener:ratelimit:"), nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q", backend)
+	}
+}
+
+// loadRateLimits reads the per-route policies, e.g. RATE_LIMIT_SHORTEN=30/1m
+// and RATE_LIMIT_SHORTEN_BURST=10, falling back to api.DefaultRateLimits
+func loadRateLimits() (api.RateLimits, error) {
+	limits := api.DefaultRateLimits
+	for _, policy := range []struct {
+		env   string
+		limit *ratelimit.Limit
+	}{
+		{"RATE_LIMIT_SHORTEN", &limits.Shorten},
+		{"RATE_LIMIT_REDIRECT", &limits.Redirect},
+		{"RATE_LIMIT_API", &limits.API},
+		{"RATE_LIMIT_UNLOCK", &limits.Unlock},
+		{"RATE_LIMIT_UNLOCK_LINK", &limits.UnlockLink},
+		{"RATE_LIMIT_AUTH", &limits.Auth},
+	} {
+		if value := os.Getenv(policy.env); value != "" {
+			limit, err := ratelimit.ParseLimit(value)
+			if err != nil {
+				return api.RateLimits{}, fmt.Errorf("%s: %w", policy.env, err)
+			}
+			// A new rate without a burst lets the whole rate through at once
+			*policy.limit = limit
+		}
+		policy.limit.Burst = config.Int(policy.env+"_BURST", policy.limit.Burst)
+	}
+	return limits, nil
+}
+
+// newGuard configures proof-of-work challenges for anonymous link creation.
+// CHALLENGE_THRESHOLD=off disables them.
+func newGuard(limiter ratelimit.Limiter, repo db.Repository) (*challenge.Guard, error) {
+	threshold := challenge.DefaultThreshold
+	if value := os.Getenv("CHALLENGE_THRESHOLD"); value != "" {
+		var err error
+		if threshold, err = ratelimit.ParseLimit(value); err != nil {
+			return nil, fmt.Errorf("CHALLENGE_THRESHOLD: %w", err)
+		}
+		if threshold.Unlimited() {
+			return nil, nil
+		}
+	}
+
+	return challenge.New(limiter, repo, challenge.Config{
+		Threshold:  threshold,
+		Difficulty: config.Int("CHALLENGE_DIFFICULTY", challenge.DefaultDifficulty),
+		TTL:        config.Duration("CHALLENGE_TTL", challenge.DefaultTTL),
+		Secret:     []byte(os.Getenv("CHALLENGE_SECRET")),
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+)
+
+const (
+	defaultReaperInterval    = time.Hour
+	defaultExpiryRetention   = 7 * 24 * time.Hour
+	defaultDeliveryRetention = 30 * 24 * time.Hour
+	defaultCaptchaRetention  = 24 * time.Hour
+)
+
+// retentions are how long the reaper keeps each kind of row
+type retentions struct {
+	// expired links, which keep answering 410 Gone meanwhile
+	expired time.Duration
+	// delivered and dead webhook deliveries
+	deliveries time.Duration
+	// challenge answers, which block replays while their challenge is valid
+	captchaAttempts time.Duration
+}
+
+// runExpiryReaper periodically purges short URLs (and their clicks) that
+// expired longer ago than their retention, along with ended rate limit
+// windows, finished webhook deliveries and old challenge answers. Keeping
+// recently expired rows around lets the redirect handler keep answering
+// 410 Gone instead of 404 for a while. Non-positive intervals fall back to
+// defaultReaperInterval.
+func runExpiryReaper(ctx context.Context, repo db.Repository, interval time.Duration, keep retentions) {
+	if interval <= 0 {
+		interval = defaultReaperInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		reapExpired(repo, keep)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func reapExpired(repo db.Repository, keep retentions) {
+	// Each purge is independent, so one failing does not stop the others
+	deleted, err := repo.DeleteExpiredShortURLs(time.Now().Add(-keep.expired))
+	if err != nil {
+		log.Printf("Failed to purge expired short URLs: %v", err)
+	} else if deleted > 0 {
+		log.Printf("Purged %d expired short URLs", deleted)
+	}
+
+	// Rate limit windows only matter until they end
+	if _, err := repo.DeleteExpiredRateLimits(time.Now()); err != nil {
+		log.Printf("Failed to purge rate limit counters: %v", err)
+	}
+
+	// Pending deliveries are kept however old they are
+	if _, err := repo.DeleteFinishedWebhookDeliveries(time.Now().Add(-keep.deliveries)); err != nil {
+		log.Printf("Failed to purge webhook deliveries: %v", err)
+	}
+
+	if _, err := repo.DeleteOldCaptchaAttempts(time.Now().Add(-keep.captchaAttempts)); err != nil {
+		log.Printf("Failed to purge challenge attempts: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/service"
+)
+
+// getAnalytics returns a link's clicks over time and its top referrers,
+// user agents and countries. Query: interval=hour|day|week, from, to
+// (RFC 3339), top and include_bots.
+func getAnalytics(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := service.AnalyticsQuery{Interval: c.Query("interval"), Host: c.Request.Host}
+		query.Top, _ = strconv.Atoi(c.Query("top"))
+		query.IncludeBots, _ = strconv.ParseBool(c.Query("include_bots"))
+
+		var err error
+		if query.From, err = parseTimeParam(c, "from"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from", "details": err.Error()})
+			return
+		}
+		if query.To, err = parseTimeParam(c, "to"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to", "details": err.Error()})
+			return
+		}
+
+		var viewerID *int64
+		if user := currentUser(c); user != nil {
+			viewerID = &user.ID
+		}
+
+		report, err := svc.GetAnalytics(viewerID, c.Param("code"), query)
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrURLNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+			case errors.Is(err, service.ErrInvalidInterval), errors.Is(err, service.ErrInvalidRange):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid range", "details": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load analytics"})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// parseTimeParam reads an optional RFC 3339 query parameter
+func parseTimeParam(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -1,30 +1,115 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/challenge"
+	"github.com/rusik69/shortener/internal/db"
 	"github.com/rusik69/shortener/internal/middleware"
+	"github.com/rusik69/shortener/internal/ratelimit"
 	"github.com/rusik69/shortener/internal/service"
+	"github.com/rusik69/shortener/internal/shortcode"
+	"github.com/rusik69/shortener/internal/urlpolicy"
 )
 
+// RateLimits are the token buckets applied to each group of routes. A zero
+// Limit turns limiting off for that group.
+type RateLimits struct {
+	// Shorten covers link creation, single and batch
+	Shorten ratelimit.Limit
+	// Redirect covers short link redirects
+	Redirect ratelimit.Limit
+	// API covers every other /api route
+	API ratelimit.Limit
+	// Unlock covers wrong passwords on protected links, per client IP
+	Unlock ratelimit.Limit
+	// UnlockLink covers wrong passwords per link, from any IP
+	UnlockLink ratelimit.Limit
+	// Auth covers rejected API keys and logins, per client IP
+	Auth ratelimit.Limit
+}
+
+// DefaultRateLimits are used unless WithRateLimits says otherwise
+var DefaultRateLimits = RateLimits{
+	Shorten:    ratelimit.Limit{Requests: 30, Window: time.Minute, Burst: 10},
+	Redirect:   ratelimit.Limit{Requests: 600, Window: time.Minute, Burst: 100},
+	API:        ratelimit.Limit{Requests: 100, Window: time.Minute, Burst: 100},
+	Unlock:     ratelimit.Limit{Requests: 10, Window: 15 * time.Minute, Burst: 5},
+	UnlockLink: ratelimit.Limit{Requests: 30, Window: time.Hour, Burst: 10},
+	Auth:       ratelimit.Limit{Requests: 10, Window: time.Minute, Burst: 10},
+}
+
+// Option configures SetupRoutes
+type Option func(*routeOptions)
+
+type routeOptions struct {
+	limiter ratelimit.Limiter
+	limits  RateLimits
+	guard   *challenge.Guard
+	codes   *shortcode.Policy
+}
+
+// WithLimiter sets where token buckets are kept; by default they live in
+// process memory
+func WithLimiter(l ratelimit.Limiter) Option {
+	return func(o *routeOptions) {
+		o.limiter = l
+	}
+}
+
+// WithRateLimits replaces DefaultRateLimits
+func WithRateLimits(limits RateLimits) Option {
+	return func(o *routeOptions) {
+		o.limits = limits
+	}
+}
+
+// WithChallenge makes anonymous clients that create links too fast solve
+// guard's proof-of-work challenges
+func WithChallenge(guard *challenge.Guard) Option {
+	return func(o *routeOptions) {
+		o.guard = guard
+	}
+}
+
+// WithCodePolicy sets the short code policy the service uses, so that
+// spellings of a code the service treats as one link share rate limits
+func WithCodePolicy(policy *shortcode.Policy) Option {
+	return func(o *routeOptions) {
+		o.codes = policy
+	}
+}
+
 // SetupRoutes configures all API routes
-func SetupRoutes(r *gin.Engine, svc service.Service) {
+func SetupRoutes(r *gin.Engine, svc service.Service, opts ...Option) {
+	o := routeOptions{limits: DefaultRateLimits}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.limiter == nil {
+		o.limiter = ratelimit.NewMemory()
+	}
+
 	// Trust all proxies
 	r.ForwardedByClientIP = true
 	
-	// Apply rate limiting middleware
-	r.Use(middleware.RateLimitMiddleware())
-	
 	// Serve static files and load templates (skip in test mode)
 	if gin.Mode() != gin.TestMode {
 		r.Static("/static", "./web")
 		r.LoadHTMLGlob("web/*.html")
 	}
 	
-	// Web frontend
+	// Web frontend, unless the domain has a landing page of its own
 	r.GET("/", func(c *gin.Context) {
+		if domain, err := svc.DomainFor(c.Request.Host); err == nil && domain.RootURL != "" {
+			c.Redirect(http.StatusFound, domain.RootURL)
+			return
+		}
 		if gin.Mode() == gin.TestMode {
 			c.JSON(http.StatusOK, gin.H{"message": "URL Shortener"})
 		} else {
@@ -36,13 +121,51 @@ func SetupRoutes(r *gin.Engine, svc service.Service) {
 	
 	// API routes
 	api := r.Group("/api")
+	api.Use(
+		middleware.FailureLimitMiddleware(o.limiter, middleware.Policy{Name: "auth", Limit: o.limits.Auth}, middleware.ClientIP),
+		authenticate(svc),
+		apiRateLimit(o.limiter, o.limits),
+	)
 	{
-		api.POST("/shorten", createShortURL(svc))
+		api.POST("/shorten", requireChallenge(o.guard), createShortURL(svc))
 		api.GET("/stats/:code", getURLStats(svc))
+		api.GET("/stats/:code/analytics", getAnalytics(svc))
+		api.GET("/qr/:code", getQRCode(svc))
+
+		api.POST("/users", registerUser(svc))
+		api.POST("/login", login(svc))
+	}
+
+	// Routes that require an API key
+	account := api.Group("")
+	account.Use(requireUser())
+	{
+		account.GET("/me", getCurrentUser())
+		account.POST("/shorten/batch", createShortURLBatch(svc))
+		account.GET("/keys", listAPIKeys(svc))
+		account.POST("/keys", createAPIKey(svc))
+		account.POST("/keys/:id/rotate", rotateAPIKey(svc))
+		account.DELETE("/keys/:id", revokeAPIKey(svc))
+
+		account.GET("/links", listLinks(svc))
+		account.GET("/links/:code", getLink(svc))
+		account.PATCH("/links/:code", updateLink(svc))
+		account.DELETE("/links/:code", deleteLink(svc))
+
+		account.GET("/webhooks", listWebhooks(svc))
+		account.POST("/webhooks", createWebhook(svc))
+		account.DELETE("/webhooks/:id", deleteWebhook(svc))
+		account.GET("/webhooks/deliveries", listWebhookDeliveries(svc))
+
+		account.GET("/export", exportData(svc))
 	}
 	
 	// Redirect route (not under /api to keep URLs short)
-	r.GET("/:code", redirectURL(svc))
+	r.GET("/:code", middleware.RateLimitMiddleware(o.limiter, middleware.Policy{Name: "redirect", Limit: o.limits.Redirect}, middleware.ClientIP), redirectURL(svc))
+	r.POST("/:code/unlock",
+		middleware.FailureLimitMiddleware(o.limiter, middleware.Policy{Name: "unlock", Limit: o.limits.Unlock}, middleware.ClientIP),
+		middleware.FailureLimitMiddleware(o.limiter, middleware.Policy{Name: "unlock", Limit: o.limits.UnlockLink}, unlockLinkKey(svc, o.codes)),
+		unlockURL(svc))
 	
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
@@ -53,17 +176,81 @@ func SetupRoutes(r *gin.Engine, svc service.Service) {
 	})
 }
 
+// apiRateLimit applies the shorten policy to link creation and the API
+// policy to everything else under /api. It runs after authenticate so
+// requests with an API key are counted per user rather than per IP.
+func apiRateLimit(limiter ratelimit.Limiter, limits RateLimits) gin.HandlerFunc {
+	shorten := middleware.RateLimitMiddleware(limiter, middleware.Policy{Name: "shorten", Limit: limits.Shorten}, rateLimitKey)
+	other := middleware.RateLimitMiddleware(limiter, middleware.Policy{Name: "api", Limit: limits.API}, rateLimitKey)
+	return func(c *gin.Context) {
+		if strings.HasPrefix(c.FullPath(), "/api/shorten") {
+			shorten(c)
+		} else {
+			other(c)
+		}
+	}
+}
+
+// rateLimitKey counts authenticated requests per user and others per IP
+func rateLimitKey(c *gin.Context) string {
+	if user := currentUser(c); user != nil {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	return middleware.ClientIP(c)
+}
+
+// RouteSegments returns the first path segment of every static route, which
+// short codes must not shadow
+func RouteSegments(r *gin.Engine) []string {
+	var segments []string
+	for _, route := range r.Routes() {
+		segment := strings.SplitN(strings.TrimPrefix(route.Path, "/"), "/", 2)[0]
+		if segment == "" || strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
 // CreateURLRequest represents the request payload for URL shortening
 type CreateURLRequest struct {
 	URL        string `json:"url" binding:"required"`
 	CustomCode string `json:"custom_code,omitempty"`
+	// ExpiresIn is a time-to-live in seconds, mutually exclusive with ExpiresAt
+	ExpiresIn int64      `json:"expires_in,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Password protects the link; visitors must enter it to be redirected
+	Password string `json:"password,omitempty"`
+	// RedirectType is 301, 302, 307 or 308; omitted uses the server default
+	RedirectType int `json:"redirect_type,omitempty"`
+	// Destinations split visitors between several URLs by weight
+	Destinations []db.Destination `json:"destinations,omitempty"`
+	// Rules send matching visitors elsewhere, first match wins
+	Rules []db.Rule `json:"rules,omitempty"`
 }
 
 // CreateURLResponse represents the response for URL shortening
 type CreateURLResponse struct {
-	ShortURL  string `json:"short_url"`
-	ShortCode string `json:"short_code"`
-	FullURL   string `json:"full_url"`
+	ShortURL  string     `json:"short_url"`
+	ShortCode string     `json:"short_code"`
+	FullURL   string     `json:"full_url"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expiresAt resolves the requested TTL or absolute expiry into a single time
+func (req *CreateURLRequest) expiresAt() (*time.Time, error) {
+	if req.ExpiresIn != 0 && req.ExpiresAt != nil {
+		return nil, errors.New("expires_in and expires_at are mutually exclusive")
+	}
+	if req.ExpiresIn < 0 {
+		return nil, errors.New("expires_in must be positive")
+	}
+	if req.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second).UTC()
+		return &t, nil
+	}
+	return req.ExpiresAt, nil
 }
 
 // createShortURL handles URL shortening requests
@@ -79,13 +266,71 @@ func createShortURL(svc service.Service) gin.HandlerFunc {
 			return
 		}
 
-		shortCode, err := svc.CreateShortURL(req.URL, req.CustomCode)
+		expiresAt, err := req.expiresAt()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid expiry",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		opts := service.CreateOptions{
+			ExpiresAt:    expiresAt,
+			Password:     req.Password,
+			RedirectType: req.RedirectType,
+			Destinations: req.Destinations,
+			Rules:        req.Rules,
+			Host:         c.Request.Host,
+		}
+		if user := currentUser(c); user != nil {
+			opts.OwnerID = &user.ID
+		}
+
+		shortCode, err := svc.CreateShortURL(req.URL, req.CustomCode, opts)
 		if err != nil {
-			if err == service.ErrInvalidURL {
+			if rejectedURL(c, err) {
+				return
+			} else if err == service.ErrInvalidURL {
 				c.JSON(http.StatusBadRequest, gin.H{
 					"error": "Invalid URL format",
 					"details": err.Error(),
 				})
+			} else if errors.Is(err, service.ErrInvalidRules) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid rules",
+					"details": err.Error(),
+				})
+			} else if errors.Is(err, service.ErrInvalidDestinations) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid destinations",
+					"details": err.Error(),
+				})
+			} else if err == service.ErrInvalidRedirectType {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid redirect type",
+					"details": err.Error(),
+				})
+			} else if err == service.ErrInvalidLinkPassword {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid password",
+					"details": err.Error(),
+				})
+			} else if err == service.ErrInvalidExpiry {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid expiry",
+					"details": err.Error(),
+				})
+			} else if errors.Is(err, shortcode.ErrInvalidCode) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid custom code",
+					"details": err.Error(),
+				})
+			} else if err == service.ErrCodeTaken {
+				c.JSON(http.StatusConflict, gin.H{
+					"error":   "Custom code already exists",
+					"details": err.Error(),
+				})
 			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "Failed to create short URL",
@@ -95,27 +340,53 @@ func createShortURL(svc service.Service) gin.HandlerFunc {
 			return
 		}
 
-		// Build full URL
-		host := c.Request.Host
-		scheme := "http"
-		if c.Request.TLS != nil {
-			scheme = "https"
-		}
-		fullURL := scheme + "://" + host + "/" + shortCode
-
+		// The link is stored already; if the domain cannot be looked up
+		// again the request host is as good a guess as any
+		domain, _ := svc.DomainFor(c.Request.Host)
 		c.JSON(http.StatusCreated, CreateURLResponse{
 			ShortURL:  shortCode,
 			ShortCode: shortCode,
-			FullURL:   fullURL,
+			FullURL:   shortLinkURL(c, domain.Host, shortCode),
+			ExpiresAt: expiresAt,
 		})
 	}
 }
 
+// shortLinkURL builds the public URL of code. Links on a configured domain
+// use its host; links in the default namespace use the request's host.
+func shortLinkURL(c *gin.Context, domain, code string) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	host := domain
+	if host == "" {
+		host = c.Request.Host
+	}
+	return scheme + "://" + host + "/" + code
+}
+
+// rejectedURL answers 400 with the rejection code if err comes from the
+// URL policy, and reports whether it did
+func rejectedURL(c *gin.Context, err error) bool {
+	var policyErr *urlpolicy.Error
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":   "URL not allowed",
+		"code":    policyErr.Code,
+		"details": err.Error(),
+	})
+	return true
+}
+
 // getURLStats retrieves statistics for a short URL
 func getURLStats(svc service.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		code := c.Param("code")
-		stats, err := svc.GetURLStats(code)
+		includeBots, _ := strconv.ParseBool(c.Query("include_bots"))
+		stats, err := svc.GetURLStats(code, service.StatsOptions{IncludeBots: includeBots, Host: c.Request.Host})
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
 			return
@@ -131,32 +402,82 @@ func redirectURL(svc service.Service) gin.HandlerFunc {
 		code := c.Param("code")
 		
 		// Validate code format
-		if len(code) == 0 || len(code) > 10 {
-			if gin.Mode() == gin.TestMode {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Invalid short code"})
-			} else {
-				c.HTML(http.StatusNotFound, "error.html", gin.H{
-					"error": "Invalid short code",
-				})
-			}
+		if len(code) == 0 || len(code) > shortcode.MaxLength {
+			renderNotFound(c, svc, "Invalid short code")
 			return
 		}
 
 		// Get IP address - pass as-is to service layer for proper handling
 		ip := c.ClientIP()
 		
-		originalURL, err := svc.RedirectURL(code, ip, c.Request.UserAgent())
+		redirect, err := svc.RedirectURL(code, service.Visit{
+			IP:        ip,
+			UserAgent: c.Request.UserAgent(),
+			Referrer:  c.Request.Referer(),
+			Query:     c.Request.URL.Query(),
+			Unlock:    unlockToken(c),
+			Variant:   splitVariant(c),
+			Language:  c.GetHeader("Accept-Language"),
+			Host:      c.Request.Host,
+		})
 		if err != nil {
-			if gin.Mode() == gin.TestMode {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Short URL not found"})
+			if errors.Is(err, service.ErrPasswordRequired) {
+				renderUnlock(c, http.StatusUnauthorized, code, "")
+			} else if errors.Is(err, service.ErrURLExpired) {
+				renderError(c, http.StatusGone, "Link expired", "This short URL has expired and is no longer available")
+			} else if errors.Is(err, service.ErrURLDisabled) {
+				renderError(c, http.StatusNotFound, "Link disabled", "This short URL has been disabled by its owner")
 			} else {
-				c.HTML(http.StatusNotFound, "error.html", gin.H{
-					"error": "Short URL not found",
-				})
+				renderNotFound(c, svc, "Short URL not found")
 			}
 			return
 		}
 
-		c.Redirect(http.StatusMovedPermanently, originalURL)
+		if redirect.Variant != "" && redirect.Variant != splitVariant(c) {
+			setSplitVariant(c, code, redirect.Variant)
+		}
+		c.Header("Cache-Control", redirectCacheControl(redirect, time.Now()))
+		c.Redirect(redirect.Status, redirect.URL)
 	}
 }
+
+// permanentRedirectMaxAge bounds how long clients cache a 301 or 308, so
+// a changed destination is picked up eventually
+const permanentRedirectMaxAge = 24 * time.Hour
+
+// redirectCacheControl lets clients cache permanent redirects until the
+// link expires, and keeps temporary ones out of every cache so each visit
+// is counted. Protected links are always temporary.
+func redirectCacheControl(redirect service.Redirect, now time.Time) string {
+	if !redirect.Permanent() {
+		return "private, no-store"
+	}
+	maxAge := permanentRedirectMaxAge
+	if redirect.ExpiresAt != nil && redirect.ExpiresAt.Sub(now) < maxAge {
+		maxAge = redirect.ExpiresAt.Sub(now)
+	}
+	return "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+}
+
+// renderNotFound sends visitors of an unknown code to the domain's
+// not-found URL, or shows the 404 page if it has none
+func renderNotFound(c *gin.Context, svc service.Service, message string) {
+	if domain, err := svc.DomainFor(c.Request.Host); err == nil && domain.NotFoundURL != "" {
+		c.Header("Cache-Control", "private, no-store")
+		c.Redirect(http.StatusFound, domain.NotFoundURL)
+		return
+	}
+	renderError(c, http.StatusNotFound, "", message)
+}
+
+// renderError responds with the error page, or with JSON in test mode
+func renderError(c *gin.Context, status int, title, message string) {
+	if gin.Mode() == gin.TestMode {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+	c.HTML(status, "error.html", gin.H{
+		"title": title,
+		"error": message,
+	})
+}
@@ -2,16 +2,29 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/challenge"
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/ingest"
+	"github.com/rusik69/shortener/internal/ratelimit"
 	"github.com/rusik69/shortener/internal/service"
+	"github.com/rusik69/shortener/internal/shortcode"
+	"github.com/rusik69/shortener/internal/urlpolicy"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -90,6 +103,153 @@ func TestShortenURLInvalid(t *testing.T) {
 	assert.Contains(t, rec.Body.String(), "Invalid URL format")
 }
 
+func TestShortenURLNotAllowed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockServiceWithErrors{})
+
+	jsonBody, _ := json.Marshal(map[string]string{"url": "http://10.0.0.1/"})
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "URL not allowed", body["error"])
+	assert.Equal(t, "private_address", body["code"])
+}
+
+func TestProtectedLink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockService{})
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/secret/unlock", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Visitors get the unlock form instead of a redirect
+	req, _ := http.NewRequest("GET", "/secret", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Password required")
+	assert.Empty(t, rec.Header().Get("Location"))
+
+	rec = unlock("wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Incorrect password")
+	assert.Empty(t, rec.Header().Get("Set-Cookie"))
+
+	rec = unlock("hunter22")
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "/secret", rec.Header().Get("Location"))
+	cookies := rec.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, "unlock-token", cookies[0].Value)
+		assert.Equal(t, "/secret", cookies[0].Path)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.InDelta(t, 3600, cookies[0].MaxAge, 5)
+	}
+
+	// The cookie lets the browser through without caching the redirect
+	req, _ = http.NewRequest("GET", "/secret", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "https://example.com", rec.Header().Get("Location"))
+	assert.Equal(t, "private, no-store", rec.Header().Get("Cache-Control"))
+}
+
+func TestUnlockRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limits := DefaultRateLimits
+	limits.Unlock = ratelimit.Limit{Requests: 2, Window: time.Hour}
+	limits.UnlockLink = ratelimit.Limit{Requests: 3, Window: time.Hour}
+	router := gin.Default()
+	SetupRoutes(router, &MockService{}, WithRateLimits(limits))
+
+	unlock := func(password, remoteAddr string) int {
+		req, _ := http.NewRequest("POST", "/secret/unlock", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Correct passwords are not counted
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusSeeOther, unlock("hunter22", "192.0.2.1:1234"), "attempt %d", i+1)
+	}
+
+	// Two wrong passwords lock the client out, even with the right one
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		assert.Equal(t, want, unlock("guess", "192.0.2.2:1234"), "attempt %d", i+1)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, unlock("hunter22", "192.0.2.2:1234"))
+
+	// A third wrong password from another IP locks the link for everyone
+	assert.Equal(t, http.StatusUnauthorized, unlock("guess", "192.0.2.3:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, unlock("hunter22", "192.0.2.4:1234"))
+
+	// Redirects have their own bucket
+	req, _ := http.NewRequest("GET", "/abc12345", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+}
+
+func TestUnlockRateLimitFoldsCase(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limits := DefaultRateLimits
+	limits.UnlockLink = ratelimit.Limit{Requests: 2, Window: time.Hour}
+	router := gin.Default()
+	SetupRoutes(router, &MockService{}, WithRateLimits(limits),
+		WithCodePolicy(shortcode.NewPolicy(shortcode.PolicyConfig{CaseInsensitive: true})))
+
+	unlock := func(code, remoteAddr string) int {
+		req, _ := http.NewRequest("POST", "/"+code+"/unlock", strings.NewReader(url.Values{"password": {"guess"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Changing the case of the code does not give a fresh bucket
+	assert.Equal(t, http.StatusUnauthorized, unlock("secret", "192.0.2.5:1234"))
+	assert.Equal(t, http.StatusUnauthorized, unlock("secret", "192.0.2.6:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, unlock("SECRET", "192.0.2.7:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, unlock("Secret", "192.0.2.8:1234"))
+}
+
+func TestUnlockNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockServiceWithErrors{})
+
+	req, _ := http.NewRequest("POST", "/missing/unlock", strings.NewReader("password=guess"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
 func TestShortenURLMissingURL(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	
@@ -132,6 +292,24 @@ func TestGetStats(t *testing.T) {
 	assert.Contains(t, rec.Body.String(), "5")
 }
 
+func TestGetStatsIncludeBots(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/api/stats/abc12345", nil)
+	assert.NoError(t, err)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.False(t, mockService.lastStatsOpts.IncludeBots)
+
+	req, err = http.NewRequest("GET", "/api/stats/abc12345?include_bots=true", nil)
+	assert.NoError(t, err)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, mockService.lastStatsOpts.IncludeBots)
+}
+
 func TestGetStatsNotFound(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	
@@ -150,6 +328,52 @@ func TestGetStatsNotFound(t *testing.T) {
 	assert.Contains(t, rec.Body.String(), "URL not found")
 }
 
+func TestGetQRCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockService{})
+
+	req, _ := http.NewRequest("GET", "/api/qr/abc12345?size=300&level=H", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Cache-Control"), "max-age")
+	img, err := png.Decode(rec.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+
+	req, _ = http.NewRequest("GET", "/api/qr/abc12345?format=svg&fg=%23336699&bg=transparent&margin=2", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/svg+xml", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), `fill="#336699"`)
+
+	for _, query := range []string{"size=10", "size=big", "level=Z", "fg=red", "format=gif", "margin=-1"} {
+		req, _ = http.NewRequest("GET", "/api/qr/abc12345?"+query, nil)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestGetQRCodeNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockServiceWithErrors{})
+
+	req, _ := http.NewRequest("GET", "/api/qr/notfound", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
 func TestRedirectURL(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	
@@ -166,104 +390,1321 @@ func TestRedirectURL(t *testing.T) {
 
 	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
 	assert.Equal(t, "https://example.com", rec.Header().Get("Location"))
+	assert.Equal(t, "public, max-age=86400", rec.Header().Get("Cache-Control"))
 }
 
-func TestRedirectURLNotFound(t *testing.T) {
+func TestRedirectURLTypes(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	
-	mockService := &MockServiceWithErrors{}
+
+	mockService := &MockService{}
 	router := gin.Default()
 	SetupRoutes(router, mockService)
 
-	// Test redirect for non-existent URL
-	req, err := http.NewRequest("GET", "/notfound", nil)
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		assert.NoError(t, err)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/temporary")
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, "https://example.com", rec.Header().Get("Location"))
+	assert.Equal(t, "private, no-store", rec.Header().Get("Cache-Control"))
+
+	// Permanent redirects are not cached past the link's expiry
+	rec = get("/expiring")
+	assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+	cacheControl := rec.Header().Get("Cache-Control")
+	assert.True(t, strings.HasPrefix(cacheControl, "public, max-age="), cacheControl)
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(cacheControl, "public, max-age="))
 	assert.NoError(t, err)
+	assert.InDelta(t, 3600, maxAge, 5)
+}
+
+func TestRedirectURLSplit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
 
+	req, err := http.NewRequest("GET", "/split", nil)
+	assert.NoError(t, err)
 	rec := httptest.NewRecorder()
 	router.ServeHTTP(rec, req)
 
-	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "https://example.com/b", rec.Header().Get("Location"))
+	var variant *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "shortener_variant" {
+			variant = cookie
+		}
+	}
+	if assert.NotNil(t, variant) {
+		assert.Equal(t, "b", variant.Value)
+		assert.Equal(t, "/split", variant.Path)
+		assert.True(t, variant.HttpOnly)
+	}
+
+	// Returning visitors send their variant and get no new cookie
+	req, err = http.NewRequest("GET", "/split", nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "shortener_variant", Value: "b"})
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, "b", mockService.lastVisit.Variant)
+	assert.Empty(t, rec.Header().Get("Set-Cookie"))
 }
 
-func TestShortenURLServiceError(t *testing.T) {
+func TestShortenURLWithDestinations(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	
-	mockService := &MockServiceWithErrors{}
+
+	mockService := &MockService{}
 	router := gin.Default()
 	SetupRoutes(router, mockService)
 
-	// Test service error during URL shortening
-	requestBody := map[string]string{
-		"url": "https://example.com",
-	}
-	jsonBody, _ := json.Marshal(requestBody)
-
+	jsonBody := []byte(`{"url": "https://example.com", "destinations": [{"url": "https://example.com/a", "weight": 70}, {"url": "https://example.com/b", "weight": 30, "label": "new"}]}`)
 	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
 	assert.NoError(t, err)
 	req.Header.Set("Content-Type", "application/json")
-
 	rec := httptest.NewRecorder()
 	router.ServeHTTP(rec, req)
 
-	assert.Equal(t, http.StatusInternalServerError, rec.Code)
-	assert.Contains(t, rec.Body.String(), "service error")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	if assert.Len(t, mockService.lastOpts.Destinations, 2) {
+		assert.Equal(t, 30, mockService.lastOpts.Destinations[1].Weight)
+		assert.Equal(t, "new", mockService.lastOpts.Destinations[1].Label)
+	}
 }
 
-func TestInvalidJSONRequest(t *testing.T) {
+func TestShortenURLWithRules(t *testing.T) {
 	gin.SetMode(gin.TestMode)
-	
+
 	mockService := &MockService{}
 	router := gin.Default()
 	SetupRoutes(router, mockService)
 
-	// Test invalid JSON
-	req, err := http.NewRequest("POST", "/api/shorten", strings.NewReader("invalid json"))
+	jsonBody := []byte(`{"url": "https://example.com", "rules": [{"name": "ios", "os": ["iOS"], "url": "https://apps.apple.com/app/id1"}, {"countries": ["DE"], "languages": ["de"], "url": "https://example.de"}]}`)
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
 	assert.NoError(t, err)
 	req.Header.Set("Content-Type", "application/json")
-
 	rec := httptest.NewRecorder()
 	router.ServeHTTP(rec, req)
 
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	if assert.Len(t, mockService.lastOpts.Rules, 2) {
+		assert.Equal(t, []string{"iOS"}, mockService.lastOpts.Rules[0].OS)
+		assert.Equal(t, []string{"DE"}, mockService.lastOpts.Rules[1].Countries)
+	}
+
+	errorRouter := gin.Default()
+	SetupRoutes(errorRouter, &MockServiceWithErrors{})
+	req, err = http.NewRequest("POST", "/api/shorten", bytes.NewBuffer([]byte(`{"url": "https://example.org", "rules": [{"url": "https://example.de"}]}`)))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	errorRouter.ServeHTTP(rec, req)
+
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid rules")
 }
 
-// MockService implements the Service interface for testing
-type MockService struct{}
+func TestRedirectURLPassesLanguage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
 
-func (m *MockService) CreateShortURL(originalURL, customCode string) (string, error) {
-	if customCode != "" {
-		return customCode, nil
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/abc12345", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "de-DE,de;q=0.9", mockService.lastVisit.Language)
+}
+
+func TestShortenURLOnDomain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{domains: map[string]db.Domain{"go.brand.example:8080": {Host: "go.brand.example"}}}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	for host, fullURL := range map[string]string{
+		"go.brand.example:8080": "http://go.brand.example/abc12345",
+		"other.example":         "http://other.example/abc12345",
+	} {
+		req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer([]byte(`{"url": "https://example.com"}`)))
+		assert.NoError(t, err)
+		req.Host = host
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, host, mockService.lastOpts.Host)
+		var response CreateURLResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.Equal(t, fullURL, response.FullURL)
 	}
-	return "abc12345", nil
 }
 
-func (m *MockService) GetURLStats(code string) (service.URLStats, error) {
-	return service.URLStats{
-		Code:        code,
-		OriginalURL: "https://example.com",
-		Clicks:      5,
-		LastAccess:  time.Now(),
-	}, nil
+func TestRedirectURLPassesHost(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/abc12345", nil)
+	assert.NoError(t, err)
+	req.Host = "go.brand.example"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "go.brand.example", mockService.lastVisit.Host)
+}
+
+func TestDomainNotFoundURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{domains: map[string]db.Domain{
+		"go.brand.example": {Host: "go.brand.example", NotFoundURL: "https://brand.example/missing"},
+	}}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/missing", nil)
+	assert.NoError(t, err)
+	req.Host = "go.brand.example"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "https://brand.example/missing", rec.Header().Get("Location"))
+
+	req, err = http.NewRequest("GET", "/missing", nil)
+	assert.NoError(t, err)
+	req.Host = "other.example"
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
 }
 
-func (m *MockService) RedirectURL(code, ip, userAgent string) (string, error) {
-	return "https://example.com", nil
+func TestDomainRootURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{domains: map[string]db.Domain{
+		"go.brand.example": {Host: "go.brand.example", RootURL: "https://brand.example"},
+	}}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	assert.NoError(t, err)
+	req.Host = "go.brand.example"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "https://brand.example", rec.Header().Get("Location"))
+
+	req, err = http.NewRequest("GET", "/", nil)
+	assert.NoError(t, err)
+	req.Host = "other.example"
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
 }
 
-// MockServiceWithErrors implements the Service interface for error testing
-type MockServiceWithErrors struct{}
+func TestShortenURLRedirectType(t *testing.T) {
+	gin.SetMode(gin.TestMode)
 
-func (m *MockServiceWithErrors) CreateShortURL(originalURL, customCode string) (string, error) {
-	if originalURL == "https://example.com" {
-		return "", errors.New("service error")
-	}
-	return "", service.ErrInvalidURL
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal(map[string]interface{}{"url": "https://example.com", "redirect_type": 308})
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, http.StatusPermanentRedirect, mockService.lastOpts.RedirectType)
+
+	errorRouter := gin.Default()
+	SetupRoutes(errorRouter, &MockServiceWithErrors{})
+	jsonBody, _ = json.Marshal(map[string]interface{}{"url": "https://example.org", "redirect_type": 303})
+	req, err = http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	errorRouter.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid redirect type")
 }
 
-func (m *MockServiceWithErrors) GetURLStats(code string) (service.URLStats, error) {
-	return service.URLStats{}, errors.New("URL not found")
+func TestRedirectURLPassesReferrerAndUTM(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/abc12345?utm_source=newsletter&utm_campaign=spring", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Referer", "https://mail.example.com/inbox")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "https://mail.example.com/inbox", mockService.lastVisit.Referrer)
+	assert.Equal(t, "newsletter", mockService.lastVisit.Query.Get("utm_source"))
+	assert.Equal(t, "spring", mockService.lastVisit.Query.Get("utm_campaign"))
+}
+
+func TestRedirectURLNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	
+	mockService := &MockServiceWithErrors{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	// Test redirect for non-existent URL
+	req, err := http.NewRequest("GET", "/notfound", nil)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestShortenURLServiceError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	
+	mockService := &MockServiceWithErrors{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	// Test service error during URL shortening
+	requestBody := map[string]string{
+		"url": "https://example.com",
+	}
+	jsonBody, _ := json.Marshal(requestBody)
+
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "service error")
+}
+
+func TestShortenURLWithExpiry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal(map[string]interface{}{
+		"url":        "https://example.com",
+		"expires_in": 3600,
+	})
+
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var resp CreateURLResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	if assert.NotNil(t, resp.ExpiresAt) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *resp.ExpiresAt, time.Minute)
+	}
+}
+
+func TestShortenURLConflictingExpiry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal(map[string]interface{}{
+		"url":        "https://example.com",
+		"expires_in": 3600,
+		"expires_at": time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid expiry")
+}
+
+func TestRedirectURLExpired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockServiceWithErrors{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/expired", nil)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusGone, rec.Code)
+	assert.Contains(t, rec.Body.String(), "expired")
+}
+
+func TestShortenURLWithAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal(map[string]string{"url": "https://example.com"})
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	if assert.NotNil(t, mockService.lastOpts.OwnerID) {
+		assert.Equal(t, int64(7), *mockService.lastOpts.OwnerID)
+	}
+}
+
+func TestShortenURLInvalidAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal(map[string]string{"url": "https://example.com"})
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer wrong-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid API key")
+}
+
+func TestListAPIKeysRequiresAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/api/keys", nil)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req, err = http.NewRequest("GET", "/api/keys", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "sk_12345678")
+	assert.NotContains(t, rec.Body.String(), "key_hash")
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("DELETE", "/api/keys/1", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	req, err = http.NewRequest("DELETE", "/api/keys/2", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestListLinks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/api/links?page=2&q=promo", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var page service.LinkPage
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	assert.Equal(t, 2, page.Page)
+	assert.Len(t, page.Links, 1)
+}
+
+func TestUpdateLink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal(map[string]interface{}{
+		"original_url": "https://example.com/fixed",
+		"enabled":      false,
+	})
+	req, err := http.NewRequest("PATCH", "/api/links/promo", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var link db.ShortURL
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &link))
+	assert.Equal(t, "https://example.com/fixed", link.OriginalURL)
+	assert.False(t, link.Enabled)
+}
+
+func TestDeleteLink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("DELETE", "/api/links/promo", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	req, err = http.NewRequest("DELETE", "/api/links/other", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCreateWebhook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	body := `{"url": "https://crm.example.com/hooks", "events": ["link.click_threshold"], "thresholds": [100, 1000], "code": "abc123"}`
+	req, err := http.NewRequest("POST", "/api/webhooks", bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	req.Host = "go.brand.example"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var response WebhookResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, "whsec_test", response.Secret)
+	assert.Equal(t, db.ClickThresholds{100, 1000}, response.Webhook.Thresholds)
+	// The secret is only shown beside the webhook, never inside it
+	assert.Empty(t, response.Webhook.Secret)
+	assert.Equal(t, "abc123", mockService.lastWebhookOpts.Code)
+	assert.Equal(t, "go.brand.example", mockService.lastWebhookOpts.Host)
+
+	req, err = http.NewRequest("POST", "/api/webhooks", bytes.NewBufferString(`{"url": "https://crm.example.com/hooks", "events": ["link.deleted"]}`))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid webhook")
+}
+
+func TestWebhooksRequireAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockService{})
+
+	for _, path := range []string{"/api/webhooks", "/api/webhooks/deliveries"} {
+		req, err := http.NewRequest("GET", path, nil)
+		assert.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, path)
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockService{})
+
+	for path, want := range map[string]int{
+		"/api/webhooks/1":    http.StatusNoContent,
+		"/api/webhooks/2":    http.StatusNotFound,
+		"/api/webhooks/nope": http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("DELETE", path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer valid-key")
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, want, rec.Code, path)
+	}
+}
+
+func TestListWebhookDeliveries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockService{})
+
+	req, err := http.NewRequest("GET", "/api/webhooks/deliveries?limit=10", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var response struct {
+		Deliveries []db.WebhookDelivery `json:"deliveries"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Len(t, response.Deliveries, 1)
+	assert.Equal(t, db.DeliveryDead, response.Deliveries[0].Status)
+	assert.JSONEq(t, `{"event":"link.first_click"}`, string(response.Deliveries[0].Payload))
+}
+
+func TestExport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/api/export?dataset=links&format=csv&gzip=false&from=2026-01-01T00:00:00Z", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), `attachment; filename="links-`)
+	assert.Equal(t, "id,short_code\n1,abc123\n", rec.Body.String())
+	assert.Equal(t, service.DatasetLinks, mockService.lastExportOpts.Dataset)
+	assert.Equal(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), mockService.lastExportOpts.From)
+}
+
+func TestExportInvalid(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockService{})
+
+	for path, want := range map[string]int{
+		"/api/export?format=xlsx":        http.StatusBadRequest,
+		"/api/export?dataset=users":      http.StatusBadRequest,
+		"/api/export?from=yesterday":     http.StatusBadRequest,
+		"/api/export?format=ndjson&gzip": http.StatusOK,
+	} {
+		req, err := http.NewRequest("GET", path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer valid-key")
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, want, rec.Code, path)
+		if want != http.StatusOK {
+			assert.Empty(t, rec.Header().Get("Content-Disposition"), path)
+			assert.Contains(t, rec.Header().Get("Content-Type"), "application/json", path)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/api/export", nil)
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestCreateShortURLBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal([]map[string]string{
+		{"url": "https://example.com/1", "custom_code": "one"},
+		{"url": "https://example.com/2"},
+	})
+	req, err := http.NewRequest("POST", "/api/shorten/batch", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+
+	var resp BatchResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.Created)
+	assert.Equal(t, 1, resp.Failed)
+}
+
+func TestCreateShortURLBatchCSVUpload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "links.csv")
+	assert.NoError(t, err)
+	_, _ = part.Write([]byte("https://example.com/csv\n"))
+	assert.NoError(t, writer.Close())
+
+	req, err := http.NewRequest("POST", "/api/shorten/batch", &body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer valid-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Contains(t, rec.Body.String(), "https://example.com/csv")
+	assert.Contains(t, rec.Body.String(), "csv1")
+}
+
+func TestCreateShortURLBatchBodyTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	SetupRoutes(router, &MockService{})
+
+	for _, contentType := range []string{"text/csv", "application/json"} {
+		req, err := http.NewRequest("POST", "/api/shorten/batch", strings.NewReader(strings.Repeat(" ", maxBatchBodyBytes+1)))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer valid-key")
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, contentType)
+	}
+}
+
+func TestCreateShortURLBatchRequiresAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("POST", "/api/shorten/batch", strings.NewReader("[]"))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestShortenURLReservedCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockServiceWithErrors{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	jsonBody, _ := json.Marshal(map[string]string{"url": "https://example.org", "custom_code": "api"})
+	req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Invalid custom code")
+}
+
+func TestRouteSegments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.Default()
+	SetupRoutes(router, &MockService{})
+
+	segments := RouteSegments(router)
+	assert.Contains(t, segments, "api")
+	assert.Contains(t, segments, "health")
+	for _, segment := range segments {
+		assert.False(t, strings.HasPrefix(segment, ":"), segment)
+	}
+}
+
+func TestGetAnalytics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	req, err := http.NewRequest("GET", "/api/stats/abc123/analytics?interval=hour&from=2026-01-01T00:00:00Z", nil)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"interval":"hour"`)
+	assert.Contains(t, rec.Body.String(), "news.example.com")
+}
+
+func TestGetAnalyticsErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	cases := map[string]int{
+		"/api/stats/abc123/analytics?interval=minute": http.StatusBadRequest,
+		"/api/stats/abc123/analytics?from=yesterday":  http.StatusBadRequest,
+		"/api/stats/owned/analytics":                  http.StatusNotFound,
+	}
+	for path, status := range cases {
+		req, err := http.NewRequest("GET", path, nil)
+		assert.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code, path)
+	}
+}
+
+func TestAuthRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	SetupRoutes(router, &MockService{}, WithRateLimits(RateLimits{
+		Auth: ratelimit.Limit{Requests: 2, Window: time.Minute},
+	}))
+
+	do := func(apiKey, remoteAddr string) int {
+		req, _ := http.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Valid keys are not counted
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, do("valid-key", "192.0.2.10:1234"))
+	}
+
+	// Guessing keys is limited before they are looked up
+	assert.Equal(t, http.StatusUnauthorized, do("guess-1", "192.0.2.11:1234"))
+	assert.Equal(t, http.StatusUnauthorized, do("guess-2", "192.0.2.11:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, do("guess-3", "192.0.2.11:1234"))
+	assert.Equal(t, http.StatusOK, do("valid-key", "192.0.2.10:1234"))
+}
+
+// slowAuthService holds every key lookup until release is closed
+type slowAuthService struct {
+	MockService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowAuthService) AuthenticateAPIKey(key string) (*db.User, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.MockService.AuthenticateAPIKey(key)
+}
+
+func TestAuthRateLimitConcurrent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	svc := &slowAuthService{started: make(chan struct{}), release: make(chan struct{})}
+	router := gin.New()
+	SetupRoutes(router, svc, WithRateLimits(RateLimits{
+		Auth: ratelimit.Limit{Requests: 2, Window: time.Minute},
+	}))
+
+	do := func(apiKey string) int {
+		req, _ := http.NewRequest("GET", "/api/me", nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.RemoteAddr = "192.0.2.12:1234"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Guesses still being checked hold their tokens, so sending them all
+	// at once does not get more past than the burst
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { codes <- do("guess") }()
+		<-svc.started
+	}
+	assert.Equal(t, http.StatusTooManyRequests, do("guess"))
+
+	close(svc.release)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusUnauthorized, <-codes)
+	}
+}
+
+func TestRateLimitPolicies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	SetupRoutes(router, &MockService{}, WithRateLimits(RateLimits{
+		Shorten:  ratelimit.Limit{Requests: 1, Window: time.Minute},
+		Redirect: ratelimit.Limit{Requests: 2, Window: time.Minute},
+	}))
+
+	do := func(method, path, apiKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(`{"url": "https://example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("POST", "/api/shorten", "")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+
+	rec = do("POST", "/api/shorten", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+
+	// An API key gets its own bucket instead of sharing the IP's
+	assert.Equal(t, http.StatusCreated, do("POST", "/api/shorten", "valid-key").Code)
+
+	// Redirects have their own policy
+	assert.Equal(t, http.StatusMovedPermanently, do("GET", "/abc12345", "").Code)
+	assert.Equal(t, http.StatusMovedPermanently, do("GET", "/abc12345", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do("GET", "/abc12345", "").Code)
+
+	// The API policy is off and health checks are never limited
+	rec = do("GET", "/api/stats/abc12345", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, http.StatusOK, do("GET", "/health", "").Code)
+}
+
+// acceptingRecorder stores nothing; replays are covered by the challenge package
+type acceptingRecorder struct{}
+
+func (acceptingRecorder) RecordCaptchaAttempt(attempt db.CaptchaAttempt) error {
+	return nil
+}
+
+func TestShortenChallenge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	guard, err := challenge.New(ratelimit.NewMemory(), acceptingRecorder{}, challenge.Config{
+		Threshold:  ratelimit.Limit{Requests: 1, Window: time.Hour},
+		Difficulty: 4,
+	})
+	assert.NoError(t, err)
+	router := gin.New()
+	SetupRoutes(router, &MockService{}, WithChallenge(guard))
+
+	shorten := func(headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/shorten", strings.NewReader(`{"url": "https://example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusCreated, shorten(nil).Code)
+
+	// Over the threshold a challenge is required
+	rec := shorten(nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	var body struct {
+		Error     string              `json:"error"`
+		Challenge challenge.Challenge `json:"challenge"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "Challenge required", body.Error)
+	assert.Equal(t, 4, body.Challenge.Difficulty)
+
+	// A wrong answer gets a fresh challenge
+	wrong := "x"
+	for challenge.LeadingZeroBits(body.Challenge.Token, wrong) >= 4 {
+		wrong += "x"
+	}
+	rec = shorten(map[string]string{"X-Challenge-Token": body.Challenge.Token, "X-Challenge-Solution": wrong})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Challenge failed")
+
+	solution := 0
+	for challenge.LeadingZeroBits(body.Challenge.Token, fmt.Sprint(solution)) < 4 {
+		solution++
+	}
+	rec = shorten(map[string]string{"X-Challenge-Token": body.Challenge.Token, "X-Challenge-Solution": fmt.Sprint(solution)})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// API key holders are never challenged
+	assert.Equal(t, http.StatusCreated, shorten(map[string]string{"Authorization": "Bearer valid-key"}).Code)
+}
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	RegisterMetrics(router, func() ingest.Stats {
+		return ingest.Stats{Queued: 3, Capacity: 100, Dropped: 2, LastFlushDuration: 1500 * time.Millisecond}
+	})
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "# TYPE shortener_clicks_queued gauge\nshortener_clicks_queued 3\n")
+	assert.Contains(t, rec.Body.String(), "shortener_clicks_queue_capacity 100\n")
+	assert.Contains(t, rec.Body.String(), "shortener_clicks_dropped_total 2\n")
+	assert.Contains(t, rec.Body.String(), "shortener_click_last_flush_seconds 1.5\n")
+}
+
+func TestInvalidJSONRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	
+	mockService := &MockService{}
+	router := gin.Default()
+	SetupRoutes(router, mockService)
+
+	// Test invalid JSON
+	req, err := http.NewRequest("POST", "/api/shorten", strings.NewReader("invalid json"))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// MockService implements the Service interface for testing. Methods that a
+// test does not override panic through the embedded nil interface.
+type MockService struct {
+	service.Service
+	lastOpts      service.CreateOptions
+	lastVisit     service.Visit
+	lastStatsOpts service.StatsOptions
+	// domains are the configured domains by request host
+	domains map[string]db.Domain
+	lastWebhookOpts service.WebhookOptions
+	lastExportOpts service.ExportOptions
+}
+
+func (m *MockService) CreateShortURL(originalURL, customCode string, opts service.CreateOptions) (string, error) {
+	m.lastOpts = opts
+	if customCode != "" {
+		return customCode, nil
+	}
+	return "abc12345", nil
+}
+
+func (m *MockService) GetURLStats(code string, opts service.StatsOptions) (service.URLStats, error) {
+	m.lastStatsOpts = opts
+	return service.URLStats{
+		Code:        code,
+		OriginalURL: "https://example.com",
+		Clicks:      5,
+	}, nil
+}
+
+func (m *MockService) RedirectURL(code string, visit service.Visit) (service.Redirect, error) {
+	m.lastVisit = visit
+	switch code {
+	case "secret":
+		if visit.Unlock != "unlock-token" {
+			return service.Redirect{}, service.ErrPasswordRequired
+		}
+		return service.Redirect{URL: "https://example.com", Status: http.StatusFound}, nil
+	case "temporary":
+		return service.Redirect{URL: "https://example.com", Status: http.StatusTemporaryRedirect}, nil
+	case "split":
+		return service.Redirect{URL: "https://example.com/b", Status: http.StatusFound, Variant: "b"}, nil
+	case "expiring":
+		expiresAt := time.Now().Add(time.Hour)
+		return service.Redirect{URL: "https://example.com", Status: http.StatusPermanentRedirect, ExpiresAt: &expiresAt}, nil
+	case "missing":
+		return service.Redirect{}, service.ErrURLNotFound
+	}
+	return service.Redirect{URL: "https://example.com", Status: http.StatusMovedPermanently}, nil
+}
+
+func (m *MockService) UnlockURL(host, code, password string) (service.Unlock, error) {
+	if code != "secret" {
+		return service.Unlock{}, nil
+	}
+	if password != "hunter22" {
+		return service.Unlock{}, service.ErrWrongPassword
+	}
+	return service.Unlock{Token: "unlock-token", ExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func (m *MockService) DomainFor(host string) (db.Domain, error) {
+	return m.domains[host], nil
+}
+
+func (m *MockService) AuthenticateAPIKey(key string) (*db.User, error) {
+	if key == "valid-key" {
+		return &db.User{ID: 7, Username: "growth-team", IsService: true}, nil
+	}
+	return nil, service.ErrInvalidAPIKey
+}
+
+func (m *MockService) ListAPIKeys(userID int64) ([]db.APIKey, error) {
+	return []db.APIKey{{ID: 1, UserID: userID, Name: "default", Prefix: "sk_12345678"}}, nil
+}
+
+func (m *MockService) RevokeAPIKey(userID, keyID int64) error {
+	if keyID != 1 {
+		return service.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (m *MockService) ListLinks(ownerID int64, query service.LinkQuery) (service.LinkPage, error) {
+	return service.LinkPage{
+		Links:   []db.ShortURL{{ShortCode: "promo", OriginalURL: "https://example.com", UserID: &ownerID, Enabled: true}},
+		Total:   1,
+		Page:    query.Page,
+		PerPage: 20,
+	}, nil
+}
+
+func (m *MockService) UpdateLink(ownerID int64, host, code string, update service.LinkUpdate) (*db.ShortURL, error) {
+	if code != "promo" {
+		return nil, service.ErrURLNotFound
+	}
+	link := &db.ShortURL{ShortCode: code, OriginalURL: "https://example.com", UserID: &ownerID, Enabled: true}
+	if update.OriginalURL != nil {
+		link.OriginalURL = *update.OriginalURL
+	}
+	if update.Enabled != nil {
+		link.Enabled = *update.Enabled
+	}
+	return link, nil
+}
+
+func (m *MockService) DeleteLink(ownerID int64, host, code string) error {
+	if code != "promo" {
+		return service.ErrURLNotFound
+	}
+	return nil
+}
+
+func (m *MockService) GetAnalytics(viewerID *int64, code string, query service.AnalyticsQuery) (service.Analytics, error) {
+	if code == "owned" && viewerID == nil {
+		return service.Analytics{}, service.ErrURLNotFound
+	}
+	if query.Interval == "minute" {
+		return service.Analytics{}, service.ErrInvalidInterval
+	}
+	return service.Analytics{
+		Code:         code,
+		Interval:     query.Interval,
+		TotalClicks:  3,
+		TopReferrers: []db.ClickTally{{Value: "news.example.com", Clicks: 2}},
+	}, nil
+}
+
+func (m *MockService) CreateShortURLBatch(items []service.BatchItem, opts service.BatchOptions) ([]service.BatchResult, error) {
+	results := make([]service.BatchResult, len(items))
+	for i, item := range items {
+		results[i] = service.BatchResult{Row: i + 1, URL: item.URL, ShortCode: item.CustomCode}
+		if item.CustomCode == "" {
+			results[i].Error = "invalid URL"
+		}
+	}
+	return results, nil
+}
+
+func (m *MockService) ImportCSV(r io.Reader, opts service.BatchOptions) ([]service.BatchResult, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return []service.BatchResult{{Row: 1, URL: strings.TrimSpace(string(data)), ShortCode: "csv1"}}, nil
+}
+
+// MockServiceWithErrors implements the Service interface for error testing
+func (m *MockService) CreateWebhook(ownerID int64, opts service.WebhookOptions) (string, *db.Webhook, error) {
+	m.lastWebhookOpts = opts
+	for _, event := range opts.Events {
+		if event == "link.deleted" {
+			return "", nil, fmt.Errorf("%w: unknown event %q", service.ErrInvalidWebhook, event)
+		}
+	}
+	return "whsec_test", &db.Webhook{ID: 1, UserID: ownerID, URL: opts.URL, Secret: "whsec_test", Events: opts.Events, Thresholds: opts.Thresholds}, nil
+}
+
+func (m *MockService) DeleteWebhook(ownerID, webhookID int64) error {
+	if webhookID != 1 {
+		return service.ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (m *MockService) ListWebhookDeliveries(ownerID int64, limit int) ([]db.WebhookDelivery, error) {
+	return []db.WebhookDelivery{{ID: 1, WebhookID: 1, Event: db.EventFirstClick, Payload: []byte(`{"event":"link.first_click"}`), Status: db.DeliveryDead, Attempts: 10}}, nil
+}
+
+func (m *MockService) Export(ctx context.Context, ownerID *int64, opts service.ExportOptions, w io.Writer) error {
+	m.lastExportOpts = opts
+	if opts.Dataset != service.DatasetLinks && opts.Dataset != service.DatasetClicks {
+		return fmt.Errorf("%w: unknown dataset", service.ErrInvalidExport)
+	}
+	_, err := io.WriteString(w, "id,short_code\n1,abc123\n")
+	return err
+}
+
+type MockServiceWithErrors struct {
+	service.Service
+}
+
+func (m *MockServiceWithErrors) CreateShortURL(originalURL, customCode string, opts service.CreateOptions) (string, error) {
+	if customCode == "api" {
+		return "", fmt.Errorf("%w: %q is reserved", shortcode.ErrInvalidCode, customCode)
+	}
+	if originalURL == "https://example.com" {
+		return "", errors.New("service error")
+	}
+	if originalURL == "http://10.0.0.1/" {
+		return "", urlpolicy.ErrPrivateAddress
+	}
+	if len(opts.Rules) > 0 {
+		return "", fmt.Errorf("%w: no conditions", service.ErrInvalidRules)
+	}
+	if opts.RedirectType != 0 {
+		return "", service.ErrInvalidRedirectType
+	}
+	return "", service.ErrInvalidURL
+}
+
+func (m *MockServiceWithErrors) GetURLStats(code string, opts service.StatsOptions) (service.URLStats, error) {
+	return service.URLStats{}, errors.New("URL not found")
+}
+
+func (m *MockServiceWithErrors) RedirectURL(code string, visit service.Visit) (service.Redirect, error) {
+	if code == "expired" {
+		return service.Redirect{}, service.ErrURLExpired
+	}
+	return service.Redirect{}, errors.New("URL not found")
+}
+
+func (m *MockServiceWithErrors) UnlockURL(host, code, password string) (service.Unlock, error) {
+	return service.Unlock{}, service.ErrURLNotFound
 }
 
-func (m *MockServiceWithErrors) RedirectURL(code, ip, userAgent string) (string, error) {
-	return "", errors.New("URL not found")
+func (m *MockServiceWithErrors) DomainFor(host string) (db.Domain, error) {
+	return db.Domain{}, errors.New("database unavailable")
 }
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/middleware"
+	"github.com/rusik69/shortener/internal/service"
+)
+
+const userContextKey = "user"
+
+// authenticate resolves an optional "Authorization: Bearer <api key>" header
+// into the owning user. Requests without the header continue anonymously,
+// while requests with an invalid key are rejected and count against the
+// auth rate limit.
+func authenticate(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		key, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || key == "" {
+			middleware.CountFailure(c)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
+			return
+		}
+
+		user, err := svc.AuthenticateAPIKey(key)
+		if err != nil {
+			if errors.Is(err, service.ErrInvalidAPIKey) {
+				middleware.CountFailure(c)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+			}
+			return
+		}
+
+		c.Set(userContextKey, user)
+		c.Next()
+	}
+}
+
+// requireUser rejects anonymous requests
+func requireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentUser(c) == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUser returns the authenticated user, or nil for anonymous requests
+func currentUser(c *gin.Context) *db.User {
+	value, exists := c.Get(userContextKey)
+	if !exists {
+		return nil
+	}
+	user, _ := value.(*db.User)
+	return user
+}
+
+// CredentialsRequest represents a username and password payload
+type CredentialsRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	KeyName  string `json:"key_name,omitempty"`
+}
+
+// APIKeyResponse carries a newly issued key, which is only ever shown once
+type APIKeyResponse struct {
+	Key    string     `json:"key"`
+	APIKey *db.APIKey `json:"api_key"`
+}
+
+// registerUser creates an account and issues its first API key
+func registerUser(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CredentialsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request format",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		user, err := svc.RegisterUser(req.Username, req.Password)
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrInvalidUsername), errors.Is(err, service.ErrWeakPassword):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, service.ErrUsernameTaken):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+			}
+			return
+		}
+
+		key, apiKey, err := svc.CreateAPIKey(user.ID, req.KeyName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"user":    user,
+			"key":     key,
+			"api_key": apiKey,
+		})
+	}
+}
+
+// login exchanges a username and password for a new API key
+func login(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CredentialsRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request format",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		user, err := svc.Login(req.Username, req.Password)
+		if err != nil {
+			if errors.Is(err, service.ErrInvalidCredentials) {
+				middleware.CountFailure(c)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+			}
+			return
+		}
+
+		key, apiKey, err := svc.CreateAPIKey(user.ID, req.KeyName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+
+		c.JSON(http.StatusOK, APIKeyResponse{Key: key, APIKey: apiKey})
+	}
+}
+
+// getCurrentUser returns the authenticated user
+func getCurrentUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, currentUser(c))
+	}
+}
+
+// listAPIKeys lists the caller's API keys, including revoked ones
+func listAPIKeys(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := svc.ListAPIKeys(currentUser(c).ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+	}
+}
+
+// CreateAPIKeyRequest represents the request payload for issuing a key
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+}
+
+// createAPIKey issues an additional API key for the caller
+func createAPIKey(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CreateAPIKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request format",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		key, apiKey, err := svc.CreateAPIKey(currentUser(c).ID, req.Name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+		c.JSON(http.StatusCreated, APIKeyResponse{Key: key, APIKey: apiKey})
+	}
+}
+
+// rotateAPIKey revokes a key and issues a replacement with the same name
+func rotateAPIKey(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key id"})
+			return
+		}
+
+		key, apiKey, err := svc.RotateAPIKey(currentUser(c).ID, keyID)
+		if err != nil {
+			if errors.Is(err, service.ErrAPIKeyNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate API key"})
+			}
+			return
+		}
+		c.JSON(http.StatusCreated, APIKeyResponse{Key: key, APIKey: apiKey})
+	}
+}
+
+// revokeAPIKey revokes one of the caller's keys
+func revokeAPIKey(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key id"})
+			return
+		}
+
+		if err := svc.RevokeAPIKey(currentUser(c).ID, keyID); err != nil {
+			if errors.Is(err, service.ErrAPIKeyNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			}
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/service"
+)
+
+// maxBatchBodyBytes caps batch request bodies, JSON, CSV or multipart,
+// before they are parsed. It leaves room for MaxBatchSize long rows.
+const maxBatchBodyBytes = 32 << 20
+
+// BatchResponse summarises a batch creation
+type BatchResponse struct {
+	Created int                   `json:"created"`
+	Failed  int                   `json:"failed"`
+	Results []service.BatchResult `json:"results"`
+}
+
+// createShortURLBatch creates many links from a JSON array, a CSV request
+// body or a CSV file uploaded as the multipart field "file". With
+// ?atomic=true nothing is stored unless every row succeeds.
+func createShortURLBatch(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		atomic, _ := strconv.ParseBool(c.Query("atomic"))
+		opts := service.BatchOptions{
+			OwnerID: &currentUser(c).ID,
+			Atomic:  atomic,
+			Host:    c.Request.Host,
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBodyBytes)
+
+		var results []service.BatchResult
+		var err error
+		switch c.ContentType() {
+		case "multipart/form-data":
+			file, ferr := c.FormFile("file")
+			if batchTooLarge(c, ferr) {
+				return
+			}
+			if ferr != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid request format",
+					"details": ferr.Error(),
+				})
+				return
+			}
+			var f io.ReadCloser
+			f, err = file.Open()
+			if err == nil {
+				results, err = svc.ImportCSV(f, opts)
+				_ = f.Close()
+			}
+		case "text/csv":
+			results, err = svc.ImportCSV(c.Request.Body, opts)
+		default:
+			var items []service.BatchItem
+			berr := c.ShouldBindJSON(&items)
+			if batchTooLarge(c, berr) {
+				return
+			}
+			if berr != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid request format",
+					"details": berr.Error(),
+				})
+				return
+			}
+			results, err = svc.CreateShortURLBatch(items, opts)
+		}
+
+		if batchTooLarge(c, err) {
+			return
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrEmptyBatch), errors.Is(err, service.ErrBatchTooLarge), errors.Is(err, service.ErrInvalidCSV):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":   "Failed to create short URLs",
+					"details": err.Error(),
+				})
+			}
+			return
+		}
+
+		resp := BatchResponse{Results: results}
+		for _, result := range results {
+			if result.Error == "" {
+				resp.Created++
+			} else {
+				resp.Failed++
+			}
+		}
+
+		status := http.StatusCreated
+		if resp.Created == 0 {
+			status = http.StatusUnprocessableEntity
+		} else if resp.Failed > 0 {
+			status = http.StatusMultiStatus
+		}
+		c.JSON(status, resp)
+	}
+}
+
+// batchTooLarge answers 413 if err came from a body over maxBatchBodyBytes
+func batchTooLarge(c *gin.Context, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error":   "Request body too large",
+		"details": fmt.Sprintf("batch requests are limited to %d bytes", tooLarge.Limit),
+	})
+	return true
+}
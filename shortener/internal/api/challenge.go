@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/challenge"
+	"github.com/rusik69/shortener/internal/middleware"
+)
+
+// Headers carrying a solved challenge
+const (
+	challengeTokenHeader    = "X-Challenge-Token"
+	challengeSolutionHeader = "X-Challenge-Solution"
+)
+
+// requireChallenge makes anonymous clients that create links faster than
+// the guard's threshold solve a proof-of-work challenge first. They get a
+// 403 with the challenge and retry with the token and their solution in
+// the X-Challenge-Token and X-Challenge-Solution headers. Requests with an
+// API key are never challenged.
+func requireChallenge(guard *challenge.Guard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if guard == nil || currentUser(c) != nil {
+			c.Next()
+			return
+		}
+		ip := middleware.IP(c)
+
+		if token := c.GetHeader(challengeTokenHeader); token != "" {
+			err := guard.Verify(ip, token, c.GetHeader(challengeSolutionHeader))
+			if err == nil {
+				c.Next()
+				return
+			}
+			if !isChallengeError(err) {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+					"error":   "Failed to verify challenge",
+					"details": err.Error(),
+				})
+				return
+			}
+			issueChallenge(c, guard, ip, "Challenge failed", err)
+			return
+		}
+
+		if guard.Suspicious(ip) {
+			issueChallenge(c, guard, ip, "Challenge required", nil)
+			return
+		}
+		c.Next()
+	}
+}
+
+// issueChallenge answers 403 with a fresh challenge for ip
+func issueChallenge(c *gin.Context, guard *challenge.Guard, ip, message string, cause error) {
+	ch, err := guard.Issue(ip)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to issue challenge",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	body := gin.H{"error": message, "challenge": ch}
+	if cause != nil {
+		body["details"] = cause.Error()
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, body)
+}
+
+func isChallengeError(err error) bool {
+	return errors.Is(err, challenge.ErrInvalid) || errors.Is(err, challenge.ErrExpired) ||
+		errors.Is(err, challenge.ErrUnsolved) || errors.Is(err, challenge.ErrReplayed)
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/export"
+	"github.com/rusik69/shortener/internal/service"
+)
+
+// exportData streams the caller's links or clicks as a file. Query:
+// dataset=links|clicks, format=csv|ndjson|parquet, gzip, from, to
+// (RFC 3339) and include_bots.
+func exportData(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		opts := service.ExportOptions{Dataset: c.DefaultQuery("dataset", service.DatasetClicks)}
+		opts.Gzip, _ = strconv.ParseBool(c.Query("gzip"))
+		opts.IncludeBots, _ = strconv.ParseBool(c.Query("include_bots"))
+
+		var err error
+		if opts.Format, err = export.ParseFormat(c.Query("format")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export", "details": err.Error()})
+			return
+		}
+		if opts.From, err = parseTimeParam(c, "from"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from", "details": err.Error()})
+			return
+		}
+		if opts.To, err = parseTimeParam(c, "to"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to", "details": err.Error()})
+			return
+		}
+
+		filename := fmt.Sprintf("%s-%s%s", opts.Dataset, time.Now().UTC().Format("20060102T150405Z"), opts.Format.Extension(opts.Gzip))
+		c.Header("Content-Type", opts.Format.ContentType(opts.Gzip))
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		userID := currentUser(c).ID
+		err = svc.Export(c.Request.Context(), &userID, opts, c.Writer)
+		if err == nil {
+			return
+		}
+		if c.Writer.Written() {
+			// The status line is gone; all we can do is cut the file short
+			log.Printf("Export for user %d failed: %v", userID, err)
+			return
+		}
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Disposition")
+		switch {
+		case errors.Is(err, service.ErrInvalidExport), errors.Is(err, service.ErrInvalidRange):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export", "details": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export"})
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/service"
+)
+
+// listLinks returns a page of the caller's links, optionally filtered by ?q=
+func listLinks(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+		perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", "0"))
+
+		result, err := svc.ListLinks(currentUser(c).ID, service.LinkQuery{
+			Search:  c.Query("q"),
+			Page:    page,
+			PerPage: perPage,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list links"})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// getLink returns one of the caller's links
+func getLink(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		link, err := svc.GetLink(currentUser(c).ID, c.Request.Host, c.Param("code"))
+		if err != nil {
+			respondLinkError(c, err, "Failed to get link")
+			return
+		}
+		c.JSON(http.StatusOK, link)
+	}
+}
+
+// updateLink changes the destination, enabled flag, redirect type, split or
+// rules of one of the caller's links
+func updateLink(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req service.LinkUpdate
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request format",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		link, err := svc.UpdateLink(currentUser(c).ID, c.Request.Host, c.Param("code"), req)
+		if err != nil {
+			respondLinkError(c, err, "Failed to update link")
+			return
+		}
+		c.JSON(http.StatusOK, link)
+	}
+}
+
+// deleteLink removes one of the caller's links together with its clicks
+func deleteLink(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := svc.DeleteLink(currentUser(c).ID, c.Request.Host, c.Param("code")); err != nil {
+			respondLinkError(c, err, "Failed to delete link")
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// respondLinkError maps link management errors to HTTP responses
+func respondLinkError(c *gin.Context, err error, fallback string) {
+	if rejectedURL(c, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, service.ErrURLNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+	case errors.Is(err, service.ErrInvalidURL):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid URL format",
+			"details": err.Error(),
+		})
+	case errors.Is(err, service.ErrInvalidRules):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid rules",
+			"details": err.Error(),
+		})
+	case errors.Is(err, service.ErrInvalidDestinations):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid destinations",
+			"details": err.Error(),
+		})
+	case errors.Is(err, service.ErrInvalidRedirectType):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid redirect type",
+			"details": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/ingest"
+)
+
+// RegisterMetrics serves click pipeline counters at GET /metrics in the
+// Prometheus text format
+func RegisterMetrics(r *gin.Engine, stats func() ingest.Stats) {
+	r.GET("/metrics", func(c *gin.Context) {
+		s := stats()
+
+		var b strings.Builder
+		metric := func(name, kind, help string, value interface{}) {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+		}
+		metric("shortener_clicks_queued", "gauge", "Clicks waiting to be written.", s.Queued)
+		metric("shortener_clicks_queue_capacity", "gauge", "Size of the click buffer.", s.Capacity)
+		metric("shortener_clicks_accepted_total", "counter", "Clicks accepted into the buffer.", s.Accepted)
+		metric("shortener_clicks_dropped_total", "counter", "Clicks dropped because the buffer was full.", s.Dropped)
+		metric("shortener_clicks_written_total", "counter", "Clicks written to the database.", s.Written)
+		metric("shortener_clicks_failed_total", "counter", "Clicks lost to failed database writes.", s.Failed)
+		metric("shortener_click_flushes_total", "counter", "Click batches written to the database.", s.Flushes)
+		metric("shortener_click_last_flush_seconds", "gauge", "Duration of the latest click batch write.", s.LastFlushDuration.Seconds())
+
+		c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+	})
+}
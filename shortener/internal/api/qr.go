@@ -0,0 +1,84 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/qr"
+	"github.com/rusik69/shortener/internal/service"
+)
+
+// getQRCode renders a QR code for a short link's public URL. Query: size
+// (pixels), level (L, M, Q or H), margin (modules), fg and bg (hex colours
+// or "transparent") and format (png or svg).
+func getQRCode(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		opts, err := qrOptions(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid QR code options", "details": err.Error()})
+			return
+		}
+
+		stats, err := svc.GetURLStats(c.Param("code"), service.StatsOptions{Host: c.Request.Host})
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := qr.Render(&buf, shortLinkURL(c, stats.Domain, stats.Code), opts); err != nil {
+			if errors.Is(err, qr.ErrInvalidOptions) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid QR code options", "details": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render QR code"})
+			return
+		}
+
+		// A code always encodes the same short URL, whatever it redirects to
+		c.Header("Cache-Control", "public, max-age=86400")
+		c.Data(http.StatusOK, opts.ContentType(), buf.Bytes())
+	}
+}
+
+// qrOptions reads rendering options from the query, starting from
+// qr.DefaultOptions
+func qrOptions(c *gin.Context) (qr.Options, error) {
+	opts := qr.DefaultOptions()
+	var err error
+
+	if value := c.Query("size"); value != "" {
+		if opts.Size, err = strconv.Atoi(value); err != nil {
+			return opts, errors.New("size must be a number")
+		}
+	}
+	if value := c.Query("margin"); value != "" {
+		if opts.Margin, err = strconv.Atoi(value); err != nil {
+			return opts, errors.New("margin must be a number")
+		}
+	}
+	if value := c.Query("level"); value != "" {
+		if opts.Level, err = qr.ParseLevel(value); err != nil {
+			return opts, err
+		}
+	}
+	if value := c.Query("fg"); value != "" {
+		if opts.Foreground, err = qr.ParseColor(value); err != nil {
+			return opts, err
+		}
+	}
+	if value := c.Query("bg"); value != "" {
+		if opts.Background, err = qr.ParseColor(value); err != nil {
+			return opts, err
+		}
+	}
+	if value := c.Query("format"); value != "" {
+		if opts.Format, err = qr.ParseFormat(value); err != nil {
+			return opts, err
+		}
+	}
+	return opts, opts.Validate()
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// variantCookie remembers which destination of a split link a browser was
+// sent to. Like the unlock cookie it is scoped to the link's path.
+const variantCookie = "shortener_variant"
+
+// variantCookieMaxAge keeps visitors in their variant for the length of a
+// typical experiment
+const variantCookieMaxAge = 30 * 24 * time.Hour
+
+// splitVariant returns the variant the browser was assigned before, if any
+func splitVariant(c *gin.Context) string {
+	variant, _ := c.Cookie(variantCookie)
+	return variant
+}
+
+// setSplitVariant remembers the variant code sent the browser to
+func setSplitVariant(c *gin.Context, code, variant string) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(variantCookie, variant, int(variantCookieMaxAge.Seconds()),
+		"/"+code, "", c.Request.TLS != nil, true)
+}
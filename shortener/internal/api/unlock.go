@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/middleware"
+	"github.com/rusik69/shortener/internal/service"
+	"github.com/rusik69/shortener/internal/shortcode"
+)
+
+// unlockCookie holds the token that lets a browser through to a protected
+// link. It is scoped to the link's path, so each link has its own.
+const unlockCookie = "shortener_unlock"
+
+// unlockToken returns the unlock token the browser sent, if any
+func unlockToken(c *gin.Context) string {
+	token, _ := c.Cookie(unlockCookie)
+	return token
+}
+
+// unlockLinkKey counts password attempts per link, whichever IP they come
+// from. Hosts are mapped to their namespace so spellings of the same host
+// share one bucket, and so are codes under a case-insensitive policy.
+func unlockLinkKey(svc service.Service, policy *shortcode.Policy) middleware.KeyFunc {
+	return func(c *gin.Context) string {
+		domain, _ := svc.DomainFor(c.Request.Host)
+		code := c.Param("code")
+		if policy != nil {
+			code = policy.Normalize(code)
+		}
+		return "link:" + domain.Host + "/" + code
+	}
+}
+
+// unlockURL checks the password posted from the unlock form. On success it
+// stores a signed, short-lived token in a cookie and sends the browser
+// back to the short link.
+func unlockURL(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code := c.Param("code")
+
+		unlock, err := svc.UnlockURL(c.Request.Host, code, c.PostForm("password"))
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrWrongPassword):
+				middleware.CountFailure(c)
+				renderUnlock(c, http.StatusUnauthorized, code, "Incorrect password")
+			case errors.Is(err, service.ErrURLExpired):
+				renderError(c, http.StatusGone, "Link expired", "This short URL has expired and is no longer available")
+			case errors.Is(err, service.ErrURLDisabled):
+				renderError(c, http.StatusNotFound, "Link disabled", "This short URL has been disabled by its owner")
+			case errors.Is(err, service.ErrURLNotFound):
+				renderError(c, http.StatusNotFound, "", "Short URL not found")
+			default:
+				renderError(c, http.StatusInternalServerError, "", "Failed to unlock link")
+			}
+			return
+		}
+
+		if unlock.Token != "" {
+			c.SetSameSite(http.SameSiteLaxMode)
+			c.SetCookie(unlockCookie, unlock.Token, int(time.Until(unlock.ExpiresAt).Seconds()),
+				"/"+code, "", c.Request.TLS != nil, true)
+		}
+		c.Redirect(http.StatusSeeOther, "/"+code)
+	}
+}
+
+// renderUnlock serves the password form for a protected link
+func renderUnlock(c *gin.Context, status int, code, message string) {
+	// Keep the form out of shared caches and frames
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	if gin.Mode() == gin.TestMode {
+		if message == "" {
+			message = "Password required"
+		}
+		c.JSON(status, gin.H{"error": message, "code": code})
+		return
+	}
+	c.HTML(status, "unlock.html", gin.H{
+		"code":  code,
+		"error": message,
+	})
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/service"
+)
+
+// WebhookResponse carries a new webhook with its signing secret, which is
+// only ever shown once
+type WebhookResponse struct {
+	Secret  string      `json:"secret"`
+	Webhook *db.Webhook `json:"webhook"`
+}
+
+// createWebhook subscribes a URL to events of the caller's links
+func createWebhook(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req service.WebhookOptions
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request format",
+				"details": err.Error(),
+			})
+			return
+		}
+		req.Host = c.Request.Host
+
+		secret, webhook, err := svc.CreateWebhook(currentUser(c).ID, req)
+		if err != nil {
+			if rejectedURL(c, err) {
+				return
+			}
+			switch {
+			case errors.Is(err, service.ErrInvalidURL):
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid URL format",
+					"details": err.Error(),
+				})
+			case errors.Is(err, service.ErrInvalidWebhook):
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid webhook",
+					"details": err.Error(),
+				})
+			case errors.Is(err, service.ErrURLNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+			}
+			return
+		}
+		c.JSON(http.StatusCreated, WebhookResponse{Secret: secret, Webhook: webhook})
+	}
+}
+
+// listWebhooks lists the caller's webhooks
+func listWebhooks(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhooks, err := svc.ListWebhooks(currentUser(c).ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhooks"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+	}
+}
+
+// deleteWebhook removes one of the caller's webhooks with its deliveries
+func deleteWebhook(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		webhookID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+			return
+		}
+
+		if err := svc.DeleteWebhook(currentUser(c).ID, webhookID); err != nil {
+			if errors.Is(err, service.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+			}
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// listWebhookDeliveries returns the most recent deliveries to the caller's
+// webhooks, newest first; ?limit= caps how many
+func listWebhookDeliveries(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "0"))
+		deliveries, err := svc.ListWebhookDeliveries(currentUser(c).ID, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhook deliveries"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	}
+}
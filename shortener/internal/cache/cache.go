@@ -0,0 +1,329 @@
+// Package cache puts a read-through cache in front of short code and domain
+// lookups so redirects of popular links do not reach Postgres on every
+// request.
+package cache
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultTTL is how long a found short URL stays cached
+	DefaultTTL = time.Minute
+	// DefaultNegativeTTL is how long an unknown code stays cached as missing
+	DefaultNegativeTTL = 10 * time.Second
+	// DefaultSize is the default number of entries kept in memory
+	DefaultSize = 10000
+)
+
+// Store keeps encoded cache entries. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Get returns the value for key and whether it was present
+	Get(key string) ([]byte, bool, error)
+	// Set stores value for key until ttl elapses
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes keys; missing keys are ignored
+	Delete(keys ...string) error
+}
+
+// Config tunes the cached repository
+type Config struct {
+	// TTL bounds how stale a cached short URL can be; zero means DefaultTTL
+	TTL time.Duration
+	// NegativeTTL is how long unknown codes are remembered; zero means
+	// DefaultNegativeTTL and a negative value disables negative caching
+	NegativeTTL time.Duration
+}
+
+// entry is what gets stored for a code or domain. gob rather than JSON keeps
+// fields that are hidden from API responses.
+type entry struct {
+	URL     *db.ShortURL
+	Domain  *db.Domain
+	Missing bool
+}
+
+// repository wraps a db.Repository and caches GetShortURLByCode and
+// GetDomain
+type repository struct {
+	db.Repository
+	store       Store
+	ttl         time.Duration
+	negativeTTL time.Duration
+	group       singleflight.Group
+
+	// mu guards flights, the database lookups running per key
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is one database lookup. It is marked stale when its key is
+// invalidated while it runs, so the row it read is not cached.
+type flight struct {
+	stale bool
+}
+
+// NewRepository returns repo with short code and domain lookups served from
+// store. Concurrent misses for one key share a single database query.
+// Entries are dropped when the link or domain is changed through the
+// returned repository, including by lookups that were already running,
+// and never outlive the link's expiry. Click counts in
+// cached entries, and domains changed by other processes, lag by up to the
+// TTL.
+func NewRepository(repo db.Repository, store Store, cfg Config) db.Repository {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.NegativeTTL == 0 {
+		cfg.NegativeTTL = DefaultNegativeTTL
+	}
+	return &repository{
+		Repository:  repo,
+		store:       store,
+		ttl:         cfg.TTL,
+		negativeTTL: cfg.NegativeTTL,
+		flights:     make(map[string]*flight),
+	}
+}
+
+// key namespaces short codes in shared stores. Codes of the default
+// namespace keep the key they had before domains existed.
+func key(domain, shortCode string) string {
+	if domain == "" {
+		return "short_url:" + shortCode
+	}
+	return "short_url:" + domain + "/" + shortCode
+}
+
+// domainKey namespaces domain hosts in shared stores
+func domainKey(host string) string {
+	return "domain:" + host
+}
+
+func (r *repository) GetShortURLByCode(domain, shortCode string) (*db.ShortURL, error) {
+	k := key(domain, shortCode)
+	if e, ok := r.load(k); ok {
+		if e.Missing {
+			return nil, sql.ErrNoRows
+		}
+		return copyShortURL(e.URL), nil
+	}
+
+	value, err, _ := r.group.Do(k, func() (interface{}, error) {
+		f := r.begin(k)
+		shortURL, err := r.Repository.GetShortURLByCode(domain, shortCode)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			r.finish(k, f, entry{Missing: true}, r.negativeTTL)
+		case err == nil:
+			r.finish(k, f, entry{URL: shortURL}, r.entryTTL(shortURL))
+		default:
+			r.finish(k, f, entry{}, 0)
+		}
+		return shortURL, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Callers sharing a flight must not share the struct
+	return copyShortURL(value.(*db.ShortURL)), nil
+}
+
+// entryTTL caps the TTL so a link drops out of the cache when it expires
+func (r *repository) entryTTL(shortURL *db.ShortURL) time.Duration {
+	if shortURL.ExpiresAt != nil {
+		if left := time.Until(*shortURL.ExpiresAt); left > 0 && left < r.ttl {
+			return left
+		}
+	}
+	return r.ttl
+}
+
+func (r *repository) GetDomain(host string) (*db.Domain, error) {
+	k := domainKey(host)
+	if e, ok := r.load(k); ok {
+		if e.Missing {
+			return nil, sql.ErrNoRows
+		}
+		d := *e.Domain
+		return &d, nil
+	}
+
+	value, err, _ := r.group.Do(k, func() (interface{}, error) {
+		f := r.begin(k)
+		domain, err := r.Repository.GetDomain(host)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			r.finish(k, f, entry{Missing: true}, r.negativeTTL)
+		case err == nil:
+			r.finish(k, f, entry{Domain: domain}, r.ttl)
+		default:
+			r.finish(k, f, entry{}, 0)
+		}
+		return domain, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	d := *value.(*db.Domain)
+	return &d, nil
+}
+
+func (r *repository) load(k string) (entry, bool) {
+	data, ok, err := r.store.Get(k)
+	if err != nil {
+		log.Printf("Cache get failed: %v", err)
+		return entry{}, false
+	}
+	if !ok {
+		return entry{}, false
+	}
+
+	var e entry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		log.Printf("Cache entry %q is corrupt: %v", k, err)
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (r *repository) save(k string, e entry, ttl time.Duration) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		log.Printf("Cache encode failed: %v", err)
+		return
+	}
+	if err := r.store.Set(k, buf.Bytes(), ttl); err != nil {
+		log.Printf("Cache set failed: %v", err)
+	}
+}
+
+// begin registers a database lookup for k
+func (r *repository) begin(k string) *flight {
+	f := &flight{}
+	r.mu.Lock()
+	r.flights[k] = f
+	r.mu.Unlock()
+	return f
+}
+
+// finish caches what f read for ttl, unless ttl is not positive or k was
+// invalidated since f began. f stays registered until after the write, so
+// an invalidation racing with it is seen afterwards and what was written
+// is deleted again.
+func (r *repository) finish(k string, f *flight, e entry, ttl time.Duration) {
+	r.mu.Lock()
+	stale := f.stale
+	r.mu.Unlock()
+	if !stale && ttl > 0 {
+		r.save(k, e, ttl)
+	}
+
+	r.mu.Lock()
+	if r.flights[k] == f {
+		delete(r.flights, k)
+	}
+	wrote := !stale && ttl > 0
+	stale = f.stale
+	r.mu.Unlock()
+
+	if wrote && stale {
+		if err := r.store.Delete(k); err != nil {
+			log.Printf("Cache invalidation failed: %v", err)
+		}
+	}
+}
+
+// invalidate drops cached entries, including negative ones, for keys.
+// Lookups of keys that are still running will not cache what they read,
+// and later lookups start a fresh query instead of joining them.
+func (r *repository) invalidate(keys ...string) {
+	r.mu.Lock()
+	for _, k := range keys {
+		if f, ok := r.flights[k]; ok {
+			f.stale = true
+		}
+		r.group.Forget(k)
+	}
+	r.mu.Unlock()
+	if err := r.store.Delete(keys...); err != nil {
+		log.Printf("Cache invalidation failed: %v", err)
+	}
+}
+
+func (r *repository) CreateShortURL(item db.NewShortURL) (*db.ShortURL, error) {
+	shortURL, err := r.Repository.CreateShortURL(item)
+	if err == nil {
+		r.invalidate(key(item.Domain, item.ShortCode))
+	}
+	return shortURL, err
+}
+
+func (r *repository) CreateShortURLBatch(items []db.NewShortURL, atomic bool) ([]error, error) {
+	errs, err := r.Repository.CreateShortURLBatch(items, atomic)
+	if err != nil {
+		return errs, err
+	}
+
+	var created []string
+	for i, item := range items {
+		if i < len(errs) && errs[i] == nil {
+			created = append(created, key(item.Domain, item.ShortCode))
+		}
+	}
+	if len(created) > 0 {
+		r.invalidate(created...)
+	}
+	return errs, nil
+}
+
+func (r *repository) UpdateShortURL(userID int64, domain, shortCode string, update db.ShortURLUpdate) (*db.ShortURL, error) {
+	shortURL, err := r.Repository.UpdateShortURL(userID, domain, shortCode, update)
+	if err == nil {
+		r.invalidate(key(domain, shortCode))
+	}
+	return shortURL, err
+}
+
+func (r *repository) DeleteShortURL(userID int64, domain, shortCode string) error {
+	err := r.Repository.DeleteShortURL(userID, domain, shortCode)
+	if err == nil {
+		r.invalidate(key(domain, shortCode))
+	}
+	return err
+}
+
+func (r *repository) SaveDomain(d db.Domain) (*db.Domain, error) {
+	domain, err := r.Repository.SaveDomain(d)
+	if err == nil {
+		r.invalidate(domainKey(d.Host))
+	}
+	return domain, err
+}
+
+func (r *repository) DeleteDomain(host string) error {
+	err := r.Repository.DeleteDomain(host)
+	if err == nil {
+		r.invalidate(domainKey(host))
+	}
+	return err
+}
+
+// copyShortURL returns a shallow copy so callers cannot modify cached data
+func copyShortURL(shortURL *db.ShortURL) *db.ShortURL {
+	if shortURL == nil {
+		return nil
+	}
+	c := *shortURL
+	return &c
+}
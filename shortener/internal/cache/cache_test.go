@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingRepository serves a fixed set of links and counts lookups. Links
+// are keyed like cache entries.
+type countingRepository struct {
+	db.Repository
+	mu      sync.Mutex
+	links   map[string]*db.ShortURL
+	domains map[string]*db.Domain
+	lookups atomic.Int32
+	// release, when set, holds lookups until it is closed
+	release chan struct{}
+}
+
+func newCountingRepository(codes ...string) *countingRepository {
+	r := &countingRepository{links: make(map[string]*db.ShortURL), domains: make(map[string]*db.Domain)}
+	for i, code := range codes {
+		r.links[key("", code)] = &db.ShortURL{ID: int64(i + 1), ShortCode: code, OriginalURL: "https://example.com/" + code, Enabled: true}
+	}
+	return r
+}
+
+func (r *countingRepository) GetShortURLByCode(domain, shortCode string) (*db.ShortURL, error) {
+	r.lookups.Add(1)
+	if r.release != nil {
+		<-r.release
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	link, ok := r.links[key(domain, shortCode)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *link
+	return &c, nil
+}
+
+func (r *countingRepository) CreateShortURL(item db.NewShortURL) (*db.ShortURL, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	link := &db.ShortURL{ID: 99, ShortCode: item.ShortCode, OriginalURL: item.OriginalURL, ExpiresAt: item.ExpiresAt, Enabled: true, Domain: item.Domain}
+	r.links[key(item.Domain, item.ShortCode)] = link
+	return link, nil
+}
+
+func (r *countingRepository) UpdateShortURL(userID int64, domain, shortCode string, update db.ShortURLUpdate) (*db.ShortURL, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	link := r.links[key(domain, shortCode)]
+	if update.Enabled != nil {
+		link.Enabled = *update.Enabled
+	}
+	c := *link
+	return &c, nil
+}
+
+func (r *countingRepository) DeleteShortURL(userID int64, domain, shortCode string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.links, key(domain, shortCode))
+	return nil
+}
+
+func (r *countingRepository) GetDomain(host string) (*db.Domain, error) {
+	r.lookups.Add(1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	domain, ok := r.domains[host]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	c := *domain
+	return &c, nil
+}
+
+func (r *countingRepository) SaveDomain(d db.Domain) (*db.Domain, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.domains[d.Host] = &d
+	c := d
+	return &c, nil
+}
+
+func TestReadThrough(t *testing.T) {
+	backend := newCountingRepository("promo")
+	repo := NewRepository(backend, NewLRU(10), Config{})
+
+	for i := 0; i < 3; i++ {
+		link, err := repo.GetShortURLByCode("", "promo")
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/promo", link.OriginalURL)
+	}
+	assert.Equal(t, int32(1), backend.lookups.Load())
+}
+
+func TestNegativeCaching(t *testing.T) {
+	backend := newCountingRepository()
+	repo := NewRepository(backend, NewLRU(10), Config{})
+
+	for i := 0; i < 3; i++ {
+		_, err := repo.GetShortURLByCode("", "nope")
+		assert.Equal(t, sql.ErrNoRows, err)
+	}
+	assert.Equal(t, int32(1), backend.lookups.Load())
+
+	// Creating the code clears the negative entry
+	_, err := repo.CreateShortURL(db.NewShortURL{ShortCode: "nope", OriginalURL: "https://example.com/new"})
+	require.NoError(t, err)
+	link, err := repo.GetShortURLByCode("", "nope")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/new", link.OriginalURL)
+}
+
+func TestNegativeCachingDisabled(t *testing.T) {
+	backend := newCountingRepository()
+	repo := NewRepository(backend, NewLRU(10), Config{NegativeTTL: -1})
+
+	_, _ = repo.GetShortURLByCode("", "nope")
+	_, _ = repo.GetShortURLByCode("", "nope")
+	assert.Equal(t, int32(2), backend.lookups.Load())
+}
+
+func TestSingleflightCollapsesMisses(t *testing.T) {
+	backend := newCountingRepository("viral")
+	backend.release = make(chan struct{})
+	repo := NewRepository(backend, NewLRU(10), Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link, err := repo.GetShortURLByCode("", "viral")
+			assert.NoError(t, err)
+			assert.Equal(t, "viral", link.ShortCode)
+		}()
+	}
+
+	// Let the goroutines pile up behind the first lookup
+	require.Eventually(t, func() bool { return backend.lookups.Load() >= 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), backend.lookups.Load())
+}
+
+func TestInvalidationOnUpdateAndDelete(t *testing.T) {
+	backend := newCountingRepository("promo")
+	repo := NewRepository(backend, NewLRU(10), Config{})
+
+	link, err := repo.GetShortURLByCode("", "promo")
+	require.NoError(t, err)
+	assert.True(t, link.Enabled)
+
+	disabled := false
+	_, err = repo.UpdateShortURL(1, "", "promo", db.ShortURLUpdate{Enabled: &disabled})
+	require.NoError(t, err)
+	link, err = repo.GetShortURLByCode("", "promo")
+	require.NoError(t, err)
+	assert.False(t, link.Enabled)
+
+	require.NoError(t, repo.DeleteShortURL(1, "", "promo"))
+	_, err = repo.GetShortURLByCode("", "promo")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+// heldRepository pauses the first short code lookup after it has read the
+// row, so the row can change before the lookup returns
+type heldRepository struct {
+	*countingRepository
+	once    sync.Once
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (r *heldRepository) GetShortURLByCode(domain, shortCode string) (*db.ShortURL, error) {
+	link, err := r.countingRepository.GetShortURLByCode(domain, shortCode)
+	r.once.Do(func() {
+		close(r.read)
+		<-r.release
+	})
+	return link, err
+}
+
+func TestInvalidationDuringLookup(t *testing.T) {
+	backend := &heldRepository{
+		countingRepository: newCountingRepository("promo"),
+		read:               make(chan struct{}),
+		release:            make(chan struct{}),
+	}
+	repo := NewRepository(backend, NewLRU(10), Config{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := repo.GetShortURLByCode("", "promo")
+		assert.NoError(t, err)
+	}()
+
+	// The link is disabled after the lookup read it but before it returned
+	<-backend.read
+	disabled := false
+	_, err := repo.UpdateShortURL(1, "", "promo", db.ShortURLUpdate{Enabled: &disabled})
+	require.NoError(t, err)
+	close(backend.release)
+	<-done
+
+	// The row read before the update was not cached
+	link, err := repo.GetShortURLByCode("", "promo")
+	require.NoError(t, err)
+	assert.False(t, link.Enabled)
+}
+
+func TestEntryTTLCappedAtExpiry(t *testing.T) {
+	r := &repository{ttl: time.Hour}
+
+	soon := time.Now().Add(time.Minute)
+	ttl := r.entryTTL(&db.ShortURL{ExpiresAt: &soon})
+	assert.True(t, ttl > 0 && ttl <= time.Minute, ttl)
+
+	later := time.Now().Add(48 * time.Hour)
+	assert.Equal(t, time.Hour, r.entryTTL(&db.ShortURL{ExpiresAt: &later}))
+	assert.Equal(t, time.Hour, r.entryTTL(&db.ShortURL{}))
+}
+
+func TestCachedCopiesAreIndependent(t *testing.T) {
+	repo := NewRepository(newCountingRepository("promo"), NewLRU(10), Config{})
+
+	link, err := repo.GetShortURLByCode("", "promo")
+	require.NoError(t, err)
+	link.OriginalURL = "https://evil.example"
+
+	link, err = repo.GetShortURLByCode("", "promo")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/promo", link.OriginalURL)
+}
+
+func TestDomainsHaveSeparateEntries(t *testing.T) {
+	backend := newCountingRepository("promo")
+	repo := NewRepository(backend, NewLRU(10), Config{})
+
+	_, err := repo.GetShortURLByCode("brand.example", "promo")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, err = repo.CreateShortURL(db.NewShortURL{ShortCode: "promo", OriginalURL: "https://brand.example/sale", Domain: "brand.example"})
+	require.NoError(t, err)
+
+	link, err := repo.GetShortURLByCode("brand.example", "promo")
+	require.NoError(t, err)
+	assert.Equal(t, "https://brand.example/sale", link.OriginalURL)
+	link, err = repo.GetShortURLByCode("", "promo")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/promo", link.OriginalURL)
+}
+
+func TestDomainLookupsAreCached(t *testing.T) {
+	backend := newCountingRepository()
+	repo := NewRepository(backend, NewLRU(10), Config{})
+
+	_, err := repo.GetDomain("brand.example")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = repo.GetDomain("brand.example")
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.Equal(t, int32(1), backend.lookups.Load())
+
+	_, err = repo.SaveDomain(db.Domain{Host: "brand.example", RootURL: "https://brand.example/home"})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		domain, err := repo.GetDomain("brand.example")
+		require.NoError(t, err)
+		assert.Equal(t, "https://brand.example/home", domain.RootURL)
+	}
+	assert.Equal(t, int32(2), backend.lookups.Load())
+}
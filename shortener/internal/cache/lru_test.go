@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU(2)
+	_ = c.Set("a", []byte("1"), time.Minute)
+	_ = c.Set("b", []byte("2"), time.Minute)
+
+	// Touch a so b becomes the eviction candidate
+	_, ok, _ := c.Get("a")
+	assert.True(t, ok)
+	_ = c.Set("c", []byte("3"), time.Minute)
+
+	_, ok, _ = c.Get("b")
+	assert.False(t, ok)
+	value, ok, _ := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestLRUExpiresEntries(t *testing.T) {
+	now := time.Now()
+	c := NewLRU(10)
+	c.now = func() time.Time { return now }
+
+	_ = c.Set("a", []byte("1"), time.Second)
+	_, ok, _ := c.Get("a")
+	assert.True(t, ok)
+
+	now = now.Add(2 * time.Second)
+	_, ok, _ = c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestLRUDelete(t *testing.T) {
+	c := NewLRU(10)
+	_ = c.Set("a", []byte("1"), time.Minute)
+	_ = c.Set("b", []byte("2"), time.Minute)
+
+	assert.NoError(t, c.Delete("a", "missing"))
+	_, ok, _ := c.Get("a")
+	assert.False(t, ok)
+	_, ok, _ = c.Get("b")
+	assert.True(t, ok)
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *Redis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return server, NewRedis(client, "shortener:")
+}
+
+func TestRedisStore(t *testing.T) {
+	server, store := newTestRedis(t)
+
+	_, ok, err := store.Get("a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.Set("a", []byte("1"), time.Minute))
+	value, ok, err := store.Get("a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	assert.True(t, server.Exists("shortener:a"))
+
+	server.FastForward(2 * time.Minute)
+	_, ok, err = store.Get("a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.Set("b", []byte("2"), time.Minute))
+	require.NoError(t, store.Delete("b"))
+	assert.False(t, server.Exists("shortener:b"))
+}
+
+func TestRedisBackedRepository(t *testing.T) {
+	server, store := newTestRedis(t)
+	backend := newCountingRepository("promo")
+	repo := NewRepository(backend, store, Config{})
+
+	for i := 0; i < 3; i++ {
+		link, err := repo.GetShortURLByCode("", "promo")
+		require.NoError(t, err)
+		assert.Equal(t, "https://example.com/promo", link.OriginalURL)
+	}
+	assert.Equal(t, int32(1), backend.lookups.Load())
+
+	_, err := repo.GetShortURLByCode("", "nope")
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.True(t, server.Exists("shortener:short_url:nope"))
+}
+
+func TestRedisOutageFallsBackToDatabase(t *testing.T) {
+	server, store := newTestRedis(t)
+	backend := newCountingRepository("promo")
+	repo := NewRepository(backend, store, Config{})
+	server.Close()
+
+	link, err := repo.GetShortURLByCode("", "promo")
+	require.NoError(t, err)
+	assert.Equal(t, "promo", link.ShortCode)
+}
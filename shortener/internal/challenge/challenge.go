@@ -0,0 +1,223 @@
+// Package challenge makes clients that create links suspiciously fast prove
+// they spent CPU time before creating more. It uses a hashcash-style
+// proof of work, so no third-party captcha service is involved.
+//
+// A challenge is a signed token naming the client IP, an expiry and a
+// difficulty. The client must find a solution string such that
+// SHA-256(token + ":" + solution) starts with that many zero bits.
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/ratelimit"
+)
+
+const (
+	// DefaultDifficulty needs about 130,000 hashes on average, a second or
+	// two in a desktop browser
+	DefaultDifficulty = 17
+	// DefaultTTL is how long a client has to solve a challenge
+	DefaultTTL = 5 * time.Minute
+	// Algorithm names the hash clients must use
+	Algorithm = "sha256"
+)
+
+// DefaultThreshold lets an IP create 20 links an hour before it is challenged
+var DefaultThreshold = ratelimit.Limit{Requests: 20, Window: time.Hour}
+
+var (
+	// ErrInvalid is returned for tokens that are malformed, forged or
+	// issued to another client
+	ErrInvalid = errors.New("invalid challenge")
+	// ErrExpired is returned for tokens past their expiry
+	ErrExpired = errors.New("challenge expired")
+	// ErrUnsolved is returned when the solution does not meet the difficulty
+	ErrUnsolved = errors.New("challenge not solved")
+	// ErrReplayed is returned for challenges that were already used
+	ErrReplayed = errors.New("challenge already used")
+)
+
+// Recorder stores attempts; db.Repository implements it
+type Recorder interface {
+	RecordCaptchaAttempt(attempt db.CaptchaAttempt) error
+}
+
+// Config tunes the guard; zero values pick the defaults
+type Config struct {
+	// Threshold is the rate of link creation an IP may sustain before it
+	// must solve challenges. A zero Limit means DefaultThreshold.
+	Threshold ratelimit.Limit
+	// Difficulty is the number of leading zero bits a solution needs
+	Difficulty int
+	// TTL is how long an issued challenge stays valid
+	TTL time.Duration
+	// Secret signs tokens. Replicas must share it; when empty a random
+	// secret is generated and tokens do not survive a restart.
+	Secret []byte
+}
+
+// Challenge is what a suspicious client has to solve
+type Challenge struct {
+	Token      string    `json:"token"`
+	Algorithm  string    `json:"algorithm"`
+	Difficulty int       `json:"difficulty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// claims are the signed contents of a token
+type claims struct {
+	ID         string `json:"id"`
+	IP         string `json:"ip"`
+	Difficulty int    `json:"bits"`
+	Expires    int64  `json:"exp"`
+}
+
+// Guard decides which clients must solve a challenge and checks solutions
+type Guard struct {
+	limiter  ratelimit.Limiter
+	recorder Recorder
+	cfg      Config
+	now      func() time.Time
+}
+
+// New returns a guard that tracks creation rates in limiter and records
+// attempts through recorder
+func New(limiter ratelimit.Limiter, recorder Recorder, cfg Config) (*Guard, error) {
+	if cfg.Threshold == (ratelimit.Limit{}) {
+		cfg.Threshold = DefaultThreshold
+	}
+	if cfg.Difficulty <= 0 {
+		cfg.Difficulty = DefaultDifficulty
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if len(cfg.Secret) == 0 {
+		cfg.Secret = make([]byte, 32)
+		if _, err := rand.Read(cfg.Secret); err != nil {
+			return nil, err
+		}
+	}
+	return &Guard{limiter: limiter, recorder: recorder, cfg: cfg, now: time.Now}, nil
+}
+
+// Suspicious counts a link creation for ip and reports whether it went
+// over the threshold. Limiter failures count as not suspicious.
+func (g *Guard) Suspicious(ip string) bool {
+	result, err := g.limiter.Allow("suspicion:"+ip, g.cfg.Threshold)
+	if err != nil {
+		log.Printf("Challenge limiter unavailable: %v", err)
+		return false
+	}
+	return !result.Allowed
+}
+
+// Issue creates a challenge for ip
+func (g *Guard) Issue(ip string) (Challenge, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Challenge{}, err
+	}
+	expiresAt := g.now().Add(g.cfg.TTL).Truncate(time.Second)
+
+	payload, err := json.Marshal(claims{
+		ID:         hex.EncodeToString(id),
+		IP:         ip,
+		Difficulty: g.cfg.Difficulty,
+		Expires:    expiresAt.Unix(),
+	})
+	if err != nil {
+		return Challenge{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return Challenge{
+		Token:      encoded + "." + g.sign(encoded),
+		Algorithm:  Algorithm,
+		Difficulty: g.cfg.Difficulty,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// Verify checks that ip solved token and records the attempt. A token can
+// be redeemed once.
+func (g *Guard) Verify(ip, token, solution string) error {
+	c, err := g.check(ip, token, solution)
+	attempt := db.CaptchaAttempt{IPAddress: ip, ChallengeID: c.ID, Success: err == nil}
+
+	recordErr := g.recorder.RecordCaptchaAttempt(attempt)
+	if attempt.Success && db.IsUniqueViolation(recordErr) {
+		// Remember the replay as a failure
+		attempt.Success = false
+		recordErr = g.recorder.RecordCaptchaAttempt(attempt)
+		err = ErrReplayed
+	}
+	if recordErr != nil {
+		// Without a record a solution could be replayed, so refuse it
+		log.Printf("Failed to record challenge attempt: %v", recordErr)
+		if err == nil {
+			return recordErr
+		}
+	}
+	return err
+}
+
+// check validates token and solution without side effects. The claims are
+// returned whenever the token is authentic.
+func (g *Guard) check(ip, token, solution string) (claims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(g.sign(encoded))) {
+		return claims{}, ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims{}, ErrInvalid
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return claims{}, ErrInvalid
+	}
+
+	if c.IP != ip {
+		return c, ErrInvalid
+	}
+	if !g.now().Before(time.Unix(c.Expires, 0)) {
+		return c, ErrExpired
+	}
+	if solution == "" || len(solution) > 64 || LeadingZeroBits(token, solution) < c.Difficulty {
+		return c, ErrUnsolved
+	}
+	return c, nil
+}
+
+func (g *Guard) sign(encoded string) string {
+	mac := hmac.New(sha256.New, g.cfg.Secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// LeadingZeroBits returns the number of leading zero bits of
+// SHA-256(token + ":" + solution)
+func LeadingZeroBits(token, solution string) int {
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,121 @@
+package challenge
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryRecorder keeps attempts and enforces one success per challenge
+type memoryRecorder struct {
+	attempts []db.CaptchaAttempt
+	solved   map[string]bool
+}
+
+func (r *memoryRecorder) RecordCaptchaAttempt(attempt db.CaptchaAttempt) error {
+	if attempt.Success {
+		if r.solved[attempt.ChallengeID] {
+			return &pgconn.PgError{Code: "23505"}
+		}
+		r.solved[attempt.ChallengeID] = true
+	}
+	r.attempts = append(r.attempts, attempt)
+	return nil
+}
+
+func newTestGuard(t *testing.T) (*Guard, *memoryRecorder) {
+	t.Helper()
+	recorder := &memoryRecorder{solved: make(map[string]bool)}
+	guard, err := New(ratelimit.NewMemory(), recorder, Config{
+		Threshold:  ratelimit.Limit{Requests: 2, Window: time.Hour},
+		Difficulty: 8,
+		Secret:     []byte("test secret"),
+	})
+	require.NoError(t, err)
+	return guard, recorder
+}
+
+// solve finds a solution by brute force, as the web UI does
+func solve(token string, difficulty int) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		if LeadingZeroBits(token, solution) >= difficulty {
+			return solution
+		}
+	}
+}
+
+func TestSuspicious(t *testing.T) {
+	guard, _ := newTestGuard(t)
+
+	assert.False(t, guard.Suspicious("203.0.113.7"))
+	assert.False(t, guard.Suspicious("203.0.113.7"))
+	assert.True(t, guard.Suspicious("203.0.113.7"))
+	assert.False(t, guard.Suspicious("203.0.113.8"))
+}
+
+func TestVerify(t *testing.T) {
+	guard, recorder := newTestGuard(t)
+
+	c, err := guard.Issue("203.0.113.7")
+	require.NoError(t, err)
+	assert.Equal(t, "sha256", c.Algorithm)
+	assert.Equal(t, 8, c.Difficulty)
+
+	solution := solve(c.Token, c.Difficulty)
+	require.NoError(t, guard.Verify("203.0.113.7", c.Token, solution))
+
+	// A solved challenge cannot be used twice
+	assert.ErrorIs(t, guard.Verify("203.0.113.7", c.Token, solution), ErrReplayed)
+
+	require.Len(t, recorder.attempts, 2)
+	assert.True(t, recorder.attempts[0].Success)
+	assert.False(t, recorder.attempts[1].Success)
+	assert.Equal(t, recorder.attempts[0].ChallengeID, recorder.attempts[1].ChallengeID)
+	assert.Equal(t, "203.0.113.7", recorder.attempts[0].IPAddress)
+}
+
+func TestVerifyRejects(t *testing.T) {
+	guard, recorder := newTestGuard(t)
+
+	c, err := guard.Issue("203.0.113.7")
+	require.NoError(t, err)
+	solution := solve(c.Token, c.Difficulty)
+
+	// Find a string that does not solve the challenge
+	wrong := "x"
+	for LeadingZeroBits(c.Token, wrong) >= c.Difficulty {
+		wrong += "x"
+	}
+	assert.ErrorIs(t, guard.Verify("203.0.113.7", c.Token, wrong), ErrUnsolved)
+	assert.ErrorIs(t, guard.Verify("203.0.113.7", c.Token, ""), ErrUnsolved)
+
+	// Tokens are bound to the client they were issued to
+	assert.ErrorIs(t, guard.Verify("203.0.113.8", c.Token, solution), ErrInvalid)
+
+	// Tampered or garbage tokens
+	encoded, signature, _ := strings.Cut(c.Token, ".")
+	assert.ErrorIs(t, guard.Verify("203.0.113.7", encoded+"x."+signature, solution), ErrInvalid)
+	assert.ErrorIs(t, guard.Verify("203.0.113.7", "garbage", solution), ErrInvalid)
+
+	// Another secret does not accept our tokens
+	other, err := New(ratelimit.NewMemory(), recorder, Config{Difficulty: 8, Secret: []byte("other")})
+	require.NoError(t, err)
+	assert.ErrorIs(t, other.Verify("203.0.113.7", c.Token, solution), ErrInvalid)
+
+	// Expired tokens
+	guard.now = func() time.Time { return time.Now().Add(DefaultTTL + time.Second) }
+	assert.ErrorIs(t, guard.Verify("203.0.113.7", c.Token, solution), ErrExpired)
+
+	for _, attempt := range recorder.attempts {
+		assert.False(t, attempt.Success)
+	}
+	assert.Len(t, recorder.attempts, 7)
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"os"
+
+	"github.com/rusik69/shortener/internal/shortcode"
+	"github.com/rusik69/shortener/internal/urlpolicy"
+)
+
+// CodePolicy builds the short code policy from the environment
+func CodePolicy() (*shortcode.Policy, error) {
+	cfg := shortcode.PolicyConfig{
+		MinLength:       Int("SHORTCODE_MIN_LENGTH", 0),
+		MaxLength:       Int("SHORTCODE_MAX_LENGTH", 0),
+		CaseInsensitive: Bool("SHORTCODE_CASE_INSENSITIVE", false),
+		Reserved:        List("SHORTCODE_RESERVED"),
+	}
+
+	if path := os.Getenv("SHORTCODE_BLOCKLIST"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		if cfg.Blocklist, err = shortcode.ReadWordList(file); err != nil {
+			return nil, err
+		}
+	}
+
+	return shortcode.NewPolicy(cfg), nil
+}
+
+// URLPolicy builds the destination URL policy from the environment
+func URLPolicy() (*urlpolicy.Policy, error) {
+	return urlpolicy.New(urlpolicy.Config{
+		Schemes:         List("URL_POLICY_SCHEMES"),
+		SelfHosts:       List("URL_POLICY_SELF_HOSTS"),
+		Shorteners:      List("URL_POLICY_SHORTENERS"),
+		AllowShorteners: Bool("URL_POLICY_ALLOW_SHORTENERS", false),
+		AllowPrivate:    Bool("URL_POLICY_ALLOW_PRIVATE", false),
+		BlocklistPath:   os.Getenv("URL_BLOCKLIST"),
+		Resolve:         Bool("URL_POLICY_RESOLVE", false),
+	})
+}
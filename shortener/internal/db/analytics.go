@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// ClickDimension is a clicks column that analytics can group by
+type ClickDimension string
+
+const (
+	DimensionReferrer     ClickDimension = "referrer"
+	DimensionReferrerHost ClickDimension = "referrer_host"
+	DimensionUserAgent    ClickDimension = "user_agent"
+	DimensionCountry      ClickDimension = "country"
+	DimensionUTMSource    ClickDimension = "utm_source"
+	DimensionUTMMedium    ClickDimension = "utm_medium"
+	DimensionUTMCampaign  ClickDimension = "utm_campaign"
+	DimensionBrowser      ClickDimension = "browser"
+	DimensionOS           ClickDimension = "os"
+	DimensionDevice       ClickDimension = "device"
+	DimensionVariant      ClickDimension = "variant"
+	DimensionRule         ClickDimension = "rule"
+)
+
+// ClickQuery selects a link's clicks in [From, To)
+type ClickQuery struct {
+	ShortURLID int64
+	From       time.Time
+	To         time.Time
+	// IncludeBots counts clicks classified as bots too
+	IncludeBots bool
+}
+
+// botFilter is the SQL condition excluding bots unless they are wanted
+func botFilter(includeBots bool) string {
+	if includeBots {
+		return ""
+	}
+	return " AND NOT is_bot"
+}
+
+// ClickBucket is the number of clicks in one time bucket
+type ClickBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+// ClickTally is the number of clicks sharing one dimension value
+type ClickTally struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+// CountClicksByTime buckets the selected clicks by the given date_trunc unit
+// ("hour", "day" or "week"), in UTC. Empty buckets are omitted.
+func (r *repository) CountClicksByTime(query ClickQuery, unit string) ([]ClickBucket, error) {
+	switch unit {
+	case "hour", "day", "week":
+	default:
+		return nil, fmt.Errorf("unsupported time bucket %q", unit)
+	}
+
+	rows, err := r.db.Query(
+		"SELECT date_trunc($2, created_at AT TIME ZONE 'UTC') AS bucket, COUNT(*) FROM clicks WHERE short_url_id = $1 AND created_at >= $3 AND created_at < $4"+botFilter(query.IncludeBots)+" GROUP BY bucket ORDER BY bucket",
+		query.ShortURLID, unit, query.From, query.To,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var buckets []ClickBucket
+	for rows.Next() {
+		var bucket ClickBucket
+		if err := rows.Scan(&bucket.Start, &bucket.Clicks); err != nil {
+			return nil, err
+		}
+		bucket.Start = bucket.Start.UTC()
+		buckets = append(buckets, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// TopClickValues returns the most frequent non-empty values of a dimension
+// among the selected clicks, most clicked first
+func (r *repository) TopClickValues(query ClickQuery, dimension ClickDimension, limit int) ([]ClickTally, error) {
+	switch dimension {
+	case DimensionReferrer, DimensionReferrerHost, DimensionUserAgent, DimensionCountry,
+		DimensionUTMSource, DimensionUTMMedium, DimensionUTMCampaign,
+		DimensionBrowser, DimensionOS, DimensionDevice, DimensionVariant, DimensionRule:
+	default:
+		return nil, fmt.Errorf("unsupported click dimension %q", dimension)
+	}
+
+	sqlQuery := fmt.Sprintf(
+		"SELECT %[1]s, COUNT(*) AS clicks FROM clicks WHERE short_url_id = $1 AND created_at >= $2 AND created_at < $3%[2]s AND %[1]s IS NOT NULL AND %[1]s <> '' GROUP BY %[1]s ORDER BY clicks DESC, %[1]s LIMIT $4",
+		dimension, botFilter(query.IncludeBots),
+	)
+	rows, err := r.db.Query(sqlQuery, query.ShortURLID, query.From, query.To, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var tallies []ClickTally
+	for rows.Next() {
+		var tally ClickTally
+		if err := rows.Scan(&tally.Value, &tally.Clicks); err != nil {
+			return nil, err
+		}
+		tallies = append(tallies, tally)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tallies, nil
+}
+
+// GetLastClickTime returns when a link was last clicked, or nil if never
+func (r *repository) GetLastClickTime(shortURLID int64, includeBots bool) (*time.Time, error) {
+	var last *time.Time
+	err := r.db.QueryRow(
+		"SELECT MAX(created_at) FROM clicks WHERE short_url_id = $1"+botFilter(includeBots),
+		shortURLID,
+	).Scan(&last)
+	if err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+// CountBotClicks returns how many of a link's clicks came from bots, which
+// are left out of click_count
+func (r *repository) CountBotClicks(shortURLID int64) (int64, error) {
+	var count int64
+	err := r.db.QueryRow(
+		"SELECT COUNT(*) FROM clicks WHERE short_url_id = $1 AND is_bot",
+		shortURLID,
+	).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrShortCodeTaken is reported for batch items whose code already exists
+var ErrShortCodeTaken = errors.New("short code already exists")
+
+// NewShortURL describes a short URL to insert
+type NewShortURL struct {
+	ShortCode   string
+	OriginalURL string
+	UserID      *int64
+	ExpiresAt   *time.Time
+	// PasswordHash is a bcrypt hash; nil leaves the link unprotected
+	PasswordHash *string
+	// RedirectType is the HTTP status of the redirect: 301, 302, 307 or 308
+	RedirectType int
+	// Destinations split traffic between several URLs
+	Destinations Destinations
+	// Rules route matching visitors elsewhere
+	Rules Rules
+	// Domain is the host whose namespace the code goes in; empty for the
+	// default namespace
+	Domain string
+}
+
+// CreateShortURLBatch inserts many short URLs in a single transaction and
+// returns one error slot per item (nil on success). Items whose code already
+// exists get ErrShortCodeTaken. In atomic mode the transaction is rolled back
+// on the first such conflict, so nothing is stored unless every item succeeds.
+func (r *repository) CreateShortURLBatch(items []NewShortURL, atomic bool) ([]error, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	stmt, err := tx.Prepare(
+		"INSERT INTO short_urls (short_code, original_url, user_id, expires_at, created_at, updated_at, click_count, password_hash, redirect_type, destinations, rules, domain) VALUES ($1, $2, $3, $4, $5, $6, 0, $7, $8, $9, $10, NULLIF($11, '')) ON CONFLICT DO NOTHING RETURNING id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = stmt.Close()
+	}()
+
+	now := time.Now()
+	errs := make([]error, len(items))
+	for i, item := range items {
+		var id int64
+		err := stmt.QueryRow(item.ShortCode, item.OriginalURL, item.UserID, item.ExpiresAt, now, now, item.PasswordHash, item.RedirectType, item.Destinations, item.Rules, item.Domain).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			errs[i] = ErrShortCodeTaken
+			if atomic {
+				return errs, nil
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
@@ -0,0 +1,37 @@
+package db
+
+import "time"
+
+// CaptchaAttempt is one answer to an abuse challenge
+type CaptchaAttempt struct {
+	IPAddress string
+	// ChallengeID identifies the challenge; empty when the token was unreadable
+	ChallengeID string
+	Success     bool
+}
+
+// RecordCaptchaAttempt stores an attempt. Only one successful attempt may
+// exist per challenge, so replaying a solved challenge fails with a unique
+// violation (see IsUniqueViolation).
+func (r *repository) RecordCaptchaAttempt(attempt CaptchaAttempt) error {
+	var challengeID interface{}
+	if attempt.ChallengeID != "" {
+		challengeID = attempt.ChallengeID
+	}
+	_, err := r.db.Exec(
+		"INSERT INTO captcha_attempts (ip_address, challenge_id, success) VALUES ($1, $2, $3)",
+		attempt.IPAddress, challengeID, attempt.Success,
+	)
+	return err
+}
+
+// DeleteOldCaptchaAttempts removes attempts made before the given time and
+// returns how many were removed. Attempts only guard against replays until
+// their challenge expires.
+func (r *repository) DeleteOldCaptchaAttempts(before time.Time) (int64, error) {
+	result, err := r.db.Exec("DELETE FROM captcha_attempts WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
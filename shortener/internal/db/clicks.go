@@ -0,0 +1,246 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	clickColumns     = "short_url_id, user_agent, ip_address, referrer, referrer_host, utm_source, utm_medium, utm_campaign, utm_term, utm_content, utm_extra, country, region, asn, browser, os, device, is_bot, variant, rule, created_at"
+	clickColumnCount = 21
+	// maxClicksPerInsert keeps each INSERT below Postgres' 65535 parameter limit
+	maxClicksPerInsert = 65535 / clickColumnCount
+	// maxLinksPerUpdate keeps each counter update, which takes the time and
+	// two parameters per link, below the same limit
+	maxLinksPerUpdate = (65535 - 1) / 2
+)
+
+// clickColumnCasts type the parameters of clickColumns, which the VALUES
+// list in RecordClicks cannot infer from the target table
+var clickColumnCasts = []string{
+	"::integer", "::text", "::inet", "::text", "::text",
+	"::text", "::text", "::text", "::text", "::text",
+	"::jsonb", "::text", "::text", "::bigint",
+	"::text", "::text", "::text", "::boolean",
+	"::text", "::text", "::timestamptz",
+}
+
+// clickArgs returns the values for clickColumns
+func clickArgs(click NewClick) ([]interface{}, error) {
+	var extra []byte
+	if len(click.UTM.Extra) > 0 {
+		var err error
+		if extra, err = json.Marshal(click.UTM.Extra); err != nil {
+			return nil, err
+		}
+	}
+	createdAt := click.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	return []interface{}{
+		click.ShortURLID, click.UserAgent, click.IPAddress, click.Referrer, click.ReferrerHost,
+		click.UTM.Source, click.UTM.Medium, click.UTM.Campaign, click.UTM.Term, click.UTM.Content,
+		extra, sql.NullString{String: click.Country, Valid: click.Country != ""},
+		click.Region, sql.NullInt64{Int64: int64(click.ASN), Valid: click.ASN != 0},
+		click.Browser, click.OS, click.Device, click.IsBot,
+		sql.NullString{String: click.Variant, Valid: click.Variant != ""},
+		sql.NullString{String: click.Rule, Valid: click.Rule != ""}, createdAt,
+	}, nil
+}
+
+// placeholders returns rows groups of "($n, ...)" with width parameters
+// each, numbered from first and suffixed with cast (e.g. "::bigint")
+func placeholders(first, rows, width int, cast string) string {
+	var b strings.Builder
+	n := first
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for col := 0; col < width; col++ {
+			if col > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "$%d%s", n, cast)
+			n++
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// typedPlaceholders is placeholders with a cast per column
+func typedPlaceholders(first, rows int, casts []string) string {
+	var b strings.Builder
+	n := first
+	for row := 0; row < rows; row++ {
+		if row > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for col, cast := range casts {
+			if col > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "$%d%s", n, cast)
+			n++
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// RecordClicks stores many clicks in one transaction using multi-row
+// inserts and bumps click_count once per short URL by its number of human
+// (non-bot) clicks. Counters are updated in id order so concurrent flushes
+// from several replicas cannot deadlock. Webhook events fired by the new
+// counts are queued in the same transaction. Clicks of links deleted while
+// the clicks were buffered are skipped.
+func (r *repository) RecordClicks(clicks []NewClick) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for start := 0; start < len(clicks); start += maxClicksPerInsert {
+		end := start + maxClicksPerInsert
+		if end > len(clicks) {
+			end = len(clicks)
+		}
+		chunk := clicks[start:end]
+
+		args := make([]interface{}, 0, len(chunk)*clickColumnCount)
+		for _, click := range chunk {
+			values, err := clickArgs(click)
+			if err != nil {
+				return err
+			}
+			args = append(args, values...)
+		}
+		_, err := tx.Exec(
+			"INSERT INTO clicks ("+clickColumns+") SELECT * FROM (VALUES "+typedPlaceholders(1, len(chunk), clickColumnCasts)+
+				") AS v("+clickColumns+") WHERE EXISTS (SELECT 1 FROM short_urls s WHERE s.id = v.short_url_id)",
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	counts := make(map[int64]int64)
+	for _, click := range clicks {
+		if !click.IsBot {
+			counts[click.ShortURLID]++
+		}
+	}
+	if len(counts) > 0 {
+		ids := make([]int64, 0, len(counts))
+		for id := range counts {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		// Chunks follow id order, so the locks are still taken in order
+		for start := 0; start < len(ids); start += maxLinksPerUpdate {
+			end := start + maxLinksPerUpdate
+			if end > len(ids) {
+				end = len(ids)
+			}
+			if err := lockShortURLs(tx, ids[start:end]); err != nil {
+				return err
+			}
+			if err := addClickCounts(tx, ids[start:end], counts); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// lockShortURLs locks the rows of the short URLs in ids, which must be
+// sorted, in id order
+func lockShortURLs(tx *sql.Tx, ids []int64) error {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := tx.Query("SELECT id FROM short_urls WHERE id IN "+placeholders(1, 1, len(ids), "")+" ORDER BY id FOR UPDATE", args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	_ = rows.Close()
+	return rows.Err()
+}
+
+// addClickCounts adds counts[id] to the click_count of each short URL in
+// ids and queues the webhook events of links whose owner has webhooks. ids
+// may hold at most maxLinksPerUpdate links.
+func addClickCounts(tx *sql.Tx, ids []int64, counts map[int64]int64) error {
+	now := time.Now()
+	args := make([]interface{}, 0, len(ids)*2+1)
+	args = append(args, now)
+	for _, id := range ids {
+		args = append(args, id, counts[id])
+	}
+	rows, err := tx.Query(
+		"UPDATE short_urls AS s SET click_count = s.click_count + v.n, updated_at = $1 FROM (VALUES "+
+			placeholders(2, len(ids), 2, "::bigint")+") AS v(id, n) WHERE s.id = v.id "+
+			"RETURNING s.id, s.user_id, s.short_code, COALESCE(s.domain, ''), s.original_url, s.click_count, v.n, "+
+			"EXISTS (SELECT 1 FROM webhooks w WHERE w.user_id = s.user_id)",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+
+	type counted struct {
+		userID int64
+		link   WebhookLink
+		before int64
+	}
+	var hooked []counted
+	for rows.Next() {
+		var c counted
+		var userID sql.NullInt64
+		var added int64
+		var hasWebhooks bool
+		err := rows.Scan(&c.link.ID, &userID, &c.link.Code, &c.link.Domain, &c.link.OriginalURL, &c.link.ClickCount, &added, &hasWebhooks)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if hasWebhooks && userID.Valid {
+			c.userID, c.before = userID.Int64, c.link.ClickCount-added
+			hooked = append(hooked, c)
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The rows must be closed before the transaction runs more statements
+	for _, c := range hooked {
+		if err := enqueueClickEvents(tx, c.userID, c.link, c.before, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
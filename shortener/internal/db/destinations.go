@@ -0,0 +1,55 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Destination is one target of a split link
+type Destination struct {
+	// Label names the variant in clicks and stats
+	Label  string `json:"label"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Destinations are the weighted targets of a split link, stored as JSONB in
+// short_urls.destinations. A link without destinations redirects to its
+// original URL.
+type Destinations []Destination
+
+// Value implements driver.Valuer; an empty list is stored as NULL
+func (d Destinations) Value() (driver.Value, error) {
+	if len(d) == 0 {
+		return nil, nil
+	}
+	return json.Marshal([]Destination(d))
+}
+
+// Scan implements sql.Scanner
+func (d *Destinations) Scan(src interface{}) error {
+	return scanJSON(src, (*[]Destination)(d))
+}
+
+// TotalWeight is the sum of all destination weights
+func (d Destinations) TotalWeight() int {
+	total := 0
+	for _, dest := range d {
+		total += dest.Weight
+	}
+	return total
+}
+
+// scanJSON decodes a JSONB column into dest; NULL leaves dest nil
+func scanJSON(src interface{}, dest interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		return json.Unmarshal([]byte("null"), dest)
+	case []byte:
+		return json.Unmarshal(v, dest)
+	case string:
+		return json.Unmarshal([]byte(v), dest)
+	}
+	return fmt.Errorf("cannot scan %T into %T", src, dest)
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Domain is a host with its own namespace of short codes. Requests for
+// hosts without a Domain row share the default namespace.
+type Domain struct {
+	ID   int64  `json:"id"`
+	Host string `json:"host"`
+	// RedirectType is used for new links that do not choose one; 0 falls
+	// back to the server default
+	RedirectType int `json:"redirect_type,omitempty"`
+	// NotFoundURL is where unknown codes redirect; empty shows the 404 page
+	NotFoundURL string `json:"not_found_url,omitempty"`
+	// RootURL is where the domain's root redirects; empty serves the web
+	// frontend
+	RootURL   string    `json:"root_url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// domainColumns lists the columns read by scanDomain, in order
+const domainColumns = "id, host, COALESCE(redirect_type, 0), COALESCE(not_found_url, ''), COALESCE(root_url, ''), created_at, updated_at"
+
+func scanDomain(row rowScanner) (*Domain, error) {
+	var d Domain
+	err := row.Scan(&d.ID, &d.Host, &d.RedirectType, &d.NotFoundURL, &d.RootURL, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// SaveDomain creates the domain for d.Host or replaces its settings. Zero
+// settings are stored as NULL.
+func (r *repository) SaveDomain(d Domain) (*Domain, error) {
+	now := time.Now()
+	return scanDomain(r.db.QueryRow(
+		`INSERT INTO domains (host, redirect_type, not_found_url, root_url, created_at, updated_at)
+		VALUES ($1, NULLIF($2, 0), NULLIF($3, ''), NULLIF($4, ''), $5, $5)
+		ON CONFLICT (host) DO UPDATE SET
+			redirect_type = EXCLUDED.redirect_type,
+			not_found_url = EXCLUDED.not_found_url,
+			root_url = EXCLUDED.root_url,
+			updated_at = EXCLUDED.updated_at
+		RETURNING `+domainColumns,
+		d.Host, d.RedirectType, d.NotFoundURL, d.RootURL, now,
+	))
+}
+
+// GetDomain returns the domain for host or sql.ErrNoRows
+func (r *repository) GetDomain(host string) (*Domain, error) {
+	return scanDomain(r.db.QueryRow("SELECT "+domainColumns+" FROM domains WHERE host = $1", host))
+}
+
+func (r *repository) ListDomains() ([]Domain, error) {
+	rows, err := r.db.Query("SELECT " + domainColumns + " FROM domains ORDER BY host")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	domains := []Domain{}
+	for rows.Next() {
+		d, err := scanDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, *d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// DeleteDomain removes the domain for host. It returns sql.ErrNoRows if
+// there is none; domains that still have links are kept by the foreign key.
+func (r *repository) DeleteDomain(host string) error {
+	res, err := r.db.Exec("DELETE FROM domains WHERE host = $1", host)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// exportBatchSize is how many rows each FETCH pulls from an export cursor
+const exportBatchSize = 1000
+
+// ExportQuery selects the links or clicks created in [From, To)
+type ExportQuery struct {
+	// UserID limits the export to one owner's links; nil exports all
+	UserID *int64
+	From   time.Time
+	To     time.Time
+	// IncludeBots exports clicks classified as bots too
+	IncludeBots bool
+}
+
+// ExportedLink is one row of a links export. The tags name the columns in
+// every export format.
+type ExportedLink struct {
+	ID           int64      `json:"id" parquet:"id"`
+	ShortCode    string     `json:"short_code" parquet:"short_code"`
+	Domain       string     `json:"domain" parquet:"domain"`
+	OriginalURL  string     `json:"original_url" parquet:"original_url"`
+	Owner        string     `json:"owner" parquet:"owner"`
+	CreatedAt    time.Time  `json:"created_at" parquet:"created_at,timestamp(millisecond)"`
+	ExpiresAt    *time.Time `json:"expires_at" parquet:"expires_at,optional,timestamp(millisecond)"`
+	ClickCount   int64      `json:"click_count" parquet:"click_count"`
+	Enabled      bool       `json:"enabled" parquet:"enabled"`
+	RedirectType int32      `json:"redirect_type" parquet:"redirect_type"`
+	Protected    bool       `json:"password_protected" parquet:"password_protected"`
+	Split        bool       `json:"split" parquet:"split"`
+	Targeted     bool       `json:"targeted" parquet:"targeted"`
+}
+
+// ExportedClick is one row of a clicks export
+type ExportedClick struct {
+	ID           int64     `json:"id" parquet:"id"`
+	CreatedAt    time.Time `json:"created_at" parquet:"created_at,timestamp(millisecond)"`
+	ShortURLID   int64     `json:"short_url_id" parquet:"short_url_id"`
+	ShortCode    string    `json:"short_code" parquet:"short_code"`
+	Domain       string    `json:"domain" parquet:"domain"`
+	Referrer     string    `json:"referrer" parquet:"referrer"`
+	ReferrerHost string    `json:"referrer_host" parquet:"referrer_host"`
+	UTMSource    string    `json:"utm_source" parquet:"utm_source"`
+	UTMMedium    string    `json:"utm_medium" parquet:"utm_medium"`
+	UTMCampaign  string    `json:"utm_campaign" parquet:"utm_campaign"`
+	UTMTerm      string    `json:"utm_term" parquet:"utm_term"`
+	UTMContent   string    `json:"utm_content" parquet:"utm_content"`
+	// UTMExtra is the JSON object of other utm_* parameters, or empty
+	UTMExtra  string `json:"utm_extra" parquet:"utm_extra"`
+	Country   string `json:"country" parquet:"country"`
+	Region    string `json:"region" parquet:"region"`
+	ASN       int64  `json:"asn" parquet:"asn"`
+	Browser   string `json:"browser" parquet:"browser"`
+	OS        string `json:"os" parquet:"os"`
+	Device    string `json:"device" parquet:"device"`
+	IsBot     bool   `json:"is_bot" parquet:"is_bot"`
+	Variant   string `json:"variant" parquet:"variant"`
+	Rule      string `json:"rule" parquet:"rule"`
+	UserAgent string `json:"user_agent" parquet:"user_agent"`
+	IPAddress string `json:"ip_address" parquet:"ip_address"`
+}
+
+// ExportLinks calls fn for each selected link, oldest first. Rows are
+// streamed from a server-side cursor, so memory use does not depend on how
+// many links there are. An error from fn stops the export.
+func (r *repository) ExportLinks(ctx context.Context, query ExportQuery, fn func(ExportedLink) error) error {
+	sqlQuery := `SELECT s.id, s.short_code, COALESCE(s.domain, ''), s.original_url, COALESCE(u.username, ''),
+		s.created_at, s.expires_at, COALESCE(s.click_count, 0), s.enabled, s.redirect_type,
+		s.password_hash IS NOT NULL, s.destinations IS NOT NULL, s.rules IS NOT NULL
+		FROM short_urls s LEFT JOIN users u ON u.id = s.user_id
+		WHERE s.created_at >= $1 AND s.created_at < $2`
+	args := []interface{}{query.From, query.To}
+	if query.UserID != nil {
+		sqlQuery += " AND s.user_id = $3"
+		args = append(args, *query.UserID)
+	}
+	sqlQuery += " ORDER BY s.id"
+
+	return r.streamRows(ctx, sqlQuery, args, func(row rowScanner) error {
+		var link ExportedLink
+		err := row.Scan(
+			&link.ID, &link.ShortCode, &link.Domain, &link.OriginalURL, &link.Owner,
+			&link.CreatedAt, &link.ExpiresAt, &link.ClickCount, &link.Enabled, &link.RedirectType,
+			&link.Protected, &link.Split, &link.Targeted,
+		)
+		if err != nil {
+			return err
+		}
+		return fn(link)
+	})
+}
+
+// ExportClicks calls fn for each selected click, oldest first, streaming
+// them like ExportLinks
+func (r *repository) ExportClicks(ctx context.Context, query ExportQuery, fn func(ExportedClick) error) error {
+	sqlQuery := `SELECT c.id, c.created_at, c.short_url_id, s.short_code, COALESCE(s.domain, ''),
+		COALESCE(c.referrer, ''), COALESCE(c.referrer_host, ''),
+		COALESCE(c.utm_source, ''), COALESCE(c.utm_medium, ''), COALESCE(c.utm_campaign, ''),
+		COALESCE(c.utm_term, ''), COALESCE(c.utm_content, ''), COALESCE(c.utm_extra::text, ''),
+		COALESCE(c.country, ''), COALESCE(c.region, ''), COALESCE(c.asn, 0),
+		COALESCE(c.browser, ''), COALESCE(c.os, ''), COALESCE(c.device, ''), c.is_bot,
+		COALESCE(c.variant, ''), COALESCE(c.rule, ''), COALESCE(c.user_agent, ''), COALESCE(host(c.ip_address), '')
+		FROM clicks c JOIN short_urls s ON s.id = c.short_url_id
+		WHERE c.created_at >= $1 AND c.created_at < $2`
+	if !query.IncludeBots {
+		sqlQuery += " AND NOT c.is_bot"
+	}
+	args := []interface{}{query.From, query.To}
+	if query.UserID != nil {
+		sqlQuery += " AND s.user_id = $3"
+		args = append(args, *query.UserID)
+	}
+	sqlQuery += " ORDER BY c.id"
+
+	return r.streamRows(ctx, sqlQuery, args, func(row rowScanner) error {
+		var click ExportedClick
+		err := row.Scan(
+			&click.ID, &click.CreatedAt, &click.ShortURLID, &click.ShortCode, &click.Domain,
+			&click.Referrer, &click.ReferrerHost,
+			&click.UTMSource, &click.UTMMedium, &click.UTMCampaign, &click.UTMTerm, &click.UTMContent, &click.UTMExtra,
+			&click.Country, &click.Region, &click.ASN,
+			&click.Browser, &click.OS, &click.Device, &click.IsBot,
+			&click.Variant, &click.Rule, &click.UserAgent, &click.IPAddress,
+		)
+		if err != nil {
+			return err
+		}
+		return fn(click)
+	})
+}
+
+// streamRows declares a cursor for query in a read-only transaction and
+// fetches exportBatchSize rows at a time, calling scan for each
+func (r *repository) streamRows(ctx context.Context, query string, args []interface{}, scan func(rowScanner) error) error {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "DECLARE export_cursor NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		return err
+	}
+
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM export_cursor", exportBatchSize)
+	for {
+		rows, err := tx.QueryContext(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		fetched := 0
+		for rows.Next() {
+			fetched++
+			if err := scan(rows); err != nil {
+				_ = rows.Close()
+				return err
+			}
+		}
+		_ = rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if fetched < exportBatchSize {
+			break
+		}
+	}
+
+	// Ending the transaction closes the cursor
+	return tx.Commit()
+}
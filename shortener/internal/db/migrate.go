@@ -1,80 +1,27 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 )
 
-// MigrateDatabase runs all database migrations
+// MigrateDatabase applies every pending migration. Databases created before
+// migrations were versioned are adopted by the idempotent baseline.
 func MigrateDatabase(db *sql.DB) error {
 	log.Println("Running database migrations...")
-	
-	// Embedded schema
-	schema := `
--- URL Shortener Database Schema
-
--- Create users table
-CREATE TABLE IF NOT EXISTS users (
-    id SERIAL PRIMARY KEY,
-    username VARCHAR(255) UNIQUE NOT NULL,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
--- Create short URLs table
-CREATE TABLE IF NOT EXISTS short_urls (
-    id SERIAL PRIMARY KEY,
-    short_code VARCHAR(10) UNIQUE NOT NULL,
-    original_url TEXT NOT NULL,
-    user_id INTEGER REFERENCES users(id),
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    expires_at TIMESTAMP WITH TIME ZONE,
-    click_count INTEGER DEFAULT 0
-);
-
--- Create clicks table
-CREATE TABLE IF NOT EXISTS clicks (
-    id SERIAL PRIMARY KEY,
-    short_url_id INTEGER REFERENCES short_urls(id),
-    user_agent TEXT,
-    ip_address INET,
-    referrer TEXT,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
--- Create rate limits table
-CREATE TABLE IF NOT EXISTS rate_limits (
-    id SERIAL PRIMARY KEY,
-    ip_address INET NOT NULL,
-    request_count INTEGER DEFAULT 0,
-    reset_at TIMESTAMP WITH TIME ZONE NOT NULL,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
 
--- Create captcha attempts table
-CREATE TABLE IF NOT EXISTS captcha_attempts (
-    id SERIAL PRIMARY KEY,
-    ip_address INET NOT NULL,
-    success BOOLEAN DEFAULT FALSE,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
--- Indexes
-CREATE INDEX IF NOT EXISTS idx_short_urls_short_code ON short_urls(short_code);
-CREATE INDEX IF NOT EXISTS idx_clicks_short_url_id ON clicks(short_url_id);
-CREATE INDEX IF NOT EXISTS idx_rate_limits_ip_address ON rate_limits(ip_address);
-CREATE INDEX IF NOT EXISTS idx_captcha_attempts_ip_address ON captcha_attempts(ip_address);
-`
-
-	// Execute schema
-	_, err := db.Exec(schema)
+	migrations, err := EmbeddedMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %v", err)
+	}
+	applied, err := NewMigrator(db, migrations).Up(context.Background())
 	if err != nil {
-		return fmt.Errorf("failed to execute schema: %v", err)
+		return err
 	}
 
-	log.Println("Database migrations completed successfully")
+	log.Printf("Database migrations completed successfully (%d applied)", applied)
 	return nil
 }
 
@@ -96,7 +43,7 @@ func SeedDatabase(db *sql.DB) error {
 	_, err = db.Exec(`
 		INSERT INTO short_urls (short_code, original_url, user_id) 
 		VALUES ('test123', 'https://example.com', 1) 
-		ON CONFLICT (short_code) DO NOTHING
+		ON CONFLICT DO NOTHING
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to create test short URL: %v", err)
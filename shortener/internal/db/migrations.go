@@ -0,0 +1,391 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationFiles are the numbered migrations, NNNN_name.up.sql and
+// NNNN_name.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID keys the advisory lock held while migrating, so servers
+// booting together do not run the same migration twice
+const migrationLockID = 7_362_845_001
+
+var (
+	migrationFileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+	migrationName     = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// ErrUnknownMigrations is returned when the database has migrations the
+// binary does not know, meaning it was migrated by a newer release
+var ErrUnknownMigrations = errors.New("database schema is newer than this binary")
+
+// Migration is one numbered schema change with the SQL that undoes it
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	// AppliedAt is nil for pending migrations
+	AppliedAt *time.Time
+	// Unknown marks migrations recorded in the database that the binary
+	// does not have; only their Version and Name are set
+	Unknown bool
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	name string
+	at   time.Time
+}
+
+// queryer is a *sql.DB or a *sql.Conn
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// EmbeddedMigrations returns the migrations compiled into the binary,
+// oldest first
+func EmbeddedMigrations() ([]Migration, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(sub)
+}
+
+// LoadMigrations reads the migrations in the root of fsys, oldest first.
+// Every version needs both an up and a down file.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// CreateMigration writes empty up and down files for a new migration in
+// dir, numbered after the newest one there, and returns their paths
+func CreateMigration(dir, name string) (string, string, error) {
+	if !migrationName.MatchString(name) {
+		return "", "", fmt.Errorf("migration name must be lowercase letters, digits and '_'")
+	}
+	migrations, err := LoadMigrations(os.DirFS(dir))
+	if err != nil {
+		return "", "", err
+	}
+	version := int64(1)
+	if len(migrations) > 0 {
+		version = migrations[len(migrations)-1].Version + 1
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%04d_%s", version, name))
+	up, down := base+".up.sql", base+".down.sql"
+	if err := os.WriteFile(up, []byte("-- "+name+"\n"), 0o644); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(down, []byte("-- Undo "+name+"\n"), 0o644); err != nil {
+		return "", "", err
+	}
+	return up, down, nil
+}
+
+// Migrator applies and rolls back migrations, recording them in the
+// schema_migrations table. Every run holds a Postgres advisory lock.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator returns a migrator for the given migrations, oldest first
+func NewMigrator(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Up applies every pending migration in order and returns how many ran
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	return m.Goto(ctx, m.latest())
+}
+
+// Down rolls back the n most recently applied migrations and returns how
+// many were rolled back
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	count := 0
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		for i := len(m.migrations) - 1; i >= 0 && count < n; i-- {
+			if _, ok := applied[m.migrations[i].Version]; !ok {
+				continue
+			}
+			if err := m.rollback(ctx, conn, m.migrations[i]); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Goto applies or rolls back migrations until exactly those up to version
+// are applied; version 0 rolls back everything. It returns how many
+// migrations ran.
+func (m *Migrator) Goto(ctx context.Context, version int64) (int, error) {
+	if version != 0 && m.find(version) == nil {
+		return 0, fmt.Errorf("unknown migration version %d", version)
+	}
+
+	count := 0
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		if len(applied) == 0 && m.hasLegacySchema(ctx, conn) {
+			log.Println("Adopting unversioned schema; the baseline migration brings it up to date")
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				if err := m.rollback(ctx, conn, migration); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := m.apply(ctx, conn, migration); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Status lists every known migration with when it was applied, followed by
+// any applied migrations the binary does not know. It only reads, so it
+// neither waits for the migration lock nor creates schema_migrations.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var exists bool
+	if err := m.db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]appliedMigration)
+	if exists {
+		var err error
+		if applied, err = readApplied(ctx, m.db); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i].Migration = migration
+		if row, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &row.at
+		}
+	}
+	for _, version := range m.unknown(applied) {
+		row := applied[version]
+		statuses = append(statuses, MigrationStatus{
+			Migration: Migration{Version: version, Name: row.name},
+			AppliedAt: &row.at,
+			Unknown:   true,
+		})
+	}
+	return statuses, nil
+}
+
+// locked runs fn on one connection while holding the migration lock,
+// passing it the applied versions. It refuses to touch a database that
+// has migrations the binary does not know.
+func (m *Migrator) locked(ctx context.Context, fn func(*sql.Conn, map[int64]appliedMigration) error) error {
+	// Advisory locks belong to a session, so everything runs on one
+	// connection
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to take migration lock: %v", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Printf("Failed to release migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	applied, err := readApplied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if unknown := m.unknown(applied); len(unknown) > 0 {
+		return fmt.Errorf("%w: it has migrations %v applied", ErrUnknownMigrations, unknown)
+	}
+	return fn(conn, applied)
+}
+
+// readApplied reads schema_migrations by version
+func readApplied(ctx context.Context, q queryer) (map[int64]appliedMigration, error) {
+	rows, err := q.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	applied := make(map[int64]appliedMigration)
+	for rows.Next() {
+		var version int64
+		var row appliedMigration
+		if err := rows.Scan(&version, &row.name, &row.at); err != nil {
+			return nil, err
+		}
+		applied[version] = row
+	}
+	return applied, rows.Err()
+}
+
+// apply runs a migration and records it in one transaction
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	log.Printf("Applying migration %d_%s", migration.Version, migration.Name)
+	return m.inTx(ctx, conn, migration, migration.Up,
+		"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+}
+
+// rollback undoes a migration and forgets it in one transaction
+func (m *Migrator) rollback(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	log.Printf("Rolling back migration %d_%s", migration.Version, migration.Name)
+	return m.inTx(ctx, conn, migration, migration.Down,
+		"DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+}
+
+func (m *Migrator) inTx(ctx context.Context, conn *sql.Conn, migration Migration, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %v", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// hasLegacySchema reports whether tables exist that the unversioned
+// MigrateDatabase created
+func (m *Migrator) hasLegacySchema(ctx context.Context, conn *sql.Conn) bool {
+	var exists bool
+	err := conn.QueryRowContext(ctx, "SELECT to_regclass('short_urls') IS NOT NULL").Scan(&exists)
+	return err == nil && exists
+}
+
+func (m *Migrator) latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// unknown returns the applied versions the binary has no migration for,
+// oldest first
+func (m *Migrator) unknown(applied map[int64]appliedMigration) []int64 {
+	var versions []int64
+	for version := range applied {
+		if m.find(version) == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+func (m *Migrator) find(version int64) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+-- Drops every table of the baseline, and with them all data
+DROP TABLE IF EXISTS captcha_attempts;
+DROP TABLE IF EXISTS rate_limits;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS clicks;
+DROP TABLE IF EXISTS short_urls;
+DROP TABLE IF EXISTS domains;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS users;
+DROP SEQUENCE IF EXISTS short_code_seq;
@@ -0,0 +1,212 @@
+-- Baseline: the schema as it was before migrations were versioned.
+--
+-- Every statement is idempotent, so this also upgrades databases created by
+-- the old unversioned MigrateDatabase, whatever release they were last
+-- migrated by, without touching their data.
+
+-- Create users table
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(255) UNIQUE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Password is NULL for service accounts that only use API keys
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_service BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Create API keys table (only the SHA-256 of each key is stored)
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Hosts with their own short code namespace and settings; requests for any
+-- other host use the default namespace
+CREATE TABLE IF NOT EXISTS domains (
+    id SERIAL PRIMARY KEY,
+    host VARCHAR(255) UNIQUE NOT NULL,
+    -- redirect type of new links; NULL uses the server default
+    redirect_type SMALLINT CHECK (redirect_type IN (301, 302, 307, 308)),
+    -- where unknown codes are sent instead of the 404 page
+    not_found_url TEXT,
+    -- where visitors of / are sent instead of the web frontend
+    root_url TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create short URLs table
+CREATE TABLE IF NOT EXISTS short_urls (
+    id SERIAL PRIMARY KEY,
+    short_code VARCHAR(32) NOT NULL,
+    original_url TEXT NOT NULL,
+    user_id INTEGER REFERENCES users(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    click_count INTEGER DEFAULT 0
+);
+
+-- Disabled links stop redirecting but keep their code and clicks
+ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- bcrypt hash of the password a visitor must enter before being redirected
+ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS password_hash TEXT;
+
+-- HTTP status of the redirect; links from before the column existed keep
+-- answering 301
+ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS redirect_type SMALLINT NOT NULL DEFAULT 301
+    CHECK (redirect_type IN (301, 302, 307, 308));
+
+-- Weighted destinations of split (A/B) links as [{label, url, weight}];
+-- NULL sends everyone to original_url
+ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS destinations JSONB;
+
+-- Ordered targeting rules by OS, device, country, language and time window;
+-- visitors no rule matches get original_url or the split
+ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS rules JSONB;
+
+-- Host whose namespace the code belongs to; NULL is the default namespace.
+-- Codes are unique per domain (see idx_short_urls_domain_code), not globally.
+ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS domain VARCHAR(255) REFERENCES domains(host);
+ALTER TABLE short_urls DROP CONSTRAINT IF EXISTS short_urls_short_code_key;
+
+-- Sequence feeding counter-based short codes
+CREATE SEQUENCE IF NOT EXISTS short_code_seq;
+
+-- Create clicks table
+CREATE TABLE IF NOT EXISTS clicks (
+    id SERIAL PRIMARY KEY,
+    short_url_id INTEGER REFERENCES short_urls(id),
+    user_agent TEXT,
+    ip_address INET,
+    referrer TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Visitor location from the GeoIP database, when known
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS country CHAR(2);
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS region TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS asn BIGINT;
+
+-- Referring host and campaign parameters of the visit
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS referrer_host TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS utm_source TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS utm_medium TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS utm_campaign TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS utm_term TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS utm_content TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS utm_extra JSONB;
+
+-- Client classification parsed from the User-Agent; bot clicks are kept
+-- out of short_urls.click_count
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS browser TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS os TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS device TEXT;
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Label of the destination a split link sent the visitor to
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS variant TEXT;
+
+-- Name of the targeting rule that chose the destination
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS rule TEXT;
+
+-- Webhook subscriptions to the link events of an owner, or of one of their
+-- links when short_url_id is set
+CREATE TABLE IF NOT EXISTS webhooks (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    short_url_id INTEGER REFERENCES short_urls(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    -- HMAC-SHA256 key signing the payloads
+    secret TEXT NOT NULL,
+    -- subscribed event names, e.g. ["link.created", "link.first_click"]
+    events JSONB NOT NULL,
+    -- click counts that fire link.click_threshold
+    thresholds JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Outbox of webhook deliveries: pending rows are retried with backoff until
+-- they are delivered or run out of attempts and become dead
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_error TEXT,
+    response_status SMALLINT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Create rate limits table
+CREATE TABLE IF NOT EXISTS rate_limits (
+    id SERIAL PRIMARY KEY,
+    -- limiter key: a client IP or another identifier
+    ip_address TEXT NOT NULL,
+    request_count INTEGER DEFAULT 0,
+    reset_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create captcha attempts table
+CREATE TABLE IF NOT EXISTS captcha_attempts (
+    id SERIAL PRIMARY KEY,
+    ip_address INET NOT NULL,
+    success BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Identify the challenge each attempt answered; a challenge can only be
+-- solved once
+ALTER TABLE captcha_attempts ADD COLUMN IF NOT EXISTS challenge_id TEXT;
+
+-- Indexes
+CREATE INDEX IF NOT EXISTS idx_short_urls_short_code ON short_urls(short_code);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_short_urls_domain_code ON short_urls((COALESCE(domain, '')), short_code);
+CREATE INDEX IF NOT EXISTS idx_short_urls_expires_at ON short_urls(expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_clicks_short_url_id ON clicks(short_url_id);
+CREATE INDEX IF NOT EXISTS idx_clicks_short_url_id_created_at ON clicks(short_url_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_short_urls_user_id ON short_urls(user_id);
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
+CREATE INDEX IF NOT EXISTS idx_rate_limits_ip_address ON rate_limits(ip_address);
+CREATE INDEX IF NOT EXISTS idx_captcha_attempts_ip_address ON captcha_attempts(ip_address);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_captcha_attempts_challenge_id ON captcha_attempts(challenge_id) WHERE success;
+CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks(user_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+
+-- Databases from when codes were limited to ten characters
+DO $$
+BEGIN
+    IF (SELECT character_maximum_length FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'short_urls' AND column_name = 'short_code') < 32 THEN
+        ALTER TABLE short_urls ALTER COLUMN short_code TYPE VARCHAR(32);
+    END IF;
+END $$;
+
+-- Databases from when rate_limits only held IP addresses: keep the newest
+-- row per key and make keys unique, so a hit is counted with one upsert
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'rate_limits' AND column_name = 'ip_address') <> 'text' THEN
+        ALTER TABLE rate_limits ALTER COLUMN ip_address TYPE TEXT USING host(ip_address);
+    END IF;
+    IF to_regclass('idx_rate_limits_key') IS NULL THEN
+        DELETE FROM rate_limits a USING rate_limits b WHERE a.ip_address = b.ip_address AND a.id < b.id;
+        CREATE UNIQUE INDEX idx_rate_limits_key ON rate_limits(ip_address);
+    END IF;
+END $$;
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS domains_set_updated_at ON domains;
+DROP TRIGGER IF EXISTS short_urls_set_updated_at ON short_urls;
+DROP TRIGGER IF EXISTS users_set_updated_at ON users;
+DROP FUNCTION IF EXISTS set_updated_at();
@@ -0,0 +1,18 @@
+-- Keep updated_at current on every update, including ones that forget to
+-- set it
+CREATE OR REPLACE FUNCTION set_updated_at()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = CURRENT_TIMESTAMP;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_set_updated_at BEFORE UPDATE ON users
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE TRIGGER short_urls_set_updated_at BEFORE UPDATE ON short_urls
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+CREATE TRIGGER domains_set_updated_at BEFORE UPDATE ON domains
+    FOR EACH ROW EXECUTE FUNCTION set_updated_at();
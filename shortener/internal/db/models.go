@@ -1,7 +1,10 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -15,6 +18,45 @@ type ShortURL struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 	ClickCount  int64     `json:"click_count"`
+	Enabled     bool      `json:"enabled"`
+	// PasswordHash is the bcrypt hash of the link's password, nil when the
+	// link is not protected
+	PasswordHash *string `json:"-"`
+	// RedirectType is the HTTP status of the redirect: 301, 302, 307 or 308
+	RedirectType int `json:"redirect_type"`
+	// Destinations split traffic between several URLs; empty for plain links
+	Destinations Destinations `json:"destinations,omitempty"`
+	// Rules route matching visitors elsewhere, checked before Destinations
+	Rules Rules `json:"rules,omitempty"`
+	// Domain is the host whose namespace the code is in; empty for the
+	// default namespace
+	Domain string `json:"domain,omitempty"`
+}
+
+// Protected reports whether visitors must enter a password
+func (u *ShortURL) Protected() bool {
+	return u.PasswordHash != nil
+}
+
+// ShortURLUpdate holds the fields of a short URL to change; nil fields are
+// left untouched
+type ShortURLUpdate struct {
+	OriginalURL  *string
+	Enabled      *bool
+	RedirectType *int
+	// Destinations replaces the split; an empty list turns it off
+	Destinations *Destinations
+	// Rules replaces the targeting rules; an empty list removes them
+	Rules *Rules
+}
+
+// ShortURLFilter selects an owner's short URLs for listing
+type ShortURLFilter struct {
+	UserID int64
+	// Search matches a substring of the short code or original URL
+	Search string
+	Limit  int
+	Offset int
 }
 
 // Click represents a click on a shortened URL
@@ -27,9 +69,46 @@ type Click struct {
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// UTM holds the utm_* query parameters a short link was opened with
+type UTM struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+	// Extra holds any other utm_* parameters keyed without the prefix
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// NewClick describes a click to record
+type NewClick struct {
+	ShortURLID   int64
+	UserAgent    string
+	IPAddress    string
+	Referrer     string
+	ReferrerHost string
+	UTM          UTM
+	// Country, Region and ASN locate the visitor; empty or zero when unknown
+	Country string
+	Region  string
+	ASN     uint32
+	// Browser, OS and Device come from parsing the User-Agent
+	Browser string
+	OS      string
+	Device  string
+	IsBot   bool
+	// Variant is the label of the destination a split link chose
+	Variant string
+	// Rule is the name of the targeting rule that matched
+	Rule string
+	// CreatedAt is when the visit happened; zero means now
+	CreatedAt time.Time
+}
+
 // RateLimit represents a rate limit entry
 type RateLimit struct {
-	ID           int64     `json:"id"`
+	ID int64 `json:"id"`
+	// IPAddress holds the limiter key: a client IP or another identifier
 	IPAddress    string    `json:"ip_address"`
 	RequestCount int64     `json:"request_count"`
 	ResetAt      time.Time `json:"reset_at"`
@@ -40,17 +119,65 @@ type RateLimit struct {
 // Repository interface defines database operations
 type Repository interface {
 	// ShortURL operations
-	CreateShortURL(shortCode, originalURL string, userID *int64, expiresAt *time.Time) (*ShortURL, error)
-	GetShortURLByCode(shortCode string) (*ShortURL, error)
+	CreateShortURL(item NewShortURL) (*ShortURL, error)
+	CreateShortURLBatch(items []NewShortURL, atomic bool) ([]error, error)
+	NextShortCodeID() (uint64, error)
+	GetShortURLByCode(domain, shortCode string) (*ShortURL, error)
 	IncrementClickCount(shortURLID int64) error
 	GetClicks(shortURLID int64, limit int) ([]Click, error)
+	DeleteExpiredShortURLs(before time.Time) (int64, error)
+	ListShortURLs(filter ShortURLFilter) ([]ShortURL, int64, error)
+	UpdateShortURL(userID int64, domain, shortCode string, update ShortURLUpdate) (*ShortURL, error)
+	DeleteShortURL(userID int64, domain, shortCode string) error
+
+	// Domain operations
+	SaveDomain(domain Domain) (*Domain, error)
+	GetDomain(host string) (*Domain, error)
+	ListDomains() ([]Domain, error)
+	DeleteDomain(host string) error
 
 	// Click operations
-	CreateClick(shortURLID int64, userAgent, ipAddress, referrer string) error
+	CreateClick(click NewClick) error
+	RecordClicks(clicks []NewClick) error
+	CountClicksByTime(query ClickQuery, unit string) ([]ClickBucket, error)
+	TopClickValues(query ClickQuery, dimension ClickDimension, limit int) ([]ClickTally, error)
+	GetLastClickTime(shortURLID int64, includeBots bool) (*time.Time, error)
+	CountBotClicks(shortURLID int64) (int64, error)
 
 	// Rate limiting operations
 	GetOrCreateRateLimit(ipAddress string) (*RateLimit, error)
 	UpdateRateLimit(rateLimit *RateLimit) error
+	TakeRateLimitToken(key string, now time.Time, interval time.Duration, burst int) (time.Time, bool, error)
+	RefundRateLimitToken(key string, interval time.Duration) error
+	DeleteExpiredRateLimits(before time.Time) (int64, error)
+	RecordCaptchaAttempt(attempt CaptchaAttempt) error
+	DeleteOldCaptchaAttempts(before time.Time) (int64, error)
+
+	// User and API key operations
+	CreateUser(username string, passwordHash *string, isService bool) (*User, error)
+	GetUserByUsername(username string) (*User, error)
+	GetUserByID(id int64) (*User, error)
+	CreateAPIKey(userID int64, name, prefix, keyHash string) (*APIKey, error)
+	GetAPIKeyByHash(keyHash string) (*APIKey, error)
+	ListAPIKeys(userID int64) ([]APIKey, error)
+	RotateAPIKey(userID, keyID int64, prefix, keyHash string) (*APIKey, error)
+	RevokeAPIKey(userID, keyID int64) error
+	TouchAPIKey(keyID int64) error
+
+	// Webhook operations
+	CreateWebhook(webhook Webhook) (*Webhook, error)
+	ListWebhooks(userID int64) ([]Webhook, error)
+	DeleteWebhook(userID, webhookID int64) error
+	EnqueueWebhookEvents(userID int64, events []WebhookEvent) error
+	ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+	CompleteWebhookDelivery(deliveryID int64, responseStatus int) error
+	FailWebhookDelivery(deliveryID int64, responseStatus int, message string, retryAt *time.Time) error
+	ListWebhookDeliveries(userID int64, limit int) ([]WebhookDelivery, error)
+	DeleteFinishedWebhookDeliveries(before time.Time) (int64, error)
+
+	// Export operations
+	ExportLinks(ctx context.Context, query ExportQuery, fn func(ExportedLink) error) error
+	ExportClicks(ctx context.Context, query ExportQuery, fn func(ExportedClick) error) error
 }
 
 // NewRepository creates a new database repository
@@ -62,47 +189,190 @@ type repository struct {
 	db *sql.DB
 }
 
-func (r *repository) CreateShortURL(shortCode, originalURL string, userID *int64, expiresAt *time.Time) (*ShortURL, error) {
+func (r *repository) CreateShortURL(item NewShortURL) (*ShortURL, error) {
 	now := time.Now()
 	var id int64
 	err := r.db.QueryRow(
-		"INSERT INTO short_urls (short_code, original_url, user_id, expires_at, created_at, updated_at, click_count) VALUES ($1, $2, $3, $4, $5, $6, 0) RETURNING id",
-		shortCode, originalURL, userID, expiresAt, now, now,
+		"INSERT INTO short_urls (short_code, original_url, user_id, expires_at, created_at, updated_at, click_count, password_hash, redirect_type, destinations, rules, domain) VALUES ($1, $2, $3, $4, $5, $6, 0, $7, $8, $9, $10, NULLIF($11, '')) RETURNING id",
+		item.ShortCode, item.OriginalURL, item.UserID, item.ExpiresAt, now, now, item.PasswordHash, item.RedirectType, item.Destinations, item.Rules, item.Domain,
 	).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ShortURL{
-		ID:          id,
-		ShortCode:   shortCode,
-		OriginalURL: originalURL,
-		UserID:      userID,
-		CreatedAt:   now,
-		UpdatedAt:   now,
-		ExpiresAt:   expiresAt,
-		ClickCount:  0,
+		ID:           id,
+		ShortCode:    item.ShortCode,
+		OriginalURL:  item.OriginalURL,
+		UserID:       item.UserID,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ExpiresAt:    item.ExpiresAt,
+		ClickCount:   0,
+		Enabled:      true,
+		PasswordHash: item.PasswordHash,
+		RedirectType: item.RedirectType,
+		Destinations: item.Destinations,
+		Rules:        item.Rules,
+		Domain:       item.Domain,
 	}, nil
 }
 
-func (r *repository) GetShortURLByCode(shortCode string) (*ShortURL, error) {
+// NextShortCodeID returns the next value of the sequence backing counter
+// based short codes
+func (r *repository) NextShortCodeID() (uint64, error) {
+	var id uint64
+	err := r.db.QueryRow("SELECT nextval('short_code_seq')").Scan(&id)
+	return id, err
+}
+
+// shortURLColumns lists the columns read by scanShortURL, in order
+const shortURLColumns = "id, short_code, original_url, user_id, created_at, updated_at, expires_at, click_count, enabled, password_hash, redirect_type, destinations, rules, COALESCE(domain, '')"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanShortURL(row rowScanner) (*ShortURL, error) {
 	var url ShortURL
-	err := r.db.QueryRow(
-		"SELECT id, short_code, original_url, user_id, created_at, updated_at, expires_at, click_count FROM short_urls WHERE short_code = $1",
-		shortCode,
-	).Scan(&url.ID, &url.ShortCode, &url.OriginalURL, &url.UserID, &url.CreatedAt, &url.UpdatedAt, &url.ExpiresAt, &url.ClickCount)
+	err := row.Scan(&url.ID, &url.ShortCode, &url.OriginalURL, &url.UserID, &url.CreatedAt, &url.UpdatedAt, &url.ExpiresAt, &url.ClickCount, &url.Enabled, &url.PasswordHash, &url.RedirectType, &url.Destinations, &url.Rules, &url.Domain)
 	if err != nil {
 		return nil, err
 	}
 	return &url, nil
 }
 
-func (r *repository) IncrementClickCount(shortURLID int64) error {
-	_, err := r.db.Exec(
-		"UPDATE short_urls SET click_count = click_count + 1, updated_at = $1 WHERE id = $2",
-		time.Now(), shortURLID,
+// GetShortURLByCode looks up a code in the namespace of domain; an empty
+// domain is the default namespace
+func (r *repository) GetShortURLByCode(domain, shortCode string) (*ShortURL, error) {
+	return scanShortURL(r.db.QueryRow(
+		"SELECT "+shortURLColumns+" FROM short_urls WHERE COALESCE(domain, '') = $1 AND short_code = $2",
+		domain, shortCode,
+	))
+}
+
+func (r *repository) ListShortURLs(filter ShortURLFilter) ([]ShortURL, int64, error) {
+	pattern := "%" + escapeLike(filter.Search) + "%"
+
+	var total int64
+	err := r.db.QueryRow(
+		"SELECT COUNT(*) FROM short_urls WHERE user_id = $1 AND (short_code ILIKE $2 OR original_url ILIKE $2)",
+		filter.UserID, pattern,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := r.db.Query(
+		"SELECT "+shortURLColumns+" FROM short_urls WHERE user_id = $1 AND (short_code ILIKE $2 OR original_url ILIKE $2) ORDER BY created_at DESC, id DESC LIMIT $3 OFFSET $4",
+		filter.UserID, pattern, filter.Limit, filter.Offset,
 	)
-	return err
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	urls := []ShortURL{}
+	for rows.Next() {
+		url, err := scanShortURL(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		urls = append(urls, *url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return urls, total, nil
+}
+
+// UpdateShortURL changes the given fields of a short URL owned by userID. It
+// returns sql.ErrNoRows if no such short URL exists.
+func (r *repository) UpdateShortURL(userID int64, domain, shortCode string, update ShortURLUpdate) (*ShortURL, error) {
+	sets := []string{"updated_at = $1"}
+	args := []interface{}{time.Now()}
+	if update.OriginalURL != nil {
+		args = append(args, *update.OriginalURL)
+		sets = append(sets, fmt.Sprintf("original_url = $%d", len(args)))
+	}
+	if update.Enabled != nil {
+		args = append(args, *update.Enabled)
+		sets = append(sets, fmt.Sprintf("enabled = $%d", len(args)))
+	}
+	if update.RedirectType != nil {
+		args = append(args, *update.RedirectType)
+		sets = append(sets, fmt.Sprintf("redirect_type = $%d", len(args)))
+	}
+	if update.Destinations != nil {
+		args = append(args, *update.Destinations)
+		sets = append(sets, fmt.Sprintf("destinations = $%d", len(args)))
+	}
+	if update.Rules != nil {
+		args = append(args, *update.Rules)
+		sets = append(sets, fmt.Sprintf("rules = $%d", len(args)))
+	}
+	args = append(args, domain, shortCode, userID)
+
+	query := fmt.Sprintf(
+		"UPDATE short_urls SET %s WHERE COALESCE(domain, '') = $%d AND short_code = $%d AND user_id = $%d RETURNING %s",
+		strings.Join(sets, ", "), len(args)-2, len(args)-1, len(args), shortURLColumns,
+	)
+	return scanShortURL(r.db.QueryRow(query, args...))
+}
+
+// DeleteShortURL removes a short URL owned by userID together with its
+// clicks. It returns sql.ErrNoRows if no such short URL exists.
+func (r *repository) DeleteShortURL(userID int64, domain, shortCode string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var id int64
+	err = tx.QueryRow(
+		"SELECT id FROM short_urls WHERE COALESCE(domain, '') = $1 AND short_code = $2 AND user_id = $3 FOR UPDATE",
+		domain, shortCode, userID,
+	).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM clicks WHERE short_url_id = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM short_urls WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// escapeLike escapes the LIKE wildcards in a user-supplied search term
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// IncrementClickCount counts one click and queues the webhook events it
+// fires in the same transaction
+func (r *repository) IncrementClickCount(shortURLID int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := addClickCounts(tx, []int64{shortURLID}, map[int64]int64{shortURLID: 1}); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (r *repository) GetClicks(shortURLID int64, limit int) ([]Click, error) {
@@ -132,11 +402,49 @@ func (r *repository) GetClicks(shortURLID int64, limit int) ([]Click, error) {
 	return clicks, nil
 }
 
-func (r *repository) CreateClick(shortURLID int64, userAgent, ipAddress, referrer string) error {
-	_, err := r.db.Exec(
-		"INSERT INTO clicks (short_url_id, user_agent, ip_address, referrer, created_at) VALUES ($1, $2, $3, $4, $5)",
-		shortURLID, userAgent, ipAddress, referrer, time.Now(),
+// DeleteExpiredShortURLs purges short URLs that expired before the given time
+// together with their clicks and returns the number of deleted short URLs.
+func (r *repository) DeleteExpiredShortURLs(before time.Time) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.Exec(
+		"DELETE FROM clicks WHERE short_url_id IN (SELECT id FROM short_urls WHERE expires_at IS NOT NULL AND expires_at < $1)",
+		before,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(
+		"DELETE FROM short_urls WHERE expires_at IS NOT NULL AND expires_at < $1",
+		before,
 	)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (r *repository) CreateClick(click NewClick) error {
+	args, err := clickArgs(click)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec("INSERT INTO clicks ("+clickColumns+") VALUES "+placeholders(1, 1, clickColumnCount, ""), args...)
 	return err
 }
 
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TakeRateLimitToken runs one GCRA step for key in rate_limits, where
+// reset_at holds the theoretical arrival time (TAT): when the key's bucket
+// is full again. One token refills every interval and the bucket holds
+// burst tokens. It returns the stored TAT and whether a token was taken; a
+// rejected request leaves the row untouched. The conditional upsert is
+// atomic, so replicas sharing the database share one bucket per key.
+func (r *repository) TakeRateLimitToken(key string, now time.Time, interval time.Duration, burst int) (time.Time, bool, error) {
+	var tat time.Time
+	err := r.db.QueryRow(`
+		INSERT INTO rate_limits (ip_address, request_count, reset_at, created_at)
+		VALUES ($1, 1, $2, $3)
+		ON CONFLICT (ip_address) DO UPDATE SET
+			request_count = rate_limits.request_count + 1,
+			reset_at = GREATEST(rate_limits.reset_at, $3) + $4 * INTERVAL '1 microsecond'
+		WHERE GREATEST(rate_limits.reset_at, $3) + $4 * INTERVAL '1 microsecond' <= $3 + $5 * INTERVAL '1 microsecond'
+		RETURNING reset_at`,
+		key, now.Add(interval), now, interval.Microseconds(), (time.Duration(burst) * interval).Microseconds(),
+	).Scan(&tat)
+	if err == nil {
+		return tat, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, err
+	}
+
+	// The bucket is empty; report when it refills
+	err = r.db.QueryRow("SELECT reset_at FROM rate_limits WHERE ip_address = $1", key).Scan(&tat)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return tat, false, nil
+}
+
+// RefundRateLimitToken gives back a token taken by TakeRateLimitToken by
+// moving the TAT of key back by interval
+func (r *repository) RefundRateLimitToken(key string, interval time.Duration) error {
+	_, err := r.db.Exec(
+		"UPDATE rate_limits SET reset_at = reset_at - $2 * INTERVAL '1 microsecond' WHERE ip_address = $1",
+		key, interval.Microseconds(),
+	)
+	return err
+}
+
+// DeleteExpiredRateLimits removes buckets that were full again before the
+// given time, which are indistinguishable from keys never seen, and returns
+// how many were removed
+func (r *repository) DeleteExpiredRateLimits(before time.Time) (int64, error) {
+	result, err := r.db.Exec("DELETE FROM rate_limits WHERE reset_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+)
+
+// Rule sends visitors matching all of its conditions to URL. Empty
+// conditions match everyone; within a condition any listed value matches.
+type Rule struct {
+	// Name labels the rule in clicks and stats
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// OS lists operating systems as reported by the User-Agent parser,
+	// e.g. "iOS" or "Android"
+	OS []string `json:"os,omitempty"`
+	// Devices lists device classes: desktop, mobile, tablet, bot or other
+	Devices []string `json:"devices,omitempty"`
+	// Countries lists ISO 3166-1 alpha-2 codes from the GeoIP database
+	Countries []string `json:"countries,omitempty"`
+	// Languages lists language tags matched against the visitor's preferred
+	// Accept-Language; "pt" also matches "pt-BR"
+	Languages []string `json:"languages,omitempty"`
+	// StartsAt and EndsAt bound when the rule applies; nil is open-ended
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+// Rules are a link's targeting rules in evaluation order, stored as JSONB in
+// short_urls.rules
+type Rules []Rule
+
+// Value implements driver.Valuer; an empty list is stored as NULL
+func (r Rules) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	return json.Marshal([]Rule(r))
+}
+
+// Scan implements sql.Scanner
+func (r *Rules) Scan(src interface{}) error {
+	return scanJSON(src, (*[]Rule)(r))
+}
@@ -1,46 +0,0 @@
--- URL Shortener Database Schema
-
--- Create users table
-CREATE TABLE IF NOT EXISTS users (
-    id SERIAL PRIMARY KEY,
-    username VARCHAR(255) UNIQUE NOT NULL,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
--- Create short URLs table
-CREATE TABLE IF NOT EXISTS short_urls (
-    id SERIAL PRIMARY KEY,
-    short_code VARCHAR(10) UNIQUE NOT NULL,
-    original_url TEXT NOT NULL,
-    user_id INTEGER REFERENCES users(id),
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    expires_at TIMESTAMP WITH TIME ZONE,
-    click_count INTEGER DEFAULT 0
-);
-
--- Create clicks table
-CREATE TABLE IF NOT EXISTS clicks (
-    id SERIAL PRIMARY KEY,
-    short_url_id INTEGER REFERENCES short_urls(id),
-    user_agent TEXT,
-    ip_address INET,
-    referrer TEXT,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
--- Create rate limits table
-CREATE TABLE IF NOT EXISTS rate_limits (
-    id SERIAL PRIMARY KEY,
-    ip_address INET NOT NULL,
-    request_count INTEGER DEFAULT 0,
-    reset_at TIMESTAMP WITH TIME ZONE NOT NULL,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
-
--- Indexes
-CREATE INDEX idx_short_urls_short_code ON short_urls(short_code);
-CREATE INDEX idx_clicks_short_url_id ON clicks(short_url_id);
-CREATE INDEX idx_rate_limits_ip_address ON rate_limits(ip_address);
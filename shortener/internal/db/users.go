@@ -0,0 +1,195 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// User represents a shortener account. Service accounts have no password
+// and authenticate with API keys only.
+type User struct {
+	ID           int64     `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash *string   `json:"-"`
+	IsService    bool      `json:"is_service"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// APIKey represents a hashed API key belonging to a user
+type APIKey struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (r *repository) CreateUser(username string, passwordHash *string, isService bool) (*User, error) {
+	now := time.Now()
+	var id int64
+	err := r.db.QueryRow(
+		"INSERT INTO users (username, password_hash, is_service, created_at, updated_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		username, passwordHash, isService, now, now,
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{
+		ID:           id,
+		Username:     username,
+		PasswordHash: passwordHash,
+		IsService:    isService,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}, nil
+}
+
+func (r *repository) GetUserByUsername(username string) (*User, error) {
+	return r.getUser("SELECT id, username, password_hash, is_service, created_at, updated_at FROM users WHERE username = $1", username)
+}
+
+func (r *repository) GetUserByID(id int64) (*User, error) {
+	return r.getUser("SELECT id, username, password_hash, is_service, created_at, updated_at FROM users WHERE id = $1", id)
+}
+
+func (r *repository) getUser(query string, arg interface{}) (*User, error) {
+	var user User
+	err := r.db.QueryRow(query, arg).Scan(
+		&user.ID, &user.Username, &user.PasswordHash, &user.IsService, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *repository) CreateAPIKey(userID int64, name, prefix, keyHash string) (*APIKey, error) {
+	return createAPIKey(r.db, userID, name, prefix, keyHash)
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func createAPIKey(q queryRower, userID int64, name, prefix, keyHash string) (*APIKey, error) {
+	now := time.Now()
+	var id int64
+	err := q.QueryRow(
+		"INSERT INTO api_keys (user_id, name, prefix, key_hash, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		userID, name, prefix, keyHash, now,
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   keyHash,
+		CreatedAt: now,
+	}, nil
+}
+
+func (r *repository) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	var key APIKey
+	err := r.db.QueryRow(
+		"SELECT id, user_id, name, prefix, key_hash, created_at, last_used_at, revoked_at FROM api_keys WHERE key_hash = $1",
+		keyHash,
+	).Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *repository) ListAPIKeys(userID int64) ([]APIKey, error) {
+	rows, err := r.db.Query(
+		"SELECT id, user_id, name, prefix, key_hash, created_at, last_used_at, revoked_at FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RotateAPIKey atomically revokes an active key and issues a replacement
+// with the same name. It returns sql.ErrNoRows if the key does not belong to
+// the user or is already revoked.
+func (r *repository) RotateAPIKey(userID, keyID int64, prefix, keyHash string) (*APIKey, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var name string
+	err = tx.QueryRow(
+		"UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL RETURNING name",
+		time.Now(), keyID, userID,
+	).Scan(&name)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := createAPIKey(tx, userID, name, prefix, keyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RevokeAPIKey marks a key as revoked. It returns sql.ErrNoRows if the key
+// does not belong to the user or is already revoked.
+func (r *repository) RevokeAPIKey(userID, keyID int64) error {
+	res, err := r.db.Exec(
+		"UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL",
+		time.Now(), keyID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *repository) TouchAPIKey(keyID int64) error {
+	_, err := r.db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", time.Now(), keyID)
+	return err
+}
@@ -0,0 +1,369 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+)
+
+// Webhook events
+const (
+	EventLinkCreated    = "link.created"
+	EventFirstClick     = "link.first_click"
+	EventClickThreshold = "link.click_threshold"
+)
+
+// Delivery states. Pending deliveries are retried until they succeed or
+// run out of attempts and become dead.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Webhook subscribes a URL to the link events of an owner
+type Webhook struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"user_id"`
+	// ShortURLID limits the subscription to one link; nil covers all of
+	// the owner's links
+	ShortURLID *int64 `json:"short_url_id,omitempty"`
+	URL        string `json:"url"`
+	// Secret signs the payloads; it is only shown when the webhook is
+	// created
+	Secret string     `json:"-"`
+	Events EventNames `json:"events"`
+	// Thresholds are the click counts that fire link.click_threshold
+	Thresholds ClickThresholds `json:"thresholds,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// EventNames are the events a webhook subscribes to, stored as JSONB
+type EventNames []string
+
+// Value implements driver.Valuer
+func (e EventNames) Value() (driver.Value, error) {
+	if e == nil {
+		e = EventNames{}
+	}
+	return json.Marshal([]string(e))
+}
+
+// Scan implements sql.Scanner
+func (e *EventNames) Scan(src interface{}) error {
+	return scanJSON(src, (*[]string)(e))
+}
+
+// ClickThresholds are click counts, stored as JSONB; an empty list is NULL
+type ClickThresholds []int64
+
+// Value implements driver.Valuer
+func (t ClickThresholds) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return nil, nil
+	}
+	return json.Marshal([]int64(t))
+}
+
+// Scan implements sql.Scanner
+func (t *ClickThresholds) Scan(src interface{}) error {
+	return scanJSON(src, (*[]int64)(t))
+}
+
+// WebhookEvent is the JSON body posted to subscribers
+type WebhookEvent struct {
+	Event string      `json:"event"`
+	Link  WebhookLink `json:"link"`
+	// Threshold is the click count a link.click_threshold event passed
+	Threshold  int64     `json:"threshold,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// WebhookLink describes the link an event is about. ID is 0 for links
+// created in a batch.
+type WebhookLink struct {
+	ID          int64  `json:"id,omitempty"`
+	Code        string `json:"code"`
+	Domain      string `json:"domain,omitempty"`
+	OriginalURL string `json:"original_url"`
+	ClickCount  int64  `json:"click_count"`
+}
+
+// WebhookDelivery is one event queued for one webhook
+type WebhookDelivery struct {
+	ID        int64           `json:"id"`
+	WebhookID int64           `json:"webhook_id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	// NextAttemptAt is when a pending delivery is tried next
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	// ResponseStatus is the HTTP status of the last attempt; 0 if the
+	// receiver could not be reached
+	ResponseStatus int        `json:"response_status,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+
+	// URL and Secret of the webhook, filled in by ClaimWebhookDeliveries
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+const (
+	webhookColumns  = "id, user_id, short_url_id, url, secret, events, thresholds, created_at"
+	deliveryColumns = "d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at, COALESCE(d.last_error, ''), COALESCE(d.response_status, 0), d.created_at, d.delivered_at"
+
+	// matchWebhooks selects the webhooks w of owner $1 that subscribe to
+	// event $3 of link $2
+	matchWebhooks = "w.user_id = $1 AND (w.short_url_id IS NULL OR w.short_url_id = $2) AND w.events @> jsonb_build_array($3::text)"
+)
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var w Webhook
+	err := row.Scan(&w.ID, &w.UserID, &w.ShortURLID, &w.URL, &w.Secret, &w.Events, &w.Thresholds, &w.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (r *repository) CreateWebhook(w Webhook) (*Webhook, error) {
+	return scanWebhook(r.db.QueryRow(
+		`INSERT INTO webhooks (user_id, short_url_id, url, secret, events, thresholds, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+webhookColumns,
+		w.UserID, w.ShortURLID, w.URL, w.Secret, w.Events, w.Thresholds, time.Now(),
+	))
+}
+
+func (r *repository) ListWebhooks(userID int64) ([]Webhook, error) {
+	rows, err := r.db.Query("SELECT "+webhookColumns+" FROM webhooks WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook and its deliveries. It returns
+// sql.ErrNoRows if the webhook does not belong to the user.
+func (r *repository) DeleteWebhook(userID, webhookID int64) error {
+	res, err := r.db.Exec("DELETE FROM webhooks WHERE id = $1 AND user_id = $2", webhookID, userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// EnqueueWebhookEvents queues each event for every webhook of the owner
+// that subscribes to it, in one transaction
+func (r *repository) EnqueueWebhookEvents(userID int64, events []WebhookEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, event := range events {
+		if err := enqueueWebhookEvent(tx, userID, event); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func enqueueWebhookEvent(q execer, userID int64, event WebhookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(
+		`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+		SELECT w.id, $3, $4, 'pending', $5, $5 FROM webhooks w WHERE `+matchWebhooks,
+		userID, event.Link.ID, event.Event, payload, event.OccurredAt,
+	)
+	return err
+}
+
+// enqueueThresholdEvents queues link.click_threshold for every threshold
+// of the owner's webhooks that the link's count passed on its way from
+// before to event.Link.ClickCount. The threshold is added to the payload.
+func enqueueThresholdEvents(q execer, userID int64, event WebhookEvent, before int64) error {
+	event.Event = EventClickThreshold
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(
+		`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+		SELECT w.id, $3, $4::jsonb || jsonb_build_object('threshold', t.value), 'pending', $5, $5
+		FROM webhooks w, jsonb_array_elements(w.thresholds) AS t
+		WHERE `+matchWebhooks+` AND t.value::bigint > $6 AND t.value::bigint <= $7`,
+		userID, event.Link.ID, event.Event, payload, event.OccurredAt, before, event.Link.ClickCount,
+	)
+	return err
+}
+
+// enqueueClickEvents queues the events fired by a link's count growing
+// from before to link.ClickCount
+func enqueueClickEvents(q execer, userID int64, link WebhookLink, before int64, now time.Time) error {
+	event := WebhookEvent{Link: link, OccurredAt: now}
+	if before == 0 {
+		event.Event = EventFirstClick
+		if err := enqueueWebhookEvent(q, userID, event); err != nil {
+			return err
+		}
+	}
+	return enqueueThresholdEvents(q, userID, event, before)
+}
+
+// ClaimWebhookDeliveries picks up to limit pending deliveries that are due
+// and counts an attempt for each. Claimed deliveries are pushed back by
+// lease, so they are retried if the claimer dies before reporting back.
+// Concurrent claimers skip each other's rows.
+func (r *repository) ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	rows, err := r.db.Query(
+		`UPDATE webhook_deliveries AS d SET attempts = d.attempts + 1, next_attempt_at = $2
+		FROM webhooks AS w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+deliveryColumns+`, w.url, w.secret`,
+		now, now.Add(lease), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows, true)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func scanDelivery(row rowScanner, withWebhook bool) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload []byte
+	dest := []interface{}{
+		&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastError, &d.ResponseStatus, &d.CreatedAt, &d.DeliveredAt,
+	}
+	if withWebhook {
+		dest = append(dest, &d.URL, &d.Secret)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	d.Payload = payload
+	return &d, nil
+}
+
+// CompleteWebhookDelivery marks a delivery as delivered
+func (r *repository) CompleteWebhookDelivery(deliveryID int64, responseStatus int) error {
+	_, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = 'delivered', response_status = $1, last_error = NULL, delivered_at = $2 WHERE id = $3",
+		responseStatus, time.Now(), deliveryID,
+	)
+	return err
+}
+
+// FailWebhookDelivery records a failed attempt. The delivery is retried at
+// retryAt, or becomes dead if retryAt is nil.
+func (r *repository) FailWebhookDelivery(deliveryID int64, responseStatus int, message string, retryAt *time.Time) error {
+	status, next := DeliveryDead, time.Now()
+	if retryAt != nil {
+		status, next = DeliveryPending, *retryAt
+	}
+	_, err := r.db.Exec(
+		"UPDATE webhook_deliveries SET status = $1, response_status = NULLIF($2, 0), last_error = $3, next_attempt_at = $4 WHERE id = $5",
+		status, responseStatus, message, next, deliveryID,
+	)
+	return err
+}
+
+// ListWebhookDeliveries returns the most recent deliveries to the user's
+// webhooks, newest first
+func (r *repository) ListWebhookDeliveries(userID int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := r.db.Query(
+		"SELECT "+deliveryColumns+" FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE w.user_id = $1 ORDER BY d.id DESC LIMIT $2",
+		userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// DeleteFinishedWebhookDeliveries purges delivered and dead deliveries
+// created before the given time
+func (r *repository) DeleteFinishedWebhookDeliveries(before time.Time) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,263 @@
+// Package export encodes rows as CSV, NDJSON or Parquet, optionally
+// gzip-compressed. Rows are written as they arrive; CSV and NDJSON keep no
+// rows in memory and Parquet buffers at most one row group.
+package export
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// RowGroupSize is how many rows a Parquet writer buffers before flushing a
+// row group
+const RowGroupSize = 10000
+
+// Format is an export file format
+type Format string
+
+const (
+	CSV     Format = "csv"
+	NDJSON  Format = "ndjson"
+	Parquet Format = "parquet"
+)
+
+// Formats are the supported formats
+var Formats = []Format{CSV, NDJSON, Parquet}
+
+// ErrUnknownFormat is returned by ParseFormat for unsupported formats
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// ParseFormat returns the format named s; empty means CSV
+func ParseFormat(s string) (Format, error) {
+	if s == "" {
+		return CSV, nil
+	}
+	for _, format := range Formats {
+		if strings.EqualFold(s, string(format)) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownFormat, s)
+}
+
+// ContentType is the media type of a file in format f
+func (f Format) ContentType(compress bool) string {
+	if compress && f != Parquet {
+		return "application/gzip"
+	}
+	switch f {
+	case NDJSON:
+		return "application/x-ndjson"
+	case Parquet:
+		return "application/vnd.apache.parquet"
+	default:
+		return "text/csv; charset=utf-8"
+	}
+}
+
+// Extension is the file name extension of a file in format f. Parquet
+// compresses its pages instead of the whole file, so it keeps its extension.
+func (f Format) Extension(compress bool) string {
+	ext := "." + string(f)
+	if compress && f != Parquet {
+		ext += ".gz"
+	}
+	return ext
+}
+
+// Writer encodes rows of type T
+type Writer[T any] interface {
+	Write(row T) error
+	// Close flushes buffered rows and the file footer, if any. It does not
+	// close the underlying writer.
+	Close() error
+}
+
+// NewWriter returns a writer encoding rows of T to w in format. T must be
+// a struct; its json tags name the CSV and NDJSON columns and its parquet
+// tags the Parquet columns.
+func NewWriter[T any](w io.Writer, format Format, compress bool) (Writer[T], error) {
+	if format == Parquet {
+		options := []parquet.WriterOption{parquet.MaxRowsPerRowGroup(RowGroupSize)}
+		if compress {
+			options = append(options, parquet.Compression(&parquet.Gzip))
+		}
+		return &parquetWriter[T]{w: parquet.NewGenericWriter[T](w, options...)}, nil
+	}
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	buf := bufio.NewWriter(w)
+
+	switch format {
+	case CSV:
+		var zero T
+		columns, err := csvColumns(reflect.TypeOf(zero))
+		if err != nil {
+			return nil, err
+		}
+		return &csvWriter[T]{stream: stream{buf: buf, gz: gz}, w: csv.NewWriter(buf), columns: columns}, nil
+	case NDJSON:
+		return &ndjsonWriter[T]{stream: stream{buf: buf, gz: gz}, enc: json.NewEncoder(buf)}, nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownFormat, format)
+	}
+}
+
+// stream is the buffered, optionally compressed output of a text format
+type stream struct {
+	buf *bufio.Writer
+	gz  *gzip.Writer
+}
+
+func (s stream) close() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if s.gz != nil {
+		return s.gz.Close()
+	}
+	return nil
+}
+
+type ndjsonWriter[T any] struct {
+	stream
+	enc *json.Encoder
+}
+
+func (w *ndjsonWriter[T]) Write(row T) error {
+	return w.enc.Encode(row)
+}
+
+func (w *ndjsonWriter[T]) Close() error {
+	return w.close()
+}
+
+type csvWriter[T any] struct {
+	stream
+	w       *csv.Writer
+	columns []csvColumn
+	record  []string
+}
+
+// csvColumn is a struct field written as a CSV column
+type csvColumn struct {
+	name  string
+	index int
+}
+
+// csvColumns lists the exported fields of struct type t, named by their
+// json tags
+func csvColumns(t reflect.Type) ([]csvColumn, error) {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("export: CSV rows must be structs, not %v", t)
+	}
+	var columns []csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		columns = append(columns, csvColumn{name: name, index: i})
+	}
+	return columns, nil
+}
+
+func (w *csvWriter[T]) Write(row T) error {
+	if w.record == nil {
+		// The header goes out with the first row, or on Close if there
+		// are none
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	value := reflect.ValueOf(row)
+	for i, column := range w.columns {
+		w.record[i] = csvValue(value.Field(column.index))
+	}
+	return w.w.Write(w.record)
+}
+
+func (w *csvWriter[T]) writeHeader() error {
+	header := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		header[i] = column.name
+	}
+	w.record = make([]string, len(w.columns))
+	return w.w.Write(header)
+}
+
+func (w *csvWriter[T]) Close() error {
+	if w.record == nil {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	w.w.Flush()
+	if err := w.w.Error(); err != nil {
+		return err
+	}
+	return w.close()
+}
+
+// csvValue formats one field; nil pointers are empty and times are RFC 3339
+// in UTC
+func csvValue(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+type parquetWriter[T any] struct {
+	w *parquet.GenericWriter[T]
+}
+
+func (w *parquetWriter[T]) Write(row T) error {
+	_, err := w.w.Write([]T{row})
+	return err
+}
+
+func (w *parquetWriter[T]) Close() error {
+	return w.w.Close()
+}
@@ -0,0 +1,114 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testRow struct {
+	ID        int64      `json:"id" parquet:"id"`
+	Name      string     `json:"name" parquet:"name"`
+	Bot       bool       `json:"is_bot" parquet:"is_bot"`
+	CreatedAt time.Time  `json:"created_at" parquet:"created_at,timestamp(millisecond)"`
+	ExpiresAt *time.Time `json:"expires_at" parquet:"expires_at,optional,timestamp(millisecond)"`
+	hidden    string
+}
+
+func testRows() []testRow {
+	created := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	expires := created.Add(24 * time.Hour)
+	return []testRow{
+		{ID: 1, Name: "plain", CreatedAt: created, hidden: "x"},
+		{ID: 2, Name: "needs, \"quoting\"", Bot: true, CreatedAt: created, ExpiresAt: &expires},
+	}
+}
+
+func writeAll(t *testing.T, format Format, compress bool, rows []testRow) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter[testRow](&buf, format, compress)
+	require.NoError(t, err)
+	for _, row := range rows {
+		require.NoError(t, w.Write(row))
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	out := writeAll(t, CSV, false, testRows())
+	assert.Equal(t,
+		"id,name,is_bot,created_at,expires_at\n"+
+			"1,plain,false,2026-03-01T12:30:00Z,\n"+
+			"2,\"needs, \"\"quoting\"\"\",true,2026-03-01T12:30:00Z,2026-03-02T12:30:00Z\n",
+		string(out))
+}
+
+func TestCSVEmptyHasHeader(t *testing.T) {
+	out := writeAll(t, CSV, false, nil)
+	assert.Equal(t, "id,name,is_bot,created_at,expires_at\n", string(out))
+}
+
+func TestNDJSONGzip(t *testing.T) {
+	out := writeAll(t, NDJSON, true, testRows())
+
+	gz, err := gzip.NewReader(bytes.NewReader(out))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(plain)), "\n")
+	require.Len(t, lines, 2)
+	var row testRow
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &row))
+	assert.Equal(t, int64(2), row.ID)
+	assert.True(t, row.Bot)
+	require.NotNil(t, row.ExpiresAt)
+}
+
+func TestParquet(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		out := writeAll(t, Parquet, compress, testRows())
+
+		reader := parquet.NewGenericReader[testRow](bytes.NewReader(out))
+		rows := make([]testRow, 3)
+		n, err := reader.Read(rows)
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+		}
+		require.NoError(t, reader.Close())
+		require.Equal(t, 2, n)
+
+		assert.Equal(t, "needs, \"quoting\"", rows[1].Name)
+		assert.True(t, rows[0].CreatedAt.Equal(testRows()[0].CreatedAt))
+		assert.Nil(t, rows[0].ExpiresAt)
+		require.NotNil(t, rows[1].ExpiresAt)
+		assert.True(t, rows[1].ExpiresAt.Equal(*testRows()[1].ExpiresAt))
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("")
+	require.NoError(t, err)
+	assert.Equal(t, CSV, format)
+
+	format, err = ParseFormat("Parquet")
+	require.NoError(t, err)
+	assert.Equal(t, Parquet, format)
+
+	_, err = ParseFormat("xlsx")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	assert.Equal(t, ".ndjson.gz", NDJSON.Extension(true))
+	assert.Equal(t, ".parquet", Parquet.Extension(true))
+	assert.Equal(t, "application/gzip", CSV.ContentType(true))
+}
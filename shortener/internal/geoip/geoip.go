@@ -0,0 +1,206 @@
+// Package geoip resolves visitor IP addresses to a location using local
+// MaxMind DB (.mmdb) files such as GeoLite2 or DB-IP Lite, without calling
+// any external service.
+package geoip
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// DefaultReloadInterval is how often database files are checked for changes
+const DefaultReloadInterval = time.Minute
+
+// Location is what is known about an IP address
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code
+	Country string
+	// Region is the ISO 3166-2 subdivision code without the country prefix,
+	// or its English name when the database has no code
+	Region string
+	// ASN is the autonomous system number, zero when unknown
+	ASN uint32
+}
+
+// Resolver looks up the location of an IP address
+type Resolver interface {
+	Lookup(ip string) Location
+}
+
+// record covers the fields of the GeoIP2/GeoLite2 City, Country and ASN
+// databases and their DB-IP equivalents
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	ASN uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// database is one .mmdb file that is reopened when it changes on disk
+type database struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// DB resolves locations from one or more .mmdb files, e.g. a City database
+// and an ASN database. Lookups merge the answers of all files.
+type DB struct {
+	mu  sync.RWMutex
+	dbs []*database
+}
+
+// Open loads the given .mmdb files
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		d := &database{path: path}
+		if err := d.open(); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		db.dbs = append(db.dbs, d)
+	}
+	return db, nil
+}
+
+// open (re)reads the file and replaces the reader, closing the old one. The
+// file is copied into memory rather than memory-mapped so that rewriting it
+// in place cannot corrupt lookups in flight.
+func (d *database) open() error {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.OpenBytes(data)
+	if err != nil {
+		return err
+	}
+	if d.reader != nil {
+		_ = d.reader.Close()
+	}
+	d.reader = reader
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	return nil
+}
+
+// changed reports whether the file on disk differs from the loaded one
+func (d *database) changed() bool {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(d.modTime) || info.Size() != d.size
+}
+
+// Lookup returns the location of ip; unknown or unparsable addresses
+// yield an empty Location
+func (db *DB) Lookup(ip string) Location {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Location{}
+	}
+	addr = addr.Unmap()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var loc Location
+	for _, d := range db.dbs {
+		if d.reader == nil {
+			continue
+		}
+		var rec record
+		result := d.reader.Lookup(addr)
+		if !result.Found() || result.Decode(&rec) != nil {
+			continue
+		}
+		if loc.Country == "" {
+			loc.Country = strings.ToUpper(rec.Country.ISOCode)
+		}
+		if loc.Region == "" && len(rec.Subdivisions) > 0 {
+			loc.Region = rec.Subdivisions[0].ISOCode
+			if loc.Region == "" {
+				loc.Region = rec.Subdivisions[0].Names["en"]
+			}
+		}
+		if loc.ASN == 0 {
+			loc.ASN = rec.ASN
+		}
+	}
+	return loc
+}
+
+// Reload reopens every file that changed on disk since it was loaded. A
+// file that fails to open keeps serving its previous contents.
+func (db *DB) Reload() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var firstErr error
+	for _, d := range db.dbs {
+		if !d.changed() {
+			continue
+		}
+		if err := d.open(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Watch reloads changed files every interval until ctx is done.
+// Non-positive intervals fall back to DefaultReloadInterval.
+func (db *DB) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := db.Reload(); err != nil {
+				log.Printf("Failed to reload GeoIP database: %v", err)
+			}
+		}
+	}
+}
+
+// Close releases all database files
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var firstErr error
+	for _, d := range db.dbs {
+		if d.reader == nil {
+			continue
+		}
+		if err := d.reader.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		d.reader = nil
+	}
+	return firstErr
+}
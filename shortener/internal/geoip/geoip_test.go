@@ -0,0 +1,119 @@
+package geoip
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFixture writes a small .mmdb file mapping CIDR networks to records
+func writeFixture(t *testing.T, path string, networks map[string]mmdbtype.Map) {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "Shortener-Test", RecordSize: 24})
+	require.NoError(t, err)
+	for cidr, rec := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.NoError(t, tree.Insert(network, rec))
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	require.NoError(t, err)
+	_, err = tree.WriteTo(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func cityRecord(country, region string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"country": mmdbtype.Map{"iso_code": mmdbtype.String(country)},
+		"subdivisions": mmdbtype.Slice{
+			mmdbtype.Map{"iso_code": mmdbtype.String(region)},
+		},
+	}
+}
+
+func TestLookupMergesDatabases(t *testing.T) {
+	dir := t.TempDir()
+	city := filepath.Join(dir, "city.mmdb")
+	asn := filepath.Join(dir, "asn.mmdb")
+	writeFixture(t, city, map[string]mmdbtype.Map{
+		"81.2.69.0/24": cityRecord("GB", "ENG"),
+		"2a02:0::/32":  {"country": mmdbtype.Map{"iso_code": mmdbtype.String("de")}},
+	})
+	writeFixture(t, asn, map[string]mmdbtype.Map{
+		"81.2.0.0/16": {"autonomous_system_number": mmdbtype.Uint32(20712)},
+	})
+
+	db, err := Open(city, asn)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	assert.Equal(t, Location{Country: "GB", Region: "ENG", ASN: 20712}, db.Lookup("81.2.69.142"))
+	assert.Equal(t, Location{Country: "GB", Region: "ENG", ASN: 20712}, db.Lookup("::ffff:81.2.69.142"))
+	assert.Equal(t, Location{Country: "DE"}, db.Lookup("2a02::1"))
+	assert.Equal(t, Location{ASN: 20712}, db.Lookup("81.2.1.1"))
+	assert.Equal(t, Location{}, db.Lookup("10.0.0.1"))
+	assert.Equal(t, Location{}, db.Lookup("not-an-ip"))
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "missing.mmdb"))
+	assert.Error(t, err)
+}
+
+func TestReloadPicksUpNewFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	writeFixture(t, path, map[string]mmdbtype.Map{"81.2.69.0/24": cityRecord("GB", "ENG")})
+
+	db, err := Open(path)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	assert.Equal(t, "GB", db.Lookup("81.2.69.142").Country)
+
+	writeFixture(t, path, map[string]mmdbtype.Map{"81.2.69.0/24": cityRecord("IE", "D")})
+	// Make sure the modification time differs on coarse-grained filesystems
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	require.NoError(t, db.Reload())
+	assert.Equal(t, Location{Country: "IE", Region: "D"}, db.Lookup("81.2.69.142"))
+}
+
+func TestReloadKeepsOldDataOnBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	writeFixture(t, path, map[string]mmdbtype.Map{"81.2.69.0/24": cityRecord("GB", "ENG")})
+
+	db, err := Open(path)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0o644))
+	assert.Error(t, db.Reload())
+	assert.Equal(t, "GB", db.Lookup("81.2.69.142").Country)
+}
+
+func TestWatchZeroInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	writeFixture(t, path, map[string]mmdbtype.Map{"81.2.69.0/24": cityRecord("GB", "ENG")})
+
+	db, err := Open(path)
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	// A zero interval falls back to the default instead of panicking
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	db.Watch(ctx, 0)
+}
@@ -0,0 +1,228 @@
+// Package ingest buffers clicks in memory and writes them to the database
+// in batches, so redirects never wait for analytics writes.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+)
+
+const (
+	// DefaultBufferSize is how many clicks can wait for a flush
+	DefaultBufferSize = 10000
+	// DefaultBatchSize is how many clicks trigger an early flush
+	DefaultBatchSize = 500
+	// DefaultFlushInterval is the longest a click waits to be written
+	DefaultFlushInterval = time.Second
+	// flushAttempts bounds retries of a failing batch before it is dropped
+	flushAttempts = 3
+)
+
+var (
+	// ErrBufferFull is returned when clicks arrive faster than they flush
+	ErrBufferFull = errors.New("click buffer is full")
+	// ErrClosed is returned for clicks recorded after Close
+	ErrClosed = errors.New("click pipeline is closed")
+)
+
+// Recorder writes a batch of clicks; db.Repository implements it
+type Recorder interface {
+	RecordClicks(clicks []db.NewClick) error
+}
+
+// Config tunes the pipeline; zero values pick the defaults
+type Config struct {
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// Stats describes the pipeline's throughput and backpressure
+type Stats struct {
+	// Queued is the number of clicks waiting in the buffer
+	Queued int `json:"queued"`
+	// Capacity is the buffer size
+	Capacity int `json:"capacity"`
+	// Accepted counts clicks taken into the buffer
+	Accepted int64 `json:"accepted"`
+	// Dropped counts clicks rejected because the buffer was full or closed
+	Dropped int64 `json:"dropped"`
+	// Written counts clicks stored in the database
+	Written int64 `json:"written"`
+	// Failed counts clicks lost after the database rejected their batch
+	Failed int64 `json:"failed"`
+	// Flushes counts batches written
+	Flushes int64 `json:"flushes"`
+	// LastFlushDuration is how long the latest batch took to write
+	LastFlushDuration time.Duration `json:"last_flush_duration"`
+}
+
+// Pipeline accepts clicks without blocking and flushes them in batches when
+// BatchSize clicks are pending or FlushInterval elapses
+type Pipeline struct {
+	recorder Recorder
+	cfg      Config
+	queue    chan db.NewClick
+	done     chan struct{}
+
+	// mu guards closed so Record never sends on a closed channel
+	mu     sync.RWMutex
+	closed bool
+
+	accepted  atomic.Int64
+	dropped   atomic.Int64
+	written   atomic.Int64
+	failed    atomic.Int64
+	flushes   atomic.Int64
+	lastFlush atomic.Int64
+}
+
+// New starts a pipeline writing to recorder
+func New(recorder Recorder, cfg Config) *Pipeline {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = DefaultBufferSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+
+	p := &Pipeline{
+		recorder: recorder,
+		cfg:      cfg,
+		queue:    make(chan db.NewClick, cfg.BufferSize),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Record queues a click. It never blocks: when the buffer is full the click
+// is dropped and counted so overload cannot slow redirects down.
+func (p *Pipeline) Record(click db.NewClick) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		p.dropped.Add(1)
+		return ErrClosed
+	}
+	select {
+	case p.queue <- click:
+		p.accepted.Add(1)
+		return nil
+	default:
+		p.dropped.Add(1)
+		return ErrBufferFull
+	}
+}
+
+// Close stops accepting clicks and waits until the buffer is flushed or
+// ctx is done
+func (p *Pipeline) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of the pipeline counters
+func (p *Pipeline) Stats() Stats {
+	return Stats{
+		Queued:            len(p.queue),
+		Capacity:          cap(p.queue),
+		Accepted:          p.accepted.Load(),
+		Dropped:           p.dropped.Load(),
+		Written:           p.written.Load(),
+		Failed:            p.failed.Load(),
+		Flushes:           p.flushes.Load(),
+		LastFlushDuration: time.Duration(p.lastFlush.Load()),
+	}
+}
+
+func (p *Pipeline) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]db.NewClick, 0, p.cfg.BatchSize)
+	for {
+		select {
+		case click, ok := <-p.queue:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, click)
+			if len(batch) >= p.cfg.BatchSize {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			p.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes a batch, retrying a few times before giving it up. A batch
+// the database rejects for its data is split in halves until only the
+// offending clicks are dropped.
+func (p *Pipeline) flush(batch []db.NewClick) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := p.write(batch)
+	if err == nil {
+		return
+	}
+	if db.IsDataError(err) && len(batch) > 1 {
+		mid := len(batch) / 2
+		p.flush(batch[:mid])
+		p.flush(batch[mid:])
+		return
+	}
+
+	p.failed.Add(int64(len(batch)))
+	log.Printf("Failed to write %d clicks: %v", len(batch), err)
+}
+
+// write records a batch, retrying errors that may be transient
+func (p *Pipeline) write(batch []db.NewClick) error {
+	var err error
+	for attempt := 0; attempt < flushAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		start := time.Now()
+		if err = p.recorder.RecordClicks(batch); err == nil {
+			p.lastFlush.Store(int64(time.Since(start)))
+			p.flushes.Add(1)
+			p.written.Add(int64(len(batch)))
+			return nil
+		}
+		if db.IsDataError(err) {
+			return err
+		}
+	}
+	return err
+}
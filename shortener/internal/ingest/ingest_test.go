@@ -0,0 +1,157 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRecorder collects batches and can block or fail on demand
+type fakeRecorder struct {
+	mu      sync.Mutex
+	batches [][]db.NewClick
+	fail    int
+	block   chan struct{}
+	// poisoned clicks make their whole batch fail with a data error
+	poisoned map[int64]bool
+}
+
+func (r *fakeRecorder) RecordClicks(clicks []db.NewClick) error {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail > 0 {
+		r.fail--
+		return errors.New("database unavailable")
+	}
+	for _, click := range clicks {
+		if r.poisoned[click.ShortURLID] {
+			return &pgconn.PgError{Code: "22021", Message: "invalid byte sequence for encoding \"UTF8\""}
+		}
+	}
+	r.batches = append(r.batches, append([]db.NewClick(nil), clicks...))
+	return nil
+}
+
+func (r *fakeRecorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sizes := make([]int, len(r.batches))
+	for i, b := range r.batches {
+		sizes[i] = len(b)
+	}
+	return sizes
+}
+
+func TestFlushesFullBatches(t *testing.T) {
+	rec := &fakeRecorder{}
+	p := New(rec, Config{BatchSize: 3, FlushInterval: time.Hour})
+
+	for i := 0; i < 7; i++ {
+		require.NoError(t, p.Record(db.NewClick{ShortURLID: int64(i)}))
+	}
+	require.NoError(t, p.Close(context.Background()))
+
+	assert.Equal(t, []int{3, 3, 1}, rec.sizes())
+	stats := p.Stats()
+	assert.Equal(t, int64(7), stats.Accepted)
+	assert.Equal(t, int64(7), stats.Written)
+	assert.Equal(t, int64(3), stats.Flushes)
+}
+
+func TestFlushesOnInterval(t *testing.T) {
+	rec := &fakeRecorder{}
+	p := New(rec, Config{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+	defer func() { _ = p.Close(context.Background()) }()
+
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 1}))
+	assert.Eventually(t, func() bool {
+		return len(rec.sizes()) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestDropsWhenBufferIsFull(t *testing.T) {
+	rec := &fakeRecorder{block: make(chan struct{})}
+	p := New(rec, Config{BufferSize: 2, BatchSize: 1, FlushInterval: time.Hour})
+
+	// The first click is taken by the flusher, which then blocks
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 1}))
+	assert.Eventually(t, func() bool { return p.Stats().Queued == 0 }, time.Second, time.Millisecond)
+
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 2}))
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 3}))
+	assert.ErrorIs(t, p.Record(db.NewClick{ShortURLID: 4}), ErrBufferFull)
+
+	stats := p.Stats()
+	assert.Equal(t, 2, stats.Queued)
+	assert.Equal(t, 2, stats.Capacity)
+	assert.Equal(t, int64(1), stats.Dropped)
+
+	close(rec.block)
+	require.NoError(t, p.Close(context.Background()))
+	assert.Equal(t, int64(3), p.Stats().Written)
+	assert.ErrorIs(t, p.Record(db.NewClick{ShortURLID: 5}), ErrClosed)
+}
+
+func TestRetriesFailedFlush(t *testing.T) {
+	rec := &fakeRecorder{fail: 1}
+	p := New(rec, Config{BatchSize: 2, FlushInterval: time.Hour})
+
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 1}))
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 2}))
+	require.NoError(t, p.Close(context.Background()))
+
+	assert.Equal(t, []int{2}, rec.sizes())
+	assert.Equal(t, int64(0), p.Stats().Failed)
+}
+
+func TestGivesUpAfterRepeatedFailures(t *testing.T) {
+	rec := &fakeRecorder{fail: flushAttempts}
+	p := New(rec, Config{BatchSize: 1, FlushInterval: time.Hour})
+
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 1}))
+	require.NoError(t, p.Close(context.Background()))
+
+	assert.Empty(t, rec.sizes())
+	assert.Equal(t, int64(1), p.Stats().Failed)
+}
+
+func TestDropsOnlyPoisonedClicks(t *testing.T) {
+	rec := &fakeRecorder{poisoned: map[int64]bool{3: true}}
+	p := New(rec, Config{BatchSize: 8, FlushInterval: time.Hour})
+
+	for id := int64(1); id <= 8; id++ {
+		require.NoError(t, p.Record(db.NewClick{ShortURLID: id}))
+	}
+	require.NoError(t, p.Close(context.Background()))
+
+	var written []int64
+	for _, batch := range rec.batches {
+		for _, click := range batch {
+			written = append(written, click.ShortURLID)
+		}
+	}
+	assert.Equal(t, []int64{1, 2, 4, 5, 6, 7, 8}, written)
+	assert.Equal(t, int64(7), p.Stats().Written)
+	assert.Equal(t, int64(1), p.Stats().Failed)
+}
+
+func TestCloseHonoursDeadline(t *testing.T) {
+	rec := &fakeRecorder{block: make(chan struct{})}
+	defer close(rec.block)
+	p := New(rec, Config{BatchSize: 1, FlushInterval: time.Hour})
+
+	require.NoError(t, p.Record(db.NewClick{ShortURLID: 1}))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Close(ctx), context.DeadlineExceeded)
+}
@@ -1,154 +1,135 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/ratelimit"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestRateLimitMiddleware(t *testing.T) {
+var testPolicy = Policy{Name: "test", Limit: ratelimit.Limit{Requests: 10, Window: time.Minute}}
+
+func newTestRouter(limiter ratelimit.Limiter, policy Policy) *gin.Engine {
 	gin.SetMode(gin.TestMode)
-	
-	// Reset global state
-	mu.Lock()
-	requests = make(map[string][]time.Time)
-	mu.Unlock()
 
 	router := gin.New()
-	router.Use(RateLimitMiddleware())
+	router.Use(RateLimitMiddleware(limiter, policy, ClientIP))
 	router.GET("/test", func(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "ok"})
 	})
+	return router
+}
 
-	// Test normal request
+func get(router *gin.Engine, remoteAddr string) *httptest.ResponseRecorder {
 	req, _ := http.NewRequest("GET", "/test", nil)
-	req.RemoteAddr = "192.168.1.1:12345"
+	req.RemoteAddr = remoteAddr
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	router := newTestRouter(ratelimit.NewMemory(), testPolicy)
+
+	// Test normal request
+	w := get(router, "192.168.1.1:12345")
 
 	assert.Equal(t, http.StatusOK, w.Code)
 	assert.Contains(t, w.Body.String(), "ok")
+	assert.Equal(t, "10", w.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "9", w.Header().Get("X-RateLimit-Remaining"))
+	reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(6*time.Second).Unix(), reset, 1)
+	assert.Empty(t, w.Header().Get("Retry-After"))
 }
 
 func TestRateLimitExceeded(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	
-	// Reset global state
-	mu.Lock()
-	requests = make(map[string][]time.Time)
-	mu.Unlock()
+	router := newTestRouter(ratelimit.NewMemory(), testPolicy)
 
-	router := gin.New()
-	router.Use(RateLimitMiddleware())
-	router.GET("/test", func(c *gin.Context) {
-		c.JSON(200, gin.H{"message": "ok"})
-	})
-
-	// Make requests up to the limit
-	for i := 0; i < MaxRequestsPerMinute; i++ {
-		req, _ := http.NewRequest("GET", "/test", nil)
-		req.RemoteAddr = "192.168.1.2:12345"
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
+	// Make requests up to the burst
+	for i := 0; i < testPolicy.Limit.Requests; i++ {
+		w := get(router, "192.168.1.2:12345")
 		assert.Equal(t, http.StatusOK, w.Code)
 	}
 
 	// This should be rate limited
-	req, _ := http.NewRequest("GET", "/test", nil)
-	req.RemoteAddr = "192.168.1.2:12345"
-	w := httptest.NewRecorder()
-	router.ServeHTTP(w, req)
+	w := get(router, "192.168.1.2:12345")
 
 	assert.Equal(t, http.StatusTooManyRequests, w.Code)
 	assert.Contains(t, w.Body.String(), "Rate limit exceeded")
+	assert.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "6", w.Header().Get("Retry-After"))
 }
 
 func TestRateLimitDifferentIPs(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	
-	// Reset global state
-	mu.Lock()
-	requests = make(map[string][]time.Time)
-	mu.Unlock()
+	router := newTestRouter(ratelimit.NewMemory(), testPolicy)
 
-	router := gin.New()
-	router.Use(RateLimitMiddleware())
-	router.GET("/test", func(c *gin.Context) {
-		c.JSON(200, gin.H{"message": "ok"})
-	})
-
-	// Test that different IPs have separate limits
+	// Test that different IPs have separate buckets
 	ips := []string{"192.168.1.10:12345", "192.168.1.11:12345", "192.168.1.12:12345"}
-	
+
 	for _, ip := range ips {
-		for i := 0; i < 50; i++ { // Well under the limit
-			req, _ := http.NewRequest("GET", "/test", nil)
-			req.RemoteAddr = ip
-			w := httptest.NewRecorder()
-			router.ServeHTTP(w, req)
+		for i := 0; i < testPolicy.Limit.Requests; i++ {
+			w := get(router, ip)
 			assert.Equal(t, http.StatusOK, w.Code)
 		}
 	}
 
-	// All IPs should still work
+	// All IPs are now out of tokens
 	for _, ip := range ips {
-		req, _ := http.NewRequest("GET", "/test", nil)
-		req.RemoteAddr = ip
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
+		w := get(router, ip)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestRateLimitPoliciesAreSeparate(t *testing.T) {
+	limiter := ratelimit.NewMemory()
+	strict := newTestRouter(limiter, Policy{Name: "strict", Limit: ratelimit.Limit{Requests: 1, Window: time.Minute}})
+	relaxed := newTestRouter(limiter, testPolicy)
+
+	assert.Equal(t, http.StatusOK, get(strict, "192.168.1.40:12345").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get(strict, "192.168.1.40:12345").Code)
+	assert.Equal(t, http.StatusOK, get(relaxed, "192.168.1.40:12345").Code)
+}
+
+func TestRateLimitUnlimitedPolicy(t *testing.T) {
+	router := newTestRouter(ratelimit.NewMemory(), Policy{Name: "open"})
+
+	for i := 0; i < 50; i++ {
+		w := get(router, "192.168.1.50:12345")
 		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("X-RateLimit-Limit"))
 	}
 }
 
-func TestRateLimitCleanup(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	
-	// Reset global state
-	mu.Lock()
-	requests = make(map[string][]time.Time)
-	// Manually add old requests that should be cleaned up
-	old := time.Now().Add(-2 * time.Minute)
-	requests["192.168.1.20"] = []time.Time{old, old, old}
-	mu.Unlock()
+// failingLimiter stands in for an unreachable shared backend
+type failingLimiter struct{}
 
-	router := gin.New()
-	router.Use(RateLimitMiddleware())
-	router.GET("/test", func(c *gin.Context) {
-		c.JSON(200, gin.H{"message": "ok"})
-	})
+func (failingLimiter) Allow(key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("connection refused")
+}
 
-	// Make a request - this should clean up old requests
-	req, _ := http.NewRequest("GET", "/test", nil)
-	req.RemoteAddr = "192.168.1.20:12345"
-	w := httptest.NewRecorder()
-	router.ServeHTTP(w, req)
+func (failingLimiter) Refund(key string, limit ratelimit.Limit) error {
+	return errors.New("connection refused")
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	router := newTestRouter(failingLimiter{}, testPolicy)
+
+	w := get(router, "192.168.1.20:12345")
 
 	assert.Equal(t, http.StatusOK, w.Code)
-	
-	// Verify old requests were cleaned up
-	mu.Lock()
-	assert.Equal(t, 1, len(requests["192.168.1.20"]))
-	mu.Unlock()
 }
 
 func TestRateLimitConcurrency(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-	
-	// Reset global state
-	mu.Lock()
-	requests = make(map[string][]time.Time)
-	mu.Unlock()
-
-	router := gin.New()
-	router.Use(RateLimitMiddleware())
-	router.GET("/test", func(c *gin.Context) {
-		c.JSON(200, gin.H{"message": "ok"})
-	})
+	router := newTestRouter(ratelimit.NewMemory(), testPolicy)
 
 	// Test concurrent requests don't cause race conditions
 	var wg sync.WaitGroup
@@ -157,20 +138,91 @@ func TestRateLimitConcurrency(t *testing.T) {
 		go func(id int) {
 			defer wg.Done()
 			for j := 0; j < 5; j++ {
-				req, _ := http.NewRequest("GET", "/test", nil)
-				req.RemoteAddr = "192.168.1.30:12345"
-				w := httptest.NewRecorder()
-				router.ServeHTTP(w, req)
 				// Should not panic or cause race conditions
+				get(router, "192.168.1.30:12345")
 			}
 		}(i)
 	}
 	wg.Wait()
 
-	// Verify we can still make requests
-	req, _ := http.NewRequest("GET", "/test", nil)
-	req.RemoteAddr = "192.168.1.31:12345"
-	w := httptest.NewRecorder()
-	router.ServeHTTP(w, req)
+	// Verify other clients can still make requests
+	w := get(router, "192.168.1.31:12345")
 	assert.Equal(t, http.StatusOK, w.Code)
 }
+
+func TestFailureLimitCountsOnlyFailures(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := ratelimit.NewMemory()
+	policy := Policy{Name: "login", Limit: ratelimit.Limit{Requests: 3, Window: time.Minute}}
+	resource := func(c *gin.Context) string { return "resource:" + c.Query("id") }
+
+	router := gin.New()
+	router.GET("/test", FailureLimitMiddleware(limiter, policy, ClientIP), FailureLimitMiddleware(limiter, policy, resource), func(c *gin.Context) {
+		if c.Query("ok") == "" {
+			CountFailure(c)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "no"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "ok"})
+	})
+	request := func(path, remoteAddr string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Successes are free
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, request("/test?id=1&ok=1", "192.168.1.60:12345"))
+	}
+
+	// Three failures empty the client's bucket, and then even a correct
+	// attempt is refused
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, request("/test?id=1", "192.168.1.61:12345"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request("/test?id=1&ok=1", "192.168.1.61:12345"))
+
+	// The resource is locked for other clients too, but not other resources
+	assert.Equal(t, http.StatusTooManyRequests, request("/test?id=1&ok=1", "192.168.1.62:12345"))
+	assert.Equal(t, http.StatusOK, request("/test?id=2&ok=1", "192.168.1.62:12345"))
+}
+
+func TestFailureLimitHoldsTokensWhileRunning(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := ratelimit.NewMemory()
+	policy := Policy{Name: "login", Limit: ratelimit.Limit{Requests: 3, Window: time.Minute}}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router := gin.New()
+	router.GET("/test", FailureLimitMiddleware(limiter, policy, ClientIP), func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		CountFailure(c)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "no"})
+	})
+	request := func() int {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "192.168.1.70:12345"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Three guesses in flight at once hold the whole burst, so a fourth is
+	// refused before any of them has been counted as a failure
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() { codes <- request() }()
+		<-started
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request())
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, <-codes)
+	}
+}
@@ -1,67 +1,125 @@
 package middleware
 
 import (
+	"log"
+	"math"
 	"net/http"
-	"sync"
-	"time"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rusik69/shortener/internal/ratelimit"
 )
 
-const (
-	MaxRequestsPerMinute = 100
-	MaxRequestsPerHour   = 1000
-)
+// Policy is a named quota. Routes under different policies draw from
+// separate buckets even for the same client.
+type Policy struct {
+	Name  string
+	Limit ratelimit.Limit
+}
 
-var (
-	window   = time.Minute
-	maxReq   = MaxRequestsPerMinute
-	requests = make(map[string][]time.Time)
-	mu       sync.RWMutex
-)
+// KeyFunc names the client a request is counted against
+type KeyFunc func(c *gin.Context) string
 
-// RateLimitMiddleware limits requests per IP
-func RateLimitMiddleware() gin.HandlerFunc {
+// IP returns the client IP, mapping empty and unspecified addresses to
+// 127.0.0.1 so they can be stored as INET
+func IP(c *gin.Context) string {
+	ip := c.ClientIP()
+	// Handle cases where IP is empty or invalid
+	if ip == "" || ip == "::" || ip == "::1" {
+		ip = "127.0.0.1"
+	}
+	return ip
+}
+
+// ClientIP counts requests per client IP
+func ClientIP(c *gin.Context) string {
+	return "ip:" + IP(c)
+}
+
+// RateLimitMiddleware takes a token from the client's bucket for policy and
+// answers 429 with Retry-After when it is empty. Every limited response
+// carries X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+// (Unix time when the bucket is full again). Requests are let through when
+// the limiter fails so an unavailable backend cannot take the service down.
+func RateLimitMiddleware(limiter ratelimit.Limiter, policy Policy, key KeyFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ip := c.ClientIP()
-		// Handle cases where IP is empty or invalid
-		if ip == "" || ip == "::" || ip == "::1" {
-			ip = "127.0.0.1"
+		if policy.Limit.Unlimited() {
+			c.Next()
+			return
 		}
-		
-		mu.Lock()
-		now := time.Now()
-		
-		// Clean old requests
-		if times, exists := requests[ip]; exists {
-			validTimes := make([]time.Time, 0)
-			for _, t := range times {
-				if now.Sub(t) < window {
-					validTimes = append(validTimes, t)
-				}
-			}
-			requests[ip] = validTimes
+
+		result, err := limiter.Allow(policy.Name+":"+key(c), policy.Limit)
+		if err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
+			return
+		}
+
+		if !limited(c, result) {
+			c.Next()
 		}
-		
-		// Check rate limit
-		if len(requests[ip]) >= maxReq {
-			mu.Unlock()
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
-			c.Abort()
+	}
+}
+
+// failedKey marks requests that FailureLimitMiddleware charges for
+const failedKey = "ratelimit.failed"
+
+// CountFailure charges the current request to the failure buckets of
+// FailureLimitMiddleware
+func CountFailure(c *gin.Context) {
+	c.Set(failedKey, true)
+}
+
+// FailureLimitMiddleware takes a token from the client's bucket for policy
+// like RateLimitMiddleware, but gives it back after the handler unless the
+// handler marked the request with CountFailure. Clients are limited by how
+// often they fail, and since every attempt holds its token while it runs,
+// concurrent attempts cannot get past the burst.
+func FailureLimitMiddleware(limiter ratelimit.Limiter, policy Policy, key KeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if policy.Limit.Unlimited() {
+			c.Next()
+			return
+		}
+
+		name := policy.Name + ":" + key(c)
+		result, err := limiter.Allow(name, policy.Limit)
+		if err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
+			return
+		}
+		if limited(c, result) {
 			return
 		}
-		
-		// Add current request
-		requests[ip] = append(requests[ip], now)
-		mu.Unlock()
-		
+
 		c.Next()
+
+		if !c.GetBool(failedKey) {
+			if err := limiter.Refund(name, policy.Limit); err != nil {
+				log.Printf("Rate limiter unavailable: %v", err)
+			}
+		}
 	}
 }
 
-// ResetRateLimiter resets the rate limiter state for testing purposes.
-func ResetRateLimiter() {
-	mu.Lock()
-	requests = make(map[string][]time.Time)
-	mu.Unlock()
+// limited sets the rate limit headers for result and, when it was
+// rejected, answers 429 and aborts. It reports whether it did.
+func limited(c *gin.Context, result ratelimit.Result) bool {
+	header := c.Writer.Header()
+	header.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(result.ResetAt.Unix(), 10))
+
+	if result.Allowed {
+		return false
+	}
+	retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	header.Set("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+	c.Abort()
+	return true
 }
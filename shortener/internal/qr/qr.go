@@ -0,0 +1,216 @@
+// Package qr renders QR codes as PNG or SVG images.
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Format is an output image format
+type Format string
+
+const (
+	PNG Format = "png"
+	SVG Format = "svg"
+)
+
+const (
+	// DefaultSize is the default image width and height in pixels
+	DefaultSize = 256
+	// MinSize and MaxSize bound Options.Size
+	MinSize = 64
+	MaxSize = 2048
+	// DefaultMargin is the quiet zone the QR specification asks for, in modules
+	DefaultMargin = 4
+	// MaxMargin bounds Options.Margin
+	MaxMargin = 16
+)
+
+var (
+	// ErrInvalidOptions is wrapped by every option validation error
+	ErrInvalidOptions = errors.New("invalid QR code options")
+	// ErrTooSmall is returned when Size leaves less than a pixel per module
+	ErrTooSmall = fmt.Errorf("%w: size too small for the content", ErrInvalidOptions)
+)
+
+// Level is the share of the code that can be damaged and still be read
+type Level = qrcode.RecoveryLevel
+
+// ParseLevel reads an error correction level: L (7%), M (15%), Q (25%) or H (30%)
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return qrcode.Low, nil
+	case "M":
+		return qrcode.Medium, nil
+	case "Q":
+		return qrcode.High, nil
+	case "H":
+		return qrcode.Highest, nil
+	}
+	return 0, fmt.Errorf("%w: level must be L, M, Q or H", ErrInvalidOptions)
+}
+
+// ParseColor reads a hex colour such as "#1a2b3c", "1a2b3c", "fff" or
+// "1a2b3c80" (with alpha), or "transparent"
+func ParseColor(s string) (color.NRGBA, error) {
+	if strings.EqualFold(s, "transparent") {
+		return color.NRGBA{}, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("%w: invalid colour %q", ErrInvalidOptions, s)
+	}
+	return color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+// ParseFormat reads "png" or "svg"
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case PNG, SVG:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w: format must be png or svg", ErrInvalidOptions)
+}
+
+// Options control how a code is drawn
+type Options struct {
+	// Size is the image width and height in pixels
+	Size int
+	// Level is the error correction level
+	Level Level
+	// Margin is the quiet zone around the code, in modules
+	Margin     int
+	Foreground color.NRGBA
+	Background color.NRGBA
+	Format     Format
+}
+
+// DefaultOptions draws a 256px black on white PNG with level M
+func DefaultOptions() Options {
+	return Options{
+		Size:       DefaultSize,
+		Level:      qrcode.Medium,
+		Margin:     DefaultMargin,
+		Foreground: color.NRGBA{A: 0xff},
+		Background: color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		Format:     PNG,
+	}
+}
+
+// Validate checks that the options are in range
+func (o Options) Validate() error {
+	if o.Size < MinSize || o.Size > MaxSize {
+		return fmt.Errorf("%w: size must be between %d and %d", ErrInvalidOptions, MinSize, MaxSize)
+	}
+	if o.Margin < 0 || o.Margin > MaxMargin {
+		return fmt.Errorf("%w: margin must be between 0 and %d", ErrInvalidOptions, MaxMargin)
+	}
+	if _, err := ParseFormat(string(o.Format)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ContentType is the MIME type of the rendered image
+func (o Options) ContentType() string {
+	if o.Format == SVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// Render encodes content as a QR code and writes the image to w
+func Render(w io.Writer, content string, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	code, err := qrcode.New(content, opts.Level)
+	if err != nil {
+		return err
+	}
+	code.DisableBorder = true
+	modules := code.Bitmap()
+
+	// Add the margin as light modules on every side
+	n := len(modules) + 2*opts.Margin
+	if opts.Size < n {
+		return ErrTooSmall
+	}
+	dark := func(x, y int) bool {
+		x, y = x-opts.Margin, y-opts.Margin
+		return y >= 0 && y < len(modules) && x >= 0 && x < len(modules) && modules[y][x]
+	}
+
+	if opts.Format == SVG {
+		return writeSVG(w, n, dark, opts)
+	}
+	return writePNG(w, n, dark, opts)
+}
+
+// writePNG scales n×n modules to opts.Size pixels. When the size is not a
+// multiple of n some modules are a pixel wider than others.
+func writePNG(w io.Writer, n int, dark func(x, y int) bool, opts Options) error {
+	img := image.NewPaletted(image.Rect(0, 0, opts.Size, opts.Size), color.Palette{opts.Background, opts.Foreground})
+	for py := 0; py < opts.Size; py++ {
+		y := py * n / opts.Size
+		for px := 0; px < opts.Size; px++ {
+			if dark(px*n/opts.Size, y) {
+				img.SetColorIndex(px, py, 1)
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// writeSVG draws one path with a rectangle per horizontal run of dark
+// modules; the viewBox is in modules so the image scales without blurring
+func writeSVG(w io.Writer, n int, dark func(x, y int) bool, opts Options) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.Size, opts.Size, n, n)
+	if opts.Background.A != 0 {
+		fmt.Fprintf(&b, `<rect width="%d" height="%d"%s/>`, n, n, svgFill(opts.Background))
+	}
+	b.WriteString(`<path d="`)
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; {
+			if !dark(x, y) {
+				x++
+				continue
+			}
+			start := x
+			for x < n && dark(x, y) {
+				x++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	fmt.Fprintf(&b, `"%s/></svg>`, svgFill(opts.Foreground))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// svgFill returns fill attributes for c
+func svgFill(c color.NRGBA) string {
+	fill := fmt.Sprintf(` fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+	if c.A != 0xff {
+		fill += fmt.Sprintf(` fill-opacity="%s"`, strconv.FormatFloat(float64(c.A)/0xff, 'f', 3, 64))
+	}
+	return fill
+}
@@ -0,0 +1,134 @@
+package qr
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testURL = "https://sho.rt/abc12345"
+
+func TestRenderPNG(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Size = 250
+	opts.Foreground = color.NRGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xff}
+
+	var buf bytes.Buffer
+	require.NoError(t, Render(&buf, testURL, opts))
+
+	img, err := png.Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 250, img.Bounds().Dx())
+	assert.Equal(t, 250, img.Bounds().Dy())
+
+	// A version 2 code is 25 modules wide, 33 with the margin, so the
+	// margin is about 30px and the top-left finder pattern starts after it
+	dark := func(x, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r>>8 == 0x12 && g>>8 == 0x34 && b>>8 == 0x56
+	}
+	assert.False(t, dark(0, 0))
+	assert.False(t, dark(25, 25))
+	assert.True(t, dark(35, 35))
+	assert.True(t, dark(249-35, 35))
+	assert.True(t, dark(35, 249-35))
+	// The light separator right of the top-left finder pattern
+	assert.False(t, dark(85, 35))
+}
+
+func TestRenderMarginAndLevel(t *testing.T) {
+	size := func(opts Options) int {
+		var buf bytes.Buffer
+		require.NoError(t, Render(&buf, testURL, opts))
+		return strings.Count(buf.String(), "M")
+	}
+
+	opts := DefaultOptions()
+	opts.Format = SVG
+	low := size(opts)
+	opts.Level, _ = ParseLevel("H")
+	high := size(opts)
+	assert.Greater(t, high, low, "higher error correction needs more modules")
+
+	opts.Margin = 0
+	var buf bytes.Buffer
+	require.NoError(t, Render(&buf, testURL, opts))
+	// Without a margin the finder pattern starts at the origin
+	assert.Contains(t, buf.String(), `d="M0 0h7v1h-7z`)
+}
+
+func TestRenderSVG(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Format = SVG
+	opts.Background, _ = ParseColor("transparent")
+	opts.Foreground, _ = ParseColor("#ff000080")
+
+	var buf bytes.Buffer
+	require.NoError(t, Render(&buf, testURL, opts))
+	svg := buf.String()
+
+	assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="256" height="256" viewBox="0 0 33 33"`))
+	assert.NotContains(t, svg, "<rect")
+	assert.Contains(t, svg, `fill="#ff0000" fill-opacity="0.502"`)
+	assert.Contains(t, svg, `d="M4 4h7v1h-7z`)
+	assert.Equal(t, "image/svg+xml", opts.ContentType())
+}
+
+func TestRenderRejectsBadOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Size = MaxSize + 1
+	assert.ErrorIs(t, Render(&bytes.Buffer{}, testURL, opts), ErrInvalidOptions)
+
+	opts = DefaultOptions()
+	opts.Margin = -1
+	assert.ErrorIs(t, Render(&bytes.Buffer{}, testURL, opts), ErrInvalidOptions)
+
+	opts = DefaultOptions()
+	opts.Format = "gif"
+	assert.ErrorIs(t, Render(&bytes.Buffer{}, testURL, opts), ErrInvalidOptions)
+
+	// Long content needs more modules than there are pixels
+	opts = DefaultOptions()
+	opts.Size = MinSize
+	assert.ErrorIs(t, Render(&bytes.Buffer{}, testURL+strings.Repeat("x", 500), opts), ErrTooSmall)
+}
+
+func TestParseColor(t *testing.T) {
+	tests := map[string]color.NRGBA{
+		"#1a2b3c":     {R: 0x1a, G: 0x2b, B: 0x3c, A: 0xff},
+		"1A2B3C":      {R: 0x1a, G: 0x2b, B: 0x3c, A: 0xff},
+		"fff":         {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		"#00000080":   {A: 0x80},
+		"transparent": {},
+	}
+	for s, want := range tests {
+		got, err := ParseColor(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{"", "#12", "red", "#gggggg", "#1234567"} {
+		_, err := ParseColor(s)
+		assert.ErrorIs(t, err, ErrInvalidOptions, s)
+	}
+}
+
+func TestParseLevelAndFormat(t *testing.T) {
+	for _, s := range []string{"L", "m", "Q", "h"} {
+		_, err := ParseLevel(s)
+		assert.NoError(t, err, s)
+	}
+	_, err := ParseLevel("X")
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+
+	f, err := ParseFormat("SVG")
+	require.NoError(t, err)
+	assert.Equal(t, SVG, f)
+	_, err = ParseFormat("jpeg")
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+}
@@ -0,0 +1,44 @@
+package ratelimit
+
+import "time"
+
+// Bucket is the part of db.Repository the Postgres limiter needs
+type Bucket interface {
+	TakeRateLimitToken(key string, now time.Time, interval time.Duration, burst int) (time.Time, bool, error)
+	// RefundRateLimitToken moves the TAT of key back by interval
+	RefundRateLimitToken(key string, interval time.Duration) error
+}
+
+// Postgres keeps buckets in the rate_limits table, one row per key. Idle
+// rows are removed by DeleteExpiredRateLimits.
+type Postgres struct {
+	bucket Bucket
+}
+
+// NewPostgres takes tokens through bucket, normally a db.Repository
+func NewPostgres(bucket Bucket) *Postgres {
+	return &Postgres{bucket: bucket}
+}
+
+func (p *Postgres) Allow(key string, limit Limit) (Result, error) {
+	if limit.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+
+	now := time.Now()
+	tat, ok, err := p.bucket.TakeRateLimitToken(key, now, limit.interval(), limit.burst())
+	if err != nil {
+		return Result{}, err
+	}
+	if !ok {
+		return rejected(tat, now, limit), nil
+	}
+	return allowed(tat, now, limit), nil
+}
+
+func (p *Postgres) Refund(key string, limit Limit) error {
+	if limit.Unlimited() {
+		return nil
+	}
+	return p.bucket.RefundRateLimitToken(key, limit.interval())
+}
@@ -0,0 +1,208 @@
+// Package ratelimit enforces token-bucket quotas per client key. The
+// in-memory limiter serves a single process; the Postgres and Redis ones
+// keep buckets where every replica sees them.
+//
+// Buckets are tracked with the generic cell rate algorithm: instead of a
+// token count each key stores its theoretical arrival time (TAT), the
+// moment its bucket would be full again. A single timestamp per key makes
+// the check easy to run atomically in SQL or a Redis script.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the in-memory limiter drops idle keys
+const sweepInterval = time.Minute
+
+// Limit refills Requests tokens per Window into a bucket holding up to
+// Burst tokens. A zero Limit means no limit.
+type Limit struct {
+	Requests int
+	Window   time.Duration
+	// Burst is the bucket size; zero means Requests
+	Burst int
+}
+
+// Unlimited reports whether l lets every request through
+func (l Limit) Unlimited() bool {
+	return l.Requests <= 0 || l.Window <= 0
+}
+
+// burst returns the bucket size
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// interval returns how long one token takes to refill
+func (l Limit) interval() time.Duration {
+	return l.Window / time.Duration(l.Requests)
+}
+
+// String formats l the way ParseLimit reads it, without the burst
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Window)
+}
+
+// ParseLimit reads a rate such as "100/1m" or "5/1s"; "off" and "0" mean
+// no limit
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+	count, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate %q, want requests/duration", s)
+	}
+	requests, err := strconv.Atoi(count)
+	if err != nil || requests <= 0 {
+		return Limit{}, fmt.Errorf("invalid request count in %q", s)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid window in %q", s)
+	}
+	limit := Limit{Requests: requests, Window: d}
+	if limit.interval() < time.Nanosecond {
+		// The refill interval would round down to zero
+		return Limit{}, fmt.Errorf("rate %q is too high, at most one request per nanosecond", s)
+	}
+	return limit, nil
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed bool
+	// Limit is the bucket size
+	Limit int
+	// Remaining is how many tokens are left after this request
+	Remaining int
+	// ResetAt is when the bucket will be full again
+	ResetAt time.Time
+	// RetryAfter is how long a rejected client has to wait for a token
+	RetryAfter time.Duration
+}
+
+// Limiter takes a token for key from a bucket shaped by limit.
+// Implementations must be safe for concurrent use.
+type Limiter interface {
+	Allow(key string, limit Limit) (Result, error)
+	// Refund gives back a token that Allow took for key
+	Refund(key string, limit Limit) error
+}
+
+// take runs one GCRA step. It returns the TAT to store, which is unchanged
+// when the request is rejected.
+func take(tat, now time.Time, limit Limit) (time.Time, Result) {
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(limit.interval())
+	if now.Before(next.Add(-time.Duration(limit.burst()) * limit.interval())) {
+		return tat, rejected(tat, now, limit)
+	}
+	return next, allowed(next, now, limit)
+}
+
+// allowed describes an accepted request that moved the TAT to next
+func allowed(next, now time.Time, limit Limit) Result {
+	free := now.Sub(next.Add(-time.Duration(limit.burst()) * limit.interval()))
+	return Result{
+		Allowed:   true,
+		Limit:     limit.burst(),
+		Remaining: int(free / limit.interval()),
+		ResetAt:   next,
+	}
+}
+
+// rejected describes a request refused while the TAT is tat
+func rejected(tat, now time.Time, limit Limit) Result {
+	if tat.Before(now) {
+		tat = now
+	}
+	allowAt := tat.Add(limit.interval()).Add(-time.Duration(limit.burst()) * limit.interval())
+	return Result{
+		Limit:      limit.burst(),
+		ResetAt:    tat,
+		RetryAfter: allowAt.Sub(now),
+	}
+}
+
+// Memory keeps buckets in process memory. They are lost on restart and not
+// shared between replicas.
+type Memory struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemory returns an empty in-memory limiter
+func NewMemory() *Memory {
+	return &Memory{
+		tats: make(map[string]time.Time),
+		now:  time.Now,
+	}
+}
+
+func (m *Memory) Allow(key string, limit Limit) (Result, error) {
+	if limit.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	tat, result := take(m.tats[key], now, limit)
+	m.tats[key] = tat
+	return result, nil
+}
+
+func (m *Memory) Refund(key string, limit Limit) error {
+	if limit.Unlimited() {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tat, ok := m.tats[key]; ok {
+		m.tats[key] = tat.Add(-limit.interval())
+	}
+	return nil
+}
+
+// sweep drops keys whose bucket has refilled; they behave exactly like keys
+// never seen, so idle clients do not hold memory
+func (m *Memory) sweep(now time.Time) {
+	if now.Before(m.nextSweep) {
+		return
+	}
+	for key, tat := range m.tats {
+		if !now.Before(tat) {
+			delete(m.tats, key)
+		}
+	}
+	m.nextSweep = now.Add(sweepInterval)
+}
+
+// Len returns the number of tracked keys
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.tats)
+}
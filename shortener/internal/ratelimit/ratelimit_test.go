@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testLimit refills one token every 20 seconds into a bucket of three
+var testLimit = Limit{Requests: 3, Window: time.Minute}
+
+// drain takes every token of a fresh bucket for key
+func drain(t *testing.T, l Limiter, key string) {
+	t.Helper()
+	for i := 0; i < testLimit.burst(); i++ {
+		res, err := l.Allow(key, testLimit)
+		require.NoError(t, err)
+		require.True(t, res.Allowed, "request %d", i+1)
+		assert.Equal(t, testLimit.burst()-i-1, res.Remaining)
+		assert.Equal(t, 3, res.Limit)
+	}
+}
+
+// checkRefund shows that a refunded token can be taken again, once
+func checkRefund(t *testing.T, l Limiter, key string) {
+	t.Helper()
+	drain(t, l, key)
+	require.NoError(t, l.Refund(key, testLimit))
+	res, err := l.Allow(key, testLimit)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	res, err = l.Allow(key, testLimit)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+
+	// Refunding a fresh key does not overfill its bucket
+	require.NoError(t, l.Refund(key+"-fresh", testLimit))
+	drain(t, l, key+"-fresh")
+}
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("100/1m")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Requests: 100, Window: time.Minute}, limit)
+	assert.Equal(t, "100/1m0s", limit.String())
+
+	limit, err = ParseLimit("off")
+	require.NoError(t, err)
+	assert.True(t, limit.Unlimited())
+
+	for _, bad := range []string{"100", "x/1m", "-1/1m", "10/soon", "10/0s", "2/1ns", "1001/1us"} {
+		_, err := ParseLimit(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestMemoryTokenBucket(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	drain(t, m, "a")
+	res, err := m.Allow("a", testLimit)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 20*time.Second, res.RetryAfter)
+	assert.Equal(t, now.Add(time.Minute), res.ResetAt)
+
+	// Other keys have their own bucket
+	res, _ = m.Allow("b", testLimit)
+	assert.True(t, res.Allowed)
+
+	// One token refills per interval
+	now = now.Add(20 * time.Second)
+	res, _ = m.Allow("a", testLimit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	res, _ = m.Allow("a", testLimit)
+	assert.False(t, res.Allowed)
+
+	// An idle bucket refills completely, but not beyond its size
+	now = now.Add(time.Hour)
+	drain(t, m, "a")
+}
+
+func TestMemoryBurst(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	limit := Limit{Requests: 60, Window: time.Minute, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		res, _ := m.Allow("a", limit)
+		assert.True(t, res.Allowed)
+	}
+	res, _ := m.Allow("a", limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+}
+
+func TestMemoryUnlimited(t *testing.T) {
+	m := NewMemory()
+	for i := 0; i < 10; i++ {
+		res, err := m.Allow("a", Limit{})
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+	}
+	assert.Equal(t, 0, m.Len())
+}
+
+func TestRefund(t *testing.T) {
+	checkRefund(t, NewMemory(), "a")
+	checkRefund(t, NewPostgres(&fakeBucket{tats: make(map[string]time.Time)}), "a")
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	checkRefund(t, NewRedis(client, "shortener:ratelimit:"), "a")
+}
+
+func TestMemoryEvictsIdleKeys(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, _ = m.Allow(key, testLimit)
+	}
+	assert.Equal(t, 3, m.Len())
+
+	now = now.Add(2 * time.Minute)
+	_, _ = m.Allow("d", testLimit)
+	assert.Equal(t, 1, m.Len())
+}
+
+// fakeBucket emulates the rate_limits upsert
+type fakeBucket struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+	err  error
+}
+
+func (b *fakeBucket) TakeRateLimitToken(key string, now time.Time, interval time.Duration, burst int) (time.Time, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return time.Time{}, false, b.err
+	}
+	tat := b.tats[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	if tat.Add(interval).After(now.Add(time.Duration(burst) * interval)) {
+		return b.tats[key], false, nil
+	}
+	b.tats[key] = tat.Add(interval)
+	return b.tats[key], true, nil
+}
+
+func (b *fakeBucket) RefundRateLimitToken(key string, interval time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if tat, ok := b.tats[key]; ok {
+		b.tats[key] = tat.Add(-interval)
+	}
+	return b.err
+}
+
+func TestPostgres(t *testing.T) {
+	bucket := &fakeBucket{tats: make(map[string]time.Time)}
+	p := NewPostgres(bucket)
+
+	drain(t, p, "a")
+	res, err := p.Allow("a", testLimit)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.InDelta(t, float64(20*time.Second), float64(res.RetryAfter), float64(time.Second))
+
+	bucket.err = errors.New("connection refused")
+	_, err = p.Allow("a", testLimit)
+	assert.Error(t, err)
+}
+
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	r := NewRedis(client, "shortener:ratelimit:")
+
+	drain(t, r, "a")
+	res, err := r.Allow("a", testLimit)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.InDelta(t, float64(20*time.Second), float64(res.RetryAfter), float64(time.Second))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), res.ResetAt, time.Second)
+	assert.True(t, server.Exists("shortener:ratelimit:a"))
+
+	// Replicas sharing the server share the bucket
+	other := NewRedis(client, "shortener:ratelimit:")
+	res, _ = other.Allow("a", testLimit)
+	assert.False(t, res.Allowed)
+
+	// The key disappears once its bucket would be full again
+	server.FastForward(time.Minute)
+	assert.False(t, server.Exists("shortener:ratelimit:a"))
+
+	server.Close()
+	_, err = r.Allow("a", testLimit)
+	assert.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds each round-trip so a slow Redis cannot stall requests
+const redisTimeout = 100 * time.Millisecond
+
+// takeScript runs one GCRA step on a key holding the TAT in microseconds.
+// ARGV is now, the refill interval and the bucket size (burst times the
+// interval), all in microseconds. It returns whether a token was taken and
+// the stored TAT; the key expires once the bucket is full again.
+var takeScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local size = tonumber(ARGV[3])
+local tat = tonumber(redis.call("GET", KEYS[1]) or "0")
+if tat < now then
+	tat = now
+end
+local next = tat + interval
+if next - size > now then
+	return {0, tat}
+end
+redis.call("SET", KEYS[1], next, "PX", math.ceil((next - now) / 1000))
+return {1, next}
+`)
+
+// refundScript moves the TAT back by one interval, deleting the key once
+// its bucket would be full. ARGV is now and the refill interval, in
+// microseconds.
+var refundScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tat = tonumber(redis.call("GET", KEYS[1]) or "0")
+local prev = tat - tonumber(ARGV[2])
+if prev <= now then
+	redis.call("DEL", KEYS[1])
+	return 0
+end
+redis.call("SET", KEYS[1], prev, "PX", math.ceil((prev - now) / 1000))
+return 1
+`)
+
+// Redis keeps buckets in any server speaking the Redis protocol (Redis,
+// Valkey, KeyDB, ...), shared by all replicas
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedis stores buckets through client with keys prefixed by prefix
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (r *Redis) Allow(key string, limit Limit) (Result, error) {
+	if limit.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	now := time.Now()
+	size := time.Duration(limit.burst()) * limit.interval()
+	values, err := takeScript.Run(ctx, r.client, []string{r.prefix + key},
+		now.UnixMicro(), limit.interval().Microseconds(), size.Microseconds(),
+	).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+
+	tat := time.UnixMicro(values[1])
+	if values[0] == 0 {
+		return rejected(tat, now, limit), nil
+	}
+	return allowed(tat, now, limit), nil
+}
+
+func (r *Redis) Refund(key string, limit Limit) error {
+	if limit.Unlimited() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return refundScript.Run(ctx, r.client, []string{r.prefix + key},
+		time.Now().UnixMicro(), limit.interval().Microseconds(),
+	).Err()
+}
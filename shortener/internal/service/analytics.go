@@ -1,94 +1,226 @@
 package service
 
 import (
-	"database/sql"
-	"log"
 	"time"
-)
-
-//go:generate mockery --name AnalyticsService --output mocks
 
-// URLAccess represents a URL access record
-type URLAccess struct {
-	AccessedAt  time.Time `json:"accessed_at"`
-	IPAddress   string    `json:"ip_address"`
-	UserAgent   string    `json:"user_agent"`
-	Referrer    string    `json:"referrer"`
-	CountryCode string    `json:"country_code"`
-}
+	"github.com/rusik69/shortener/internal/db"
+)
 
+// Time bucket sizes accepted by GetAnalytics
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+	IntervalWeek = "week"
+)
 
+const (
+	defaultTopValues = 10
+	maxTopValues     = 100
+	// maxBuckets bounds the length of a time series
+	maxBuckets = 1000
+)
 
-// AnalyticsService handles URL analytics
+// AnalyticsService reports how a short URL's clicks are distributed
 type AnalyticsService interface {
-	TrackURLAccess(code, ip, userAgent string) error
-	GetURLStats(code string) (URLStats, error)
-	GetAnalytics(code string, startDate, endDate time.Time) ([]URLAccess, error)
+	// GetAnalytics returns click analytics for a link. Links with an owner
+	// are only visible to that owner; viewerID is nil for anonymous callers.
+	GetAnalytics(viewerID *int64, code string, query AnalyticsQuery) (Analytics, error)
 }
 
-// analyticsService implements AnalyticsService
-type analyticsService struct {
-	db *sql.DB
+// AnalyticsQuery selects the range and granularity of a report. Zero values
+// pick defaults: daily buckets over the last 30 days, the top 10 values and
+// human clicks only.
+type AnalyticsQuery struct {
+	Interval string
+	From     time.Time
+	To       time.Time
+	Top      int
+	// IncludeBots counts clicks from crawlers and link previews too
+	IncludeBots bool
+	// Host is the request host, which selects the code namespace
+	Host string
 }
 
-// NewAnalyticsService creates a new analytics service
-func NewAnalyticsService(db *sql.DB) AnalyticsService {
-	return &analyticsService{db: db}
+// Analytics is a click report for one link
+type Analytics struct {
+	Code                string           `json:"code"`
+	Interval            string           `json:"interval"`
+	From                time.Time        `json:"from"`
+	To                  time.Time        `json:"to"`
+	TotalClicks         int64            `json:"total_clicks"`
+	LastAccess          *time.Time       `json:"last_access"`
+	Series              []db.ClickBucket `json:"series"`
+	TopReferrers        []db.ClickTally  `json:"top_referrers"`
+	TopReferrerHosts    []db.ClickTally  `json:"top_referrer_hosts"`
+	TopUserAgents       []db.ClickTally  `json:"top_user_agents"`
+	TopCountries        []db.ClickTally  `json:"top_countries"`
+	TopSources          []db.ClickTally  `json:"top_utm_sources"`
+	TopMediums          []db.ClickTally  `json:"top_utm_mediums"`
+	TopCampaigns        []db.ClickTally  `json:"top_utm_campaigns"`
+	TopBrowsers         []db.ClickTally  `json:"top_browsers"`
+	TopOperatingSystems []db.ClickTally  `json:"top_operating_systems"`
+	TopDevices          []db.ClickTally  `json:"top_devices"`
+	// TopVariants is only reported for split links
+	TopVariants []db.ClickTally `json:"top_variants,omitempty"`
+	// TopRules is only reported for links with targeting rules
+	TopRules []db.ClickTally `json:"top_rules,omitempty"`
 }
 
-// TrackURLAccess records a URL access event
-func (s *analyticsService) TrackURLAccess(code, ip, userAgent string) error {
-	_, err := s.db.Exec(
-		"INSERT INTO analytics (code, ip, user_agent, timestamp) VALUES (?, ?, ?, ?)",
-		code, ip, userAgent, time.Now(),
-	)
-	return err
-}
+func (s *service) GetAnalytics(viewerID *int64, code string, query AnalyticsQuery) (Analytics, error) {
+	if err := normalizeAnalyticsQuery(&query, time.Now()); err != nil {
+		return Analytics{}, err
+	}
+
+	shortURL, err := s.lookup(query.Host, code)
+	if err != nil {
+		return Analytics{}, err
+	}
+	if shortURL.UserID != nil && (viewerID == nil || *viewerID != *shortURL.UserID) {
+		return Analytics{}, ErrURLNotFound
+	}
 
-// GetURLStats retrieves statistics for a URL
-func (s *analyticsService) GetURLStats(code string) (URLStats, error) {
-	var stats URLStats
-	row := s.db.QueryRow(
-		"SELECT code, original_url, clicks, last_access FROM urls WHERE code = ?",
-		code,
-	)
+	clicks := db.ClickQuery{
+		ShortURLID:  shortURL.ID,
+		From:        query.From,
+		To:          query.To,
+		IncludeBots: query.IncludeBots,
+	}
+	counts, err := s.repo.CountClicksByTime(clicks, query.Interval)
+	if err != nil {
+		return Analytics{}, err
+	}
 
-	if err := row.Scan(&stats.Code, &stats.OriginalURL, &stats.Clicks, &stats.LastAccess); err != nil {
-		return URLStats{}, err
+	report := Analytics{
+		Code:     shortURL.ShortCode,
+		Interval: query.Interval,
+		From:     query.From,
+		To:       query.To,
+		Series:   fillBuckets(counts, query),
+	}
+	for _, bucket := range counts {
+		report.TotalClicks += bucket.Clicks
 	}
 
-	return stats, nil
-}
+	if report.LastAccess, err = s.repo.GetLastClickTime(shortURL.ID, query.IncludeBots); err != nil {
+		return Analytics{}, err
+	}
 
-// GetAnalytics retrieves detailed access analytics for a URL
-func (s *analyticsService) GetAnalytics(code string, startDate, endDate time.Time) ([]URLAccess, error) {
-	rows, err := s.db.Query(
-		"SELECT accessed_at, ip_address, user_agent, referrer, country_code FROM analytics WHERE code = ? AND accessed_at BETWEEN ? AND ? ORDER BY accessed_at DESC",
-		code, startDate, endDate,
-	)
-	if err != nil {
-		return nil, err
+	tops := []struct {
+		dimension db.ClickDimension
+		dest      *[]db.ClickTally
+	}{
+		{db.DimensionReferrer, &report.TopReferrers},
+		{db.DimensionReferrerHost, &report.TopReferrerHosts},
+		{db.DimensionUserAgent, &report.TopUserAgents},
+		{db.DimensionCountry, &report.TopCountries},
+		{db.DimensionUTMSource, &report.TopSources},
+		{db.DimensionUTMMedium, &report.TopMediums},
+		{db.DimensionUTMCampaign, &report.TopCampaigns},
+		{db.DimensionBrowser, &report.TopBrowsers},
+		{db.DimensionOS, &report.TopOperatingSystems},
+		{db.DimensionDevice, &report.TopDevices},
+	}
+	for _, top := range tops {
+		tallies, err := s.repo.TopClickValues(clicks, top.dimension, query.Top)
+		if err != nil {
+			return Analytics{}, err
+		}
+		if tallies == nil {
+			tallies = []db.ClickTally{}
+		}
+		*top.dest = tallies
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			log.Printf("Error closing rows: %v", err)
+	if len(shortURL.Destinations) > 0 {
+		if report.TopVariants, err = s.repo.TopClickValues(clicks, db.DimensionVariant, query.Top); err != nil {
+			return Analytics{}, err
 		}
-	}()
-
-	var accesses []URLAccess
-	for rows.Next() {
-		var access URLAccess
-		if err := rows.Scan(
-			&access.AccessedAt,
-			&access.IPAddress,
-			&access.UserAgent,
-			&access.Referrer,
-			&access.CountryCode,
-		); err != nil {
-			return nil, err
+	}
+	if len(shortURL.Rules) > 0 {
+		if report.TopRules, err = s.repo.TopClickValues(clicks, db.DimensionRule, query.Top); err != nil {
+			return Analytics{}, err
 		}
-		accesses = append(accesses, access)
 	}
 
-	return accesses, nil
+	return report, nil
+}
+
+// normalizeAnalyticsQuery fills in defaults and rejects ranges that are
+// inverted or would produce too many buckets
+func normalizeAnalyticsQuery(query *AnalyticsQuery, now time.Time) error {
+	if query.Interval == "" {
+		query.Interval = IntervalDay
+	}
+	step := bucketStep(query.Interval)
+	if step == 0 {
+		return ErrInvalidInterval
+	}
+
+	if query.To.IsZero() {
+		query.To = now
+	}
+	if query.From.IsZero() {
+		query.From = query.To.Add(-30 * 24 * time.Hour)
+		if query.Interval == IntervalHour {
+			query.From = query.To.Add(-24 * time.Hour)
+		}
+	}
+	query.From = query.From.UTC()
+	query.To = query.To.UTC()
+	if !query.From.Before(query.To) {
+		return ErrInvalidRange
+	}
+	if query.To.Sub(truncateBucket(query.From, query.Interval)) > step*maxBuckets {
+		return ErrInvalidRange
+	}
+
+	if query.Top < 1 {
+		query.Top = defaultTopValues
+	}
+	if query.Top > maxTopValues {
+		query.Top = maxTopValues
+	}
+	return nil
+}
+
+// bucketStep returns the length of a bucket, or zero for unknown intervals
+func bucketStep(interval string) time.Duration {
+	switch interval {
+	case IntervalHour:
+		return time.Hour
+	case IntervalDay:
+		return 24 * time.Hour
+	case IntervalWeek:
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+// truncateBucket mirrors Postgres date_trunc in UTC; weeks start on Monday
+func truncateBucket(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	switch interval {
+	case IntervalHour:
+		return t.Truncate(time.Hour)
+	case IntervalWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// fillBuckets expands sparse counts into a contiguous series covering the
+// query range, with zero for buckets that saw no clicks
+func fillBuckets(counts []db.ClickBucket, query AnalyticsQuery) []db.ClickBucket {
+	byStart := make(map[time.Time]int64, len(counts))
+	for _, bucket := range counts {
+		byStart[bucket.Start.UTC()] = bucket.Clicks
+	}
+
+	step := bucketStep(query.Interval)
+	series := []db.ClickBucket{}
+	for start := truncateBucket(query.From, query.Interval); start.Before(query.To); start = start.Add(step) {
+		series = append(series, db.ClickBucket{Start: start, Clicks: byStart[start]})
+	}
+	return series
 }
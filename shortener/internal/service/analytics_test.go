@@ -0,0 +1,142 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// analyticsRepository serves canned click aggregates
+type analyticsRepository struct {
+	MockRepository
+	buckets   []db.ClickBucket
+	lastClick *time.Time
+	botClicks int64
+	unit      string
+	query     db.ClickQuery
+}
+
+func (r *analyticsRepository) CountClicksByTime(query db.ClickQuery, unit string) ([]db.ClickBucket, error) {
+	r.unit = unit
+	r.query = query
+	return r.buckets, nil
+}
+
+func (r *analyticsRepository) TopClickValues(query db.ClickQuery, dimension db.ClickDimension, limit int) ([]db.ClickTally, error) {
+	if dimension == db.DimensionCountry {
+		return []db.ClickTally{{Value: "DE", Clicks: 2}}, nil
+	}
+	return nil, nil
+}
+
+func (r *analyticsRepository) GetLastClickTime(shortURLID int64, includeBots bool) (*time.Time, error) {
+	return r.lastClick, nil
+}
+
+func (r *analyticsRepository) CountBotClicks(shortURLID int64) (int64, error) {
+	return r.botClicks, nil
+}
+
+func TestGetAnalyticsFillsBuckets(t *testing.T) {
+	from := time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC)
+	last := from.Add(2 * time.Hour)
+	repo := &analyticsRepository{
+		buckets: []db.ClickBucket{
+			{Start: time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC), Clicks: 2},
+			{Start: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), Clicks: 3},
+		},
+		lastClick: &last,
+	}
+	svc := NewService(repo)
+
+	report, err := svc.GetAnalytics(nil, "abc123", AnalyticsQuery{
+		Interval: IntervalHour,
+		From:     from,
+		To:       from.Add(4 * time.Hour),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "hour", repo.unit)
+	assert.Equal(t, int64(5), report.TotalClicks)
+	assert.Equal(t, &last, report.LastAccess)
+	require.Len(t, report.Series, 5)
+	assert.Equal(t, []int64{2, 0, 3, 0, 0}, []int64{
+		report.Series[0].Clicks, report.Series[1].Clicks, report.Series[2].Clicks,
+		report.Series[3].Clicks, report.Series[4].Clicks,
+	})
+	assert.Equal(t, []db.ClickTally{{Value: "DE", Clicks: 2}}, report.TopCountries)
+	assert.NotNil(t, report.TopReferrers)
+}
+
+func TestGetAnalyticsOwnedLink(t *testing.T) {
+	owner := int64(7)
+	other := int64(8)
+	svc := NewService(&analyticsRepository{MockRepository: MockRepository{ownerID: &owner}})
+
+	_, err := svc.GetAnalytics(nil, "abc123", AnalyticsQuery{})
+	assert.Equal(t, ErrURLNotFound, err)
+	_, err = svc.GetAnalytics(&other, "abc123", AnalyticsQuery{})
+	assert.Equal(t, ErrURLNotFound, err)
+	_, err = svc.GetAnalytics(&owner, "abc123", AnalyticsQuery{})
+	assert.NoError(t, err)
+}
+
+func TestGetAnalyticsRejectsBadQueries(t *testing.T) {
+	svc := NewService(&analyticsRepository{})
+	now := time.Now()
+
+	_, err := svc.GetAnalytics(nil, "abc123", AnalyticsQuery{Interval: "minute"})
+	assert.Equal(t, ErrInvalidInterval, err)
+	_, err = svc.GetAnalytics(nil, "abc123", AnalyticsQuery{From: now, To: now.Add(-time.Hour)})
+	assert.Equal(t, ErrInvalidRange, err)
+	_, err = svc.GetAnalytics(nil, "abc123", AnalyticsQuery{Interval: IntervalHour, From: now.AddDate(-1, 0, 0), To: now})
+	assert.Equal(t, ErrInvalidRange, err)
+}
+
+func TestTruncateBucketWeekStartsMonday(t *testing.T) {
+	sunday := time.Date(2026, 3, 8, 15, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), truncateBucket(sunday, IntervalWeek))
+
+	monday := time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, monday, truncateBucket(monday, IntervalWeek))
+}
+
+func TestGetURLStatsLastAccess(t *testing.T) {
+	last := time.Now().Add(-time.Minute)
+	svc := NewService(&analyticsRepository{lastClick: &last})
+
+	stats, err := svc.GetURLStats("abc123", StatsOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, &last, stats.LastAccess)
+}
+
+func TestGetURLStatsIncludeBots(t *testing.T) {
+	svc := NewService(&analyticsRepository{botClicks: 4})
+
+	stats, err := svc.GetURLStats("abc123", StatsOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, stats.Clicks)
+	assert.Nil(t, stats.BotClicks)
+
+	stats, err = svc.GetURLStats("abc123", StatsOptions{IncludeBots: true})
+	require.NoError(t, err)
+	assert.Equal(t, 9, stats.Clicks)
+	require.NotNil(t, stats.BotClicks)
+	assert.Equal(t, int64(4), *stats.BotClicks)
+}
+
+func TestGetAnalyticsIncludeBots(t *testing.T) {
+	repo := &analyticsRepository{}
+	svc := NewService(repo)
+
+	_, err := svc.GetAnalytics(nil, "abc123", AnalyticsQuery{})
+	require.NoError(t, err)
+	assert.False(t, repo.query.IncludeBots)
+
+	_, err = svc.GetAnalytics(nil, "abc123", AnalyticsQuery{IncludeBots: true})
+	require.NoError(t, err)
+	assert.True(t, repo.query.IncludeBots)
+}
@@ -0,0 +1,376 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/urlpolicy"
+)
+
+// MaxBatchSize caps the number of links created by one batch
+const MaxBatchSize = 10000
+
+// BatchItem is one link to create in a batch
+type BatchItem struct {
+	URL        string     `json:"url"`
+	CustomCode string     `json:"custom_code,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	// ExpiresIn is a time-to-live in seconds, mutually exclusive with ExpiresAt
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	// RedirectType is 301, 302, 307 or 308; 0 uses the domain default
+	RedirectType int `json:"redirect_type,omitempty"`
+	// Destinations split visitors between several URLs by weight
+	Destinations []db.Destination `json:"destinations,omitempty"`
+	// Rules send matching visitors elsewhere
+	Rules []db.Rule `json:"rules,omitempty"`
+	// Row is the source row reported in results; 0 means the item's
+	// 1-based position in the batch
+	Row int `json:"-"`
+}
+
+// BatchOptions controls how a batch is stored
+type BatchOptions struct {
+	OwnerID *int64
+	// Atomic stores nothing unless every item succeeds
+	Atomic bool
+	// Host is the request host; see CreateOptions.Host
+	Host string
+}
+
+// BatchResult reports the outcome for one batch item. Row is 1-based and
+// refers to the array index or the CSV data row (header excluded).
+type BatchResult struct {
+	Row       int    `json:"row"`
+	URL       string `json:"url,omitempty"`
+	ShortCode string `json:"short_code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Code is set when the URL policy rejected the row
+	Code string `json:"code,omitempty"`
+}
+
+// BatchService creates many links at once
+type BatchService interface {
+	CreateShortURLBatch(items []BatchItem, opts BatchOptions) ([]BatchResult, error)
+	ImportCSV(r io.Reader, opts BatchOptions) ([]BatchResult, error)
+}
+
+// errBatchRolledBack marks valid items that were not stored because another
+// item in an atomic batch failed
+var errBatchRolledBack = errors.New("not created: batch rolled back")
+
+func (s *service) CreateShortURLBatch(items []BatchItem, opts BatchOptions) ([]BatchResult, error) {
+	if len(items) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	if len(items) > MaxBatchSize {
+		return nil, ErrBatchTooLarge
+	}
+
+	domain, err := s.DomainFor(opts.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(items))
+	errs := make([]error, len(items))
+	seen := make(map[string]int, len(items))
+	now := time.Now()
+
+	var toInsert []db.NewShortURL
+	var insertRows []int
+	for i, item := range items {
+		row := item.Row
+		if row == 0 {
+			row = i + 1
+		}
+		results[i] = BatchResult{Row: row, URL: item.URL}
+
+		newURL, err := s.prepareBatchItem(item, opts, domain, now)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if first, dup := seen[newURL.ShortCode]; dup {
+			errs[i] = fmt.Errorf("custom code duplicates row %d", first)
+			continue
+		}
+		seen[newURL.ShortCode] = row
+
+		toInsert = append(toInsert, newURL)
+		insertRows = append(insertRows, i)
+	}
+
+	failed := len(toInsert) < len(items)
+	if len(toInsert) > 0 && !(opts.Atomic && failed) {
+		insertErrs, err := s.insertBatch(toInsert, items, insertRows, opts.Atomic)
+		if err != nil {
+			return nil, err
+		}
+		var created []db.WebhookLink
+		for j, insertErr := range insertErrs {
+			if insertErr != nil {
+				errs[insertRows[j]] = insertErr
+				failed = true
+			} else {
+				results[insertRows[j]].ShortCode = toInsert[j].ShortCode
+				created = append(created, db.WebhookLink{
+					Code:        toInsert[j].ShortCode,
+					Domain:      toInsert[j].Domain,
+					OriginalURL: toInsert[j].OriginalURL,
+				})
+			}
+		}
+		// An atomic batch with failures stored nothing
+		if !(opts.Atomic && failed) {
+			s.notifyCreated(opts.OwnerID, created)
+		}
+	}
+
+	for i := range results {
+		if errs[i] == nil && opts.Atomic && failed {
+			errs[i] = errBatchRolledBack
+		}
+		if errs[i] != nil {
+			results[i].ShortCode = ""
+			results[i].Error = errs[i].Error()
+			var policyErr *urlpolicy.Error
+			if errors.As(errs[i], &policyErr) {
+				results[i].Code = policyErr.Code
+			}
+		}
+	}
+	return results, nil
+}
+
+// insertBatch stores prepared links, giving generated codes that collide
+// with existing ones a fresh code. toInsert[j] was prepared from
+// items[rows[j]]. It returns one error slot per element of toInsert.
+func (s *service) insertBatch(toInsert []db.NewShortURL, items []BatchItem, rows []int, atomic bool) ([]error, error) {
+	errs := make([]error, len(toInsert))
+	pending := make([]int, len(toInsert))
+	for j := range pending {
+		pending[j] = j
+	}
+
+	for attempt := 1; ; attempt++ {
+		batch := make([]db.NewShortURL, len(pending))
+		for k, j := range pending {
+			batch[k] = toInsert[j]
+		}
+
+		insertErrs, err := s.repo.CreateShortURLBatch(batch, atomic)
+		if err != nil {
+			return nil, err
+		}
+
+		var retry []int
+		final := false
+		for k, insertErr := range insertErrs {
+			j := pending[k]
+			errs[j] = insertErr
+			if insertErr == nil {
+				continue
+			}
+			if items[rows[j]].CustomCode != "" || attempt >= maxCodeAttempts {
+				final = true
+				continue
+			}
+			code, err := s.newCode()
+			if err != nil {
+				return nil, err
+			}
+			toInsert[j].ShortCode = code
+			retry = append(retry, j)
+		}
+
+		if len(retry) == 0 || (atomic && final) {
+			return errs, nil
+		}
+		if !atomic {
+			// Rows that succeeded are committed; only retry the collisions
+			pending = retry
+		}
+	}
+}
+
+// prepareBatchItem validates an item and assigns its short code
+func (s *service) prepareBatchItem(item BatchItem, opts BatchOptions, domain db.Domain, now time.Time) (db.NewShortURL, error) {
+	if err := s.validateURL(item.URL, opts.Host); err != nil {
+		return db.NewShortURL{}, err
+	}
+
+	expiresAt := item.ExpiresAt
+	if item.ExpiresIn != 0 {
+		if expiresAt != nil || item.ExpiresIn < 0 {
+			return db.NewShortURL{}, ErrInvalidExpiry
+		}
+		t := now.Add(time.Duration(item.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+	if expiresAt != nil && !expiresAt.After(now) {
+		return db.NewShortURL{}, ErrInvalidExpiry
+	}
+
+	redirectType, err := s.resolveRedirectType(item.RedirectType, domain)
+	if err != nil {
+		return db.NewShortURL{}, err
+	}
+
+	destinations, err := s.validateDestinations(item.Destinations, opts.Host)
+	if err != nil {
+		return db.NewShortURL{}, err
+	}
+
+	rules, err := s.validateRules(item.Rules, opts.Host)
+	if err != nil {
+		return db.NewShortURL{}, err
+	}
+
+	shortCode := s.policy.Normalize(item.CustomCode)
+	if shortCode != "" {
+		if err := s.policy.Validate(shortCode); err != nil {
+			return db.NewShortURL{}, err
+		}
+	} else {
+		code, err := s.newCode()
+		if err != nil {
+			return db.NewShortURL{}, err
+		}
+		shortCode = code
+	}
+
+	return db.NewShortURL{
+		ShortCode:    shortCode,
+		OriginalURL:  item.URL,
+		UserID:       opts.OwnerID,
+		ExpiresAt:    expiresAt,
+		RedirectType: redirectType,
+		Destinations: destinations,
+		Rules:        rules,
+		Domain:       domain.Host,
+	}, nil
+}
+
+// ImportCSV creates links from CSV with the columns url, custom_code, expiry
+// and redirect_type. The header row is optional; without it columns are
+// positional. Expiry is either an RFC 3339 timestamp or a duration such as
+// "720h".
+// Rows that cannot be parsed are reported alongside the creation results.
+// Records are read one at a time, and reading stops as soon as there are
+// more than MaxBatchSize of them.
+func (s *service) ImportCSV(r io.Reader, opts BatchOptions) ([]BatchResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var columns map[string]int
+	var records [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidCSV, err)
+		}
+
+		if columns == nil {
+			columns = map[string]int{"url": 0, "custom_code": 1, "expiry": 2, "redirect_type": 3}
+			if len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "url") {
+				columns = map[string]int{}
+				for i, name := range record {
+					columns[strings.ToLower(strings.TrimSpace(name))] = i
+				}
+				continue
+			}
+		}
+
+		if len(records) == MaxBatchSize {
+			return nil, ErrBatchTooLarge
+		}
+		records = append(records, record)
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	now := time.Now()
+	var items []BatchItem
+	var rejected []BatchResult
+	for i, record := range records {
+		item := BatchItem{
+			URL:        field(record, "url"),
+			CustomCode: field(record, "custom_code"),
+			Row:        i + 1,
+		}
+		if expiry := field(record, "expiry"); expiry != "" {
+			expiresAt, err := parseExpiry(expiry, now)
+			if err != nil {
+				rejected = append(rejected, BatchResult{Row: i + 1, URL: item.URL, Error: err.Error()})
+				continue
+			}
+			item.ExpiresAt = expiresAt
+		}
+		if redirectType := field(record, "redirect_type"); redirectType != "" {
+			status, err := strconv.Atoi(redirectType)
+			if err != nil {
+				rejected = append(rejected, BatchResult{Row: i + 1, URL: item.URL, Error: ErrInvalidRedirectType.Error()})
+				continue
+			}
+			item.RedirectType = status
+		}
+		items = append(items, item)
+	}
+
+	results := make([]BatchResult, 0, len(records))
+	if len(items) > 0 {
+		if opts.Atomic && len(rejected) > 0 {
+			for _, item := range items {
+				results = append(results, BatchResult{Row: item.Row, URL: item.URL, Error: errBatchRolledBack.Error()})
+			}
+		} else {
+			created, err := s.CreateShortURLBatch(items, opts)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, created...)
+		}
+	} else if len(rejected) == 0 {
+		return nil, ErrEmptyBatch
+	}
+
+	// Merge rejected rows back in source order
+	results = append(results, rejected...)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Row < results[j].Row
+	})
+	return results, nil
+}
+
+// parseExpiry accepts an RFC 3339 timestamp or a time-to-live duration
+func parseExpiry(value string, now time.Time) (*time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		t := now.Add(d)
+		return &t, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		t := now.Add(time.Duration(secs) * time.Second)
+		return &t, nil
+	}
+	return nil, fmt.Errorf("invalid expiry %q", value)
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchRepository treats the code "taken" as already in use
+type batchRepository struct {
+	MockRepository
+	inserted []db.NewShortURL
+	calls    int
+}
+
+func (r *batchRepository) CreateShortURLBatch(items []db.NewShortURL, atomic bool) ([]error, error) {
+	r.calls++
+	errs := make([]error, len(items))
+	for i, item := range items {
+		if item.ShortCode == "taken" {
+			errs[i] = db.ErrShortCodeTaken
+			if atomic {
+				return errs, nil
+			}
+			continue
+		}
+		r.inserted = append(r.inserted, item)
+	}
+	return errs, nil
+}
+
+func TestCreateShortURLBatchPartial(t *testing.T) {
+	repo := &batchRepository{}
+	svc := NewService(repo)
+	owner := int64(7)
+
+	results, err := svc.CreateShortURLBatch([]BatchItem{
+		{URL: "https://example.com/1"},
+		{URL: "not-a-url"},
+		{URL: "https://example.com/3", CustomCode: "promo"},
+		{URL: "https://example.com/4", CustomCode: "promo"},
+		{URL: "https://example.com/5", CustomCode: "taken"},
+		{URL: "https://example.com/6", ExpiresIn: 3600},
+		{URL: "http://192.168.0.1/"},
+	}, BatchOptions{OwnerID: &owner})
+	require.NoError(t, err)
+	require.Len(t, results, 7)
+
+	assert.Empty(t, results[0].Error)
+	assert.NotEmpty(t, results[0].ShortCode)
+	assert.Equal(t, ErrInvalidURL.Error(), results[1].Error)
+	assert.Equal(t, "promo", results[2].ShortCode)
+	assert.Contains(t, results[3].Error, "duplicates row 3")
+	assert.Equal(t, db.ErrShortCodeTaken.Error(), results[4].Error)
+	assert.Empty(t, results[4].ShortCode)
+	assert.Empty(t, results[5].Error)
+	assert.Equal(t, "private_address", results[6].Code)
+	assert.Empty(t, results[1].Code)
+
+	require.Len(t, repo.inserted, 3)
+	for _, item := range repo.inserted {
+		assert.Equal(t, &owner, item.UserID)
+	}
+	assert.NotNil(t, repo.inserted[2].ExpiresAt)
+}
+
+func TestCreateShortURLBatchAtomic(t *testing.T) {
+	repo := &batchRepository{}
+	svc := NewService(repo)
+
+	results, err := svc.CreateShortURLBatch([]BatchItem{
+		{URL: "https://example.com/1"},
+		{URL: "not-a-url"},
+	}, BatchOptions{Atomic: true})
+	require.NoError(t, err)
+
+	// Invalid rows stop the batch before it reaches the database
+	assert.Equal(t, 0, repo.calls)
+	assert.Equal(t, errBatchRolledBack.Error(), results[0].Error)
+	assert.Equal(t, ErrInvalidURL.Error(), results[1].Error)
+
+	results, err = svc.CreateShortURLBatch([]BatchItem{
+		{URL: "https://example.com/1"},
+		{URL: "https://example.com/2", CustomCode: "taken"},
+	}, BatchOptions{Atomic: true})
+	require.NoError(t, err)
+	assert.Equal(t, errBatchRolledBack.Error(), results[0].Error)
+	assert.Equal(t, db.ErrShortCodeTaken.Error(), results[1].Error)
+}
+
+func TestCreateShortURLBatchLimits(t *testing.T) {
+	svc := NewService(&batchRepository{})
+
+	_, err := svc.CreateShortURLBatch(nil, BatchOptions{})
+	assert.Equal(t, ErrEmptyBatch, err)
+
+	_, err = svc.CreateShortURLBatch(make([]BatchItem, MaxBatchSize+1), BatchOptions{})
+	assert.Equal(t, ErrBatchTooLarge, err)
+}
+
+func TestImportCSV(t *testing.T) {
+	repo := &batchRepository{}
+	svc := NewService(repo)
+
+	csv := strings.Join([]string{
+		"url,expiry,custom_code",
+		"https://example.com/a,,shoe-a",
+		"https://example.com/b,soon,shoe-b",
+		"https://example.com/c,720h,",
+		"https://example.com/d,2099-01-01T00:00:00Z,shoe-d",
+	}, "\n")
+
+	results, err := svc.ImportCSV(strings.NewReader(csv), BatchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+
+	for i, result := range results {
+		assert.Equal(t, i+1, result.Row)
+	}
+	assert.Equal(t, "shoe-a", results[0].ShortCode)
+	assert.Contains(t, results[1].Error, "invalid expiry")
+	assert.Empty(t, results[2].Error)
+	assert.Equal(t, "shoe-d", results[3].ShortCode)
+
+	require.Len(t, repo.inserted, 3)
+	assert.WithinDuration(t, time.Now().Add(720*time.Hour), *repo.inserted[1].ExpiresAt, time.Minute)
+}
+
+func TestImportCSVPositionalAtomic(t *testing.T) {
+	repo := &batchRepository{}
+	svc := NewService(repo)
+
+	csv := "https://example.com/a,shoe-a\nhttps://example.com/b,shoe-b,never\n"
+
+	results, err := svc.ImportCSV(strings.NewReader(csv), BatchOptions{Atomic: true})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, errBatchRolledBack.Error(), results[0].Error)
+	assert.Contains(t, results[1].Error, "invalid expiry")
+	assert.Equal(t, 0, repo.calls)
+}
+
+func TestImportCSVDuplicateReportsSourceRow(t *testing.T) {
+	svc := NewService(&batchRepository{})
+
+	csv := strings.Join([]string{
+		"url,expiry,custom_code",
+		"https://example.com/a,soon,",
+		"https://example.com/b,,promo",
+		"https://example.com/c,,promo",
+	}, "\n")
+
+	results, err := svc.ImportCSV(strings.NewReader(csv), BatchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	// The rejected first row does not shift the row numbers
+	assert.Equal(t, 3, results[2].Row)
+	assert.Contains(t, results[2].Error, "duplicates row 2")
+}
+
+func TestImportCSVTooLarge(t *testing.T) {
+	svc := NewService(&batchRepository{})
+
+	csv := "url\n" + strings.Repeat("https://example.com/\n", MaxBatchSize)
+	_, err := svc.ImportCSV(strings.NewReader(csv), BatchOptions{})
+	assert.NotEqual(t, ErrBatchTooLarge, err)
+
+	csv += "https://example.com/\n"
+	_, err = svc.ImportCSV(strings.NewReader(csv), BatchOptions{})
+	assert.Equal(t, ErrBatchTooLarge, err)
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/shortcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sequenceGenerator returns the given codes in order
+type sequenceGenerator struct {
+	codes []string
+}
+
+func (g *sequenceGenerator) Generate() (string, error) {
+	code := g.codes[0]
+	g.codes = g.codes[1:]
+	return code, nil
+}
+
+// collidingRepository rejects the code "taken" like a unique constraint
+type collidingRepository struct {
+	MockRepository
+	created []string
+}
+
+func (r *collidingRepository) CreateShortURL(item db.NewShortURL) (*db.ShortURL, error) {
+	if item.ShortCode == "taken" {
+		return nil, &pgconn.PgError{Code: "23505"}
+	}
+	r.created = append(r.created, item.ShortCode)
+	return r.MockRepository.CreateShortURL(item)
+}
+
+func TestCreateShortURLRetriesCollisions(t *testing.T) {
+	repo := &collidingRepository{}
+	svc := NewService(repo, WithCodeGenerator(&sequenceGenerator{codes: []string{"taken", "taken", "fresh"}}))
+
+	code, err := svc.CreateShortURL("https://example.com", "", CreateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "fresh", code)
+	assert.Equal(t, []string{"fresh"}, repo.created)
+}
+
+func TestCreateShortURLGivesUpAfterCollisions(t *testing.T) {
+	codes := make([]string, maxCodeAttempts)
+	for i := range codes {
+		codes[i] = "taken"
+	}
+	svc := NewService(&collidingRepository{}, WithCodeGenerator(&sequenceGenerator{codes: codes}))
+
+	_, err := svc.CreateShortURL("https://example.com", "", CreateOptions{})
+	assert.Equal(t, ErrCodeSpaceExhausted, err)
+}
+
+func TestCreateShortURLCustomCodeTaken(t *testing.T) {
+	svc := NewService(&collidingRepository{})
+
+	_, err := svc.CreateShortURL("https://example.com", "taken", CreateOptions{})
+	assert.Equal(t, ErrCodeTaken, err)
+}
+
+func TestCreateShortURLBatchRetriesGeneratedCollisions(t *testing.T) {
+	repo := &batchRepository{}
+	svc := NewService(repo, WithCodeGenerator(&sequenceGenerator{codes: []string{"gen1", "taken", "gen2"}}))
+
+	results, err := svc.CreateShortURLBatch([]BatchItem{
+		{URL: "https://example.com/1"},
+		{URL: "https://example.com/2"},
+	}, BatchOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "gen1", results[0].ShortCode)
+	assert.Equal(t, "gen2", results[1].ShortCode)
+	assert.Empty(t, results[1].Error)
+	assert.Equal(t, 2, repo.calls)
+}
+
+func TestCreateShortURLRejectsInvalidCustomCode(t *testing.T) {
+	svc := NewService(&collidingRepository{}, WithCodePolicy(shortcode.NewPolicy(shortcode.PolicyConfig{
+		Blocklist: []string{"damn"},
+	})))
+
+	for _, code := range []string{"api", "ab", "has space", "ohdamnit"} {
+		_, err := svc.CreateShortURL("https://example.com", code, CreateOptions{})
+		assert.ErrorIs(t, err, shortcode.ErrInvalidCode, code)
+	}
+}
+
+func TestCreateShortURLCaseInsensitiveCode(t *testing.T) {
+	repo := &collidingRepository{}
+	svc := NewService(repo, WithCodePolicy(shortcode.NewPolicy(shortcode.PolicyConfig{CaseInsensitive: true})))
+
+	code, err := svc.CreateShortURL("https://example.com", "Promo", CreateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "promo", code)
+	assert.Equal(t, []string{"promo"}, repo.created)
+}
+
+func TestCreateShortURLSkipsBlockedGeneratedCodes(t *testing.T) {
+	repo := &collidingRepository{}
+	svc := NewService(repo,
+		WithCodeGenerator(&sequenceGenerator{codes: []string{"xdamnx", "clean"}}),
+		WithCodePolicy(shortcode.NewPolicy(shortcode.PolicyConfig{Blocklist: []string{"damn"}})),
+	)
+
+	code, err := svc.CreateShortURL("https://example.com", "", CreateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "clean", code)
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/rusik69/shortener/internal/db"
+)
+
+// maxHostLength is the longest DNS name
+const maxHostLength = 253
+
+// DomainService manages the hosts that have their own code namespace. Each
+// link is addressed by the host it was created on; hosts that are not
+// configured share the default namespace.
+type DomainService interface {
+	// DomainFor returns the settings of the domain serving host. Hosts that
+	// are not configured get the default domain, whose Host is empty.
+	DomainFor(host string) (db.Domain, error)
+	// SetDomain adds a domain or replaces the settings of an existing one
+	SetDomain(domain db.Domain) (*db.Domain, error)
+	ListDomains() ([]db.Domain, error)
+	RemoveDomain(host string) error
+}
+
+// normalizeHost lowercases host and strips the port and any trailing dot,
+// so "Go.Brand-A.com:443" and "go.brand-a.com" are the same domain
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// validHost reports whether host looks like a DNS name or IP address
+func validHost(host string) bool {
+	if host == "" || len(host) > maxHostLength {
+		return false
+	}
+	for _, r := range host {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '.' && r != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *service) DomainFor(host string) (db.Domain, error) {
+	host = normalizeHost(host)
+	if host == "" {
+		return db.Domain{}, nil
+	}
+	domain, err := s.repo.GetDomain(host)
+	if errors.Is(err, sql.ErrNoRows) {
+		return db.Domain{}, nil
+	}
+	if err != nil {
+		return db.Domain{}, err
+	}
+	return *domain, nil
+}
+
+// namespace returns the host whose codes a request for host addresses: the
+// configured domain, or "" for the default namespace
+func (s *service) namespace(host string) (string, error) {
+	domain, err := s.DomainFor(host)
+	return domain.Host, err
+}
+
+func (s *service) SetDomain(domain db.Domain) (*db.Domain, error) {
+	domain.Host = normalizeHost(domain.Host)
+	if !validHost(domain.Host) {
+		return nil, ErrInvalidDomain
+	}
+	if domain.RedirectType != 0 && !ValidRedirectType(domain.RedirectType) {
+		return nil, ErrInvalidRedirectType
+	}
+	for _, rawURL := range []string{domain.NotFoundURL, domain.RootURL} {
+		if rawURL != "" && !isValidURL(rawURL) {
+			return nil, ErrInvalidURL
+		}
+	}
+	return s.repo.SaveDomain(domain)
+}
+
+func (s *service) ListDomains() ([]db.Domain, error) {
+	return s.repo.ListDomains()
+}
+
+func (s *service) RemoveDomain(host string) error {
+	err := s.repo.DeleteDomain(normalizeHost(host))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDomainNotFound
+	}
+	if db.IsForeignKeyViolation(err) {
+		return ErrDomainInUse
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/urlpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"go.brand-a.com":      "go.brand-a.com",
+		"Go.Brand-A.com:8443": "go.brand-a.com",
+		"brand-b.link.":       "brand-b.link",
+		" brand-b.link ":      "brand-b.link",
+		"[2001:db8::1]:8080":  "2001:db8::1",
+		"localhost:8080":      "localhost",
+		"":                    "",
+	}
+	for host, want := range tests {
+		assert.Equal(t, want, normalizeHost(host), host)
+	}
+}
+
+func TestSetDomain(t *testing.T) {
+	repo := &MockRepository{}
+	svc := NewService(repo)
+
+	domain, err := svc.SetDomain(db.Domain{Host: "Go.Brand-A.com", RedirectType: http.StatusMovedPermanently, RootURL: "https://brand-a.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "go.brand-a.com", domain.Host)
+	assert.Contains(t, repo.domains, "go.brand-a.com")
+
+	_, err = svc.SetDomain(db.Domain{Host: ""})
+	assert.Equal(t, ErrInvalidDomain, err)
+	_, err = svc.SetDomain(db.Domain{Host: "brand/a"})
+	assert.Equal(t, ErrInvalidDomain, err)
+	_, err = svc.SetDomain(db.Domain{Host: "brand.example", RedirectType: http.StatusOK})
+	assert.Equal(t, ErrInvalidRedirectType, err)
+	_, err = svc.SetDomain(db.Domain{Host: "brand.example", NotFoundURL: "not a url"})
+	assert.Equal(t, ErrInvalidURL, err)
+}
+
+func TestRemoveDomain(t *testing.T) {
+	repo := &MockRepository{domains: map[string]db.Domain{"brand.example": {Host: "brand.example"}}}
+	svc := NewService(repo)
+
+	require.NoError(t, svc.RemoveDomain("Brand.Example"))
+	assert.Empty(t, repo.domains)
+	assert.Equal(t, ErrDomainNotFound, svc.RemoveDomain("brand.example"))
+}
+
+func TestDomainForUnknownHost(t *testing.T) {
+	svc := NewService(&MockRepository{domains: map[string]db.Domain{"brand.example": {Host: "brand.example"}}})
+
+	domain, err := svc.DomainFor("brand.example:443")
+	require.NoError(t, err)
+	assert.Equal(t, "brand.example", domain.Host)
+
+	domain, err = svc.DomainFor("other.example")
+	require.NoError(t, err)
+	assert.Equal(t, db.Domain{}, domain)
+}
+
+func TestCreateShortURLOnDomain(t *testing.T) {
+	repo := &MockRepository{domains: map[string]db.Domain{
+		"brand.example": {Host: "brand.example", RedirectType: http.StatusMovedPermanently},
+	}}
+	svc := NewService(repo)
+
+	_, err := svc.CreateShortURL("https://example.com", "", CreateOptions{Host: "Brand.Example:8080"})
+	require.NoError(t, err)
+	_, err = svc.CreateShortURL("https://example.com", "", CreateOptions{Host: "brand.example", RedirectType: http.StatusTemporaryRedirect})
+	require.NoError(t, err)
+	_, err = svc.CreateShortURL("https://example.com", "", CreateOptions{Host: "other.example"})
+	require.NoError(t, err)
+
+	require.Len(t, repo.created, 3)
+	assert.Equal(t, "brand.example", repo.created[0].Domain)
+	assert.Equal(t, http.StatusMovedPermanently, repo.created[0].RedirectType)
+	assert.Equal(t, http.StatusTemporaryRedirect, repo.created[1].RedirectType)
+	assert.Equal(t, "", repo.created[2].Domain)
+	assert.Equal(t, DefaultRedirectType, repo.created[2].RedirectType)
+}
+
+func TestLookupUsesDomainNamespace(t *testing.T) {
+	svc := NewService(&MockRepository{domains: map[string]db.Domain{"brand.example": {Host: "brand.example"}}})
+
+	stats, err := svc.GetURLStats("abc12345", StatsOptions{Host: "brand.example"})
+	require.NoError(t, err)
+	assert.Equal(t, "brand.example", stats.Domain)
+
+	stats, err = svc.GetURLStats("abc12345", StatsOptions{Host: "other.example"})
+	require.NoError(t, err)
+	assert.Equal(t, "", stats.Domain)
+}
+
+func TestCreateShortURLBatchOnDomain(t *testing.T) {
+	repo := &batchRepository{}
+	repo.domains = map[string]db.Domain{"brand.example": {Host: "brand.example", RedirectType: http.StatusPermanentRedirect}}
+	svc := NewService(repo)
+
+	_, err := svc.CreateShortURLBatch([]BatchItem{{URL: "https://example.com/a"}}, BatchOptions{Host: "brand.example"})
+	require.NoError(t, err)
+	require.Len(t, repo.inserted, 1)
+	assert.Equal(t, "brand.example", repo.inserted[0].Domain)
+	assert.Equal(t, http.StatusPermanentRedirect, repo.inserted[0].RedirectType)
+}
+
+func TestConfiguredDomainsAreSelfHosts(t *testing.T) {
+	svc := NewService(&MockRepository{domains: map[string]db.Domain{
+		"go.brand-a.com": {Host: "go.brand-a.com"},
+		"brand-b.link":   {Host: "brand-b.link"},
+	}})
+
+	// go.brand-a.com/x -> brand-b.link/y -> go.brand-a.com/x would loop
+	_, err := svc.CreateShortURL("https://Go.Brand-A.com/x", "", CreateOptions{Host: "brand-b.link"})
+	assert.ErrorIs(t, err, urlpolicy.ErrSelfReference)
+	_, err = svc.CreateShortURL("https://brand-b.link/y", "", CreateOptions{Host: "go.brand-a.com"})
+	assert.ErrorIs(t, err, urlpolicy.ErrSelfReference)
+
+	_, err = svc.CreateShortURL("https://brand-c.example/", "", CreateOptions{Host: "go.brand-a.com"})
+	assert.NoError(t, err)
+}
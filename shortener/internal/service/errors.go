@@ -2,4 +2,44 @@ package service
 
 import "errors"
 
-var ErrInvalidURL = errors.New("invalid URL")
+var (
+	ErrInvalidURL    = errors.New("invalid URL")
+	ErrInvalidExpiry = errors.New("expiry must be in the future")
+	ErrURLNotFound   = errors.New("short URL not found")
+	ErrURLExpired    = errors.New("short URL has expired")
+	ErrURLDisabled   = errors.New("short URL is disabled")
+
+	ErrInvalidRedirectType = errors.New("redirect type must be 301, 302, 307 or 308")
+	ErrInvalidDestinations = errors.New("invalid split destinations")
+	ErrInvalidRules        = errors.New("invalid targeting rules")
+
+	ErrPasswordRequired    = errors.New("short URL is password protected")
+	ErrWrongPassword       = errors.New("incorrect password")
+	ErrInvalidLinkPassword = errors.New("link password must be 4-72 bytes")
+
+	ErrCodeTaken          = errors.New("custom code already exists")
+	ErrCodeSpaceExhausted = errors.New("could not generate a unique short code")
+
+	ErrInvalidUsername    = errors.New("username must be 3-64 letters, digits, '.', '_' or '-'")
+	ErrWeakPassword       = errors.New("password must be 8-72 bytes")
+	ErrUsernameTaken      = errors.New("username already taken")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidAPIKey      = errors.New("invalid API key")
+	ErrAPIKeyNotFound     = errors.New("API key not found")
+
+	ErrEmptyBatch    = errors.New("batch contains no links")
+	ErrBatchTooLarge = errors.New("batch exceeds the maximum number of links")
+	ErrInvalidCSV    = errors.New("invalid CSV")
+
+	ErrInvalidDomain  = errors.New("invalid domain host")
+	ErrDomainNotFound = errors.New("domain not found")
+	ErrDomainInUse    = errors.New("domain still has short URLs")
+
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+	ErrWebhookNotFound = errors.New("webhook not found")
+
+	ErrInvalidInterval = errors.New("interval must be hour, day or week")
+	ErrInvalidRange    = errors.New("invalid or too large time range")
+
+	ErrInvalidExport = errors.New("invalid export")
+)
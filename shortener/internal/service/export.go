@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/export"
+)
+
+// Datasets accepted by Export
+const (
+	DatasetLinks  = "links"
+	DatasetClicks = "clicks"
+)
+
+// ExportOptions selects what Export writes. Zero values pick defaults:
+// clicks as uncompressed CSV, from the beginning until now, humans only.
+type ExportOptions struct {
+	Dataset string
+	Format  export.Format
+	// Gzip compresses the file; Parquet compresses its pages instead
+	Gzip bool
+	// From and To bound the creation time of the rows to [From, To)
+	From time.Time
+	To   time.Time
+	// IncludeBots exports clicks from crawlers and link previews too
+	IncludeBots bool
+}
+
+// ExportService streams raw links and clicks for analysis elsewhere
+type ExportService interface {
+	// Export writes the owner's links or clicks to w; a nil ownerID
+	// exports every owner's. Options are checked before anything is
+	// written, so an error with no output means the options were invalid.
+	Export(ctx context.Context, ownerID *int64, opts ExportOptions, w io.Writer) error
+}
+
+func (s *service) Export(ctx context.Context, ownerID *int64, opts ExportOptions, w io.Writer) error {
+	if opts.Dataset == "" {
+		opts.Dataset = DatasetClicks
+	}
+	if opts.Dataset != DatasetLinks && opts.Dataset != DatasetClicks {
+		return fmt.Errorf("%w: dataset must be %s or %s", ErrInvalidExport, DatasetLinks, DatasetClicks)
+	}
+	format, err := export.ParseFormat(string(opts.Format))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	if opts.To.IsZero() {
+		opts.To = time.Now()
+	}
+	if !opts.From.Before(opts.To) {
+		return ErrInvalidRange
+	}
+
+	query := db.ExportQuery{UserID: ownerID, From: opts.From.UTC(), To: opts.To.UTC(), IncludeBots: opts.IncludeBots}
+	if opts.Dataset == DatasetLinks {
+		return exportRows(w, format, opts.Gzip, func(fn func(db.ExportedLink) error) error {
+			return s.repo.ExportLinks(ctx, query, fn)
+		})
+	}
+	return exportRows(w, format, opts.Gzip, func(fn func(db.ExportedClick) error) error {
+		return s.repo.ExportClicks(ctx, query, fn)
+	})
+}
+
+// exportRows encodes the rows that stream passes to its callback
+func exportRows[T any](w io.Writer, format export.Format, compress bool, stream func(func(T) error) error) error {
+	writer, err := export.NewWriter[T](w, format, compress)
+	if err != nil {
+		return err
+	}
+	if err := stream(writer.Write); err != nil {
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/export"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportClicks(t *testing.T) {
+	created := time.Date(2026, 5, 1, 8, 0, 0, 0, time.UTC)
+	repo := &MockRepository{exportedClicks: []db.ExportedClick{
+		{ID: 1, CreatedAt: created, ShortURLID: 7, ShortCode: "abc12345", Country: "DE"},
+		{ID: 2, CreatedAt: created, ShortURLID: 7, ShortCode: "abc12345", Browser: "Firefox"},
+	}}
+	svc := NewService(repo)
+
+	var buf bytes.Buffer
+	ownerID := int64(3)
+	require.NoError(t, svc.Export(context.Background(), &ownerID, ExportOptions{Format: export.NDJSON}, &buf))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"country":"DE"`)
+	assert.Contains(t, lines[1], `"browser":"Firefox"`)
+
+	// Defaults: everything up to now, humans only, for the owner
+	require.NotNil(t, repo.exportQuery.UserID)
+	assert.Equal(t, ownerID, *repo.exportQuery.UserID)
+	assert.True(t, repo.exportQuery.From.IsZero())
+	assert.WithinDuration(t, time.Now(), repo.exportQuery.To, 5*time.Second)
+	assert.False(t, repo.exportQuery.IncludeBots)
+}
+
+func TestExportLinksCSVHeader(t *testing.T) {
+	svc := NewService(&MockRepository{})
+
+	var buf bytes.Buffer
+	require.NoError(t, svc.Export(context.Background(), nil, ExportOptions{Dataset: DatasetLinks}, &buf))
+	assert.True(t, strings.HasPrefix(buf.String(), "id,short_code,domain,original_url,"))
+}
+
+func TestExportInvalid(t *testing.T) {
+	svc := NewService(&MockRepository{})
+	now := time.Now()
+
+	for _, opts := range []ExportOptions{
+		{Dataset: "users"},
+		{Format: "xlsx"},
+	} {
+		var buf bytes.Buffer
+		assert.ErrorIs(t, svc.Export(context.Background(), nil, opts, &buf), ErrInvalidExport)
+		assert.Zero(t, buf.Len())
+	}
+
+	var buf bytes.Buffer
+	err := svc.Export(context.Background(), nil, ExportOptions{From: now, To: now.Add(-time.Hour)}, &buf)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	assert.Zero(t, buf.Len())
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/rusik69/shortener/internal/db"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// LinkService lets owners manage the short URLs they created. ListLinks
+// covers every domain; the other methods address a code in the namespace of
+// the domain serving host.
+type LinkService interface {
+	ListLinks(ownerID int64, query LinkQuery) (LinkPage, error)
+	GetLink(ownerID int64, host, code string) (*db.ShortURL, error)
+	UpdateLink(ownerID int64, host, code string, update LinkUpdate) (*db.ShortURL, error)
+	DeleteLink(ownerID int64, host, code string) error
+}
+
+// LinkQuery selects a page of an owner's links
+type LinkQuery struct {
+	Search  string
+	Page    int
+	PerPage int
+}
+
+// LinkPage is one page of an owner's links
+type LinkPage struct {
+	Links   []db.ShortURL `json:"links"`
+	Total   int64         `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+}
+
+// LinkUpdate holds the link fields to change; nil fields are left untouched
+type LinkUpdate struct {
+	OriginalURL  *string `json:"original_url,omitempty"`
+	Enabled      *bool   `json:"enabled,omitempty"`
+	RedirectType *int    `json:"redirect_type,omitempty"`
+	// Destinations replaces the split; an empty list turns it off
+	Destinations *[]db.Destination `json:"destinations,omitempty"`
+	// Rules replaces the targeting rules; an empty list removes them
+	Rules *[]db.Rule `json:"rules,omitempty"`
+}
+
+func (s *service) ListLinks(ownerID int64, query LinkQuery) (LinkPage, error) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PerPage < 1 {
+		query.PerPage = defaultPerPage
+	}
+	if query.PerPage > maxPerPage {
+		query.PerPage = maxPerPage
+	}
+
+	links, total, err := s.repo.ListShortURLs(db.ShortURLFilter{
+		UserID: ownerID,
+		Search: query.Search,
+		Limit:  query.PerPage,
+		Offset: (query.Page - 1) * query.PerPage,
+	})
+	if err != nil {
+		return LinkPage{}, err
+	}
+
+	return LinkPage{
+		Links:   links,
+		Total:   total,
+		Page:    query.Page,
+		PerPage: query.PerPage,
+	}, nil
+}
+
+func (s *service) GetLink(ownerID int64, host, code string) (*db.ShortURL, error) {
+	shortURL, err := s.lookup(host, code)
+	if err != nil {
+		return nil, err
+	}
+	// Links owned by someone else are reported as missing
+	if shortURL.UserID == nil || *shortURL.UserID != ownerID {
+		return nil, ErrURLNotFound
+	}
+	return shortURL, nil
+}
+
+func (s *service) UpdateLink(ownerID int64, host, code string, update LinkUpdate) (*db.ShortURL, error) {
+	if update.OriginalURL != nil {
+		if err := s.validateURL(*update.OriginalURL, host); err != nil {
+			return nil, err
+		}
+	}
+
+	if update.RedirectType != nil && !ValidRedirectType(*update.RedirectType) {
+		return nil, ErrInvalidRedirectType
+	}
+
+	var destinations *db.Destinations
+	if update.Destinations != nil {
+		split, err := s.validateDestinations(*update.Destinations, host)
+		if err != nil {
+			return nil, err
+		}
+		destinations = &split
+	}
+	var rules *db.Rules
+	if update.Rules != nil {
+		validated, err := s.validateRules(*update.Rules, host)
+		if err != nil {
+			return nil, err
+		}
+		rules = &validated
+	}
+
+	existing, err := s.GetLink(ownerID, host, code)
+	if err != nil {
+		return nil, err
+	}
+
+	shortURL, err := s.repo.UpdateShortURL(ownerID, existing.Domain, existing.ShortCode, db.ShortURLUpdate{
+		OriginalURL:  update.OriginalURL,
+		Enabled:      update.Enabled,
+		RedirectType: update.RedirectType,
+		Destinations: destinations,
+		Rules:        rules,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrURLNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return shortURL, nil
+}
+
+func (s *service) DeleteLink(ownerID int64, host, code string) error {
+	existing, err := s.GetLink(ownerID, host, code)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.DeleteShortURL(ownerID, existing.Domain, existing.ShortCode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrURLNotFound
+	}
+	return err
+}
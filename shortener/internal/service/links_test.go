@@ -0,0 +1,66 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/rusik69/shortener/internal/urlpolicy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListLinksClampsPaging(t *testing.T) {
+	mockRepo := &MockRepository{}
+	svc := NewService(mockRepo)
+
+	page, err := svc.ListLinks(7, LinkQuery{Search: "promo", Page: 3, PerPage: 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, page.Page)
+	assert.Equal(t, maxPerPage, page.PerPage)
+	assert.Equal(t, int64(7), mockRepo.filter.UserID)
+	assert.Equal(t, "promo", mockRepo.filter.Search)
+	assert.Equal(t, maxPerPage, mockRepo.filter.Limit)
+	assert.Equal(t, 2*maxPerPage, mockRepo.filter.Offset)
+
+	page, err = svc.ListLinks(7, LinkQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, page.Page)
+	assert.Equal(t, defaultPerPage, page.PerPage)
+	assert.Equal(t, 0, mockRepo.filter.Offset)
+}
+
+func TestGetLinkOwnership(t *testing.T) {
+	owner := int64(7)
+	svc := NewService(&MockRepository{ownerID: &owner})
+
+	link, err := svc.GetLink(7, "", "abc12345")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc12345", link.ShortCode)
+
+	_, err = svc.GetLink(8, "", "abc12345")
+	assert.Equal(t, ErrURLNotFound, err)
+
+	// Anonymous links have no owner to manage them
+	_, err = NewService(&MockRepository{}).GetLink(7, "", "abc12345")
+	assert.Equal(t, ErrURLNotFound, err)
+}
+
+func TestUpdateLink(t *testing.T) {
+	svc := NewService(&MockRepository{})
+
+	invalid := "not-a-url"
+	_, err := svc.UpdateLink(7, "", "abc12345", LinkUpdate{OriginalURL: &invalid})
+	assert.Equal(t, ErrInvalidURL, err)
+
+	private := "http://127.0.0.1/"
+	_, err = svc.UpdateLink(7, "", "abc12345", LinkUpdate{OriginalURL: &private})
+	assert.ErrorIs(t, err, urlpolicy.ErrPrivateAddress)
+
+	valid := "https://example.org"
+	_, err = svc.UpdateLink(7, "", "missing", LinkUpdate{OriginalURL: &valid})
+	assert.Equal(t, ErrURLNotFound, err)
+}
+
+func TestDeleteLinkNotFound(t *testing.T) {
+	svc := NewService(&MockRepository{})
+
+	assert.Equal(t, ErrURLNotFound, svc.DeleteLink(7, "", "missing"))
+}
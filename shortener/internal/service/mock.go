@@ -19,7 +19,7 @@ func NewMockService() *MockService {
 	}
 }
 
-func (m *MockService) CreateShortURL(originalURL, customCode string) (string, error) {
+func (m *MockService) CreateShortURL(originalURL, customCode string, opts CreateOptions) (string, error) {
 	if originalURL == "" || !strings.HasPrefix(originalURL, "http") {
 		return "", ErrInvalidURL
 	}
@@ -39,28 +39,33 @@ func (m *MockService) CreateShortURL(originalURL, customCode string) (string, er
 		Code:        code,
 		OriginalURL: originalURL,
 		Clicks:      0,
-		LastAccess:  time.Now(),
+		ExpiresAt:   opts.ExpiresAt,
+		Enabled:     true,
 	}
 	return code, nil
 }
 
-func (m *MockService) GetURLStats(code string) (URLStats, error) {
+func (m *MockService) GetURLStats(code string, opts StatsOptions) (URLStats, error) {
 	if stats, exists := m.stats[code]; exists {
 		return stats, nil
 	}
-	return URLStats{}, errors.New("URL not found")
+	return URLStats{}, ErrURLNotFound
 }
 
-func (m *MockService) RedirectURL(code, ip, userAgent string) (string, error) {
+func (m *MockService) RedirectURL(code string, visit Visit) (Redirect, error) {
 	if originalURL, exists := m.urls[code]; exists {
 		if stats, exists := m.stats[code]; exists {
+			if stats.ExpiresAt != nil && !time.Now().Before(*stats.ExpiresAt) {
+				return Redirect{}, ErrURLExpired
+			}
 			stats.Clicks++
-			stats.LastAccess = time.Now()
+			now := time.Now()
+			stats.LastAccess = &now
 			m.stats[code] = stats
 		}
-		return originalURL, nil
+		return Redirect{URL: originalURL, Status: DefaultRedirectType}, nil
 	}
-	return "", errors.New("URL not found")
+	return Redirect{}, ErrURLNotFound
 }
 
 
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+)
+
+// DefaultRedirectType is used for new links that do not choose one. A
+// temporary redirect keeps every visit coming back to the shortener, so
+// clicks are counted and the destination can still be changed.
+const DefaultRedirectType = http.StatusFound
+
+// Redirect is where a short URL sends a visitor
+type Redirect struct {
+	URL string
+	// Status is 301, 302, 307 or 308
+	Status int
+	// ExpiresAt is when the link stops redirecting; nil means never
+	ExpiresAt *time.Time
+	// Variant is the label of the destination a split link chose
+	Variant string
+}
+
+// Permanent reports whether clients may cache the redirect
+func (r Redirect) Permanent() bool {
+	return r.Status == http.StatusMovedPermanently || r.Status == http.StatusPermanentRedirect
+}
+
+// ValidRedirectType reports whether status is a redirect type links may use
+func ValidRedirectType(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// WithDefaultRedirectType sets the redirect type for links created without
+// one. Invalid types are ignored.
+func WithDefaultRedirectType(status int) Option {
+	return func(s *service) {
+		if ValidRedirectType(status) {
+			s.redirectType = status
+		}
+	}
+}
+
+// resolveRedirectType returns the type a new link on domain should store;
+// 0 picks the domain's default, or the service default if it has none
+func (s *service) resolveRedirectType(status int, domain db.Domain) (int, error) {
+	if status == 0 {
+		if domain.RedirectType != 0 {
+			return domain.RedirectType, nil
+		}
+		return s.redirectType, nil
+	}
+	if !ValidRedirectType(status) {
+		return 0, ErrInvalidRedirectType
+	}
+	return status, nil
+}
+
+// temporaryRedirect returns the non-cacheable status with the same method
+// semantics as status
+func temporaryRedirect(status int) int {
+	switch status {
+	case http.StatusMovedPermanently:
+		return http.StatusFound
+	case http.StatusPermanentRedirect:
+		return http.StatusTemporaryRedirect
+	}
+	return status
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateShortURLRedirectType(t *testing.T) {
+	repo := &MockRepository{}
+	svc := NewService(repo)
+
+	_, err := svc.CreateShortURL("https://example.com", "", CreateOptions{})
+	require.NoError(t, err)
+	_, err = svc.CreateShortURL("https://example.com", "", CreateOptions{RedirectType: http.StatusPermanentRedirect})
+	require.NoError(t, err)
+	require.Len(t, repo.created, 2)
+	assert.Equal(t, DefaultRedirectType, repo.created[0].RedirectType)
+	assert.Equal(t, http.StatusPermanentRedirect, repo.created[1].RedirectType)
+
+	for _, status := range []int{200, 303, 304, -1} {
+		_, err = svc.CreateShortURL("https://example.com", "", CreateOptions{RedirectType: status})
+		assert.Equal(t, ErrInvalidRedirectType, err, status)
+	}
+	assert.Len(t, repo.created, 2)
+}
+
+func TestDefaultRedirectTypeOption(t *testing.T) {
+	repo := &MockRepository{}
+	_, err := NewService(repo, WithDefaultRedirectType(http.StatusMovedPermanently)).CreateShortURL("https://example.com", "", CreateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMovedPermanently, repo.created[0].RedirectType)
+
+	// Invalid defaults are ignored
+	_, err = NewService(repo, WithDefaultRedirectType(http.StatusOK)).CreateShortURL("https://example.com", "", CreateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRedirectType, repo.created[1].RedirectType)
+}
+
+func TestRedirectURLStatus(t *testing.T) {
+	for _, status := range []int{301, 302, 307, 308} {
+		svc := NewService(&MockRepository{redirectType: status})
+
+		redirect, err := svc.RedirectURL("abc12345", Visit{IP: "192.168.1.1"})
+		require.NoError(t, err)
+		assert.Equal(t, status, redirect.Status)
+		assert.Equal(t, status == 301 || status == 308, redirect.Permanent())
+
+		stats, err := svc.GetURLStats("abc12345", StatsOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, status, stats.RedirectType)
+	}
+}
+
+func TestUpdateLinkRedirectType(t *testing.T) {
+	owner := int64(7)
+	svc := NewService(&MockRepository{ownerID: &owner})
+
+	status := http.StatusSeeOther
+	_, err := svc.UpdateLink(owner, "", "abc12345", LinkUpdate{RedirectType: &status})
+	assert.Equal(t, ErrInvalidRedirectType, err)
+}
+
+func TestImportCSVRedirectType(t *testing.T) {
+	svc := NewService(&MockRepository{})
+
+	results, err := svc.ImportCSV(strings.NewReader("url,redirect_type\nhttps://example.com/a,307\nhttps://example.com/b,303\nhttps://example.com/c,permanent\nhttps://example.com/d,\n"), BatchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	assert.Empty(t, results[0].Error)
+	assert.Equal(t, ErrInvalidRedirectType.Error(), results[1].Error)
+	assert.Equal(t, ErrInvalidRedirectType.Error(), results[2].Error)
+	assert.Empty(t, results[3].Error)
+}
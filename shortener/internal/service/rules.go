@@ -0,0 +1,224 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/useragent"
+)
+
+const (
+	// MaxRules bounds the targeting rules of a link
+	MaxRules = 20
+	// maxRuleNameLength bounds rule names, which end up in every click
+	maxRuleNameLength = 32
+)
+
+// RuleStats reports the clicks a targeting rule sent to its destination
+type RuleStats struct {
+	Name string `json:"name"`
+	// URL is empty for password protected links and removed rules
+	URL    string `json:"url,omitempty"`
+	Clicks int64  `json:"clicks"`
+}
+
+// validateRules checks targeting rules and normalizes their conditions.
+// Unnamed rules are called "rule-1", "rule-2", ... by position. host is
+// the request host, as for validateURL.
+func (s *service) validateRules(rules []db.Rule, host string) (db.Rules, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if len(rules) > MaxRules {
+		return nil, fmt.Errorf("%w: at most %d rules", ErrInvalidRules, MaxRules)
+	}
+
+	validated := make(db.Rules, len(rules))
+	seen := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		rule.Name = strings.TrimSpace(rule.Name)
+		if rule.Name == "" {
+			rule.Name = "rule-" + strconv.Itoa(i+1)
+		}
+		if len(rule.Name) > maxRuleNameLength {
+			return nil, fmt.Errorf("%w: name %q is longer than %d bytes", ErrInvalidRules, rule.Name, maxRuleNameLength)
+		}
+		if seen[rule.Name] {
+			return nil, fmt.Errorf("%w: duplicate name %q", ErrInvalidRules, rule.Name)
+		}
+		seen[rule.Name] = true
+
+		if err := s.validateURL(rule.URL, host); err != nil {
+			return nil, err
+		}
+		if err := normalizeRule(&rule); err != nil {
+			return nil, fmt.Errorf("%w: rule %q: %v", ErrInvalidRules, rule.Name, err)
+		}
+		validated[i] = rule
+	}
+	return validated, nil
+}
+
+// normalizeRule checks the conditions of a rule and brings them into the
+// form matchRule compares against
+func normalizeRule(rule *db.Rule) error {
+	if len(rule.OS) == 0 && len(rule.Devices) == 0 && len(rule.Countries) == 0 &&
+		len(rule.Languages) == 0 && rule.StartsAt == nil && rule.EndsAt == nil {
+		return fmt.Errorf("no conditions")
+	}
+	if rule.StartsAt != nil && rule.EndsAt != nil && !rule.EndsAt.After(*rule.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+
+	for i, os := range rule.OS {
+		if rule.OS[i] = strings.TrimSpace(os); rule.OS[i] == "" {
+			return fmt.Errorf("empty os")
+		}
+	}
+	for i, device := range rule.Devices {
+		rule.Devices[i] = strings.ToLower(strings.TrimSpace(device))
+		switch rule.Devices[i] {
+		case useragent.DeviceDesktop, useragent.DeviceMobile, useragent.DeviceTablet, useragent.DeviceBot, useragent.DeviceOther:
+		default:
+			return fmt.Errorf("unknown device %q", device)
+		}
+	}
+	for i, country := range rule.Countries {
+		rule.Countries[i] = strings.ToUpper(strings.TrimSpace(country))
+		if !isLetters(rule.Countries[i]) || len(rule.Countries[i]) != 2 {
+			return fmt.Errorf("country %q is not a two-letter code", country)
+		}
+	}
+	for i, lang := range rule.Languages {
+		rule.Languages[i] = strings.ToLower(strings.TrimSpace(lang))
+		primary, _, _ := strings.Cut(rule.Languages[i], "-")
+		if !isLetters(primary) || len(primary) < 2 || len(primary) > 8 {
+			return fmt.Errorf("invalid language %q", lang)
+		}
+	}
+	return nil
+}
+
+// isLetters reports whether s is non-empty and only ASCII letters
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// matchRules returns the first rule the visit matches. click carries the
+// OS, device and country already worked out for the visit.
+func matchRules(rules db.Rules, click db.NewClick, language string, now time.Time) (db.Rule, bool) {
+	for _, rule := range rules {
+		if matchRule(rule, click, language, now) {
+			return rule, true
+		}
+	}
+	return db.Rule{}, false
+}
+
+// matchRule reports whether the visit meets every condition of rule
+func matchRule(rule db.Rule, click db.NewClick, language string, now time.Time) bool {
+	if rule.StartsAt != nil && now.Before(*rule.StartsAt) {
+		return false
+	}
+	if rule.EndsAt != nil && !now.Before(*rule.EndsAt) {
+		return false
+	}
+	if len(rule.OS) > 0 && !containsFold(rule.OS, click.OS) {
+		return false
+	}
+	if len(rule.Devices) > 0 && !containsFold(rule.Devices, click.Device) {
+		return false
+	}
+	if len(rule.Countries) > 0 && !containsFold(rule.Countries, click.Country) {
+		return false
+	}
+	if len(rule.Languages) > 0 {
+		matched := false
+		for _, lang := range rule.Languages {
+			if language == lang || strings.HasPrefix(language, lang+"-") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// containsFold reports whether value is in list, ignoring case. An empty
+// value never matches.
+func containsFold(list []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredLanguage returns the lowercased tag the Accept-Language header
+// ranks highest, or "" if there is none. Ties go to the first listed.
+func preferredLanguage(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// ruleStats returns each rule of a link with the clicks it matched. Rules
+// that were removed but have clicks are listed after the current ones.
+func (s *service) ruleStats(shortURL *db.ShortURL, includeBots bool) ([]RuleStats, error) {
+	tallies, err := s.linkClickTallies(shortURL, db.DimensionRule, includeBots)
+	if err != nil {
+		return nil, err
+	}
+	clicks := make(map[string]int64, len(tallies))
+	for _, tally := range tallies {
+		clicks[tally.Value] = tally.Clicks
+	}
+
+	stats := make([]RuleStats, 0, len(shortURL.Rules))
+	for _, rule := range shortURL.Rules {
+		stat := RuleStats{Name: rule.Name, Clicks: clicks[rule.Name]}
+		if !shortURL.Protected() {
+			stat.URL = rule.URL
+		}
+		stats = append(stats, stat)
+		delete(clicks, rule.Name)
+	}
+	for _, tally := range tallies {
+		if _, removed := clicks[tally.Value]; removed {
+			stats = append(stats, RuleStats{Name: tally.Value, Clicks: tally.Clicks})
+		}
+	}
+	return stats, nil
+}
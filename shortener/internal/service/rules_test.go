@@ -0,0 +1,195 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/geoip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	iPhoneUserAgent  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1"
+	androidUserAgent = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Mobile Safari/537.36"
+	desktopUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36"
+)
+
+// rulesRepository serves a link with app store rules and a German campaign
+type rulesRepository struct {
+	clickRepository
+	rules db.Rules
+}
+
+func (r *rulesRepository) GetShortURLByCode(domain, shortCode string) (*db.ShortURL, error) {
+	shortURL, err := r.MockRepository.GetShortURLByCode(domain, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	shortURL.Rules = r.rules
+	return shortURL, nil
+}
+
+func (r *rulesRepository) TopClickValues(query db.ClickQuery, dimension db.ClickDimension, limit int) ([]db.ClickTally, error) {
+	if dimension != db.DimensionRule {
+		return nil, nil
+	}
+	return []db.ClickTally{{Value: "ios", Clicks: 5}, {Value: "old", Clicks: 2}}, nil
+}
+
+func appRules() db.Rules {
+	return db.Rules{
+		{Name: "ios", OS: []string{"iOS"}, URL: "https://apps.apple.com/app/id1"},
+		{Name: "android", OS: []string{"Android"}, URL: "https://play.google.com/store/apps/details?id=app"},
+		{Name: "german", Countries: []string{"DE", "AT"}, Languages: []string{"de"}, URL: "https://example.de/"},
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	svc := NewService(&MockRepository{}).(*service)
+
+	rules, err := svc.validateRules([]db.Rule{
+		{OS: []string{" iOS "}, URL: "https://example.com/ios"},
+		{Name: "campaign", Devices: []string{"Mobile"}, Countries: []string{"de"}, Languages: []string{"PT-br"}, URL: "https://example.com/c"},
+	}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "rule-1", rules[0].Name)
+	assert.Equal(t, []string{"iOS"}, rules[0].OS)
+	assert.Equal(t, []string{"mobile"}, rules[1].Devices)
+	assert.Equal(t, []string{"DE"}, rules[1].Countries)
+	assert.Equal(t, []string{"pt-br"}, rules[1].Languages)
+
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+	invalid := []db.Rule{
+		{URL: "https://example.com/"},
+		{Devices: []string{"phone"}, URL: "https://example.com/"},
+		{Countries: []string{"DEU"}, URL: "https://example.com/"},
+		{Languages: []string{"1"}, URL: "https://example.com/"},
+		{StartsAt: &now, EndsAt: &earlier, URL: "https://example.com/"},
+		{Name: "this rule name is far too long to store", OS: []string{"iOS"}, URL: "https://example.com/"},
+	}
+	for _, rule := range invalid {
+		_, err := svc.validateRules([]db.Rule{rule}, "")
+		assert.ErrorIs(t, err, ErrInvalidRules, "%+v", rule)
+	}
+
+	_, err = svc.validateRules([]db.Rule{{Name: "x", OS: []string{"iOS"}, URL: "https://example.com/"}, {Name: "x", OS: []string{"Android"}, URL: "https://example.com/"}}, "")
+	assert.ErrorIs(t, err, ErrInvalidRules)
+	_, err = svc.validateRules([]db.Rule{{OS: []string{"iOS"}, URL: "javascript:alert(1)"}}, "")
+	assert.Equal(t, ErrInvalidURL, err)
+}
+
+func TestMatchRule(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	start, end := now.Add(-time.Hour), now.Add(time.Hour)
+	click := db.NewClick{OS: "iOS", Device: "mobile", Country: "DE"}
+
+	tests := []struct {
+		rule db.Rule
+		want bool
+	}{
+		{db.Rule{OS: []string{"ios", "Android"}}, true},
+		{db.Rule{OS: []string{"Android"}}, false},
+		{db.Rule{Devices: []string{"mobile", "tablet"}}, true},
+		{db.Rule{Countries: []string{"DE"}, Devices: []string{"desktop"}}, false},
+		{db.Rule{Languages: []string{"de"}}, true},
+		{db.Rule{Languages: []string{"de-at"}}, false},
+		{db.Rule{StartsAt: &start, EndsAt: &end}, true},
+		{db.Rule{EndsAt: &start}, false},
+		{db.Rule{StartsAt: &end}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchRule(tt.rule, click, "de-de", now), "%+v", tt.rule)
+	}
+
+	// Unknown countries never match a country condition
+	assert.False(t, matchRule(db.Rule{Countries: []string{"DE"}}, db.NewClick{}, "", now))
+}
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"de-DE,de;q=0.9,en;q=0.8": "de-de",
+		"en;q=0.5, fr-CH":         "fr-ch",
+		"*, pt-BR;q=0.7":          "pt-br",
+		"en;q=0, es;q=0.1":        "es",
+		"fr;q=bogus, it;q=0.3":    "it",
+		"nl, en":                  "nl",
+	}
+	for header, want := range tests {
+		assert.Equal(t, want, preferredLanguage(header), header)
+	}
+}
+
+func TestRedirectURLRules(t *testing.T) {
+	repo := &rulesRepository{rules: appRules()}
+	geo := &staticResolver{loc: geoip.Location{Country: "AT"}}
+	svc := NewService(repo, WithGeoResolver(geo))
+
+	tests := []struct {
+		visit Visit
+		url   string
+		rule  string
+	}{
+		{Visit{IP: "203.0.113.7", UserAgent: iPhoneUserAgent, Language: "de-AT"}, "https://apps.apple.com/app/id1", "ios"},
+		{Visit{IP: "203.0.113.7", UserAgent: androidUserAgent}, "https://play.google.com/store/apps/details?id=app", "android"},
+		{Visit{IP: "203.0.113.7", UserAgent: desktopUserAgent, Language: "de-AT,en;q=0.5"}, "https://example.de/", "german"},
+		{Visit{IP: "203.0.113.7", UserAgent: desktopUserAgent, Language: "en-US"}, "https://example.com", ""},
+	}
+	for i, tt := range tests {
+		redirect, err := svc.RedirectURL("abc12345", tt.visit)
+		require.NoError(t, err)
+		assert.Equal(t, tt.url, redirect.URL)
+		// The mock stores 301; routed links are never cached
+		assert.Equal(t, http.StatusFound, redirect.Status)
+		require.Len(t, repo.clicks, i+1)
+		assert.Equal(t, tt.rule, repo.clicks[i].Rule)
+	}
+}
+
+func TestRedirectURLRulesBeforeSplit(t *testing.T) {
+	repo := &rulesRepository{rules: db.Rules{{Name: "ios", OS: []string{"iOS"}, URL: "https://apps.apple.com/app/id1"}}}
+	svc := NewService(&splitRulesRepository{rulesRepository: repo})
+
+	redirect, err := svc.RedirectURL("abc12345", Visit{IP: "203.0.113.7", UserAgent: iPhoneUserAgent})
+	require.NoError(t, err)
+	assert.Equal(t, "https://apps.apple.com/app/id1", redirect.URL)
+	assert.Empty(t, redirect.Variant)
+
+	redirect, err = svc.RedirectURL("abc12345", Visit{IP: "203.0.113.7", UserAgent: desktopUserAgent})
+	require.NoError(t, err)
+	assert.NotEmpty(t, redirect.Variant)
+}
+
+// splitRulesRepository serves a split link that also has rules
+type splitRulesRepository struct {
+	*rulesRepository
+}
+
+func (r *splitRulesRepository) GetShortURLByCode(domain, shortCode string) (*db.ShortURL, error) {
+	shortURL, err := r.rulesRepository.GetShortURLByCode(domain, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	shortURL.Destinations = db.Destinations{
+		{Label: "a", URL: "https://example.com/a", Weight: 1},
+		{Label: "b", URL: "https://example.com/b", Weight: 1},
+	}
+	return shortURL, nil
+}
+
+func TestGetURLStatsRules(t *testing.T) {
+	svc := NewService(&rulesRepository{rules: appRules()})
+
+	stats, err := svc.GetURLStats("abc12345", StatsOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []RuleStats{
+		{Name: "ios", URL: "https://apps.apple.com/app/id1", Clicks: 5},
+		{Name: "android", URL: "https://play.google.com/store/apps/details?id=app", Clicks: 0},
+		{Name: "german", URL: "https://example.de/", Clicks: 0},
+		{Name: "old", Clicks: 2},
+	}, stats.Rules)
+}
@@ -1,100 +1,399 @@
 package service
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/url"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/geoip"
+	"github.com/rusik69/shortener/internal/shortcode"
+	"github.com/rusik69/shortener/internal/urlpolicy"
 )
 
-
-
 // Service defines the interface for URL shortening operations
 type Service interface {
-	CreateShortURL(originalURL, customCode string) (string, error)
-	GetURLStats(code string) (URLStats, error)
-	RedirectURL(code, ip, userAgent string) (string, error)
+	CreateShortURL(originalURL, customCode string, opts CreateOptions) (string, error)
+	GetURLStats(code string, opts StatsOptions) (URLStats, error)
+	RedirectURL(code string, visit Visit) (Redirect, error)
+	UnlockURL(host, code, password string) (Unlock, error)
+
+	UserService
+	DomainService
+	LinkService
+	BatchService
+	AnalyticsService
+	WebhookService
+	ExportService
 }
 
+// maxCodeAttempts bounds retries when a generated code is already taken
+const maxCodeAttempts = 5
+
 type service struct {
-	repo db.Repository
+	repo      db.Repository
+	generator shortcode.Generator
+	policy    *shortcode.Policy
+	geo       geoip.Resolver
+	clicks    ClickRecorder
+	urls      *urlpolicy.Policy
+	unlock    unlockConfig
+
+	redirectType int
+}
+
+// Option configures optional service behaviour
+type Option func(*service)
+
+// WithCodeGenerator sets the generator used for links without a custom code
+func WithCodeGenerator(g shortcode.Generator) Option {
+	return func(s *service) {
+		s.generator = g
+	}
+}
+
+// WithCodePolicy sets the rules for custom and generated codes
+func WithCodePolicy(p *shortcode.Policy) Option {
+	return func(s *service) {
+		s.policy = p
+	}
+}
+
+// WithGeoResolver locates visitors so clicks record country, region and ASN
+func WithGeoResolver(r geoip.Resolver) Option {
+	return func(s *service) {
+		s.geo = r
+	}
+}
+
+// WithURLPolicy sets the rules destination URLs must follow
+func WithURLPolicy(p *urlpolicy.Policy) Option {
+	return func(s *service) {
+		s.urls = p
+	}
+}
+
+// ClickRecorder takes clicks off the redirect path. Record must not block;
+// ingest.Pipeline implements it.
+type ClickRecorder interface {
+	Record(click db.NewClick) error
+}
+
+// WithClickRecorder hands clicks to r instead of writing them during the
+// redirect. The recorder is responsible for counting non-bot clicks.
+func WithClickRecorder(r ClickRecorder) Option {
+	return func(s *service) {
+		s.clicks = r
+	}
 }
 
 // NewService creates a new service instance
-func NewService(repo db.Repository) Service {
-	return &service{repo: repo}
+func NewService(repo db.Repository, opts ...Option) Service {
+	s := &service{repo: repo, redirectType: DefaultRedirectType}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.generator == nil {
+		s.generator, _ = shortcode.NewRandom(shortcode.DefaultRandomLength)
+	}
+	if s.policy == nil {
+		s.policy = shortcode.NewPolicy(shortcode.PolicyConfig{})
+	}
+	if s.urls == nil {
+		s.urls, _ = urlpolicy.New(urlpolicy.Config{})
+	}
+	if len(s.unlock.secret) == 0 {
+		s.unlock.secret = make([]byte, 32)
+		_, _ = rand.Read(s.unlock.secret)
+	}
+	if s.unlock.ttl <= 0 {
+		s.unlock.ttl = DefaultUnlockTTL
+	}
+	return s
 }
 
-func (s *service) CreateShortURL(originalURL, customCode string) (string, error) {
-	parsedURL, err := url.ParseRequestURI(originalURL)
-	if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
-		return "", ErrInvalidURL
+func (s *service) CreateShortURL(originalURL, customCode string, opts CreateOptions) (string, error) {
+	if err := s.validateURL(originalURL, opts.Host); err != nil {
+		return "", err
 	}
 
-	var shortCode string
-	if customCode != "" {
-		// Validate custom code (alphanumeric, hyphens, underscores only)
-		if len(customCode) < 3 || len(customCode) > 20 {
-			return "", fmt.Errorf("custom code must be between 3 and 20 characters")
-		}
-		
-		// Check if custom code already exists
-		_, err := s.repo.GetShortURLByCode(customCode)
-		if err == nil {
-			return "", fmt.Errorf("custom code already exists")
-		}
-		
-		shortCode = customCode
-	} else {
-		shortCode = uuid.New().String()[:8]
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return "", ErrInvalidExpiry
+	}
+
+	domain, err := s.DomainFor(opts.Host)
+	if err != nil {
+		return "", err
+	}
+
+	redirectType, err := s.resolveRedirectType(opts.RedirectType, domain)
+	if err != nil {
+		return "", err
+	}
+
+	destinations, err := s.validateDestinations(opts.Destinations, opts.Host)
+	if err != nil {
+		return "", err
 	}
 
-	_, err = s.repo.CreateShortURL(shortCode, originalURL, nil, nil)
+	rules, err := s.validateRules(opts.Rules, opts.Host)
 	if err != nil {
 		return "", err
 	}
 
-	return shortCode, nil
+	item := db.NewShortURL{
+		OriginalURL:  originalURL,
+		UserID:       opts.OwnerID,
+		ExpiresAt:    opts.ExpiresAt,
+		RedirectType: redirectType,
+		Destinations: destinations,
+		Rules:        rules,
+		Domain:       domain.Host,
+	}
+	if opts.Password != "" {
+		hash, err := hashLinkPassword(opts.Password)
+		if err != nil {
+			return "", err
+		}
+		item.PasswordHash = &hash
+	}
+
+	if customCode != "" {
+		customCode = s.policy.Normalize(customCode)
+		if err := s.policy.Validate(customCode); err != nil {
+			return "", err
+		}
+
+		item.ShortCode = customCode
+		created, err := s.repo.CreateShortURL(item)
+		if db.IsUniqueViolation(err) {
+			return "", ErrCodeTaken
+		}
+		if err != nil {
+			return "", err
+		}
+		s.notifyCreated(opts.OwnerID, []db.WebhookLink{webhookLink(created)})
+		return customCode, nil
+	}
+
+	// Generated codes may collide with existing ones, so retry with a new code
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		shortCode, err := s.newCode()
+		if err != nil {
+			return "", err
+		}
+
+		item.ShortCode = shortCode
+		created, err := s.repo.CreateShortURL(item)
+		if db.IsUniqueViolation(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		s.notifyCreated(opts.OwnerID, []db.WebhookLink{webhookLink(created)})
+		return shortCode, nil
+	}
+	return "", ErrCodeSpaceExhausted
 }
 
-func (s *service) GetURLStats(code string) (URLStats, error) {
-	shortURL, err := s.repo.GetShortURLByCode(code)
+func (s *service) GetURLStats(code string, opts StatsOptions) (URLStats, error) {
+	shortURL, err := s.lookup(opts.Host, code)
 	if err != nil {
 		return URLStats{}, err
 	}
 
 	stats := URLStats{
-		Code:        shortURL.ShortCode,
-		OriginalURL: shortURL.OriginalURL,
-		Clicks:      int(shortURL.ClickCount),
-		LastAccess:  shortURL.CreatedAt,
+		Code:         shortURL.ShortCode,
+		OriginalURL:  shortURL.OriginalURL,
+		Clicks:       int(shortURL.ClickCount),
+		ExpiresAt:    shortURL.ExpiresAt,
+		Enabled:      shortURL.Enabled,
+		RedirectType: shortURL.RedirectType,
+		Domain:       shortURL.Domain,
+	}
+	if shortURL.Protected() {
+		stats.OriginalURL = ""
+		stats.PasswordProtected = true
+	}
+	if len(shortURL.Destinations) > 0 {
+		if stats.Variants, err = s.variantStats(shortURL, opts.IncludeBots); err != nil {
+			return URLStats{}, err
+		}
+	}
+	if len(shortURL.Rules) > 0 {
+		if stats.Rules, err = s.ruleStats(shortURL, opts.IncludeBots); err != nil {
+			return URLStats{}, err
+		}
+	}
+
+	if stats.LastAccess, err = s.repo.GetLastClickTime(shortURL.ID, opts.IncludeBots); err != nil {
+		return URLStats{}, err
+	}
+
+	if opts.IncludeBots {
+		bots, err := s.repo.CountBotClicks(shortURL.ID)
+		if err != nil {
+			return URLStats{}, err
+		}
+		stats.BotClicks = &bots
+		stats.Clicks += int(bots)
+	}
+
+	if shortURL.UserID != nil {
+		owner, err := s.repo.GetUserByID(*shortURL.UserID)
+		if err != nil {
+			return URLStats{}, err
+		}
+		stats.Owner = owner.Username
 	}
 
 	return stats, nil
 }
 
-func (s *service) RedirectURL(code, ip, userAgent string) (string, error) {
-	shortURL, err := s.repo.GetShortURLByCode(code)
+func (s *service) RedirectURL(code string, visit Visit) (Redirect, error) {
+	shortURL, err := s.lookup(visit.Host, code)
 	if err != nil {
-		return "", err
+		return Redirect{}, err
 	}
 
-	// Increment click count
-	err = s.repo.IncrementClickCount(shortURL.ID)
-	if err != nil {
-		fmt.Printf("Failed to increment click count: %v\n", err)
+	now := time.Now()
+	if isExpired(shortURL, now) {
+		return Redirect{}, ErrURLExpired
+	}
+	if !shortURL.Enabled {
+		return Redirect{}, ErrURLDisabled
+	}
+	if shortURL.Protected() && !s.unlocked(shortURL, visit.Unlock) {
+		return Redirect{}, ErrPasswordRequired
+	}
+
+	redirect := Redirect{URL: shortURL.OriginalURL, Status: shortURL.RedirectType, ExpiresAt: shortURL.ExpiresAt}
+	if shortURL.Protected() {
+		// Unlocking is per visitor, so the redirect must not be cached
+		redirect.Status = temporaryRedirect(redirect.Status)
+	}
+
+	click := s.newClick(shortURL.ID, visit)
+
+	// Targeting rules come first, then the split, then original_url
+	if rule, ok := matchRules(shortURL.Rules, click, preferredLanguage(visit.Language), now); ok {
+		redirect.URL = rule.URL
+		click.Rule = rule.Name
+	} else if len(shortURL.Destinations) > 0 {
+		dest := chooseDestination(shortURL, visit)
+		redirect.URL, redirect.Variant = dest.URL, dest.Label
+		click.Variant = dest.Label
+	}
+	if len(shortURL.Rules) > 0 || len(shortURL.Destinations) > 0 {
+		// The destination depends on the visitor, so every visit has to
+		// come back to be routed and counted
+		redirect.Status = temporaryRedirect(redirect.Status)
+	}
+
+	if s.clicks != nil {
+		// The recorder stores the click and bumps the counter in the background
+		if err := s.clicks.Record(click); err != nil {
+			fmt.Printf("Failed to queue click: %v\n", err)
+		}
+		return redirect, nil
 	}
 
-	// Record analytics - ensure we have a valid IP
-	if ip == "" || ip == "::" || ip == "::1" {
-		ip = "127.0.0.1" // Use localhost for invalid IPs
+	// Increment click count; bots only show up in the clicks table
+	if !click.IsBot {
+		err = s.repo.IncrementClickCount(shortURL.ID)
+		if err != nil {
+			fmt.Printf("Failed to increment click count: %v\n", err)
+		}
 	}
-	err = s.repo.CreateClick(shortURL.ID, userAgent, ip, "")
+
+	// Record analytics
+	err = s.repo.CreateClick(click)
 	if err != nil {
 		// Don't fail the redirect if analytics fails
 		fmt.Printf("Failed to record analytics: %v\n", err)
 	}
 
-	return shortURL.OriginalURL, nil
+	return redirect, nil
+}
+
+// newCode generates a code that the policy allows
+func (s *service) newCode() (string, error) {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		code, err := s.generator.Generate()
+		if err != nil {
+			return "", err
+		}
+		code = s.policy.Normalize(code)
+		if s.policy.Allowed(code) {
+			return code, nil
+		}
+	}
+	return "", ErrCodeSpaceExhausted
+}
+
+// lookup fetches a short URL by code in the namespace of the domain serving
+// host, mapping a missing row to ErrURLNotFound
+func (s *service) lookup(host, code string) (*db.ShortURL, error) {
+	if !s.policy.Resolvable(code) {
+		return nil, ErrURLNotFound
+	}
+
+	domain, err := s.namespace(host)
+	if err != nil {
+		return nil, err
+	}
+
+	shortURL, err := s.repo.GetShortURLByCode(domain, code)
+	if errors.Is(err, sql.ErrNoRows) && s.policy.CaseInsensitive() && s.policy.Normalize(code) != code {
+		// Codes created before case folding was enabled keep their case
+		shortURL, err = s.repo.GetShortURLByCode(domain, s.policy.Normalize(code))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrURLNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return shortURL, nil
+}
+
+// isValidURL reports whether rawURL is an absolute URL with a scheme and host
+func isValidURL(rawURL string) bool {
+	parsedURL, err := url.ParseRequestURI(rawURL)
+	return err == nil && parsedURL.Scheme != "" && parsedURL.Host != ""
+}
+
+// validateURL checks that rawURL is well formed and allowed by the URL
+// policy. host is the request host; links back to it or to any configured
+// domain would redirect in a loop. Policy rejections are *urlpolicy.Error
+// values.
+func (s *service) validateURL(rawURL, host string) error {
+	if !isValidURL(rawURL) {
+		return ErrInvalidURL
+	}
+	selfHosts := []string{host}
+	if dest, err := url.Parse(rawURL); err == nil && s.isDomain(dest.Hostname()) {
+		selfHosts = append(selfHosts, dest.Hostname())
+	}
+	return s.urls.Check(rawURL, selfHosts...)
+}
+
+// isDomain reports whether host is a configured domain. Lookup errors
+// count as no; the URL policy still applies.
+func (s *service) isDomain(host string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+	_, err := s.repo.GetDomain(host)
+	return err == nil
+}
+
+// isExpired reports whether the short URL has passed its expiry time
+func isExpired(shortURL *db.ShortURL, now time.Time) bool {
+	return shortURL.ExpiresAt != nil && !now.Before(*shortURL.ExpiresAt)
 }
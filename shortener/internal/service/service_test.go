@@ -1,10 +1,15 @@
 package service
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/urlpolicy"
 )
 
 func TestCreateShortURL(t *testing.T) {
@@ -12,7 +17,7 @@ func TestCreateShortURL(t *testing.T) {
 	svc := NewService(mockRepo)
 	testURL := "https://example.com"
 
-	shortCode, err := svc.CreateShortURL(testURL, "")
+	shortCode, err := svc.CreateShortURL(testURL, "", CreateOptions{})
 	if err != nil {
 		t.Errorf("CreateShortURL failed: %v", err)
 	}
@@ -27,7 +32,7 @@ func TestGetURLStats(t *testing.T) {
 	svc := NewService(mockRepo)
 	testCode := "abc12345"
 
-	stats, err := svc.GetURLStats(testCode)
+	stats, err := svc.GetURLStats(testCode, StatsOptions{})
 	if err != nil {
 		t.Errorf("GetURLStats failed: %v", err)
 	}
@@ -45,40 +50,164 @@ func TestRedirectURL(t *testing.T) {
 	testIP := "192.168.1.1"
 	testUserAgent := "Mozilla/5.0"
 
-	originalURL, err := svc.RedirectURL(testCode, testIP, testUserAgent)
+	redirect, err := svc.RedirectURL(testCode, Visit{IP: testIP, UserAgent: testUserAgent})
 	if err != nil {
 		t.Errorf("RedirectURL failed: %v", err)
 	}
 
-	if originalURL != testURL {
-		t.Errorf("Expected URL %s, got %s", testURL, originalURL)
+	if redirect.URL != testURL {
+		t.Errorf("Expected URL %s, got %s", testURL, redirect.URL)
+	}
+}
+
+func TestCreateShortURLPastExpiry(t *testing.T) {
+	mockRepo := &MockRepository{}
+	svc := NewService(mockRepo)
+	past := time.Now().Add(-time.Minute)
+
+	_, err := svc.CreateShortURL("https://example.com", "", CreateOptions{ExpiresAt: &past})
+	if err != ErrInvalidExpiry {
+		t.Errorf("Expected ErrInvalidExpiry, got %v", err)
+	}
+}
+
+func TestCreateShortURLPolicy(t *testing.T) {
+	policy, err := urlpolicy.New(urlpolicy.Config{SelfHosts: []string{"sho.rt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(&MockRepository{}, WithURLPolicy(policy))
+
+	tests := map[string]error{
+		"https://sho.rt/abc12345":  urlpolicy.ErrSelfReference,
+		"http://10.0.0.1/admin":    urlpolicy.ErrPrivateAddress,
+		"https://bit.ly/xyz":       urlpolicy.ErrShortenerChain,
+		"ftp://example.com/file":   urlpolicy.ErrScheme,
+		"https://example.com/page": nil,
+	}
+	for rawURL, want := range tests {
+		_, err := svc.CreateShortURL(rawURL, "", CreateOptions{})
+		if !errors.Is(err, want) {
+			t.Errorf("%s: expected %v, got %v", rawURL, want, err)
+		}
+	}
+
+	// The default policy blocks private networks too
+	_, err = NewService(&MockRepository{}).CreateShortURL("http://localhost:8080/", "", CreateOptions{})
+	if !errors.Is(err, urlpolicy.ErrPrivateAddress) {
+		t.Errorf("Expected ErrPrivateAddress, got %v", err)
+	}
+
+	// The request host is the shortener even when SelfHosts is empty
+	_, err = NewService(&MockRepository{}).CreateShortURL("https://go.example.com/abc12345", "", CreateOptions{Host: "go.example.com:8080"})
+	if !errors.Is(err, urlpolicy.ErrSelfReference) {
+		t.Errorf("Expected ErrSelfReference, got %v", err)
+	}
+}
+
+func TestRedirectURLExpired(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	mockRepo := &MockRepository{expiresAt: &past}
+	svc := NewService(mockRepo)
+
+	_, err := svc.RedirectURL("abc12345", Visit{IP: "192.168.1.1", UserAgent: "Mozilla/5.0"})
+	if err != ErrURLExpired {
+		t.Errorf("Expected ErrURLExpired, got %v", err)
+	}
+}
+
+func TestRedirectURLNotYetExpired(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	mockRepo := &MockRepository{expiresAt: &future}
+	svc := NewService(mockRepo)
+
+	redirect, err := svc.RedirectURL("abc12345", Visit{IP: "192.168.1.1", UserAgent: "Mozilla/5.0"})
+	if err != nil {
+		t.Errorf("RedirectURL failed: %v", err)
+	}
+	if redirect.URL != "https://example.com" {
+		t.Errorf("Expected URL https://example.com, got %s", redirect.URL)
+	}
+	if redirect.ExpiresAt == nil || !redirect.ExpiresAt.Equal(future) {
+		t.Errorf("Expected expiry %v, got %v", future, redirect.ExpiresAt)
+	}
+}
+
+func TestRedirectURLDisabled(t *testing.T) {
+	mockRepo := &MockRepository{disabled: true}
+	svc := NewService(mockRepo)
+
+	_, err := svc.RedirectURL("abc12345", Visit{IP: "192.168.1.1", UserAgent: "Mozilla/5.0"})
+	if err != ErrURLDisabled {
+		t.Errorf("Expected ErrURLDisabled, got %v", err)
 	}
 }
 
 // MockRepository implements the Repository interface for testing
-type MockRepository struct{}
+type MockRepository struct {
+	expiresAt *time.Time
+	disabled  bool
+	ownerID   *int64
+	filter    db.ShortURLFilter
+	// passwordHash protects the link returned by GetShortURLByCode
+	passwordHash *string
+	// redirectType is the stored redirect type; 0 means the column default
+	redirectType int
+	created      []db.NewShortURL
+	// domains are the configured domains by host
+	domains map[string]db.Domain
+	// webhooks are the stored webhooks; events were queued for them
+	webhooks []db.Webhook
+	events   []db.WebhookEvent
+	// exportedClicks are streamed by ExportClicks; exportQuery is the last
+	// export query
+	exportedClicks []db.ExportedClick
+	exportQuery    db.ExportQuery
+}
 
-func (m *MockRepository) CreateShortURL(shortCode, originalURL string, userID *int64, expiresAt *time.Time) (*db.ShortURL, error) {
+func (m *MockRepository) CreateShortURL(item db.NewShortURL) (*db.ShortURL, error) {
+	m.created = append(m.created, item)
 	return &db.ShortURL{
-		ID:          1,
-		ShortCode:   shortCode,
-		OriginalURL: originalURL,
-		UserID:      userID,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-		ExpiresAt:   expiresAt,
-		ClickCount:  0,
+		ID:           1,
+		ShortCode:    item.ShortCode,
+		OriginalURL:  item.OriginalURL,
+		UserID:       item.UserID,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		ExpiresAt:    item.ExpiresAt,
+		ClickCount:   0,
+		PasswordHash: item.PasswordHash,
+		RedirectType: item.RedirectType,
+		Domain:       item.Domain,
 	}, nil
 }
 
-func (m *MockRepository) GetShortURLByCode(shortCode string) (*db.ShortURL, error) {
+func (m *MockRepository) CreateShortURLBatch(items []db.NewShortURL, atomic bool) ([]error, error) {
+	return make([]error, len(items)), nil
+}
+
+func (m *MockRepository) NextShortCodeID() (uint64, error) {
+	return 1, nil
+}
+
+func (m *MockRepository) GetShortURLByCode(domain, shortCode string) (*db.ShortURL, error) {
+	redirectType := m.redirectType
+	if redirectType == 0 {
+		redirectType = http.StatusMovedPermanently
+	}
 	return &db.ShortURL{
-		ID:          1,
-		ShortCode:   shortCode,
-		OriginalURL: "https://example.com",
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-		ClickCount:  5,
+		ID:           1,
+		ShortCode:    shortCode,
+		OriginalURL:  "https://example.com",
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		ExpiresAt:    m.expiresAt,
+		ClickCount:   5,
+		Enabled:      !m.disabled,
+		UserID:       m.ownerID,
+		PasswordHash: m.passwordHash,
+		RedirectType: redirectType,
+		Domain:       domain,
 	}, nil
 }
 
@@ -90,10 +219,79 @@ func (m *MockRepository) GetClicks(shortURLID int64, limit int) ([]db.Click, err
 	return []db.Click{}, nil
 }
 
-func (m *MockRepository) CreateClick(shortURLID int64, userAgent, ipAddress, referrer string) error {
+func (m *MockRepository) DeleteExpiredShortURLs(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) ListShortURLs(filter db.ShortURLFilter) ([]db.ShortURL, int64, error) {
+	m.filter = filter
+	return []db.ShortURL{}, 0, nil
+}
+
+func (m *MockRepository) UpdateShortURL(userID int64, domain, shortCode string, update db.ShortURLUpdate) (*db.ShortURL, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockRepository) DeleteShortURL(userID int64, domain, shortCode string) error {
+	return sql.ErrNoRows
+}
+
+func (m *MockRepository) SaveDomain(domain db.Domain) (*db.Domain, error) {
+	if m.domains == nil {
+		m.domains = make(map[string]db.Domain)
+	}
+	m.domains[domain.Host] = domain
+	return &domain, nil
+}
+
+func (m *MockRepository) GetDomain(host string) (*db.Domain, error) {
+	domain, ok := m.domains[host]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &domain, nil
+}
+
+func (m *MockRepository) ListDomains() ([]db.Domain, error) {
+	domains := []db.Domain{}
+	for _, domain := range m.domains {
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+func (m *MockRepository) DeleteDomain(host string) error {
+	if _, ok := m.domains[host]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.domains, host)
+	return nil
+}
+
+func (m *MockRepository) CreateClick(click db.NewClick) error {
 	return nil
 }
 
+func (m *MockRepository) RecordClicks(clicks []db.NewClick) error {
+	return nil
+}
+
+func (m *MockRepository) CountClicksByTime(query db.ClickQuery, unit string) ([]db.ClickBucket, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) TopClickValues(query db.ClickQuery, dimension db.ClickDimension, limit int) ([]db.ClickTally, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) GetLastClickTime(shortURLID int64, includeBots bool) (*time.Time, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) CountBotClicks(shortURLID int64) (int64, error) {
+	return 0, nil
+}
+
 func (m *MockRepository) GetOrCreateRateLimit(ipAddress string) (*db.RateLimit, error) {
 	return &db.RateLimit{}, nil
 }
@@ -102,3 +300,124 @@ func (m *MockRepository) UpdateRateLimit(rateLimit *db.RateLimit) error {
 	return nil
 }
 
+func (m *MockRepository) TakeRateLimitToken(key string, now time.Time, interval time.Duration, burst int) (time.Time, bool, error) {
+	return now.Add(interval), true, nil
+}
+
+func (m *MockRepository) RefundRateLimitToken(key string, interval time.Duration) error {
+	return nil
+}
+
+func (m *MockRepository) DeleteExpiredRateLimits(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) RecordCaptchaAttempt(attempt db.CaptchaAttempt) error {
+	return nil
+}
+
+func (m *MockRepository) DeleteOldCaptchaAttempts(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) CreateUser(username string, passwordHash *string, isService bool) (*db.User, error) {
+	return &db.User{ID: 1, Username: username, PasswordHash: passwordHash, IsService: isService}, nil
+}
+
+func (m *MockRepository) GetUserByUsername(username string) (*db.User, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockRepository) GetUserByID(id int64) (*db.User, error) {
+	return &db.User{ID: id, Username: "testuser"}, nil
+}
+
+func (m *MockRepository) CreateAPIKey(userID int64, name, prefix, keyHash string) (*db.APIKey, error) {
+	return &db.APIKey{ID: 1, UserID: userID, Name: name, Prefix: prefix, KeyHash: keyHash}, nil
+}
+
+func (m *MockRepository) GetAPIKeyByHash(keyHash string) (*db.APIKey, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockRepository) ListAPIKeys(userID int64) ([]db.APIKey, error) {
+	return []db.APIKey{}, nil
+}
+
+func (m *MockRepository) RotateAPIKey(userID, keyID int64, prefix, keyHash string) (*db.APIKey, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *MockRepository) RevokeAPIKey(userID, keyID int64) error {
+	return sql.ErrNoRows
+}
+
+func (m *MockRepository) TouchAPIKey(keyID int64) error {
+	return nil
+}
+
+func (m *MockRepository) CreateWebhook(webhook db.Webhook) (*db.Webhook, error) {
+	webhook.ID = int64(len(m.webhooks) + 1)
+	m.webhooks = append(m.webhooks, webhook)
+	return &webhook, nil
+}
+
+func (m *MockRepository) ListWebhooks(userID int64) ([]db.Webhook, error) {
+	webhooks := []db.Webhook{}
+	for _, webhook := range m.webhooks {
+		if webhook.UserID == userID {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+func (m *MockRepository) DeleteWebhook(userID, webhookID int64) error {
+	for i, webhook := range m.webhooks {
+		if webhook.ID == webhookID && webhook.UserID == userID {
+			m.webhooks = append(m.webhooks[:i], m.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MockRepository) EnqueueWebhookEvents(userID int64, events []db.WebhookEvent) error {
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *MockRepository) ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]db.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (m *MockRepository) CompleteWebhookDelivery(deliveryID int64, responseStatus int) error {
+	return nil
+}
+
+func (m *MockRepository) FailWebhookDelivery(deliveryID int64, responseStatus int, message string, retryAt *time.Time) error {
+	return nil
+}
+
+func (m *MockRepository) ListWebhookDeliveries(userID int64, limit int) ([]db.WebhookDelivery, error) {
+	return []db.WebhookDelivery{}, nil
+}
+
+func (m *MockRepository) DeleteFinishedWebhookDeliveries(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (m *MockRepository) ExportLinks(ctx context.Context, query db.ExportQuery, fn func(db.ExportedLink) error) error {
+	m.exportQuery = query
+	return nil
+}
+
+func (m *MockRepository) ExportClicks(ctx context.Context, query db.ExportQuery, fn func(db.ExportedClick) error) error {
+	m.exportQuery = query
+	for _, click := range m.exportedClicks {
+		if err := fn(click); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+)
+
+const (
+	// MaxDestinations bounds the variants of a split link
+	MaxDestinations = 10
+	// MaxDestinationWeight bounds a single variant's weight
+	MaxDestinationWeight = 10000
+	// maxVariantLabelLength bounds variant labels, which end up in every click
+	maxVariantLabelLength = 32
+)
+
+// VariantStats reports one destination of a split link
+type VariantStats struct {
+	Label string `json:"label"`
+	// URL is empty for password protected links
+	URL    string `json:"url,omitempty"`
+	Weight int    `json:"weight"`
+	Clicks int64  `json:"clicks"`
+}
+
+// validateDestinations checks a split and fills in missing labels with
+// "a", "b", ... by position. An empty list means no split. host is the
+// request host, as for validateURL.
+func (s *service) validateDestinations(dests []db.Destination, host string) (db.Destinations, error) {
+	if len(dests) == 0 {
+		return nil, nil
+	}
+	if len(dests) < 2 || len(dests) > MaxDestinations {
+		return nil, fmt.Errorf("%w: a split needs 2 to %d destinations", ErrInvalidDestinations, MaxDestinations)
+	}
+
+	split := make(db.Destinations, len(dests))
+	seen := make(map[string]bool, len(dests))
+	for i, dest := range dests {
+		if err := s.validateURL(dest.URL, host); err != nil {
+			return nil, err
+		}
+		if dest.Weight < 1 || dest.Weight > MaxDestinationWeight {
+			return nil, fmt.Errorf("%w: weight must be between 1 and %d", ErrInvalidDestinations, MaxDestinationWeight)
+		}
+		dest.Label = strings.TrimSpace(dest.Label)
+		if dest.Label == "" {
+			dest.Label = string(rune('a' + i))
+		}
+		if len(dest.Label) > maxVariantLabelLength {
+			return nil, fmt.Errorf("%w: label %q is longer than %d bytes", ErrInvalidDestinations, dest.Label, maxVariantLabelLength)
+		}
+		if seen[dest.Label] {
+			return nil, fmt.Errorf("%w: duplicate label %q", ErrInvalidDestinations, dest.Label)
+		}
+		seen[dest.Label] = true
+		split[i] = dest
+	}
+	return split, nil
+}
+
+// chooseDestination picks the variant a visitor is sent to. A visitor who
+// was already assigned a variant that still exists keeps it; otherwise the
+// choice is a weighted hash of the code and IP, so the same visitor lands
+// on the same variant even without the cookie.
+func chooseDestination(shortURL *db.ShortURL, visit Visit) db.Destination {
+	dests := shortURL.Destinations
+	if visit.Variant != "" {
+		for _, dest := range dests {
+			if dest.Label == visit.Variant {
+				return dest
+			}
+		}
+	}
+
+	var point uint64
+	if visit.IP != "" {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(shortURL.ShortCode))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(visit.IP))
+		point = h.Sum64() % uint64(dests.TotalWeight())
+	} else {
+		point = uint64(rand.Intn(dests.TotalWeight()))
+	}
+	for _, dest := range dests {
+		if point < uint64(dest.Weight) {
+			return dest
+		}
+		point -= uint64(dest.Weight)
+	}
+	return dests[len(dests)-1]
+}
+
+// variantStats returns the split of a link with each variant's clicks.
+// Variants that were removed from the split but have clicks are listed
+// after the current ones with weight 0.
+func (s *service) variantStats(shortURL *db.ShortURL, includeBots bool) ([]VariantStats, error) {
+	tallies, err := s.linkClickTallies(shortURL, db.DimensionVariant, includeBots)
+	if err != nil {
+		return nil, err
+	}
+	clicks := make(map[string]int64, len(tallies))
+	for _, tally := range tallies {
+		clicks[tally.Value] = tally.Clicks
+	}
+
+	variants := make([]VariantStats, 0, len(shortURL.Destinations))
+	for _, dest := range shortURL.Destinations {
+		variant := VariantStats{Label: dest.Label, Weight: dest.Weight, Clicks: clicks[dest.Label]}
+		if !shortURL.Protected() {
+			variant.URL = dest.URL
+		}
+		variants = append(variants, variant)
+		delete(clicks, dest.Label)
+	}
+	for _, tally := range tallies {
+		if _, removed := clicks[tally.Value]; removed {
+			variants = append(variants, VariantStats{Label: tally.Value, Clicks: tally.Clicks})
+		}
+	}
+	return variants, nil
+}
+
+// linkClickTallies counts all of a link's clicks by dimension
+func (s *service) linkClickTallies(shortURL *db.ShortURL, dimension db.ClickDimension, includeBots bool) ([]db.ClickTally, error) {
+	return s.repo.TopClickValues(db.ClickQuery{
+		ShortURLID:  shortURL.ID,
+		From:        shortURL.CreatedAt,
+		To:          time.Now(),
+		IncludeBots: includeBots,
+	}, dimension, maxTopValues)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/urlpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splitRepository serves a 70/30 split link and per-variant click counts
+type splitRepository struct {
+	clickRepository
+}
+
+func (r *splitRepository) GetShortURLByCode(domain, shortCode string) (*db.ShortURL, error) {
+	shortURL, err := r.MockRepository.GetShortURLByCode(domain, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	shortURL.Destinations = db.Destinations{
+		{Label: "control", URL: "https://example.com/a", Weight: 70},
+		{Label: "new", URL: "https://example.com/b", Weight: 30},
+	}
+	return shortURL, nil
+}
+
+func (r *splitRepository) TopClickValues(query db.ClickQuery, dimension db.ClickDimension, limit int) ([]db.ClickTally, error) {
+	if dimension != db.DimensionVariant {
+		return nil, nil
+	}
+	return []db.ClickTally{{Value: "control", Clicks: 7}, {Value: "retired", Clicks: 4}, {Value: "new", Clicks: 3}}, nil
+}
+
+func TestValidateDestinations(t *testing.T) {
+	svc := NewService(&MockRepository{}).(*service)
+
+	split, err := svc.validateDestinations([]db.Destination{
+		{URL: "https://example.com/a", Weight: 1},
+		{URL: "https://example.com/b", Weight: 2, Label: " promo "},
+		{URL: "https://example.com/c", Weight: 3},
+	}, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "promo", "c"}, []string{split[0].Label, split[1].Label, split[2].Label})
+
+	split, err = svc.validateDestinations(nil, "")
+	assert.NoError(t, err)
+	assert.Nil(t, split)
+
+	invalid := [][]db.Destination{
+		{{URL: "https://example.com/a", Weight: 1}},
+		{{URL: "https://example.com/a", Weight: 1}, {URL: "https://example.com/b", Weight: 0}},
+		{{URL: "https://example.com/a", Weight: 1}, {URL: "https://example.com/b", Weight: MaxDestinationWeight + 1}},
+		{{URL: "https://example.com/a", Weight: 1, Label: "x"}, {URL: "https://example.com/b", Weight: 1, Label: "x"}},
+		{{URL: "https://example.com/a", Weight: 1, Label: "this label is far too long to store"}, {URL: "https://example.com/b", Weight: 1}},
+	}
+	for _, dests := range invalid {
+		_, err := svc.validateDestinations(dests, "")
+		assert.ErrorIs(t, err, ErrInvalidDestinations, "%v", dests)
+	}
+
+	_, err = svc.validateDestinations([]db.Destination{{URL: "https://example.com/a", Weight: 1}, {URL: "not a url", Weight: 1}}, "")
+	assert.Equal(t, ErrInvalidURL, err)
+	_, err = svc.validateDestinations([]db.Destination{{URL: "https://example.com/a", Weight: 1}, {URL: "http://10.0.0.1/", Weight: 1}}, "")
+	assert.ErrorIs(t, err, urlpolicy.ErrPrivateAddress)
+}
+
+func TestCreateShortURLWithDestinations(t *testing.T) {
+	repo := &MockRepository{}
+	svc := NewService(repo)
+
+	_, err := svc.CreateShortURL("https://example.com", "", CreateOptions{Destinations: []db.Destination{
+		{URL: "https://example.com/a", Weight: 70},
+		{URL: "https://example.com/b", Weight: 30},
+	}})
+	require.NoError(t, err)
+	require.Len(t, repo.created, 1)
+	assert.Len(t, repo.created[0].Destinations, 2)
+	assert.Equal(t, 100, repo.created[0].Destinations.TotalWeight())
+}
+
+func TestChooseDestination(t *testing.T) {
+	shortURL, err := (&splitRepository{}).GetShortURLByCode("", "abc12345")
+	require.NoError(t, err)
+
+	// The same IP always gets the same variant
+	first := chooseDestination(shortURL, Visit{IP: "203.0.113.7"})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, chooseDestination(shortURL, Visit{IP: "203.0.113.7"}))
+	}
+
+	// A remembered variant wins over the hash, unless it no longer exists
+	assert.Equal(t, "new", chooseDestination(shortURL, Visit{IP: "203.0.113.7", Variant: "new"}).Label)
+	assert.Equal(t, "control", chooseDestination(shortURL, Visit{IP: "203.0.113.7", Variant: "control"}).Label)
+	assert.Equal(t, first, chooseDestination(shortURL, Visit{IP: "203.0.113.7", Variant: "retired"}))
+
+	// Across many visitors traffic follows the weights
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+		counts[chooseDestination(shortURL, Visit{IP: ip}).Label]++
+	}
+	assert.InDelta(t, 7000, counts["control"], 300)
+	assert.InDelta(t, 3000, counts["new"], 300)
+}
+
+func TestRedirectURLSplit(t *testing.T) {
+	repo := &splitRepository{}
+	svc := NewService(repo)
+
+	redirect, err := svc.RedirectURL("abc12345", Visit{IP: "203.0.113.7", Variant: "new"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/b", redirect.URL)
+	assert.Equal(t, "new", redirect.Variant)
+	// The mock stores 301; split links are never cached
+	assert.Equal(t, http.StatusFound, redirect.Status)
+
+	require.Len(t, repo.clicks, 1)
+	assert.Equal(t, "new", repo.clicks[0].Variant)
+
+	redirect, err = NewService(&MockRepository{}).RedirectURL("abc12345", Visit{IP: "203.0.113.7"})
+	require.NoError(t, err)
+	assert.Empty(t, redirect.Variant)
+}
+
+func TestGetURLStatsVariants(t *testing.T) {
+	svc := NewService(&splitRepository{})
+
+	stats, err := svc.GetURLStats("abc12345", StatsOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []VariantStats{
+		{Label: "control", URL: "https://example.com/a", Weight: 70, Clicks: 7},
+		{Label: "new", URL: "https://example.com/b", Weight: 30, Clicks: 3},
+		{Label: "retired", Clicks: 4},
+	}, stats.Variants)
+
+	stats, err = NewService(&MockRepository{}).GetURLStats("abc12345", StatsOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, stats.Variants)
+}
@@ -1,11 +1,62 @@
 package service
 
-import "time"
+import (
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+)
 
 // URLStats represents URL statistics
 type URLStats struct {
-	Code        string    `json:"code"`
-	OriginalURL string    `json:"original_url"`
-	Clicks      int       `json:"clicks"`
-	LastAccess  time.Time `json:"last_access"`
+	Code        string     `json:"code"`
+	OriginalURL string     `json:"original_url"`
+	Clicks      int        `json:"clicks"`
+	BotClicks   *int64     `json:"bot_clicks,omitempty"`
+	LastAccess  *time.Time `json:"last_access"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	// PasswordProtected links do not reveal OriginalURL
+	PasswordProtected bool `json:"password_protected,omitempty"`
+	// RedirectType is the HTTP status visitors are redirected with
+	RedirectType int `json:"redirect_type"`
+	// Domain is the host the code belongs to; empty for the default
+	// namespace
+	Domain string `json:"domain,omitempty"`
+	// Variants break down the clicks of a split link by destination
+	Variants []VariantStats `json:"variants,omitempty"`
+	// Rules break down the clicks of a link with targeting rules by the
+	// rule that matched; clicks no rule matched are not listed
+	Rules []RuleStats `json:"rules,omitempty"`
+}
+
+// StatsOptions tunes what GetURLStats counts
+type StatsOptions struct {
+	// IncludeBots adds clicks from crawlers and link previews to Clicks
+	// and reports them separately in BotClicks
+	IncludeBots bool
+	// Host is the request host, which selects the code namespace
+	Host string
+}
+
+// CreateOptions holds optional settings for a new short URL
+type CreateOptions struct {
+	// ExpiresAt is the moment the link stops redirecting; nil means never.
+	ExpiresAt *time.Time
+	// OwnerID is the user creating the link; nil for anonymous links.
+	OwnerID *int64
+	// Password must be entered by visitors before they are redirected;
+	// empty means the link is public.
+	Password string
+	// RedirectType is 301, 302, 307 or 308; 0 uses the domain default.
+	RedirectType int
+	// Destinations split visitors between several URLs by weight; empty
+	// sends everyone to the original URL.
+	Destinations []db.Destination
+	// Rules send matching visitors elsewhere; the first match wins and
+	// visitors no rule matches get the split or the original URL.
+	Rules []db.Rule
+	// Host is the request host. Links created on a configured domain go
+	// in its namespace and use its default redirect type.
+	Host string
 }
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultUnlockTTL is how long a protected link stays unlocked
+	DefaultUnlockTTL = time.Hour
+	// Link passwords are shared secrets rather than account passwords, so
+	// short ones are allowed; bcrypt ignores anything past 72 bytes
+	minLinkPasswordLength = 4
+	maxLinkPasswordLength = 72
+)
+
+// Unlock lets a visitor through to a protected link until ExpiresAt
+type Unlock struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+type unlockConfig struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// WithUnlockSecret sets the key signing unlock tokens and how long they
+// last. Replicas must share the secret; by default a random one is
+// generated and visitors are asked again after a restart.
+func WithUnlockSecret(secret []byte, ttl time.Duration) Option {
+	return func(s *service) {
+		s.unlock = unlockConfig{secret: secret, ttl: ttl}
+	}
+}
+
+func hashLinkPassword(password string) (string, error) {
+	if len(password) < minLinkPasswordLength || len(password) > maxLinkPasswordLength {
+		return "", ErrInvalidLinkPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// UnlockURL checks password against a protected link and returns a token
+// to pass as Visit.Unlock. Public links need no token and return an empty
+// Unlock.
+func (s *service) UnlockURL(host, code, password string) (Unlock, error) {
+	shortURL, err := s.lookup(host, code)
+	if err != nil {
+		return Unlock{}, err
+	}
+	// Dead links answer the same whatever the password, so they cannot
+	// be used to try passwords
+	if isExpired(shortURL, time.Now()) {
+		return Unlock{}, ErrURLExpired
+	}
+	if !shortURL.Enabled {
+		return Unlock{}, ErrURLDisabled
+	}
+	if !shortURL.Protected() {
+		return Unlock{}, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(*shortURL.PasswordHash), []byte(password)) != nil {
+		return Unlock{}, ErrWrongPassword
+	}
+
+	expiresAt := time.Now().Add(s.unlock.ttl).Truncate(time.Second)
+	payload := shortURL.ShortCode + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return Unlock{
+		Token:     payload + "." + s.signUnlock(shortURL, payload),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// unlocked reports whether token is a valid, unexpired unlock for shortURL
+func (s *service) unlocked(shortURL *db.ShortURL, token string) bool {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.signUnlock(shortURL, payload))) {
+		return false
+	}
+	code, expires, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	return err == nil && code == shortURL.ShortCode && time.Now().Before(time.Unix(unix, 0))
+}
+
+// signUnlock MACs payload together with the link's password hash, so that
+// changing the password invalidates earlier unlocks
+func (s *service) signUnlock(shortURL *db.ShortURL, payload string) string {
+	mac := hmac.New(sha256.New, s.unlock.secret)
+	mac.Write([]byte(payload))
+	mac.Write([]byte{0})
+	mac.Write([]byte(*shortURL.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// protectedRepository returns links protected by password
+func protectedRepository(t *testing.T, password string) *MockRepository {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	passwordHash := string(hash)
+	return &MockRepository{passwordHash: &passwordHash}
+}
+
+func TestCreateShortURLWithPassword(t *testing.T) {
+	repo := &MockRepository{}
+	svc := NewService(repo)
+
+	_, err := svc.CreateShortURL("https://example.com", "", CreateOptions{Password: "hunter22"})
+	require.NoError(t, err)
+	require.Len(t, repo.created, 1)
+	require.NotNil(t, repo.created[0].PasswordHash)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(*repo.created[0].PasswordHash), []byte("hunter22")))
+
+	_, err = svc.CreateShortURL("https://example.com", "", CreateOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, repo.created[1].PasswordHash)
+
+	for _, password := range []string{"abc", strings.Repeat("x", 73)} {
+		_, err = svc.CreateShortURL("https://example.com", "", CreateOptions{Password: password})
+		assert.Equal(t, ErrInvalidLinkPassword, err)
+	}
+}
+
+func TestRedirectURLProtected(t *testing.T) {
+	svc := NewService(protectedRepository(t, "hunter22"), WithUnlockSecret([]byte("secret"), time.Hour))
+	visit := Visit{IP: "192.168.1.1", UserAgent: "Mozilla/5.0"}
+
+	_, err := svc.RedirectURL("abc12345", visit)
+	assert.Equal(t, ErrPasswordRequired, err)
+
+	_, err = svc.UnlockURL("", "abc12345", "wrong")
+	assert.Equal(t, ErrWrongPassword, err)
+
+	unlock, err := svc.UnlockURL("", "abc12345", "hunter22")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), unlock.ExpiresAt, time.Second)
+
+	visit.Unlock = unlock.Token
+	redirect, err := svc.RedirectURL("abc12345", visit)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com", redirect.URL)
+	// Unlocked redirects are per visitor and must not be cached
+	assert.Equal(t, http.StatusFound, redirect.Status)
+
+	// Tokens are bound to their link, their password and the secret
+	_, err = svc.RedirectURL("other123", visit)
+	assert.Equal(t, ErrPasswordRequired, err)
+	_, err = NewService(protectedRepository(t, "changed!"), WithUnlockSecret([]byte("secret"), time.Hour)).RedirectURL("abc12345", visit)
+	assert.Equal(t, ErrPasswordRequired, err)
+	_, err = NewService(protectedRepository(t, "hunter22")).RedirectURL("abc12345", visit)
+	assert.Equal(t, ErrPasswordRequired, err)
+
+	visit.Unlock = strings.Replace(unlock.Token, "abc12345", "abc12346", 1)
+	_, err = svc.RedirectURL("abc12346", visit)
+	assert.Equal(t, ErrPasswordRequired, err)
+}
+
+func TestUnlockExpires(t *testing.T) {
+	svc := NewService(protectedRepository(t, "hunter22"), WithUnlockSecret([]byte("secret"), time.Millisecond))
+
+	unlock, err := svc.UnlockURL("", "abc12345", "hunter22")
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = svc.RedirectURL("abc12345", Visit{IP: "192.168.1.1", Unlock: unlock.Token})
+	assert.Equal(t, ErrPasswordRequired, err)
+}
+
+func TestUnlockDeadLink(t *testing.T) {
+	// Expired and disabled links give the same answer for every password
+	past := time.Now().Add(-time.Minute)
+	expired := protectedRepository(t, "hunter22")
+	expired.expiresAt = &past
+	disabled := protectedRepository(t, "hunter22")
+	disabled.disabled = true
+
+	for _, password := range []string{"hunter22", "wrong"} {
+		_, err := NewService(expired).UnlockURL("", "abc12345", password)
+		assert.Equal(t, ErrURLExpired, err)
+		_, err = NewService(disabled).UnlockURL("", "abc12345", password)
+		assert.Equal(t, ErrURLDisabled, err)
+	}
+}
+
+func TestUnlockPublicLink(t *testing.T) {
+	svc := NewService(&MockRepository{})
+
+	unlock, err := svc.UnlockURL("", "abc12345", "anything")
+	require.NoError(t, err)
+	assert.Empty(t, unlock.Token)
+}
+
+func TestGetURLStatsHidesProtectedURL(t *testing.T) {
+	svc := NewService(protectedRepository(t, "hunter22"))
+
+	stats, err := svc.GetURLStats("abc12345", StatsOptions{})
+	require.NoError(t, err)
+	assert.True(t, stats.PasswordProtected)
+	assert.Empty(t, stats.OriginalURL)
+}
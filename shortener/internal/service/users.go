@@ -0,0 +1,180 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	apiKeyPrefix      = "sk_"
+	apiKeyRandomBytes = 24
+	// apiKeyDisplayLen is how much of a key is kept in clear for display
+	apiKeyDisplayLen  = len(apiKeyPrefix) + 8
+	minPasswordLength = 8
+	// maxPasswordLength is where bcrypt stops reading
+	maxPasswordLength = 72
+	// apiKeyTouchInterval is how stale last_used_at may get, so busy keys
+	// do not cost a write per request
+	apiKeyTouchInterval = time.Minute
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,64}$`)
+
+// dummyPasswordHash is compared against when there is no account to check,
+// so failed logins take as long whether or not the username exists
+var dummyPasswordHash = []byte("$2a$10$43fAQhi8KRKSjEQeAG2l/OBsnWw/DKvSCYbsztlS3qTN9gqAWA5Ie")
+
+// UserService manages accounts and their API keys
+type UserService interface {
+	RegisterUser(username, password string) (*db.User, error)
+	CreateServiceUser(username string) (*db.User, error)
+	Login(username, password string) (*db.User, error)
+	AuthenticateAPIKey(key string) (*db.User, error)
+	CreateAPIKey(userID int64, name string) (string, *db.APIKey, error)
+	ListAPIKeys(userID int64) ([]db.APIKey, error)
+	RotateAPIKey(userID, keyID int64) (string, *db.APIKey, error)
+	RevokeAPIKey(userID, keyID int64) error
+}
+
+func (s *service) RegisterUser(username, password string) (*db.User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash := string(hash)
+
+	return s.createUser(username, &passwordHash, false)
+}
+
+func (s *service) CreateServiceUser(username string) (*db.User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	return s.createUser(username, nil, true)
+}
+
+func (s *service) createUser(username string, passwordHash *string, isService bool) (*db.User, error) {
+	user, err := s.repo.CreateUser(username, passwordHash, isService)
+	if db.IsUniqueViolation(err) {
+		return nil, ErrUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *service) Login(username, password string) (*db.User, error) {
+	user, err := s.repo.GetUserByUsername(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.PasswordHash == nil {
+		// Service accounts cannot log in with a password
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(*user.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+func (s *service) AuthenticateAPIKey(key string) (*db.User, error) {
+	apiKey, err := s.repo.GetAPIKeyByHash(hashAPIKey(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.RevokedAt != nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if apiKey.LastUsedAt == nil || time.Since(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.repo.TouchAPIKey(apiKey.ID); err != nil {
+			log.Printf("Failed to update API key last use: %v", err)
+		}
+	}
+
+	return s.repo.GetUserByID(apiKey.UserID)
+}
+
+func (s *service) CreateAPIKey(userID int64, name string) (string, *db.APIKey, error) {
+	if name == "" {
+		name = "default"
+	}
+	key, err := generateAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiKey, err := s.repo.CreateAPIKey(userID, name, key[:apiKeyDisplayLen], hashAPIKey(key))
+	if err != nil {
+		return "", nil, err
+	}
+	return key, apiKey, nil
+}
+
+func (s *service) ListAPIKeys(userID int64) ([]db.APIKey, error) {
+	return s.repo.ListAPIKeys(userID)
+}
+
+func (s *service) RotateAPIKey(userID, keyID int64) (string, *db.APIKey, error) {
+	key, err := generateAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiKey, err := s.repo.RotateAPIKey(userID, keyID, key[:apiKeyDisplayLen], hashAPIKey(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return key, apiKey, nil
+}
+
+func (s *service) RevokeAPIKey(userID, keyID int64) error {
+	err := s.repo.RevokeAPIKey(userID, keyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// generateAPIKey returns a new random key; only its hash is ever stored
+func generateAPIKey() (string, error) {
+	buf := make([]byte, apiKeyRandomBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
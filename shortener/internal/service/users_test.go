@@ -0,0 +1,185 @@
+package service
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userRepository keeps users and API keys in memory
+type userRepository struct {
+	MockRepository
+	users []db.User
+	keys  []db.APIKey
+	// touches counts TouchAPIKey calls
+	touches int
+}
+
+func (r *userRepository) CreateUser(username string, passwordHash *string, isService bool) (*db.User, error) {
+	user := db.User{ID: int64(len(r.users) + 1), Username: username, PasswordHash: passwordHash, IsService: isService}
+	r.users = append(r.users, user)
+	return &user, nil
+}
+
+func (r *userRepository) GetUserByUsername(username string) (*db.User, error) {
+	for _, u := range r.users {
+		if u.Username == username {
+			return &u, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *userRepository) GetUserByID(id int64) (*db.User, error) {
+	for _, u := range r.users {
+		if u.ID == id {
+			return &u, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *userRepository) CreateAPIKey(userID int64, name, prefix, keyHash string) (*db.APIKey, error) {
+	key := db.APIKey{ID: int64(len(r.keys) + 1), UserID: userID, Name: name, Prefix: prefix, KeyHash: keyHash}
+	r.keys = append(r.keys, key)
+	return &key, nil
+}
+
+func (r *userRepository) GetAPIKeyByHash(keyHash string) (*db.APIKey, error) {
+	for _, k := range r.keys {
+		if k.KeyHash == keyHash {
+			return &k, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *userRepository) TouchAPIKey(keyID int64) error {
+	r.touches++
+	now := time.Now()
+	r.keys[keyID-1].LastUsedAt = &now
+	return nil
+}
+
+func (r *userRepository) RotateAPIKey(userID, keyID int64, prefix, keyHash string) (*db.APIKey, error) {
+	if err := r.RevokeAPIKey(userID, keyID); err != nil {
+		return nil, err
+	}
+	return r.CreateAPIKey(userID, r.keys[keyID-1].Name, prefix, keyHash)
+}
+
+func (r *userRepository) RevokeAPIKey(userID, keyID int64) error {
+	for i := range r.keys {
+		if r.keys[i].ID == keyID && r.keys[i].UserID == userID && r.keys[i].RevokedAt == nil {
+			now := time.Now()
+			r.keys[i].RevokedAt = &now
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	svc := NewService(&userRepository{})
+
+	user, err := svc.RegisterUser("alice", "correct horse")
+	require.NoError(t, err)
+	require.NotNil(t, user.PasswordHash)
+	assert.NotEqual(t, "correct horse", *user.PasswordHash)
+
+	_, err = svc.Login("alice", "wrong password")
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	_, err = svc.Login("bob", "correct horse")
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	loggedIn, err := svc.Login("alice", "correct horse")
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, loggedIn.ID)
+}
+
+func TestRegisterUserValidation(t *testing.T) {
+	svc := NewService(&userRepository{})
+
+	_, err := svc.RegisterUser("a b", "correct horse")
+	assert.Equal(t, ErrInvalidUsername, err)
+
+	_, err = svc.RegisterUser("alice", "short")
+	assert.Equal(t, ErrWeakPassword, err)
+
+	// bcrypt would ignore everything past 72 bytes
+	_, err = svc.RegisterUser("alice", strings.Repeat("a", 73))
+	assert.Equal(t, ErrWeakPassword, err)
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	// Logins for unknown users only take as long as real ones if the dummy
+	// hash parses and costs the same
+	cost, err := bcrypt.Cost(dummyPasswordHash)
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.DefaultCost, cost)
+}
+
+func TestServiceUserCannotLogin(t *testing.T) {
+	svc := NewService(&userRepository{})
+
+	_, err := svc.CreateServiceUser("growth-team")
+	require.NoError(t, err)
+
+	_, err = svc.Login("growth-team", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	repo := &userRepository{}
+	svc := NewService(repo)
+
+	user, err := svc.CreateServiceUser("growth-team")
+	require.NoError(t, err)
+
+	key, apiKey, err := svc.CreateAPIKey(user.ID, "ci")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, apiKey.Prefix))
+	assert.NotContains(t, apiKey.KeyHash, key)
+
+	authed, err := svc.AuthenticateAPIKey(key)
+	require.NoError(t, err)
+	assert.Equal(t, "growth-team", authed.Username)
+
+	// Last use is recorded at most once a minute
+	_, err = svc.AuthenticateAPIKey(key)
+	require.NoError(t, err)
+	assert.Equal(t, 1, repo.touches)
+	stale := time.Now().Add(-2 * time.Minute)
+	repo.keys[apiKey.ID-1].LastUsedAt = &stale
+	_, err = svc.AuthenticateAPIKey(key)
+	require.NoError(t, err)
+	assert.Equal(t, 2, repo.touches)
+
+	_, err = svc.AuthenticateAPIKey("sk_unknown")
+	assert.Equal(t, ErrInvalidAPIKey, err)
+
+	// Rotating invalidates the old key and issues a working replacement
+	rotated, rotatedKey, err := svc.RotateAPIKey(user.ID, apiKey.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ci", rotatedKey.Name)
+
+	_, err = svc.AuthenticateAPIKey(key)
+	assert.Equal(t, ErrInvalidAPIKey, err)
+	_, err = svc.AuthenticateAPIKey(rotated)
+	assert.NoError(t, err)
+
+	// Revoking works once and only for the owner
+	assert.Equal(t, ErrAPIKeyNotFound, svc.RevokeAPIKey(user.ID+1, rotatedKey.ID))
+	assert.NoError(t, svc.RevokeAPIKey(user.ID, rotatedKey.ID))
+	assert.Equal(t, ErrAPIKeyNotFound, svc.RevokeAPIKey(user.ID, rotatedKey.ID))
+
+	_, err = svc.AuthenticateAPIKey(rotated)
+	assert.Equal(t, ErrInvalidAPIKey, err)
+}
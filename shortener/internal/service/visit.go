@@ -0,0 +1,142 @@
+package service
+
+import (
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/useragent"
+)
+
+const (
+	// maxReferrerLength bounds the stored Referer URL
+	maxReferrerLength = 2048
+	// maxUserAgentLength bounds the stored User-Agent
+	maxUserAgentLength = 1024
+	// maxUTMLength bounds each stored utm_* value
+	maxUTMLength = 255
+	// maxUTMExtra bounds how many non-standard utm_* parameters are kept
+	maxUTMExtra = 10
+)
+
+// Visit describes the request that followed a short link
+type Visit struct {
+	IP        string
+	UserAgent string
+	// Referrer is the raw Referer header
+	Referrer string
+	// Query holds the query parameters of the short link request
+	Query url.Values
+	// Unlock is the token from UnlockURL, needed for protected links
+	Unlock string
+	// Variant is the split variant the visitor was sent to before, if any
+	Variant string
+	// Language is the raw Accept-Language header
+	Language string
+	// Host is the request host, which selects the code namespace
+	Host string
+}
+
+// newClick turns a visit into the click row recorded for it
+func (s *service) newClick(shortURLID int64, visit Visit) db.NewClick {
+	// Ensure we have a valid IP
+	ip := visit.IP
+	if ip == "" || ip == "::" || ip == "::1" {
+		ip = "127.0.0.1" // Use localhost for invalid IPs
+	}
+
+	referrer, host := normalizeReferrer(visit.Referrer)
+	userAgent := cleanText(visit.UserAgent, maxUserAgentLength)
+	click := db.NewClick{
+		ShortURLID:   shortURLID,
+		UserAgent:    userAgent,
+		IPAddress:    ip,
+		Referrer:     referrer,
+		ReferrerHost: host,
+		UTM:          parseUTM(visit.Query),
+		CreatedAt:    time.Now(),
+	}
+
+	client := useragent.Parse(userAgent)
+	click.Browser, click.OS, click.Device, click.IsBot = client.Browser, client.OS, client.Device, client.IsBot
+
+	if s.geo != nil {
+		loc := s.geo.Lookup(ip)
+		click.Country, click.Region, click.ASN = loc.Country, loc.Region, loc.ASN
+	}
+	return click
+}
+
+// normalizeReferrer returns the Referer as an absolute http(s) URL without
+// fragment or credentials, and its lowercased host without port. Anything
+// else, such as android-app:// referrers or garbage, yields empty strings.
+func normalizeReferrer(raw string) (string, string) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "", ""
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.User = nil
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	return cleanText(u.String(), maxReferrerLength), cleanText(u.Hostname(), maxReferrerLength)
+}
+
+// parseUTM extracts utm_* parameters; the first value of each wins
+func parseUTM(query url.Values) db.UTM {
+	var utm db.UTM
+	for key, values := range query {
+		name := strings.ToLower(key)
+		if !strings.HasPrefix(name, "utm_") || len(values) == 0 {
+			continue
+		}
+		// Values are percent-decoded, so they can hold any bytes
+		value := cleanText(strings.TrimSpace(values[0]), maxUTMLength)
+		if value == "" {
+			continue
+		}
+
+		switch name = strings.TrimPrefix(name, "utm_"); name {
+		case "source":
+			utm.Source = value
+		case "medium":
+			utm.Medium = value
+		case "campaign":
+			utm.Campaign = value
+		case "term":
+			utm.Term = value
+		case "content":
+			utm.Content = value
+		default:
+			if name == "" || len(utm.Extra) >= maxUTMExtra {
+				continue
+			}
+			if utm.Extra == nil {
+				utm.Extra = make(map[string]string)
+			}
+			utm.Extra[cleanText(name, maxUTMLength)] = value
+		}
+	}
+	return utm
+}
+
+// cleanText makes request data storable: invalid UTF-8 becomes U+FFFD, NUL
+// bytes (which Postgres rejects in text) are removed and the result is cut
+// to at most max bytes without splitting a character
+func cleanText(s string, max int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	s = strings.ReplaceAll(s, "\x00", "")
+	if len(s) <= max {
+		return s
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
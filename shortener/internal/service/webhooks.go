@@ -0,0 +1,207 @@
+package service
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/rusik69/shortener/internal/db"
+)
+
+const (
+	// MaxWebhookThresholds bounds the click thresholds of a webhook
+	MaxWebhookThresholds = 20
+	// MaxWebhookDeliveries bounds how many recent deliveries are listed
+	MaxWebhookDeliveries = 100
+
+	webhookSecretPrefix      = "whsec_"
+	webhookSecretRandomBytes = 24
+)
+
+// WebhookEvents are the events a webhook can subscribe to
+var WebhookEvents = []string{db.EventLinkCreated, db.EventFirstClick, db.EventClickThreshold}
+
+// DefaultWebhookThresholds are used when a webhook subscribes to
+// link.click_threshold without choosing thresholds
+var DefaultWebhookThresholds = []int64{100, 1000}
+
+// WebhookOptions describes a new webhook
+type WebhookOptions struct {
+	URL string `json:"url"`
+	// Events to subscribe to; empty means all of WebhookEvents
+	Events []string `json:"events,omitempty"`
+	// Thresholds are the click counts that fire link.click_threshold
+	Thresholds []int64 `json:"thresholds,omitempty"`
+	// Code limits the webhook to one of the owner's links, in the
+	// namespace of Host; empty covers all of them
+	Code string `json:"code,omitempty"`
+	Host string `json:"-"`
+}
+
+// WebhookService lets owners subscribe URLs to events of their links.
+// Events are queued in an outbox and posted by a webhook.Dispatcher.
+type WebhookService interface {
+	// CreateWebhook returns the secret that signs the payloads, which is
+	// only ever shown once
+	CreateWebhook(ownerID int64, opts WebhookOptions) (string, *db.Webhook, error)
+	ListWebhooks(ownerID int64) ([]db.Webhook, error)
+	DeleteWebhook(ownerID, webhookID int64) error
+	ListWebhookDeliveries(ownerID int64, limit int) ([]db.WebhookDelivery, error)
+}
+
+func (s *service) CreateWebhook(ownerID int64, opts WebhookOptions) (string, *db.Webhook, error) {
+	if err := s.validateURL(opts.URL, opts.Host); err != nil {
+		return "", nil, err
+	}
+	events, err := validateWebhookEvents(opts.Events)
+	if err != nil {
+		return "", nil, err
+	}
+	thresholds, err := validateWebhookThresholds(opts.Thresholds)
+	if err != nil {
+		return "", nil, err
+	}
+	subscribed := false
+	for _, event := range events {
+		subscribed = subscribed || event == db.EventClickThreshold
+	}
+	if !subscribed {
+		thresholds = nil
+	} else if len(thresholds) == 0 {
+		thresholds = append(db.ClickThresholds(nil), DefaultWebhookThresholds...)
+	}
+
+	webhook := db.Webhook{UserID: ownerID, URL: opts.URL, Events: events, Thresholds: thresholds}
+	if opts.Code != "" {
+		link, err := s.GetLink(ownerID, opts.Host, opts.Code)
+		if err != nil {
+			return "", nil, err
+		}
+		webhook.ShortURLID = &link.ID
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	webhook.Secret = secret
+
+	created, err := s.repo.CreateWebhook(webhook)
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, created, nil
+}
+
+// validateWebhookEvents checks the events of a webhook and drops
+// duplicates. An empty list subscribes to every event.
+func validateWebhookEvents(events []string) (db.EventNames, error) {
+	if len(events) == 0 {
+		return append(db.EventNames(nil), WebhookEvents...), nil
+	}
+	validated := make(db.EventNames, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, event := range events {
+		known := false
+		for _, name := range WebhookEvents {
+			known = known || event == name
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			validated = append(validated, event)
+		}
+	}
+	return validated, nil
+}
+
+// validateWebhookThresholds checks click thresholds and returns them sorted
+// without duplicates
+func validateWebhookThresholds(thresholds []int64) (db.ClickThresholds, error) {
+	if len(thresholds) > MaxWebhookThresholds {
+		return nil, fmt.Errorf("%w: at most %d thresholds", ErrInvalidWebhook, MaxWebhookThresholds)
+	}
+	sorted := append(db.ClickThresholds(nil), thresholds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	validated := sorted[:0]
+	for i, threshold := range sorted {
+		if threshold < 1 {
+			return nil, fmt.Errorf("%w: thresholds must be positive", ErrInvalidWebhook)
+		}
+		if i == 0 || threshold != sorted[i-1] {
+			validated = append(validated, threshold)
+		}
+	}
+	return validated, nil
+}
+
+func (s *service) ListWebhooks(ownerID int64) ([]db.Webhook, error) {
+	return s.repo.ListWebhooks(ownerID)
+}
+
+func (s *service) DeleteWebhook(ownerID, webhookID int64) error {
+	err := s.repo.DeleteWebhook(ownerID, webhookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+func (s *service) ListWebhookDeliveries(ownerID int64, limit int) ([]db.WebhookDelivery, error) {
+	if limit < 1 || limit > MaxWebhookDeliveries {
+		limit = MaxWebhookDeliveries
+	}
+	return s.repo.ListWebhookDeliveries(ownerID, limit)
+}
+
+// notifyCreated queues link.created for the owner's webhooks. Failures are
+// logged rather than failing the creation, which already happened.
+func (s *service) notifyCreated(ownerID *int64, links []db.WebhookLink) {
+	if ownerID == nil || len(links) == 0 {
+		return
+	}
+	// Most owners have no webhooks; spare them a query per link
+	webhooks, err := s.repo.ListWebhooks(*ownerID)
+	if err != nil {
+		log.Printf("Failed to queue link.created webhooks: %v", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	now := time.Now()
+	events := make([]db.WebhookEvent, len(links))
+	for i, link := range links {
+		events[i] = db.WebhookEvent{Event: db.EventLinkCreated, Link: link, OccurredAt: now}
+	}
+	if err := s.repo.EnqueueWebhookEvents(*ownerID, events); err != nil {
+		log.Printf("Failed to queue link.created webhooks: %v", err)
+	}
+}
+
+// generateWebhookSecret returns a new random signing secret
+func generateWebhookSecret() (string, error) {
+	buf := make([]byte, webhookSecretRandomBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + hex.EncodeToString(buf), nil
+}
+
+// webhookLink describes a stored link in webhook payloads
+func webhookLink(shortURL *db.ShortURL) db.WebhookLink {
+	return db.WebhookLink{
+		ID:          shortURL.ID,
+		Code:        shortURL.ShortCode,
+		Domain:      shortURL.Domain,
+		OriginalURL: shortURL.OriginalURL,
+		ClickCount:  shortURL.ClickCount,
+	}
+}
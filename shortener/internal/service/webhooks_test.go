@@ -0,0 +1,122 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/urlpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateWebhook(t *testing.T) {
+	repo := &MockRepository{}
+	svc := NewService(repo)
+
+	secret, webhook, err := svc.CreateWebhook(1, WebhookOptions{URL: "https://crm.example.com/hooks"})
+	require.NoError(t, err)
+	assert.Contains(t, secret, webhookSecretPrefix)
+	assert.Equal(t, secret, webhook.Secret)
+	assert.Equal(t, db.EventNames(WebhookEvents), webhook.Events)
+	assert.Equal(t, db.ClickThresholds(DefaultWebhookThresholds), webhook.Thresholds)
+	assert.Nil(t, webhook.ShortURLID)
+
+	_, webhook, err = svc.CreateWebhook(1, WebhookOptions{
+		URL:        "https://crm.example.com/hooks",
+		Events:     []string{db.EventClickThreshold, db.EventClickThreshold},
+		Thresholds: []int64{1000, 10, 1000},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, db.EventNames{db.EventClickThreshold}, webhook.Events)
+	assert.Equal(t, db.ClickThresholds{10, 1000}, webhook.Thresholds)
+
+	_, webhook, err = svc.CreateWebhook(1, WebhookOptions{
+		URL:        "https://crm.example.com/hooks",
+		Events:     []string{db.EventLinkCreated},
+		Thresholds: []int64{10},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, webhook.Thresholds)
+}
+
+func TestCreateWebhookForLink(t *testing.T) {
+	ownerID := int64(1)
+	svc := NewService(&MockRepository{ownerID: &ownerID})
+
+	_, webhook, err := svc.CreateWebhook(ownerID, WebhookOptions{URL: "https://crm.example.com/hooks", Code: "abc12345"})
+	require.NoError(t, err)
+	require.NotNil(t, webhook.ShortURLID)
+	assert.Equal(t, int64(1), *webhook.ShortURLID)
+
+	_, _, err = svc.CreateWebhook(2, WebhookOptions{URL: "https://crm.example.com/hooks", Code: "abc12345"})
+	assert.Equal(t, ErrURLNotFound, err)
+}
+
+func TestCreateWebhookInvalid(t *testing.T) {
+	svc := NewService(&MockRepository{})
+
+	_, _, err := svc.CreateWebhook(1, WebhookOptions{URL: "not a url"})
+	assert.Equal(t, ErrInvalidURL, err)
+	_, _, err = svc.CreateWebhook(1, WebhookOptions{URL: "http://127.0.0.1:8080/hooks"})
+	assert.ErrorIs(t, err, urlpolicy.ErrPrivateAddress)
+	_, _, err = svc.CreateWebhook(1, WebhookOptions{URL: "https://crm.example.com", Events: []string{"link.deleted"}})
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+	_, _, err = svc.CreateWebhook(1, WebhookOptions{URL: "https://crm.example.com", Thresholds: []int64{0}})
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+	_, _, err = svc.CreateWebhook(1, WebhookOptions{URL: "https://crm.example.com", Thresholds: make([]int64, MaxWebhookThresholds+1)})
+	assert.ErrorIs(t, err, ErrInvalidWebhook)
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	repo := &MockRepository{webhooks: []db.Webhook{{ID: 1, UserID: 1}}}
+	svc := NewService(repo)
+
+	assert.Equal(t, ErrWebhookNotFound, svc.DeleteWebhook(2, 1))
+	require.NoError(t, svc.DeleteWebhook(1, 1))
+	assert.Empty(t, repo.webhooks)
+}
+
+func TestCreateShortURLQueuesWebhook(t *testing.T) {
+	ownerID := int64(1)
+	repo := &MockRepository{}
+	svc := NewService(repo)
+
+	// Owners without webhooks queue nothing
+	_, err := svc.CreateShortURL("https://example.com", "", CreateOptions{OwnerID: &ownerID})
+	require.NoError(t, err)
+	assert.Empty(t, repo.events)
+
+	repo.webhooks = []db.Webhook{{ID: 1, UserID: ownerID}}
+	code, err := svc.CreateShortURL("https://example.com", "", CreateOptions{OwnerID: &ownerID})
+	require.NoError(t, err)
+	_, err = svc.CreateShortURL("https://example.com", "", CreateOptions{})
+	require.NoError(t, err)
+
+	require.Len(t, repo.events, 1)
+	assert.Equal(t, db.EventLinkCreated, repo.events[0].Event)
+	assert.Equal(t, code, repo.events[0].Link.Code)
+	assert.Equal(t, "https://example.com", repo.events[0].Link.OriginalURL)
+}
+
+func TestCreateShortURLBatchQueuesWebhooks(t *testing.T) {
+	ownerID := int64(1)
+	repo := &batchRepository{}
+	repo.webhooks = []db.Webhook{{ID: 1, UserID: ownerID}}
+	svc := NewService(repo)
+
+	_, err := svc.CreateShortURLBatch([]BatchItem{
+		{URL: "https://example.com/a", CustomCode: "first"},
+		{URL: "https://example.com/b", CustomCode: "taken"},
+	}, BatchOptions{OwnerID: &ownerID})
+	require.NoError(t, err)
+	require.Len(t, repo.events, 1)
+	assert.Equal(t, "first", repo.events[0].Link.Code)
+
+	// Atomic batches that fail store and announce nothing
+	_, err = svc.CreateShortURLBatch([]BatchItem{
+		{URL: "https://example.com/a", CustomCode: "second"},
+		{URL: "https://example.com/b", CustomCode: "taken"},
+	}, BatchOptions{OwnerID: &ownerID, Atomic: true})
+	require.NoError(t, err)
+	assert.Len(t, repo.events, 1)
+}
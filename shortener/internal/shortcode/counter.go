@@ -0,0 +1,115 @@
+package shortcode
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+)
+
+// DefaultCounterLength gives 62^6 (about 5.7*10^10) codes before they grow
+const DefaultCounterLength = 6
+
+// Counter turns unique sequence numbers into short codes, in the spirit of
+// Hashids/Sqids. Numbers below 62^minLength are scrambled by an affine
+// permutation and padded to minLength; larger numbers are encoded directly and
+// are therefore longer. Both mappings are injective and their ranges do not
+// overlap, so two numbers never produce the same code.
+type Counter struct {
+	next     func() (uint64, error)
+	alphabet string
+	length   int
+	space    uint64
+	mul      uint64
+	offset   uint64
+}
+
+// NewCounter creates a counter generator. next must return a different
+// number on every call, e.g. from a database sequence.
+func NewCounter(next func() (uint64, error), salt string, minLength int) (*Counter, error) {
+	if next == nil {
+		return nil, errors.New("counter short codes need a sequence")
+	}
+	if minLength < 1 || minLength > 10 {
+		return nil, fmt.Errorf("counter short code length must be between 1 and 10, got %d", minLength)
+	}
+
+	space := uint64(1)
+	for i := 0; i < minLength; i++ {
+		space *= uint64(len(Alphabet))
+	}
+
+	// The multiplier must be coprime with 62^n = 2^n * 31^n for the
+	// permutation to be a bijection, i.e. odd and not a multiple of 31.
+	mul := (saltHash(salt, "mul") % space) | 1
+	for mul%31 == 0 {
+		mul = (mul + 2) % space
+	}
+
+	return &Counter{
+		next:     next,
+		alphabet: shuffle(Alphabet, salt),
+		length:   minLength,
+		space:    space,
+		mul:      mul,
+		offset:   saltHash(salt, "offset") % space,
+	}, nil
+}
+
+// Generate returns the code for the next sequence number
+func (g *Counter) Generate() (string, error) {
+	n, err := g.next()
+	if err != nil {
+		return "", err
+	}
+	return g.Encode(n), nil
+}
+
+// Encode returns the code for n
+func (g *Counter) Encode(n uint64) string {
+	if n >= g.space {
+		return encode(n, g.alphabet, 0)
+	}
+	hi, lo := bits.Mul64(n, g.mul)
+	permuted := bits.Rem64(hi, lo, g.space)
+	permuted = (permuted + g.offset) % g.space
+	return encode(permuted, g.alphabet, g.length)
+}
+
+// encode writes n in base len(alphabet), left-padded to width
+func encode(n uint64, alphabet string, width int) string {
+	base := uint64(len(alphabet))
+	var buf [16]byte
+	i := len(buf)
+	for n > 0 || len(buf)-i < width || i == len(buf) {
+		i--
+		buf[i] = alphabet[n%base]
+		n /= base
+	}
+	return string(buf[i:])
+}
+
+// shuffle deterministically permutes alphabet using salt, the same way
+// Hashids does, so different deployments produce different codes
+func shuffle(alphabet, salt string) string {
+	if salt == "" {
+		return alphabet
+	}
+	a := []byte(alphabet)
+	for i, v, p := len(a)-1, 0, 0; i > 0; i-- {
+		v %= len(salt)
+		p += int(salt[v])
+		j := (int(salt[v]) + v + p) % i
+		a[i], a[j] = a[j], a[i]
+		v++
+	}
+	return string(a)
+}
+
+func saltHash(salt, purpose string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(purpose))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(salt))
+	return h.Sum64()
+}
@@ -0,0 +1,168 @@
+package shortcode
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// MaxLength is the longest code the short_urls.short_code column holds.
+	// The baseline migration hard-codes the same width; change both
+	// together (TestShortCodeColumnWidth checks they match).
+	MaxLength = 32
+	// DefaultMinLength is the shortest custom code accepted by default
+	DefaultMinLength = 3
+)
+
+// ErrInvalidCode is wrapped by every policy violation
+var ErrInvalidCode = errors.New("invalid short code")
+
+// DefaultReserved are codes kept free for current and future routes, in
+// addition to the routes registered on the router
+var DefaultReserved = []string{
+	"about", "admin", "api", "app", "assets", "dashboard", "docs", "favicon",
+	"health", "help", "login", "logout", "metrics", "qr", "register",
+	"robots", "settings", "signup", "static", "status", "www",
+}
+
+// PolicyConfig tunes a Policy
+type PolicyConfig struct {
+	MinLength int
+	// MaxLength may only lower the schema limit
+	MaxLength int
+	// CaseInsensitive folds codes to lower case on creation and lookup
+	CaseInsensitive bool
+	Reserved        []string
+	// Blocklist holds words that may not appear anywhere in a code
+	Blocklist []string
+}
+
+// Policy decides which short codes are acceptable. It is shared by link
+// creation, redirects and the database schema so that every code that can be
+// created can also be resolved.
+type Policy struct {
+	minLength       int
+	maxLength       int
+	caseInsensitive bool
+
+	mu        sync.RWMutex
+	reserved  map[string]struct{}
+	blocklist []string
+}
+
+// NewPolicy creates a policy, filling in defaults for zero values
+func NewPolicy(cfg PolicyConfig) *Policy {
+	p := &Policy{
+		minLength:       cfg.MinLength,
+		maxLength:       cfg.MaxLength,
+		caseInsensitive: cfg.CaseInsensitive,
+		reserved:        make(map[string]struct{}),
+	}
+	if p.minLength <= 0 {
+		p.minLength = DefaultMinLength
+	}
+	if p.maxLength <= 0 || p.maxLength > MaxLength {
+		p.maxLength = MaxLength
+	}
+	p.Reserve(DefaultReserved...)
+	p.Reserve(cfg.Reserved...)
+	for _, word := range cfg.Blocklist {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			p.blocklist = append(p.blocklist, word)
+		}
+	}
+	return p
+}
+
+// Reserve marks codes as unavailable, e.g. the first segment of every route
+func (p *Policy) Reserve(codes ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, code := range codes {
+		if code = strings.ToLower(strings.TrimSpace(code)); code != "" {
+			p.reserved[code] = struct{}{}
+		}
+	}
+}
+
+// CaseInsensitive reports whether codes are folded to lower case
+func (p *Policy) CaseInsensitive() bool {
+	return p.caseInsensitive
+}
+
+// Normalize returns the stored form of a code
+func (p *Policy) Normalize(code string) string {
+	if p.caseInsensitive {
+		return strings.ToLower(code)
+	}
+	return code
+}
+
+// Validate checks a code a user wants to create
+func (p *Policy) Validate(code string) error {
+	if len(code) < p.minLength || len(code) > p.maxLength {
+		return fmt.Errorf("%w: must be between %d and %d characters", ErrInvalidCode, p.minLength, p.maxLength)
+	}
+	if !validCharset(code) {
+		return fmt.Errorf("%w: only letters, digits, '-' and '_' are allowed", ErrInvalidCode)
+	}
+	return p.checkWords(code)
+}
+
+// Allowed reports whether a generated code is free of reserved and blocked
+// words. Generators do not know about either, so callers regenerate on false.
+func (p *Policy) Allowed(code string) bool {
+	return p.checkWords(code) == nil
+}
+
+// Resolvable reports whether a code could exist at all, letting redirects
+// skip the database for obviously bogus paths
+func (p *Policy) Resolvable(code string) bool {
+	return len(code) > 0 && len(code) <= MaxLength && validCharset(code)
+}
+
+func (p *Policy) checkWords(code string) error {
+	lower := strings.ToLower(code)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if _, reserved := p.reserved[lower]; reserved {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidCode, code)
+	}
+	for _, word := range p.blocklist {
+		if strings.Contains(lower, word) {
+			return fmt.Errorf("%w: contains a blocked word", ErrInvalidCode)
+		}
+	}
+	return nil
+}
+
+func validCharset(code string) bool {
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ReadWordList reads one word per line, ignoring blank lines and # comments
+func ReadWordList(r io.Reader) ([]string, error) {
+	var words []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	return words, scanner.Err()
+}
@@ -0,0 +1,68 @@
+package shortcode
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	p := NewPolicy(PolicyConfig{Reserved: []string{"shorten"}, Blocklist: []string{"darn"}})
+
+	assert.NoError(t, p.Validate("spring-sale_2024"))
+	assert.NoError(t, p.Validate(strings.Repeat("a", MaxLength)))
+
+	for _, code := range []string{
+		"ab",                             // too short
+		strings.Repeat("a", MaxLength+1), // longer than the column
+		"with space",                     // charset
+		"emoji😀",                         // charset
+		"API",                            // default reserved, any case
+		"shorten",                        // configured reserved
+		"DarnIt",                         // blocklisted substring
+	} {
+		err := p.Validate(code)
+		assert.True(t, errors.Is(err, ErrInvalidCode), "expected %q to be rejected, got %v", code, err)
+	}
+}
+
+func TestPolicyReserve(t *testing.T) {
+	p := NewPolicy(PolicyConfig{})
+	assert.NoError(t, p.Validate("pricing"))
+
+	p.Reserve("Pricing")
+	assert.Error(t, p.Validate("pricing"))
+	assert.False(t, p.Allowed("pricing"))
+}
+
+func TestPolicyMaxLength(t *testing.T) {
+	p := NewPolicy(PolicyConfig{MaxLength: 10})
+	assert.Error(t, p.Validate("elevenchars"))
+
+	// The schema limit cannot be raised
+	p = NewPolicy(PolicyConfig{MaxLength: 100})
+	assert.Error(t, p.Validate(strings.Repeat("a", MaxLength+1)))
+}
+
+func TestPolicyNormalize(t *testing.T) {
+	assert.Equal(t, "Promo", NewPolicy(PolicyConfig{}).Normalize("Promo"))
+	assert.Equal(t, "promo", NewPolicy(PolicyConfig{CaseInsensitive: true}).Normalize("Promo"))
+}
+
+func TestPolicyResolvable(t *testing.T) {
+	p := NewPolicy(PolicyConfig{})
+	assert.True(t, p.Resolvable("abc12345"))
+	assert.True(t, p.Resolvable("x")) // legacy codes may be shorter than the minimum
+	assert.False(t, p.Resolvable(""))
+	assert.False(t, p.Resolvable("favicon.ico"))
+	assert.False(t, p.Resolvable(strings.Repeat("a", MaxLength+1)))
+}
+
+func TestReadWordList(t *testing.T) {
+	words, err := ReadWordList(strings.NewReader("# comment\nfoo\n\n  bar  \n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, words)
+}
@@ -0,0 +1,44 @@
+package shortcode
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// DefaultRandomLength gives 62^8 (about 2*10^14) possible codes
+const DefaultRandomLength = 8
+
+// Random generates uniformly random base62 codes of a fixed length
+type Random struct {
+	length int
+}
+
+// NewRandom creates a random generator producing codes of the given length
+func NewRandom(length int) (*Random, error) {
+	if length < 4 {
+		return nil, fmt.Errorf("random short codes must be at least 4 characters, got %d", length)
+	}
+	return &Random{length: length}, nil
+}
+
+// Generate returns a new random code
+func (g *Random) Generate() (string, error) {
+	code := make([]byte, 0, g.length)
+	buf := make([]byte, g.length*2)
+	for len(code) < g.length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// Reject the top of the byte range to keep the distribution uniform
+			if b >= 248 {
+				continue
+			}
+			code = append(code, Alphabet[int(b)%len(Alphabet)])
+			if len(code) == g.length {
+				break
+			}
+		}
+	}
+	return string(code), nil
+}
@@ -0,0 +1,57 @@
+// Package shortcode generates short codes for shortened URLs.
+package shortcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Alphabet is the base62 character set used by the generators
+const Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Generator produces candidate short codes. Codes from random generators may
+// collide with existing ones, so callers retry on unique violations.
+type Generator interface {
+	Generate() (string, error)
+}
+
+// Strategy names accepted by New
+const (
+	StrategyRandom  = "random"
+	StrategyCounter = "counter"
+	StrategyWords   = "words"
+)
+
+// Config selects and tunes a generator
+type Config struct {
+	// Strategy is one of random, counter or words; empty means random
+	Strategy string
+	// Length is the code length for random codes and the minimum length for
+	// counter codes
+	Length int
+	// Salt shuffles the counter alphabet so that codes are not guessable
+	Salt string
+}
+
+// New builds the generator described by cfg. next supplies unique,
+// increasing numbers and is only used by the counter strategy.
+func New(cfg Config, next func() (uint64, error)) (Generator, error) {
+	switch strings.ToLower(cfg.Strategy) {
+	case "", StrategyRandom:
+		length := cfg.Length
+		if length == 0 {
+			length = DefaultRandomLength
+		}
+		return NewRandom(length)
+	case StrategyCounter:
+		length := cfg.Length
+		if length == 0 {
+			length = DefaultCounterLength
+		}
+		return NewCounter(next, cfg.Salt, length)
+	case StrategyWords:
+		return NewWords(), nil
+	default:
+		return nil, fmt.Errorf("unknown short code strategy %q", cfg.Strategy)
+	}
+}
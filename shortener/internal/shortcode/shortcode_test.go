@@ -0,0 +1,108 @@
+package shortcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandom(t *testing.T) {
+	g, err := NewRandom(10)
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		code, err := g.Generate()
+		require.NoError(t, err)
+		assert.Len(t, code, 10)
+		for _, r := range code {
+			assert.True(t, strings.ContainsRune(Alphabet, r), "unexpected character %q", r)
+		}
+		seen[code] = true
+	}
+	assert.Len(t, seen, 1000)
+
+	_, err = NewRandom(3)
+	assert.Error(t, err)
+}
+
+func TestCounterIsInjective(t *testing.T) {
+	g, err := NewCounter(func() (uint64, error) { return 0, nil }, "pepper", 2)
+	require.NoError(t, err)
+
+	// Cover the whole padded range plus some of the longer codes after it
+	seen := make(map[string]uint64)
+	for n := uint64(0); n < 62*62+500; n++ {
+		code := g.Encode(n)
+		if n < 62*62 {
+			assert.Len(t, code, 2)
+		} else {
+			assert.Greater(t, len(code), 2)
+		}
+		if prev, dup := seen[code]; dup {
+			t.Fatalf("numbers %d and %d both encode to %q", prev, n, code)
+		}
+		seen[code] = n
+	}
+}
+
+func TestCounterGenerate(t *testing.T) {
+	var n uint64
+	next := func() (uint64, error) {
+		n++
+		return n, nil
+	}
+
+	g, err := NewCounter(next, "pepper", DefaultCounterLength)
+	require.NoError(t, err)
+
+	first, err := g.Generate()
+	require.NoError(t, err)
+	second, err := g.Generate()
+	require.NoError(t, err)
+
+	assert.Len(t, first, DefaultCounterLength)
+	assert.NotEqual(t, first, second)
+
+	// The salt changes the codes
+	other, err := NewCounter(func() (uint64, error) { return 1, nil }, "salt", DefaultCounterLength)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, other.Encode(1))
+	assert.Equal(t, first, g.Encode(1))
+}
+
+func TestWords(t *testing.T) {
+	for _, w := range append(append([]string{}, adjectives...), nouns...) {
+		assert.LessOrEqual(t, len(w), 4, w)
+	}
+
+	g := NewWords()
+	for i := 0; i < 100; i++ {
+		code, err := g.Generate()
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(code), 10)
+		assert.GreaterOrEqual(t, len(code), 7)
+	}
+}
+
+func TestNew(t *testing.T) {
+	g, err := New(Config{}, nil)
+	require.NoError(t, err)
+	assert.IsType(t, &Random{}, g)
+
+	g, err = New(Config{Strategy: "counter", Salt: "s"}, func() (uint64, error) { return 1, nil })
+	require.NoError(t, err)
+	assert.IsType(t, &Counter{}, g)
+
+	_, err = New(Config{Strategy: "counter"}, nil)
+	assert.Error(t, err)
+
+	g, err = New(Config{Strategy: "Words"}, nil)
+	require.NoError(t, err)
+	assert.IsType(t, &Words{}, g)
+
+	_, err = New(Config{Strategy: "uuid"}, nil)
+	assert.Error(t, err)
+}
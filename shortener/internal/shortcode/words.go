@@ -0,0 +1,61 @@
+package shortcode
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+// Words of at most four letters keep codes within ten characters
+var (
+	adjectives = []string{
+		"able", "bold", "blue", "busy", "calm", "cool", "cozy", "cute",
+		"dark", "deep", "easy", "fair", "fast", "fine", "fond", "free",
+		"glad", "gold", "good", "kind", "keen", "late", "lazy", "live",
+		"loud", "lush", "mild", "neat", "nice", "odd", "pink", "pure",
+		"rare", "red", "rich", "ripe", "safe", "shy", "slow", "soft",
+		"spry", "tall", "tidy", "tiny", "true", "warm", "wild", "wise",
+	}
+	nouns = []string{
+		"ant", "bat", "bear", "bee", "bird", "boat", "cat", "clam",
+		"cod", "cow", "crab", "deer", "dog", "dove", "duck", "elk",
+		"fish", "fox", "frog", "goat", "hare", "hawk", "jay", "kite",
+		"lamb", "lark", "lion", "lynx", "mole", "moon", "moth", "newt",
+		"owl", "pike", "pony", "puma", "ram", "seal", "star", "swan",
+		"tree", "toad", "wasp", "wave", "wind", "wolf", "wren", "yak",
+	}
+)
+
+// Words generates readable codes such as "calmfox42". The code space is
+// small (about 230,000 codes), so it suits low-volume, human-facing links.
+type Words struct{}
+
+// NewWords creates a word-based generator
+func NewWords() *Words {
+	return &Words{}
+}
+
+// Generate returns a new adjective-noun-number code
+func (g *Words) Generate() (string, error) {
+	adj, err := pick(len(adjectives))
+	if err != nil {
+		return "", err
+	}
+	noun, err := pick(len(nouns))
+	if err != nil {
+		return "", err
+	}
+	num, err := pick(100)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s%02d", adjectives[adj], nouns[noun], num), nil
+}
+
+func pick(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64()), nil
+}
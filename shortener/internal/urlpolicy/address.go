@@ -0,0 +1,99 @@
+package urlpolicy
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// reservedPrefixes are internal or unroutable ranges that netip.Addr's
+// predicates do not cover
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, incl. broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64 of any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+}
+
+// internalNames are special-use domains that never resolve on the public
+// internet
+var internalNames = []string{"localhost", "local", "localdomain", "internal", "intranet", "lan", "home.arpa"}
+
+// InternalAddr reports whether addr is loopback, private, link-local,
+// multicast, unspecified or reserved. Servers connecting to user-supplied
+// URLs should refuse such addresses at dial time, after DNS resolution.
+func InternalAddr(addr netip.Addr) bool {
+	return internalAddr(addr)
+}
+
+// internalAddr reports whether addr is loopback, private, link-local,
+// multicast, unspecified or reserved
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalName reports whether host is a special-use or single-label name
+// that can only refer to a machine on the local network
+func internalName(host string) bool {
+	if !strings.Contains(host, ".") {
+		return true
+	}
+	for _, name := range internalNames {
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses host as an IP address, including the legacy IPv4 forms
+// browsers still accept such as 2130706433, 0x7f.1 or 0177.0.0.1
+func parseIP(host string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap(), true
+	}
+
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 0, 32)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		values[i] = value
+	}
+
+	// Every part but the last is one byte; the last fills the rest
+	var ip uint64
+	for i, value := range values[:len(values)-1] {
+		if value > 0xff {
+			return netip.Addr{}, false
+		}
+		ip |= value << (24 - 8*i)
+	}
+	last := values[len(values)-1]
+	if last >= 1<<(8*(5-len(values))) {
+		return netip.Addr{}, false
+	}
+	ip |= last
+
+	return netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}), true
+}
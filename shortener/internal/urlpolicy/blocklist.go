@@ -0,0 +1,123 @@
+package urlpolicy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultReloadInterval is how often the blocklist file is checked for changes
+const DefaultReloadInterval = time.Minute
+
+// blocklist is a domain list file that is reread when it changes on disk
+type blocklist struct {
+	path    string
+	domains map[string]bool
+	modTime time.Time
+	size    int64
+}
+
+// loadBlocklist reads the file at path
+func loadBlocklist(path string) (*blocklist, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	domains, err := ReadDomainList(file)
+	if err != nil {
+		return nil, err
+	}
+	list := &blocklist{
+		path:    path,
+		domains: make(map[string]bool, len(domains)),
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	for _, domain := range domains {
+		list.domains[domain] = true
+	}
+	return list, nil
+}
+
+// changed reports whether the file on disk differs from the loaded one
+func (b *blocklist) changed() bool {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(b.modTime) || info.Size() != b.size
+}
+
+// ReadDomainList reads one domain per line, ignoring blank lines and #
+// comments. Hosts-file lines such as "0.0.0.0 example.com" are accepted;
+// the last field is the domain. Blocking a domain blocks its subdomains.
+func ReadDomainList(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		domain, err := normalizeHost(fields[len(fields)-1])
+		if err != nil {
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	return domains, scanner.Err()
+}
+
+// Reload rereads the blocklist if it changed on disk since it was loaded.
+// On error the previous list stays in effect.
+func (p *Policy) Reload() error {
+	p.mu.RLock()
+	current := p.blocklist
+	p.mu.RUnlock()
+	if current == nil || !current.changed() {
+		return nil
+	}
+
+	list, err := loadBlocklist(current.path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.blocklist = list
+	p.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the blocklist every interval until ctx is done.
+// Non-positive intervals fall back to DefaultReloadInterval.
+func (p *Policy) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Reload(); err != nil {
+				log.Printf("Failed to reload URL blocklist: %v", err)
+			}
+		}
+	}
+}
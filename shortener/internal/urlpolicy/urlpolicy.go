@@ -0,0 +1,274 @@
+// Package urlpolicy decides which destinations may be shortened. It rejects
+// schemes outside an allowlist, URLs with embedded credentials, links back
+// to the shortener itself, hosts on a domain blocklist, other URL
+// shorteners and addresses on private or loopback networks.
+package urlpolicy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// Error is a rejected destination. Code is stable and meant for API
+// clients; Reason explains the rejection.
+type Error struct {
+	Code   string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return e.Reason
+}
+
+// Is matches errors with the same Code, so errors.Is(err, ErrBlockedDomain)
+// holds for every blocked domain
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+var (
+	// ErrInvalid is returned for URLs that cannot be parsed or have no host
+	ErrInvalid = &Error{Code: "invalid_url", Reason: "invalid URL"}
+	// ErrScheme is returned for schemes outside the allowlist
+	ErrScheme = &Error{Code: "scheme_not_allowed", Reason: "URL scheme is not allowed"}
+	// ErrCredentials is returned for URLs with a user name or password
+	ErrCredentials = &Error{Code: "credentials_not_allowed", Reason: "URLs with credentials are not allowed"}
+	// ErrSelfReference is returned for links to the shortener itself,
+	// which would redirect in a loop
+	ErrSelfReference = &Error{Code: "self_reference", Reason: "URL points back to this shortener"}
+	// ErrBlockedDomain is returned for hosts on the blocklist
+	ErrBlockedDomain = &Error{Code: "blocked_domain", Reason: "domain is blocked"}
+	// ErrShortenerChain is returned for links to other URL shorteners
+	ErrShortenerChain = &Error{Code: "shortener_chain", Reason: "URL points to another URL shortener"}
+	// ErrPrivateAddress is returned for hosts on private, loopback or
+	// otherwise internal networks
+	ErrPrivateAddress = &Error{Code: "private_address", Reason: "URL points to a private network address"}
+)
+
+// reject returns err with a reason naming the offending part of the URL
+func reject(err *Error, format string, args ...any) *Error {
+	return &Error{Code: err.Code, Reason: err.Reason + ": " + fmt.Sprintf(format, args...)}
+}
+
+// DefaultSchemes are allowed unless Config.Schemes says otherwise
+var DefaultSchemes = []string{"http", "https"}
+
+// DefaultShorteners are well-known URL shorteners. Links to them hide the
+// final destination from the blocklist and can build redirect chains.
+var DefaultShorteners = []string{
+	"bit.ly", "bitly.com", "bl.ink", "buff.ly", "cutt.ly", "goo.gl",
+	"is.gd", "lnkd.in", "ow.ly", "rb.gy", "rebrand.ly", "s.id",
+	"shorturl.at", "t.co", "t.ly", "tiny.cc", "tinyurl.com", "v.gd",
+}
+
+// resolveTimeout bounds DNS lookups when Config.Resolve is set
+const resolveTimeout = 2 * time.Second
+
+// Config tunes the policy; zero values pick the defaults
+type Config struct {
+	// Schemes are the allowed URL schemes. Empty means DefaultSchemes.
+	Schemes []string
+	// SelfHosts are the host names the shortener is served on
+	SelfHosts []string
+	// Shorteners are the domains treated as other URL shorteners. Empty
+	// means DefaultShorteners.
+	Shorteners []string
+	// AllowShorteners permits links to other URL shorteners
+	AllowShorteners bool
+	// AllowPrivate permits private, loopback and link-local destinations
+	AllowPrivate bool
+	// BlocklistPath is a file of blocked domains, reloaded when it changes
+	BlocklistPath string
+	// Resolve looks up host names and rejects those that resolve to
+	// private addresses. Lookup failures are not treated as rejections.
+	Resolve bool
+}
+
+// Policy checks destination URLs. It is safe for concurrent use.
+type Policy struct {
+	schemes    map[string]bool
+	selfHosts  map[string]bool
+	shorteners map[string]bool
+	cfg        Config
+	lookup     func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu        sync.RWMutex
+	blocklist *blocklist
+}
+
+// New returns a policy for cfg, loading the blocklist if one is configured
+func New(cfg Config) (*Policy, error) {
+	if len(cfg.Schemes) == 0 {
+		cfg.Schemes = DefaultSchemes
+	}
+	if len(cfg.Shorteners) == 0 {
+		cfg.Shorteners = DefaultShorteners
+	}
+
+	p := &Policy{
+		schemes:    make(map[string]bool, len(cfg.Schemes)),
+		selfHosts:  make(map[string]bool, len(cfg.SelfHosts)),
+		shorteners: make(map[string]bool, len(cfg.Shorteners)),
+		cfg:        cfg,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+	}
+	for _, scheme := range cfg.Schemes {
+		p.schemes[strings.ToLower(scheme)] = true
+	}
+	for _, host := range cfg.SelfHosts {
+		if host, ok := selfHost(host); ok {
+			p.selfHosts[host] = true
+		}
+	}
+	for _, domain := range cfg.Shorteners {
+		if domain, err := normalizeHost(domain); err == nil {
+			p.shorteners[domain] = true
+		}
+	}
+
+	if cfg.BlocklistPath != "" {
+		list, err := loadBlocklist(cfg.BlocklistPath)
+		if err != nil {
+			return nil, err
+		}
+		p.blocklist = list
+	}
+	return p, nil
+}
+
+// Check returns nil if rawURL may be shortened, or an *Error saying why not.
+// selfHosts are further hosts the shortener is reached on, such as the
+// host of the request creating the link; they are rejected like
+// Config.SelfHosts.
+func (p *Policy) Check(rawURL string, selfHosts ...string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ErrInvalid
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if !p.schemes[scheme] {
+		return reject(ErrScheme, "%q", scheme)
+	}
+	if u.User != nil {
+		return ErrCredentials
+	}
+
+	host, err := normalizeHost(u.Hostname())
+	if err != nil {
+		return ErrInvalid
+	}
+
+	if p.selfHosts[host] {
+		return reject(ErrSelfReference, "%s", host)
+	}
+	for _, self := range selfHosts {
+		if self, ok := selfHost(self); ok && self == host {
+			return reject(ErrSelfReference, "%s", host)
+		}
+	}
+	if domain, ok := p.blocked(host); ok {
+		return reject(ErrBlockedDomain, "%s", domain)
+	}
+	if !p.cfg.AllowShorteners {
+		if domain, ok := matchDomain(p.shorteners, host); ok {
+			return reject(ErrShortenerChain, "%s", domain)
+		}
+	}
+
+	if p.cfg.AllowPrivate {
+		return nil
+	}
+	if addr, ok := parseIP(host); ok {
+		if internalAddr(addr) {
+			return reject(ErrPrivateAddress, "%s", addr)
+		}
+		return nil
+	}
+	if internalName(host) {
+		return reject(ErrPrivateAddress, "%s", host)
+	}
+	if p.cfg.Resolve {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		addrs, err := p.lookup(ctx, host)
+		if err != nil {
+			return nil
+		}
+		for _, addr := range addrs {
+			if internalAddr(addr.Unmap()) {
+				return reject(ErrPrivateAddress, "%s resolves to %s", host, addr.Unmap())
+			}
+		}
+	}
+	return nil
+}
+
+// blocked reports the blocklist entry matching host, if any
+func (p *Policy) blocked(host string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.blocklist == nil {
+		return "", false
+	}
+	return matchDomain(p.blocklist.domains, host)
+}
+
+// selfHost normalizes a host the shortener is served on. It accepts
+// "host:port" and full URLs as well as bare host names.
+func selfHost(host string) (string, bool) {
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host, err := normalizeHost(host)
+	return host, err == nil
+}
+
+// normalizeHost lowercases host, drops a trailing dot and converts
+// internationalized names to their ASCII (punycode) form so that lookalike
+// spellings match the same list entries
+func normalizeHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if host == "" {
+		return "", ErrInvalid
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return host, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		// Not a valid IDN; keep the name so list entries still match it
+		return host, nil
+	}
+	return ascii, nil
+}
+
+// matchDomain reports the entry of set that is host or one of its parent
+// domains
+func matchDomain(set map[string]bool, host string) (string, bool) {
+	for domain := host; domain != ""; {
+		if set[domain] {
+			return domain, true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			break
+		}
+		domain = parent
+	}
+	return "", false
+}
@@ -0,0 +1,160 @@
+// Package useragent derives browser, operating system, device class and a
+// bot flag from User-Agent headers. It recognises the clients that matter
+// for click analytics rather than every string in the wild.
+package useragent
+
+import "strings"
+
+// Device classes
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+// Info is what a User-Agent header reveals about the client
+type Info struct {
+	// Browser is the browser family, or the crawler name for known bots
+	Browser string
+	OS      string
+	Device  string
+	IsBot   bool
+}
+
+// knownBots maps lowercase User-Agent fragments to crawler names. Link
+// preview fetchers are listed first so they win over generic matches.
+var knownBots = []struct {
+	token, name string
+}{
+	{"slackbot", "Slackbot"},
+	{"slack-imgproxy", "Slackbot"},
+	{"twitterbot", "Twitterbot"},
+	{"facebookexternalhit", "Facebook"},
+	{"facebookcatalog", "Facebook"},
+	{"linkedinbot", "LinkedInBot"},
+	{"discordbot", "Discordbot"},
+	{"telegrambot", "TelegramBot"},
+	{"whatsapp", "WhatsApp"},
+	{"skypeuripreview", "Skype"},
+	{"microsoftpreview", "Microsoft Preview"},
+	{"bingpreview", "BingPreview"},
+	{"pinterestbot", "Pinterestbot"},
+	{"redditbot", "Redditbot"},
+	{"applebot", "Applebot"},
+	{"googlebot", "Googlebot"},
+	{"google-inspectiontool", "Googlebot"},
+	{"adsbot-google", "Googlebot"},
+	{"bingbot", "Bingbot"},
+	{"yandex", "YandexBot"},
+	{"baiduspider", "Baiduspider"},
+	{"duckduckbot", "DuckDuckBot"},
+	{"embedly", "Embedly"},
+	{"iframely", "Iframely"},
+	{"headlesschrome", "HeadlessChrome"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"python-requests", "python-requests"},
+	{"python-urllib", "python-urllib"},
+	{"go-http-client", "Go-http-client"},
+	{"node-fetch", "node-fetch"},
+	{"axios/", "axios"},
+	{"libwww-perl", "libwww-perl"},
+	{"java/", "Java"},
+	{"apache-httpclient", "Apache-HttpClient"},
+}
+
+// genericBotTokens mark self-declared crawlers that are not listed above
+var genericBotTokens = []string{"bot", "crawler", "spider", "slurp", "preview", "fetcher", "monitor"}
+
+// Parse classifies a User-Agent header. An empty header counts as a bot:
+// browsers always send one.
+func Parse(ua string) Info {
+	lower := strings.ToLower(strings.TrimSpace(ua))
+	if lower == "" {
+		return Info{Device: DeviceBot, IsBot: true}
+	}
+
+	info := Info{OS: parseOS(ua)}
+
+	for _, bot := range knownBots {
+		if strings.Contains(lower, bot.token) {
+			info.Browser = bot.name
+			info.Device = DeviceBot
+			info.IsBot = true
+			return info
+		}
+	}
+	for _, token := range genericBotTokens {
+		if strings.Contains(lower, token) {
+			info.Browser = "Other"
+			info.Device = DeviceBot
+			info.IsBot = true
+			return info
+		}
+	}
+
+	info.Browser = parseBrowser(ua)
+	info.Device = parseDevice(ua, info.OS)
+	return info
+}
+
+// parseBrowser checks the tokens of browsers built on another engine before
+// the engine they claim to be compatible with
+func parseBrowser(ua string) string {
+	switch {
+	case strings.Contains(ua, "Edg/"), strings.Contains(ua, "EdgA/"), strings.Contains(ua, "EdgiOS/"), strings.Contains(ua, "Edge/"):
+		return "Edge"
+	case strings.Contains(ua, "OPR/"), strings.Contains(ua, "Opera"):
+		return "Opera"
+	case strings.Contains(ua, "SamsungBrowser/"):
+		return "Samsung Internet"
+	case strings.Contains(ua, "YaBrowser/"):
+		return "Yandex Browser"
+	case strings.Contains(ua, "Firefox/"), strings.Contains(ua, "FxiOS/"):
+		return "Firefox"
+	case strings.Contains(ua, "CriOS/"), strings.Contains(ua, "Chrome/"), strings.Contains(ua, "Chromium/"):
+		return "Chrome"
+	case strings.Contains(ua, "Safari/") && strings.Contains(ua, "Version/"):
+		return "Safari"
+	case strings.Contains(ua, "MSIE "), strings.Contains(ua, "Trident/"):
+		return "Internet Explorer"
+	}
+	return "Other"
+}
+
+func parseOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "Windows"):
+		return "Windows"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return "iOS"
+	case strings.Contains(ua, "Android"):
+		return "Android"
+	case strings.Contains(ua, "CrOS"):
+		return "ChromeOS"
+	case strings.Contains(ua, "Mac OS X"), strings.Contains(ua, "Macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "Linux"), strings.Contains(ua, "X11"):
+		return "Linux"
+	}
+	return "Other"
+}
+
+func parseDevice(ua, os string) string {
+	switch {
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"):
+		return DeviceTablet
+	case os == "Android" && !strings.Contains(ua, "Mobile"):
+		// Android tablets omit the Mobile token
+		return DeviceTablet
+	case strings.Contains(ua, "Mobi"), strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"):
+		return DeviceMobile
+	}
+	switch os {
+	case "Windows", "macOS", "Linux", "ChromeOS":
+		return DeviceDesktop
+	}
+	return DeviceOther
+}
@@ -0,0 +1,97 @@
+package useragent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name string
+		ua   string
+		want Info
+	}{
+		{
+			"chrome on windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			Info{Browser: "Chrome", OS: "Windows", Device: DeviceDesktop},
+		},
+		{
+			"edge on windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.51",
+			Info{Browser: "Edge", OS: "Windows", Device: DeviceDesktop},
+		},
+		{
+			"safari on iphone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			Info{Browser: "Safari", OS: "iOS", Device: DeviceMobile},
+		},
+		{
+			"chrome on ipad",
+			"Mozilla/5.0 (iPad; CPU OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/124.0.6367.88 Mobile/15E148 Safari/604.1",
+			Info{Browser: "Chrome", OS: "iOS", Device: DeviceTablet},
+		},
+		{
+			"firefox on android phone",
+			"Mozilla/5.0 (Android 14; Mobile; rv:125.0) Gecko/125.0 Firefox/125.0",
+			Info{Browser: "Firefox", OS: "Android", Device: DeviceMobile},
+		},
+		{
+			"samsung on android tablet",
+			"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/24.0 Chrome/117.0.0.0 Safari/537.36",
+			Info{Browser: "Samsung Internet", OS: "Android", Device: DeviceTablet},
+		},
+		{
+			"safari on mac",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4.1 Safari/605.1.15",
+			Info{Browser: "Safari", OS: "macOS", Device: DeviceDesktop},
+		},
+		{
+			"firefox on linux",
+			"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+			Info{Browser: "Firefox", OS: "Linux", Device: DeviceDesktop},
+		},
+		{
+			"slack preview",
+			"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+			Info{Browser: "Slackbot", OS: "Other", Device: DeviceBot, IsBot: true},
+		},
+		{
+			"twitter preview",
+			"Twitterbot/1.0",
+			Info{Browser: "Twitterbot", OS: "Other", Device: DeviceBot, IsBot: true},
+		},
+		{
+			"facebook preview",
+			"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)",
+			Info{Browser: "Facebook", OS: "Other", Device: DeviceBot, IsBot: true},
+		},
+		{
+			"googlebot on android",
+			"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Info{Browser: "Googlebot", OS: "Android", Device: DeviceBot, IsBot: true},
+		},
+		{
+			"curl",
+			"curl/8.5.0",
+			Info{Browser: "curl", OS: "Other", Device: DeviceBot, IsBot: true},
+		},
+		{
+			"unknown crawler",
+			"ExampleCrawler/2.0 (+https://example.com)",
+			Info{Browser: "Other", OS: "Other", Device: DeviceBot, IsBot: true},
+		},
+		{
+			"empty",
+			"",
+			Info{Device: DeviceBot, IsBot: true},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, Parse(tc.ua))
+		})
+	}
+}
@@ -0,0 +1,318 @@
+// Package webhook posts queued webhook deliveries to their subscribers.
+// Deliveries are read from the outbox table, so events survive restarts;
+// failed attempts are retried with exponential backoff until they run out
+// of attempts and become dead.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/urlpolicy"
+)
+
+const (
+	// DefaultInterval is how often due deliveries are polled
+	DefaultInterval = 5 * time.Second
+	// DefaultTimeout bounds one delivery attempt
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxAttempts is how many attempts a delivery gets before it
+	// becomes dead
+	DefaultMaxAttempts = 10
+	// DefaultBaseBackoff is the wait after the first failed attempt; it
+	// doubles with every further failure
+	DefaultBaseBackoff = 30 * time.Second
+	// DefaultMaxBackoff caps the wait between attempts
+	DefaultMaxBackoff = 6 * time.Hour
+	// DefaultBatchSize is how many deliveries are claimed per poll
+	DefaultBatchSize = 50
+
+	// maxErrorLength bounds the error stored with a failed delivery
+	maxErrorLength = 500
+)
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "X-Shortener-Signature"
+	EventHeader     = "X-Shortener-Event"
+	DeliveryHeader  = "X-Shortener-Delivery"
+)
+
+// Store is the outbox the dispatcher works from; db.Repository implements it
+type Store interface {
+	ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]db.WebhookDelivery, error)
+	CompleteWebhookDelivery(deliveryID int64, responseStatus int) error
+	FailWebhookDelivery(deliveryID int64, responseStatus int, message string, retryAt *time.Time) error
+}
+
+// Config tunes the dispatcher; zero values pick the defaults
+type Config struct {
+	Interval    time.Duration
+	Timeout     time.Duration
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	BatchSize   int
+	// AllowInternal lets deliveries reach loopback, private and
+	// link-local addresses, e.g. receivers on the same host in tests
+	AllowInternal bool
+	// Client posts the deliveries; nil uses a client with Timeout that
+	// refuses internal addresses unless AllowInternal is set
+	Client *http.Client
+}
+
+// Dispatcher delivers due webhook deliveries
+type Dispatcher struct {
+	store Store
+	cfg   Config
+}
+
+// New returns a dispatcher for store
+func New(store Store, cfg Config) *Dispatcher {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = DefaultBaseBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.Client == nil {
+		dialer := &net.Dialer{Timeout: cfg.Timeout}
+		if !cfg.AllowInternal {
+			dialer.Control = refuseInternal
+		}
+		cfg.Client = &http.Client{
+			Timeout: cfg.Timeout,
+			// No proxy: the address checked at dial time must be the
+			// receiver's
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: cfg.Timeout,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			// Receivers must answer themselves rather than send us elsewhere
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	return &Dispatcher{store: store, cfg: cfg}
+}
+
+// ErrInternalAddress is returned for receivers that resolve to loopback,
+// private or link-local addresses
+var ErrInternalAddress = errors.New("webhook receiver resolves to an internal address")
+
+// refuseInternal is a net.Dialer Control func rejecting internal addresses.
+// It sees the address actually being connected to, so host names that
+// resolve, or later rebind, to internal addresses are caught too.
+func refuseInternal(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInternalAddress, address)
+	}
+	if urlpolicy.InternalAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrInternalAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// Run delivers due deliveries every Interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while full batches are waiting
+		for {
+			n, err := d.DeliverDue(ctx)
+			if err != nil {
+				log.Printf("Failed to claim webhook deliveries: %v", err)
+			}
+			if err != nil || n < d.cfg.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue claims one batch of due deliveries, posts them and records the
+// outcomes. It returns the number of deliveries attempted.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	// A claim lasts long enough for the whole batch to be attempted
+	lease := d.cfg.Timeout*time.Duration(d.cfg.BatchSize) + time.Minute
+	deliveries, err := d.store.ClaimWebhookDeliveries(time.Now(), lease, d.cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, delivery := range deliveries {
+		status, err := d.post(ctx, delivery)
+		if err == nil {
+			err = d.store.CompleteWebhookDelivery(delivery.ID, status)
+		} else {
+			err = d.store.FailWebhookDelivery(delivery.ID, status, truncate(err.Error(), maxErrorLength), d.retryAt(delivery.Attempts))
+		}
+		if err != nil {
+			log.Printf("Failed to record webhook delivery %d: %v", delivery.ID, err)
+		}
+	}
+	return len(deliveries), nil
+}
+
+// retryAt returns when to try again after attempts failed attempts, or nil
+// once they are used up
+func (d *Dispatcher) retryAt(attempts int) *time.Time {
+	if attempts >= d.cfg.MaxAttempts {
+		return nil
+	}
+	retry := time.Now().Add(Backoff(attempts, d.cfg.BaseBackoff, d.cfg.MaxBackoff))
+	return &retry
+}
+
+// Backoff is the wait after the given number of failed attempts: base,
+// doubling with every attempt up to max
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	wait := base
+	for i := 1; i < attempts; i++ {
+		if wait >= max/2 {
+			return max
+		}
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+// post sends one delivery and returns the response status. Any status
+// outside 2xx is an error.
+func (d *Dispatcher) post(ctx context.Context, delivery db.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "shortener-webhooks/1.0")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, time.Now(), delivery.Payload))
+
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorLength))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := resp.Status
+		if text := strings.TrimSpace(string(body)); text != "" {
+			msg += ": " + text
+		}
+		return resp.StatusCode, errors.New(msg)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature header for body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">".
+// Signing the timestamp lets receivers reject replayed deliveries.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + signature(secret, ts, body)
+}
+
+func signature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrInvalidSignature is returned by Verify for signatures that do not
+// match or are too old
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Verify checks a signature header made by Sign. Signatures older than
+// tolerance are rejected; a tolerance of 0 accepts any age.
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			sigs = append(sigs, value)
+		}
+	}
+	sent, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing timestamp", ErrInvalidSignature)
+	}
+	if tolerance > 0 && time.Since(time.Unix(sent, 0)).Abs() > tolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidSignature)
+	}
+
+	expected := signature(secret, ts, body)
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// truncate shortens s to at most n bytes of valid UTF-8, cutting on a rune
+// boundary. Receivers may answer with any bytes, and Postgres rejects text
+// that is not UTF-8 or holds NUL.
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, "\uFFFD"), "\x00", "")
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
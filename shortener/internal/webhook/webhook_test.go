@@ -0,0 +1,244 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rusik69/shortener/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore is an in-memory outbox
+type fakeStore struct {
+	mu         sync.Mutex
+	deliveries []db.WebhookDelivery
+}
+
+func (s *fakeStore) ClaimWebhookDeliveries(now time.Time, lease time.Duration, limit int) ([]db.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var claimed []db.WebhookDelivery
+	for i := range s.deliveries {
+		d := &s.deliveries[i]
+		if d.Status != db.DeliveryPending || d.NextAttemptAt.After(now) || len(claimed) == limit {
+			continue
+		}
+		d.Attempts++
+		d.NextAttemptAt = now.Add(lease)
+		claimed = append(claimed, *d)
+	}
+	return claimed, nil
+}
+
+func (s *fakeStore) CompleteWebhookDelivery(deliveryID int64, responseStatus int) error {
+	return s.update(deliveryID, func(d *db.WebhookDelivery) {
+		d.Status, d.ResponseStatus, d.LastError = db.DeliveryDelivered, responseStatus, ""
+	})
+}
+
+func (s *fakeStore) FailWebhookDelivery(deliveryID int64, responseStatus int, message string, retryAt *time.Time) error {
+	return s.update(deliveryID, func(d *db.WebhookDelivery) {
+		d.ResponseStatus, d.LastError = responseStatus, message
+		if retryAt == nil {
+			d.Status = db.DeliveryDead
+		} else {
+			d.NextAttemptAt = *retryAt
+		}
+	})
+}
+
+func (s *fakeStore) update(id int64, fn func(*db.WebhookDelivery)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.deliveries {
+		if s.deliveries[i].ID == id {
+			fn(&s.deliveries[i])
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) get(id int64) db.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	return db.WebhookDelivery{}
+}
+
+// dueNow makes a failed delivery due again without waiting for its backoff
+func (s *fakeStore) dueNow(id int64) {
+	_ = s.update(id, func(d *db.WebhookDelivery) { d.NextAttemptAt = time.Now() })
+}
+
+func newDelivery(id int64, url string) db.WebhookDelivery {
+	payload, _ := json.Marshal(db.WebhookEvent{
+		Event:      db.EventFirstClick,
+		Link:       db.WebhookLink{ID: 7, Code: "abc12345", OriginalURL: "https://example.com", ClickCount: 1},
+		OccurredAt: time.Now(),
+	})
+	return db.WebhookDelivery{
+		ID: id, Event: db.EventFirstClick, Payload: payload, Status: db.DeliveryPending,
+		NextAttemptAt: time.Now(), URL: url, Secret: "whsec_test",
+	}
+}
+
+func TestDeliverySigned(t *testing.T) {
+	var mu sync.Mutex
+	var received []db.WebhookEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify("whsec_test", r.Header.Get(SignatureHeader), body, time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, db.EventFirstClick, r.Header.Get(EventHeader))
+		assert.Equal(t, "1", r.Header.Get(DeliveryHeader))
+
+		var event db.WebhookEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{deliveries: []db.WebhookDelivery{newDelivery(1, receiver.URL)}}
+	n, err := New(store, Config{AllowInternal: true}).DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	delivered := store.get(1)
+	assert.Equal(t, db.DeliveryDelivered, delivered.Status)
+	assert.Equal(t, http.StatusNoContent, delivered.ResponseStatus)
+	require.Len(t, received, 1)
+	assert.Equal(t, "abc12345", received[0].Link.Code)
+}
+
+func TestDeliveryRetriesThenDies(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{deliveries: []db.WebhookDelivery{newDelivery(1, receiver.URL)}}
+	d := New(store, Config{MaxAttempts: 3, BaseBackoff: time.Minute, AllowInternal: true})
+
+	before := time.Now()
+	_, err := d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	failed := store.get(1)
+	assert.Equal(t, db.DeliveryPending, failed.Status)
+	assert.Equal(t, 1, failed.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, failed.ResponseStatus)
+	assert.Contains(t, failed.LastError, "try later")
+	assert.WithinDuration(t, before.Add(time.Minute), failed.NextAttemptAt, 5*time.Second)
+
+	// Not due until the backoff has passed
+	n, err := d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	for i := 0; i < 2; i++ {
+		store.dueNow(1)
+		_, err = d.DeliverDue(context.Background())
+		require.NoError(t, err)
+	}
+	dead := store.get(1)
+	assert.Equal(t, db.DeliveryDead, dead.Status)
+	assert.Equal(t, 3, dead.Attempts)
+}
+
+func TestDeliveryUnreachable(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	url := receiver.URL
+	receiver.Close()
+
+	store := &fakeStore{deliveries: []db.WebhookDelivery{newDelivery(1, url)}}
+	_, err := New(store, Config{AllowInternal: true}).DeliverDue(context.Background())
+	require.NoError(t, err)
+
+	failed := store.get(1)
+	assert.Equal(t, db.DeliveryPending, failed.Status)
+	assert.Equal(t, 0, failed.ResponseStatus)
+	assert.NotEmpty(t, failed.LastError)
+}
+
+func TestDeliveryStoresReceiverErrorAsUTF8(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("bad \xff\xfe gateway\x00 " + strings.Repeat("é", maxErrorLength)))
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{deliveries: []db.WebhookDelivery{newDelivery(1, receiver.URL)}}
+	_, err := New(store, Config{AllowInternal: true}).DeliverDue(context.Background())
+	require.NoError(t, err)
+
+	failed := store.get(1)
+	assert.Equal(t, http.StatusBadGateway, failed.ResponseStatus)
+	assert.True(t, utf8.ValidString(failed.LastError))
+	assert.NotContains(t, failed.LastError, "\x00")
+	assert.LessOrEqual(t, len(failed.LastError), maxErrorLength)
+	assert.Contains(t, failed.LastError, "bad \uFFFD gateway")
+}
+
+func TestDeliveryRefusesInternalAddress(t *testing.T) {
+	hit := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{deliveries: []db.WebhookDelivery{newDelivery(1, receiver.URL)}}
+	_, err := New(store, Config{}).DeliverDue(context.Background())
+	require.NoError(t, err)
+
+	refused := store.get(1)
+	assert.False(t, hit)
+	assert.Equal(t, db.DeliveryPending, refused.Status)
+	assert.Contains(t, refused.LastError, ErrInternalAddress.Error())
+
+	// Explicitly allowed, the same receiver gets the delivery
+	store.dueNow(1)
+	_, err = New(store, Config{AllowInternal: true}).DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.True(t, hit)
+	assert.Equal(t, db.DeliveryDelivered, store.get(1).Status)
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 30*time.Second, time.Hour
+	assert.Equal(t, 30*time.Second, Backoff(1, base, max))
+	assert.Equal(t, time.Minute, Backoff(2, base, max))
+	assert.Equal(t, 4*time.Minute, Backoff(4, base, max))
+	assert.Equal(t, time.Hour, Backoff(8, base, max))
+	assert.Equal(t, time.Hour, Backoff(1000, base, max))
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"event":"link.created"}`)
+	header := Sign("secret", time.Now(), body)
+
+	assert.NoError(t, Verify("secret", header, body, time.Minute))
+	assert.ErrorIs(t, Verify("other", header, body, time.Minute), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("secret", header, []byte(`{}`), time.Minute), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("secret", "v1=abc", body, 0), ErrInvalidSignature)
+
+	old := Sign("secret", time.Now().Add(-time.Hour), body)
+	assert.ErrorIs(t, Verify("secret", old, body, time.Minute), ErrInvalidSignature)
+	assert.NoError(t, Verify("secret", old, body, 0))
+}
@@ -1,12 +1,20 @@
 package tests
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/rusik69/shortener/internal/db"
+	"github.com/rusik69/shortener/internal/shortcode"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -20,10 +28,10 @@ func TestRepositoryCreateShortURL(t *testing.T) {
 
 	// Test successful URL creation
 	mock.ExpectQuery("INSERT INTO short_urls").
-		WithArgs("abc12345", "https://example.com", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WithArgs("abc12345", "https://example.com", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 302, nil, nil, "").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 
-	url, err := repo.CreateShortURL("abc12345", "https://example.com", nil, nil)
+	url, err := repo.CreateShortURL(db.NewShortURL{ShortCode: "abc12345", OriginalURL: "https://example.com", RedirectType: 302})
 	assert.NoError(t, err)
 	assert.NotNil(t, url)
 	assert.Equal(t, "abc12345", url.ShortCode)
@@ -40,14 +48,14 @@ func TestRepositoryGetShortURLByCode(t *testing.T) {
 
 	// Test successful URL retrieval
 	now := time.Now()
-	rows := sqlmock.NewRows([]string{"id", "short_code", "original_url", "user_id", "created_at", "updated_at", "expires_at", "click_count"}).
-		AddRow(1, "abc12345", "https://example.com", nil, now, now, nil, 5)
+	rows := sqlmock.NewRows([]string{"id", "short_code", "original_url", "user_id", "created_at", "updated_at", "expires_at", "click_count", "enabled", "password_hash", "redirect_type", "destinations", "rules", "domain"}).
+		AddRow(1, "abc12345", "https://example.com", nil, now, now, nil, 5, true, nil, 301, nil, nil, "")
 
-	mock.ExpectQuery("SELECT (.+) FROM short_urls WHERE short_code = \\$1").
-		WithArgs("abc12345").
+	mock.ExpectQuery("SELECT (.+) FROM short_urls WHERE COALESCE\\(domain, ''\\) = \\$1 AND short_code = \\$2").
+		WithArgs("", "abc12345").
 		WillReturnRows(rows)
 
-	url, err := repo.GetShortURLByCode("abc12345")
+	url, err := repo.GetShortURLByCode("", "abc12345")
 	assert.NoError(t, err)
 	assert.Equal(t, "abc12345", url.ShortCode)
 	assert.Equal(t, "https://example.com", url.OriginalURL)
@@ -55,6 +63,42 @@ func TestRepositoryGetShortURLByCode(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestRepositoryShortURLRouting(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+	split := db.Destinations{
+		{Label: "a", URL: "https://example.com/a", Weight: 70},
+		{Label: "b", URL: "https://example.com/b", Weight: 30},
+	}
+	splitJSON := []byte(`[{"label":"a","url":"https://example.com/a","weight":70},{"label":"b","url":"https://example.com/b","weight":30}]`)
+	rules := db.Rules{{Name: "ios", URL: "https://apps.apple.com/app/id1", OS: []string{"iOS"}}}
+	rulesJSON := []byte(`[{"name":"ios","url":"https://apps.apple.com/app/id1","os":["iOS"]}]`)
+
+	// Test storing the split and rules as JSON
+	mock.ExpectQuery("INSERT INTO short_urls").
+		WithArgs("ab123456", "https://example.com", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 302, splitJSON, rulesJSON, "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	_, err = repo.CreateShortURL(db.NewShortURL{ShortCode: "ab123456", OriginalURL: "https://example.com", RedirectType: 302, Destinations: split, Rules: rules})
+	assert.NoError(t, err)
+
+	// Test reading it back
+	now := time.Now()
+	mock.ExpectQuery("SELECT (.+) FROM short_urls WHERE COALESCE\\(domain, ''\\) = \\$1 AND short_code = \\$2").
+		WithArgs("", "ab123456").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short_code", "original_url", "user_id", "created_at", "updated_at", "expires_at", "click_count", "enabled", "password_hash", "redirect_type", "destinations", "rules", "domain"}).
+			AddRow(1, "ab123456", "https://example.com", nil, now, now, nil, 0, true, nil, 302, splitJSON, rulesJSON, ""))
+
+	url, err := repo.GetShortURLByCode("", "ab123456")
+	assert.NoError(t, err)
+	assert.Equal(t, split, url.Destinations)
+	assert.Equal(t, rules, url.Rules)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestRepositoryGetShortURLByCodeNotFound(t *testing.T) {
 	database, mock, err := sqlmock.New()
 	require.NoError(t, err)
@@ -63,11 +107,11 @@ func TestRepositoryGetShortURLByCodeNotFound(t *testing.T) {
 	repo := db.NewRepository(database)
 
 	// Test URL not found
-	mock.ExpectQuery("SELECT (.+) FROM short_urls WHERE short_code = \\$1").
-		WithArgs("notfound").
+	mock.ExpectQuery("SELECT (.+) FROM short_urls WHERE COALESCE\\(domain, ''\\) = \\$1 AND short_code = \\$2").
+		WithArgs("", "notfound").
 		WillReturnError(sql.ErrNoRows)
 
-	url, err := repo.GetShortURLByCode("notfound")
+	url, err := repo.GetShortURLByCode("", "notfound")
 	assert.Error(t, err)
 	assert.Nil(t, url)
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -80,10 +124,12 @@ func TestRepositoryIncrementClickCount(t *testing.T) {
 
 	repo := db.NewRepository(database)
 
-	// Test successful click increment
-	mock.ExpectExec("UPDATE short_urls SET click_count = click_count \\+ 1").
-		WithArgs(sqlmock.AnyArg(), int64(1)).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Test successful click increment of a link whose owner has no webhooks
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE short_urls AS s SET click_count = s.click_count \\+ v.n").
+		WithArgs(sqlmock.AnyArg(), int64(1), int64(1)).
+		WillReturnRows(clickCountRows().AddRow(1, nil, "abc12345", "", "https://example.com", 6, 1, false))
+	mock.ExpectCommit()
 
 	err = repo.IncrementClickCount(1)
 	assert.NoError(t, err)
@@ -99,14 +145,158 @@ func TestRepositoryCreateClick(t *testing.T) {
 
 	// Test successful click recording
 	mock.ExpectExec("INSERT INTO clicks").
-		WithArgs(int64(1), "Mozilla/5.0", "192.168.1.1", "https://google.com", sqlmock.AnyArg()).
+		WithArgs(int64(1), "Mozilla/5.0", "192.168.1.1", "https://google.com/search", "google.com",
+			"newsletter", "email", "spring", "", "", []byte(`{"id":"42"}`),
+			sql.NullString{String: "DE", Valid: true}, "BE", sql.NullInt64{Int64: 3320, Valid: true},
+			"Chrome", "Windows", "desktop", false, sql.NullString{String: "b", Valid: true}, sql.NullString{String: "ios", Valid: true}, sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err = repo.CreateClick(1, "Mozilla/5.0", "192.168.1.1", "https://google.com")
+	err = repo.CreateClick(db.NewClick{
+		ShortURLID:   1,
+		UserAgent:    "Mozilla/5.0",
+		IPAddress:    "192.168.1.1",
+		Referrer:     "https://google.com/search",
+		ReferrerHost: "google.com",
+		UTM: db.UTM{
+			Source:   "newsletter",
+			Medium:   "email",
+			Campaign: "spring",
+			Extra:    map[string]string{"id": "42"},
+		},
+		Country: "DE",
+		Region:  "BE",
+		ASN:     3320,
+		Browser: "Chrome",
+		OS:      "Windows",
+		Device:  "desktop",
+		Variant: "b",
+		Rule:    "ios",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryRecordClicks(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Three rows in one insert, one counter update per link without the bot
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO clicks \\(.+\\) SELECT \\* FROM \\(VALUES \\(\\$1::integer, .+\\), \\(\\$22::integer, .+\\), \\(\\$43::integer, .+\\)\\) AS v\\(.+\\) WHERE EXISTS \\(SELECT 1 FROM short_urls s WHERE s.id = v.short_url_id\\)").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectQuery("SELECT id FROM short_urls WHERE id IN \\(\\$1, \\$2\\) ORDER BY id FOR UPDATE").
+		WithArgs(int64(1), int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectQuery("UPDATE short_urls AS s SET click_count = s.click_count \\+ v.n").
+		WithArgs(sqlmock.AnyArg(), int64(1), int64(1), int64(2), int64(1)).
+		WillReturnRows(clickCountRows().
+			AddRow(1, 3, "abc12345", "", "https://example.com", 6, 1, false).
+			AddRow(2, nil, "xyz98765", "", "https://example.org", 1, 1, false))
+	mock.ExpectCommit()
+
+	err = repo.RecordClicks([]db.NewClick{
+		{ShortURLID: 2, IPAddress: "192.168.1.1", CreatedAt: at},
+		{ShortURLID: 1, IPAddress: "192.168.1.2", CreatedAt: at},
+		{ShortURLID: 1, IPAddress: "192.168.1.3", IsBot: true, CreatedAt: at},
+	})
 	assert.NoError(t, err)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestRepositoryRecordClicksChunksCounterUpdates(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// One more link than fits in a counter update with two parameters per link
+	const links = (65535-1)/2 + 1
+	clicks := make([]db.NewClick, links)
+	for i := range clicks {
+		clicks[i] = db.NewClick{ShortURLID: int64(i + 1), IPAddress: "192.168.1.1"}
+	}
+
+	mock.ExpectBegin()
+	for inserted := 0; inserted < links; inserted += 65535 / 21 {
+		mock.ExpectExec("INSERT INTO clicks").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectQuery("SELECT id FROM short_urls WHERE id IN \\(\\$1, .+, \\$32767\\) ORDER BY id FOR UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("UPDATE short_urls AS s SET click_count").
+		WillReturnRows(clickCountRows())
+	mock.ExpectQuery("SELECT id FROM short_urls WHERE id IN \\(\\$1\\) ORDER BY id FOR UPDATE").
+		WithArgs(int64(links)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(links))
+	mock.ExpectQuery("UPDATE short_urls AS s SET click_count").
+		WithArgs(sqlmock.AnyArg(), int64(links), int64(1)).
+		WillReturnRows(clickCountRows())
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.RecordClicks(clicks))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// clickCountRows are returned by the click_count update
+func clickCountRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "user_id", "short_code", "domain", "original_url", "click_count", "n", "exists"})
+}
+
+func TestRepositoryClickCountQueuesWebhooks(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// The first click fires link.first_click and any threshold of 1
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE short_urls AS s SET click_count").
+		WithArgs(sqlmock.AnyArg(), int64(1), int64(1)).
+		WillReturnRows(clickCountRows().AddRow(1, 3, "abc12345", "", "https://example.com", 1, 1, true))
+	mock.ExpectExec("INSERT INTO webhook_deliveries .+ FROM webhooks w WHERE w.user_id = \\$1").
+		WithArgs(int64(3), int64(1), db.EventFirstClick, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO webhook_deliveries .+ jsonb_array_elements\\(w.thresholds\\)").
+		WithArgs(int64(3), int64(1), db.EventClickThreshold, sqlmock.AnyArg(), sqlmock.AnyArg(), int64(0), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	// Later clicks only check the thresholds passed
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE short_urls AS s SET click_count").
+		WithArgs(sqlmock.AnyArg(), int64(1), int64(1)).
+		WillReturnRows(clickCountRows().AddRow(1, 3, "abc12345", "", "https://example.com", 100, 1, true))
+	mock.ExpectExec("INSERT INTO webhook_deliveries .+ jsonb_array_elements\\(w.thresholds\\)").
+		WithArgs(int64(3), int64(1), db.EventClickThreshold, sqlmock.AnyArg(), sqlmock.AnyArg(), int64(99), int64(100)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.IncrementClickCount(1))
+	assert.NoError(t, repo.IncrementClickCount(1))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryRecordClicksRollsBack(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO clicks").WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err = repo.RecordClicks([]db.NewClick{{ShortURLID: 1, IPAddress: "192.168.1.1"}})
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestRepositoryGetOrCreateRateLimit(t *testing.T) {
 	database, mock, err := sqlmock.New()
 	require.NoError(t, err)
@@ -178,6 +368,121 @@ func TestRepositoryUpdateRateLimit(t *testing.T) {
 }
 
 
+func TestRepositoryTakeRateLimitToken(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test taking a token with a single conditional upsert
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO rate_limits (.+) ON CONFLICT \\(ip_address\\) DO UPDATE (.+) WHERE (.+) RETURNING reset_at").
+		WithArgs("shorten:user:7", now.Add(time.Second), now, int64(1000000), int64(10000000)).
+		WillReturnRows(sqlmock.NewRows([]string{"reset_at"}).AddRow(now.Add(3 * time.Second)))
+
+	tat, ok, err := repo.TakeRateLimitToken("shorten:user:7", now, time.Second, 10)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(3*time.Second), tat)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryTakeRateLimitTokenEmpty(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test an empty bucket: the upsert changes nothing and the TAT is read
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO rate_limits").
+		WillReturnRows(sqlmock.NewRows([]string{"reset_at"}))
+	mock.ExpectQuery("SELECT reset_at FROM rate_limits WHERE ip_address = \\$1").
+		WithArgs("ip:192.168.1.1").
+		WillReturnRows(sqlmock.NewRows([]string{"reset_at"}).AddRow(now.Add(10 * time.Second)))
+
+	tat, ok, err := repo.TakeRateLimitToken("ip:192.168.1.1", now, time.Second, 10)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, now.Add(10*time.Second), tat)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryRefundRateLimitToken(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test giving a token back by moving the TAT back one interval
+	mock.ExpectExec("UPDATE rate_limits SET reset_at = reset_at - \\$2 (.+) WHERE ip_address = \\$1").
+		WithArgs("unlock:ip:192.168.1.1", int64(1000000)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = repo.RefundRateLimitToken("unlock:ip:192.168.1.1", time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryDeleteExpiredRateLimits(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	before := time.Now()
+	mock.ExpectExec("DELETE FROM rate_limits WHERE reset_at < \\$1").
+		WithArgs(before).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+
+	deleted, err := repo.DeleteExpiredRateLimits(before)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryDeleteOldCaptchaAttempts(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	before := time.Now().Add(-24 * time.Hour)
+	mock.ExpectExec("DELETE FROM captcha_attempts WHERE created_at < \\$1").
+		WithArgs(before).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	deleted, err := repo.DeleteOldCaptchaAttempts(before)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryRecordCaptchaAttempt(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	mock.ExpectExec("INSERT INTO captcha_attempts \\(ip_address, challenge_id, success\\)").
+		WithArgs("203.0.113.7", "5f2b", true).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Unreadable tokens have no challenge id
+	mock.ExpectExec("INSERT INTO captcha_attempts").
+		WithArgs("203.0.113.7", nil, false).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	assert.NoError(t, repo.RecordCaptchaAttempt(db.CaptchaAttempt{IPAddress: "203.0.113.7", ChallengeID: "5f2b", Success: true}))
+	assert.NoError(t, repo.RecordCaptchaAttempt(db.CaptchaAttempt{IPAddress: "203.0.113.7"}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestRepositoryGetClicks(t *testing.T) {
 	database, mock, err := sqlmock.New()
 	require.NoError(t, err)
@@ -202,3 +507,732 @@ func TestRepositoryGetClicks(t *testing.T) {
 	assert.Equal(t, "Chrome/91.0", clicks[1].UserAgent)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestRepositoryDeleteExpiredShortURLs(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test purging expired URLs and their clicks
+	before := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM clicks WHERE short_url_id IN").
+		WithArgs(before).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec("DELETE FROM short_urls WHERE expires_at IS NOT NULL AND expires_at < \\$1").
+		WithArgs(before).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	deleted, err := repo.DeleteExpiredShortURLs(before)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryCountClicksByTime(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test bucketing clicks by day
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 7)
+	rows := sqlmock.NewRows([]string{"bucket", "count"}).
+		AddRow(from, 4).
+		AddRow(from.AddDate(0, 0, 2), 1)
+	mock.ExpectQuery("SELECT date_trunc\\(\\$2, created_at AT TIME ZONE 'UTC'\\) AS bucket, COUNT\\(\\*\\) FROM clicks WHERE (.+) AND NOT is_bot GROUP BY bucket").
+		WithArgs(int64(1), "day", from, to).
+		WillReturnRows(rows)
+
+	query := db.ClickQuery{ShortURLID: 1, From: from, To: to}
+	buckets, err := repo.CountClicksByTime(query, "day")
+	assert.NoError(t, err)
+	assert.Len(t, buckets, 2)
+	assert.Equal(t, int64(4), buckets[0].Clicks)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = repo.CountClicksByTime(query, "minute")
+	assert.Error(t, err)
+}
+
+func TestRepositoryTopClickValues(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test top referrers
+	from := time.Now().Add(-time.Hour)
+	to := time.Now()
+	rows := sqlmock.NewRows([]string{"referrer", "clicks"}).
+		AddRow("https://news.example.com", 3).
+		AddRow("https://mail.example.com", 1)
+	mock.ExpectQuery("SELECT referrer, COUNT\\(\\*\\) AS clicks FROM clicks WHERE (.+) GROUP BY referrer ORDER BY clicks DESC, referrer LIMIT \\$4").
+		WithArgs(int64(1), from, to, 5).
+		WillReturnRows(rows)
+
+	query := db.ClickQuery{ShortURLID: 1, From: from, To: to, IncludeBots: true}
+	tallies, err := repo.TopClickValues(query, db.DimensionReferrer, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.ClickTally{
+		{Value: "https://news.example.com", Clicks: 3},
+		{Value: "https://mail.example.com", Clicks: 1},
+	}, tallies)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = repo.TopClickValues(query, db.ClickDimension("ip_address; DROP TABLE clicks"), 5)
+	assert.Error(t, err)
+}
+
+func TestRepositoryGetLastClickTime(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test a link that was never clicked
+	mock.ExpectQuery("SELECT MAX\\(created_at\\) FROM clicks WHERE short_url_id = \\$1 AND NOT is_bot").
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+
+	last, err := repo.GetLastClickTime(1, false)
+	assert.NoError(t, err)
+	assert.Nil(t, last)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryCountBotClicks(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test counting link preview and crawler hits
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM clicks WHERE short_url_id = \\$1 AND is_bot").
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(6))
+
+	count, err := repo.CountBotClicks(1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), count)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryGetAPIKeyByHash(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test key lookup by hash
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "key_hash", "created_at", "last_used_at", "revoked_at"}).
+		AddRow(3, 7, "ci", "sk_12345678", "deadbeef", now, nil, nil)
+
+	mock.ExpectQuery("SELECT (.+) FROM api_keys WHERE key_hash = \\$1").
+		WithArgs("deadbeef").
+		WillReturnRows(rows)
+
+	key, err := repo.GetAPIKeyByHash("deadbeef")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), key.UserID)
+	assert.Equal(t, "ci", key.Name)
+	assert.Nil(t, key.RevokedAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryRevokeAPIKeyNotFound(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test revoking a key that is missing or already revoked
+	mock.ExpectExec("UPDATE api_keys SET revoked_at = \\$1 WHERE id = \\$2 AND user_id = \\$3 AND revoked_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), int64(3), int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = repo.RevokeAPIKey(7, 3)
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryRotateAPIKey(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test revoking the old key and inserting its replacement in one transaction
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE api_keys SET revoked_at").
+		WithArgs(sqlmock.AnyArg(), int64(3), int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("ci"))
+	mock.ExpectQuery("INSERT INTO api_keys").
+		WithArgs(int64(7), "ci", "sk_abcdefgh", "cafebabe", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectCommit()
+
+	key, err := repo.RotateAPIKey(7, 3, "sk_abcdefgh", "cafebabe")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), key.ID)
+	assert.Equal(t, "ci", key.Name)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryListShortURLs(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test listing with an escaped search term
+	now := time.Now()
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM short_urls WHERE user_id = \\$1").
+		WithArgs(int64(7), "%50\\%%").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT (.+) FROM short_urls WHERE user_id = \\$1 (.+) LIMIT \\$3 OFFSET \\$4").
+		WithArgs(int64(7), "%50\\%%", 20, 40).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short_code", "original_url", "user_id", "created_at", "updated_at", "expires_at", "click_count", "enabled", "password_hash", "redirect_type", "destinations", "rules", "domain"}).
+			AddRow(1, "sale50", "https://example.com/50%", 7, now, now, nil, 3, true, nil, 302, nil, nil, ""))
+
+	urls, total, err := repo.ListShortURLs(db.ShortURLFilter{UserID: 7, Search: "50%", Limit: 20, Offset: 40})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Len(t, urls, 1)
+	assert.Equal(t, "sale50", urls[0].ShortCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryUpdateShortURL(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test updating only the fields that are set
+	now := time.Now()
+	disabled := false
+	mock.ExpectQuery("UPDATE short_urls SET updated_at = \\$1, enabled = \\$2 WHERE COALESCE\\(domain, ''\\) = \\$3 AND short_code = \\$4 AND user_id = \\$5 RETURNING").
+		WithArgs(sqlmock.AnyArg(), false, "", "promo", int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short_code", "original_url", "user_id", "created_at", "updated_at", "expires_at", "click_count", "enabled", "password_hash", "redirect_type", "destinations", "rules", "domain"}).
+			AddRow(1, "promo", "https://example.com", 7, now, now, nil, 3, false, nil, 302, nil, nil, ""))
+
+	url, err := repo.UpdateShortURL(7, "", "promo", db.ShortURLUpdate{Enabled: &disabled})
+	assert.NoError(t, err)
+	assert.False(t, url.Enabled)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Test changing the redirect type
+	redirectType := 308
+	mock.ExpectQuery("UPDATE short_urls SET updated_at = \\$1, redirect_type = \\$2 WHERE COALESCE\\(domain, ''\\) = \\$3 AND short_code = \\$4 AND user_id = \\$5 RETURNING").
+		WithArgs(sqlmock.AnyArg(), 308, "", "promo", int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short_code", "original_url", "user_id", "created_at", "updated_at", "expires_at", "click_count", "enabled", "password_hash", "redirect_type", "destinations", "rules", "domain"}).
+			AddRow(1, "promo", "https://example.com", 7, now, now, nil, 3, true, nil, 308, nil, nil, ""))
+
+	url, err = repo.UpdateShortURL(7, "", "promo", db.ShortURLUpdate{RedirectType: &redirectType})
+	assert.NoError(t, err)
+	assert.Equal(t, 308, url.RedirectType)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryDeleteShortURL(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test deleting a link together with its clicks
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM short_urls WHERE COALESCE\\(domain, ''\\) = \\$1 AND short_code = \\$2 AND user_id = \\$3 FOR UPDATE").
+		WithArgs("", "promo", int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("DELETE FROM clicks WHERE short_url_id = \\$1").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM short_urls WHERE id = \\$1").
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = repo.DeleteShortURL(7, "", "promo")
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryCreateShortURLBatch(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test that a code conflict is reported per item without aborting the batch
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare("INSERT INTO short_urls (.+) ON CONFLICT DO NOTHING RETURNING id")
+	prep.ExpectQuery().
+		WithArgs("one", "https://example.com/1", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 0, nil, nil, "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	prep.ExpectQuery().
+		WithArgs("two", "https://example.com/2", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 0, nil, nil, "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	prep.ExpectQuery().
+		WithArgs("three", "https://example.com/3", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 0, nil, nil, "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+
+	errs, err := repo.CreateShortURLBatch([]db.NewShortURL{
+		{ShortCode: "one", OriginalURL: "https://example.com/1"},
+		{ShortCode: "two", OriginalURL: "https://example.com/2"},
+		{ShortCode: "three", OriginalURL: "https://example.com/3"},
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []error{nil, db.ErrShortCodeTaken, nil}, errs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryShortURLOnDomain(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test storing the domain of the code's namespace
+	mock.ExpectQuery("INSERT INTO short_urls (.+) NULLIF\\(\\$11, ''\\)").
+		WithArgs("promo", "https://example.com", nil, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, 301, nil, nil, "go.brand.example").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	url, err := repo.CreateShortURL(db.NewShortURL{ShortCode: "promo", OriginalURL: "https://example.com", RedirectType: 301, Domain: "go.brand.example"})
+	assert.NoError(t, err)
+	assert.Equal(t, "go.brand.example", url.Domain)
+
+	// Test looking the code up in that namespace
+	now := time.Now()
+	mock.ExpectQuery("SELECT (.+) FROM short_urls WHERE COALESCE\\(domain, ''\\) = \\$1 AND short_code = \\$2").
+		WithArgs("go.brand.example", "promo").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "short_code", "original_url", "user_id", "created_at", "updated_at", "expires_at", "click_count", "enabled", "password_hash", "redirect_type", "destinations", "rules", "domain"}).
+			AddRow(1, "promo", "https://example.com", nil, now, now, nil, 0, true, nil, 301, nil, nil, "go.brand.example"))
+
+	url, err = repo.GetShortURLByCode("go.brand.example", "promo")
+	assert.NoError(t, err)
+	assert.Equal(t, "go.brand.example", url.Domain)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositorySaveDomain(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	// Test upserting a domain with unset settings stored as NULL
+	now := time.Now()
+	mock.ExpectQuery("INSERT INTO domains (.+) ON CONFLICT \\(host\\) DO UPDATE SET (.+) RETURNING").
+		WithArgs("go.brand.example", 301, "", "https://brand.example", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "host", "redirect_type", "not_found_url", "root_url", "created_at", "updated_at"}).
+			AddRow(1, "go.brand.example", 301, "", "https://brand.example", now, now))
+
+	domain, err := repo.SaveDomain(db.Domain{Host: "go.brand.example", RedirectType: 301, RootURL: "https://brand.example"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), domain.ID)
+	assert.Equal(t, 301, domain.RedirectType)
+	assert.Equal(t, "https://brand.example", domain.RootURL)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryGetDomainNotFound(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	mock.ExpectQuery("SELECT (.+) FROM domains WHERE host = \\$1").
+		WithArgs("other.example").
+		WillReturnError(sql.ErrNoRows)
+
+	_, err = repo.GetDomain("other.example")
+	assert.Equal(t, sql.ErrNoRows, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryDeleteDomain(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+
+	mock.ExpectExec("DELETE FROM domains WHERE host = \\$1").
+		WithArgs("go.brand.example").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM domains WHERE host = \\$1").
+		WithArgs("go.brand.example").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.DeleteDomain("go.brand.example"))
+	assert.Equal(t, sql.ErrNoRows, repo.DeleteDomain("go.brand.example"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryCreateWebhook(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+	now := time.Now()
+
+	mock.ExpectQuery("INSERT INTO webhooks").
+		WithArgs(int64(3), nil, "https://crm.example.com/hooks", "whsec_test", db.EventNames{db.EventClickThreshold}, db.ClickThresholds{100, 1000}, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "short_url_id", "url", "secret", "events", "thresholds", "created_at"}).
+			AddRow(1, 3, nil, "https://crm.example.com/hooks", "whsec_test", []byte(`["link.click_threshold"]`), []byte(`[100, 1000]`), now))
+
+	webhook, err := repo.CreateWebhook(db.Webhook{
+		UserID:     3,
+		URL:        "https://crm.example.com/hooks",
+		Secret:     "whsec_test",
+		Events:     db.EventNames{db.EventClickThreshold},
+		Thresholds: db.ClickThresholds{100, 1000},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), webhook.ID)
+	assert.Nil(t, webhook.ShortURLID)
+	assert.Equal(t, db.EventNames{db.EventClickThreshold}, webhook.Events)
+	assert.Equal(t, db.ClickThresholds{100, 1000}, webhook.Thresholds)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryClaimWebhookDeliveries(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+	now := time.Now()
+
+	mock.ExpectQuery("UPDATE webhook_deliveries AS d SET attempts = d.attempts \\+ 1.+FOR UPDATE SKIP LOCKED").
+		WithArgs(now, now.Add(time.Minute), 50).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "webhook_id", "event", "payload", "status", "attempts", "next_attempt_at", "last_error", "response_status", "created_at", "delivered_at", "url", "secret"}).
+			AddRow(9, 1, db.EventLinkCreated, `{"event":"link.created"}`, db.DeliveryPending, 2, now.Add(time.Minute), "503 Service Unavailable", 503, now, nil, "https://crm.example.com/hooks", "whsec_test"))
+
+	deliveries, err := repo.ClaimWebhookDeliveries(now, time.Minute, 50)
+	assert.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, 2, deliveries[0].Attempts)
+	assert.JSONEq(t, `{"event":"link.created"}`, string(deliveries[0].Payload))
+	assert.Equal(t, "https://crm.example.com/hooks", deliveries[0].URL)
+	assert.Equal(t, "whsec_test", deliveries[0].Secret)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryFailWebhookDelivery(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+	retryAt := time.Now().Add(time.Minute)
+
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1").
+		WithArgs(db.DeliveryPending, 503, "503 Service Unavailable", retryAt, int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE webhook_deliveries SET status = \\$1").
+		WithArgs(db.DeliveryDead, 0, "connection refused", sqlmock.AnyArg(), int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, repo.FailWebhookDelivery(9, 503, "503 Service Unavailable", &retryAt))
+	assert.NoError(t, repo.FailWebhookDelivery(9, 0, "connection refused", nil))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryExportLinks(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+	from := time.Now().Add(-time.Hour)
+	to := time.Now()
+	columns := []string{"id", "short_code", "domain", "original_url", "owner", "created_at", "expires_at", "click_count", "enabled", "redirect_type", "protected", "split", "targeted"}
+
+	// A full batch is followed by another FETCH until one comes back short
+	full := sqlmock.NewRows(columns)
+	for i := 1; i <= 1000; i++ {
+		full.AddRow(i, "abc12345", "", "https://example.com", "alice", from, nil, 0, true, 301, false, false, false)
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec("DECLARE export_cursor NO SCROLL CURSOR FOR SELECT s.id.+FROM short_urls s.+ORDER BY s.id").
+		WithArgs(from, to).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FETCH FORWARD 1000 FROM export_cursor").WillReturnRows(full)
+	mock.ExpectQuery("FETCH FORWARD 1000 FROM export_cursor").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1001, "xyz98765", "go.brand.example", "https://example.com/2", "", from, to, 5, false, 302, true, true, false))
+	mock.ExpectCommit()
+
+	var links []db.ExportedLink
+	err = repo.ExportLinks(context.Background(), db.ExportQuery{From: from, To: to}, func(link db.ExportedLink) error {
+		links = append(links, link)
+		return nil
+	})
+	assert.NoError(t, err)
+	require.Len(t, links, 1001)
+	assert.Equal(t, "go.brand.example", links[1000].Domain)
+	assert.True(t, links[1000].Protected)
+	require.NotNil(t, links[1000].ExpiresAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRepositoryExportClicksStops(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	repo := db.NewRepository(database)
+	from := time.Now().Add(-time.Hour)
+	to := time.Now()
+	userID := int64(3)
+	row := []driver.Value{1, from, 7, "abc12345", "", "", "", "", "", "", "", "", "", "DE", "", 0, "Firefox", "Linux", "desktop", false, "", "", "", "203.0.113.7"}
+	columns := make([]string, len(row))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DECLARE export_cursor NO SCROLL CURSOR FOR SELECT c.id.+AND NOT c.is_bot AND s.user_id = \\$3 ORDER BY c.id").
+		WithArgs(from, to, userID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FETCH FORWARD 1000 FROM export_cursor").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(row...).AddRow(row...))
+	mock.ExpectRollback()
+
+	// An error from the callback ends the export and the transaction
+	stop := errors.New("client went away")
+	calls := 0
+	err = repo.ExportClicks(context.Background(), db.ExportQuery{UserID: &userID, From: from, To: to}, func(click db.ExportedClick) error {
+		calls++
+		assert.Equal(t, "203.0.113.7", click.IPAddress)
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testMigrations() fstest.MapFS {
+	return fstest.MapFS{
+		"0001_create_things.up.sql":   {Data: []byte("CREATE TABLE things (id SERIAL PRIMARY KEY);")},
+		"0001_create_things.down.sql": {Data: []byte("DROP TABLE things;")},
+		"0002_add_name.up.sql":        {Data: []byte("ALTER TABLE things ADD COLUMN name TEXT;")},
+		"0002_add_name.down.sql":      {Data: []byte("ALTER TABLE things DROP COLUMN name;")},
+	}
+}
+
+// expectMigrationLock expects the lock, the bookkeeping table and the read
+// of the applied versions
+func expectMigrationLock(mock sqlmock.Sqlmock, applied ...int64) {
+	mock.ExpectExec("SELECT pg_advisory_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, name, applied_at FROM schema_migrations").WillReturnRows(appliedRows(applied...))
+}
+
+func appliedRows(applied ...int64) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"version", "name", "applied_at"})
+	for _, version := range applied {
+		rows.AddRow(version, fmt.Sprintf("migration_%d", version), time.Now())
+	}
+	return rows
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := db.LoadMigrations(testMigrations())
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, int64(1), migrations[0].Version)
+	assert.Equal(t, "create_things", migrations[0].Name)
+	assert.Equal(t, "ALTER TABLE things DROP COLUMN name;", migrations[1].Down)
+
+	missingDown := testMigrations()
+	delete(missingDown, "0002_add_name.down.sql")
+	_, err = db.LoadMigrations(missingDown)
+	assert.Error(t, err)
+
+	badName := testMigrations()
+	badName["3-add-index.up.sql"] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+	_, err = db.LoadMigrations(badName)
+	assert.Error(t, err)
+
+	embedded, err := db.EmbeddedMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, embedded)
+	assert.Equal(t, "baseline", embedded[0].Name)
+	for i, migration := range embedded {
+		assert.Equal(t, int64(i+1), migration.Version, "migrations are numbered without gaps")
+	}
+}
+
+func TestShortCodeColumnWidth(t *testing.T) {
+	embedded, err := db.EmbeddedMigrations()
+	require.NoError(t, err)
+
+	// Every width the migrations give short_code, including the one the
+	// baseline widens older columns from, must match the code policy
+	column := regexp.MustCompile(`short_code\s+(?:TYPE\s+)?VARCHAR\((\d+)\)`)
+	widen := regexp.MustCompile(`column_name = 'short_code'\) < (\d+)`)
+	found := 0
+	for _, migration := range embedded {
+		for _, re := range []*regexp.Regexp{column, widen} {
+			for _, match := range re.FindAllStringSubmatch(migration.Up, -1) {
+				assert.Equal(t, strconv.Itoa(shortcode.MaxLength), match[1], "migration %d_%s: %s", migration.Version, migration.Name, match[0])
+				found++
+			}
+		}
+	}
+	assert.GreaterOrEqual(t, found, 3)
+}
+
+func TestMigratorUp(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	migrations, err := db.LoadMigrations(testMigrations())
+	require.NoError(t, err)
+
+	// Version 1 is already applied, so only 2 runs
+	expectMigrationLock(mock, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec("ALTER TABLE things ADD COLUMN name TEXT").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(int64(2), "add_name").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := db.NewMigrator(database, migrations).Up(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorUpFailureRollsBack(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	migrations, err := db.LoadMigrations(testMigrations())
+	require.NoError(t, err)
+
+	expectMigrationLock(mock)
+	mock.ExpectQuery("SELECT to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE things").WillReturnError(errors.New("relation \"things\" already exists"))
+	mock.ExpectRollback()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := db.NewMigrator(database, migrations).Up(context.Background())
+	assert.ErrorContains(t, err, "migration 1_create_things failed")
+	assert.Equal(t, 0, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorDownAndGoto(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	migrations, err := db.LoadMigrations(testMigrations())
+	require.NoError(t, err)
+	migrator := db.NewMigrator(database, migrations)
+
+	// Down 1 rolls back the newest applied migration only
+	expectMigrationLock(mock, 1, 2)
+	mock.ExpectBegin()
+	mock.ExpectExec("ALTER TABLE things DROP COLUMN name").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations WHERE version = \\$1").WithArgs(int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rolledBack, err := migrator.Down(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rolledBack)
+
+	// Goto 0 rolls back everything that is left
+	expectMigrationLock(mock, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec("DROP TABLE things").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations WHERE version = \\$1").WithArgs(int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ran, err := migrator.Goto(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ran)
+
+	_, err = migrator.Goto(context.Background(), 7)
+	assert.ErrorContains(t, err, "unknown migration version 7")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorRefusesNewerSchema(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	migrations, err := db.LoadMigrations(testMigrations())
+	require.NoError(t, err)
+
+	// Version 3 came from a newer release; nothing may run
+	expectMigrationLock(mock, 1, 2, 3)
+	mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ran, err := db.NewMigrator(database, migrations).Up(context.Background())
+	assert.ErrorIs(t, err, db.ErrUnknownMigrations)
+	assert.Equal(t, 0, ran)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorStatus(t *testing.T) {
+	database, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer func() { _ = database.Close() }()
+
+	migrations, err := db.LoadMigrations(testMigrations())
+	require.NoError(t, err)
+	migrator := db.NewMigrator(database, migrations)
+
+	// A fresh database has no schema_migrations yet; Status neither locks
+	// nor creates it
+	mock.ExpectQuery("SELECT to_regclass\\('schema_migrations'\\)").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	statuses, err := migrator.Status(context.Background())
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	assert.Nil(t, statuses[0].AppliedAt)
+	assert.Nil(t, statuses[1].AppliedAt)
+
+	mock.ExpectQuery("SELECT to_regclass\\('schema_migrations'\\)").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT version, name, applied_at FROM schema_migrations").WillReturnRows(appliedRows(1, 3))
+	statuses, err = migrator.Status(context.Background())
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	assert.NotNil(t, statuses[0].AppliedAt)
+	assert.Nil(t, statuses[1].AppliedAt)
+	assert.Equal(t, int64(3), statuses[2].Version)
+	assert.Equal(t, "migration_3", statuses[2].Name)
+	assert.True(t, statuses[2].Unknown)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
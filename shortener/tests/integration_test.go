@@ -4,19 +4,25 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/rusik69/shortener/internal/api"
 	"github.com/rusik69/shortener/internal/db"
-	"github.com/rusik69/shortener/internal/middleware"
 	"github.com/rusik69/shortener/internal/service"
+	"github.com/rusik69/shortener/internal/webhook"
 )
 
 func TestMain(m *testing.M) {
@@ -39,8 +45,12 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 
 	cleanup := func() {
 		// Clean up test data - ignore errors as these are cleanup operations
+		_, _ = testDB.Exec("DELETE FROM webhook_deliveries")
+		_, _ = testDB.Exec("DELETE FROM webhooks")
 		_, _ = testDB.Exec("DELETE FROM clicks")
 		_, _ = testDB.Exec("DELETE FROM short_urls")
+		_, _ = testDB.Exec("DELETE FROM domains")
+		_, _ = testDB.Exec("DELETE FROM api_keys")
 		_, _ = testDB.Exec("DELETE FROM users")
 		if err := testDB.Close(); err != nil {
 			t.Logf("Error closing test database: %v", err)
@@ -54,9 +64,6 @@ func setupTestRouter(testDB *sql.DB) *gin.Engine {
 	repo := db.NewRepository(testDB)
 	svc := service.NewService(repo)
 
-	// Reset rate limiter before each test
-	middleware.ResetRateLimiter()
-
 	router := gin.Default()
 	api.SetupRoutes(router, svc)
 
@@ -173,8 +180,9 @@ func TestIntegrationRedirectFlow(t *testing.T) {
 	w = httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	if w.Code != http.StatusMovedPermanently {
-		t.Errorf("Expected status %d, got %d", http.StatusMovedPermanently, w.Code)
+	// New links default to a temporary redirect so every visit is counted
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected status %d, got %d", http.StatusFound, w.Code)
 	}
 
 	location := w.Header().Get("Location")
@@ -183,6 +191,516 @@ func TestIntegrationRedirectFlow(t *testing.T) {
 	}
 }
 
+func TestIntegrationRedirectType(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	router := setupTestRouter(testDB)
+
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"url":           "https://example.com/moved",
+		"redirect_type": 308,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	shortCode := created["short_code"].(string)
+
+	req, _ = http.NewRequest("GET", "/"+shortCode, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("Expected status %d, got %d", http.StatusPermanentRedirect, w.Code)
+	}
+	if cacheControl := w.Header().Get("Cache-Control"); cacheControl != "public, max-age=86400" {
+		t.Errorf("Expected a cacheable redirect, got Cache-Control %q", cacheControl)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/stats/"+shortCode, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var stats map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to unmarshal stats: %v", err)
+	}
+	if stats["redirect_type"] != float64(http.StatusPermanentRedirect) {
+		t.Errorf("Expected redirect_type 308 in stats, got %v", stats["redirect_type"])
+	}
+}
+
+// browserUserAgent keeps test visits from being classified as bots
+const browserUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36"
+
+func TestIntegrationSplitLink(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	router := setupTestRouter(testDB)
+
+	jsonBody := []byte(`{"url": "https://example.com", "destinations": [
+		{"label": "a", "url": "https://example.com/a", "weight": 50},
+		{"label": "b", "url": "https://example.com/b", "weight": 50}]}`)
+	req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	shortCode := created["short_code"].(string)
+
+	// Visitors from different addresses are spread over both variants, and
+	// each is told which one it got
+	served := map[string]int{}
+	var cookie *http.Cookie
+	for i := 0; i < 20; i++ {
+		req, _ = http.NewRequest("GET", "/"+shortCode, nil)
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i+1))
+		req.Header.Set("User-Agent", browserUserAgent)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected status %d, got %d", http.StatusFound, w.Code)
+		}
+		served[w.Header().Get("Location")]++
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "shortener_variant" {
+				cookie = c
+			}
+		}
+	}
+	if served["https://example.com/a"] == 0 || served["https://example.com/b"] == 0 {
+		t.Errorf("Expected both variants to be served, got %v", served)
+	}
+	if cookie == nil {
+		t.Fatal("Expected a variant cookie")
+	}
+
+	// The cookie keeps a visitor on their variant even from a new address
+	req, _ = http.NewRequest("GET", "/"+shortCode, nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.99")
+	req.Header.Set("User-Agent", browserUserAgent)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if location := w.Header().Get("Location"); location != "https://example.com/"+cookie.Value {
+		t.Errorf("Expected redirect to variant %s, got %s", cookie.Value, location)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/stats/"+shortCode, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var stats struct {
+		Clicks   int `json:"clicks"`
+		Variants []struct {
+			Label  string `json:"label"`
+			Clicks int    `json:"clicks"`
+		} `json:"variants"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to unmarshal stats: %v", err)
+	}
+	if len(stats.Variants) != 2 {
+		t.Fatalf("Expected 2 variants in stats, got %+v", stats.Variants)
+	}
+	total := 0
+	for _, variant := range stats.Variants {
+		total += variant.Clicks
+	}
+	if total != 21 || stats.Clicks != 21 {
+		t.Errorf("Expected 21 clicks split between variants, got %d of %d", total, stats.Clicks)
+	}
+}
+
+func TestIntegrationTargetingRules(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	router := setupTestRouter(testDB)
+
+	jsonBody := []byte(`{"url": "https://example.com", "rules": [
+		{"name": "ios", "os": ["iOS"], "url": "https://apps.apple.com/app/id1"},
+		{"name": "german", "languages": ["de"], "url": "https://example.de/"}]}`)
+	req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	shortCode := created["short_code"].(string)
+
+	visits := []struct {
+		userAgent string
+		language  string
+		want      string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1", "de", "https://apps.apple.com/app/id1"},
+		{browserUserAgent, "de-DE,en;q=0.5", "https://example.de/"},
+		{browserUserAgent, "en-US", "https://example.com"},
+	}
+	for _, visit := range visits {
+		req, _ = http.NewRequest("GET", "/"+shortCode, nil)
+		req.Header.Set("User-Agent", visit.userAgent)
+		req.Header.Set("Accept-Language", visit.language)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if location := w.Header().Get("Location"); location != visit.want {
+			t.Errorf("Expected redirect to %s, got %s", visit.want, location)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/api/stats/"+shortCode, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var stats struct {
+		Rules []struct {
+			Name   string `json:"name"`
+			Clicks int    `json:"clicks"`
+		} `json:"rules"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to unmarshal stats: %v", err)
+	}
+	if len(stats.Rules) != 2 || stats.Rules[0].Clicks != 1 || stats.Rules[1].Clicks != 1 {
+		t.Errorf("Expected one click per rule, got %+v", stats.Rules)
+	}
+}
+
+func TestIntegrationCustomDomains(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	router := setupTestRouter(testDB)
+	svc := service.NewService(db.NewRepository(testDB))
+	_, err := svc.SetDomain(db.Domain{
+		Host:         "go.brand-a.test",
+		RedirectType: http.StatusMovedPermanently,
+		NotFoundURL:  "https://brand-a.test/missing",
+		RootURL:      "https://brand-a.test/",
+	})
+	if err != nil {
+		t.Fatalf("Failed to add domain: %v", err)
+	}
+
+	// The same code can be taken once per domain
+	shorten := func(host, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(fmt.Sprintf(`{"url": %q, "custom_code": "promo"}`, url)))
+		req.Host = host
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w := shorten("go.brand-a.test:443", "https://brand-a.test/sale")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"full_url":"http://go.brand-a.test/promo"`) {
+		t.Errorf("Expected full_url on the domain, got %s", w.Body.String())
+	}
+	if w = shorten("brand-b.test", "https://brand-b.test/sale"); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w = shorten("go.brand-a.test", "https://brand-a.test/other"); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	tests := []struct {
+		host     string
+		path     string
+		status   int
+		location string
+	}{
+		{"go.brand-a.test", "/promo", http.StatusMovedPermanently, "https://brand-a.test/sale"},
+		{"brand-b.test", "/promo", http.StatusFound, "https://brand-b.test/sale"},
+		{"go.brand-a.test", "/nothing", http.StatusFound, "https://brand-a.test/missing"},
+		{"brand-b.test", "/nothing", http.StatusNotFound, ""},
+		{"go.brand-a.test", "/", http.StatusFound, "https://brand-a.test/"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		req.Host = tt.host
+		req.Header.Set("User-Agent", browserUserAgent)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s%s: expected %d %s, got %d %s", tt.host, tt.path, tt.status, tt.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestIntegrationWebhooks(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := db.NewRepository(testDB)
+	svc := service.NewService(repo)
+
+	var mu sync.Mutex
+	var received []db.WebhookEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := webhook.Verify("whsec_integration", r.Header.Get(webhook.SignatureHeader), body, time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var event db.WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	user, err := repo.CreateUser("crm", nil, true)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	// The service refuses loopback receivers, so subscribe directly
+	_, err = repo.CreateWebhook(db.Webhook{
+		UserID:     user.ID,
+		URL:        receiver.URL,
+		Secret:     "whsec_integration",
+		Events:     db.EventNames(service.WebhookEvents),
+		Thresholds: db.ClickThresholds{2},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create webhook: %v", err)
+	}
+
+	code, err := svc.CreateShortURL("https://example.com/crm", "", service.CreateOptions{OwnerID: &user.ID})
+	if err != nil {
+		t.Fatalf("Failed to create short URL: %v", err)
+	}
+	link, err := repo.GetShortURLByCode("", code)
+	if err != nil {
+		t.Fatalf("Failed to load short URL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := repo.IncrementClickCount(link.ID); err != nil {
+			t.Fatalf("Failed to count click: %v", err)
+		}
+	}
+
+	n, err := webhook.New(repo, webhook.Config{AllowInternal: true}).DeliverDue(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to deliver webhooks: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected 3 deliveries, got %d", n)
+	}
+
+	events := map[string]db.WebhookEvent{}
+	for _, event := range received {
+		events[event.Event] = event
+	}
+	if events[db.EventLinkCreated].Link.Code != code {
+		t.Errorf("Expected link.created for %s, got %+v", code, events[db.EventLinkCreated])
+	}
+	if events[db.EventFirstClick].Link.ClickCount != 1 {
+		t.Errorf("Expected link.first_click at 1 click, got %+v", events[db.EventFirstClick])
+	}
+	if events[db.EventClickThreshold].Threshold != 2 {
+		t.Errorf("Expected link.click_threshold for 2 clicks, got %+v", events[db.EventClickThreshold])
+	}
+
+	deliveries, err := repo.ListWebhookDeliveries(user.ID, 10)
+	if err != nil {
+		t.Fatalf("Failed to list deliveries: %v", err)
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status != db.DeliveryDelivered || delivery.Attempts != 1 {
+			t.Errorf("Expected delivered after one attempt, got %+v", delivery)
+		}
+	}
+}
+
+func TestIntegrationExport(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := db.NewRepository(testDB)
+	svc := service.NewService(repo)
+
+	user, err := repo.CreateUser("analyst", nil, true)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	code, err := svc.CreateShortURL("https://example.com/export", "", service.CreateOptions{OwnerID: &user.ID})
+	if err != nil {
+		t.Fatalf("Failed to create short URL: %v", err)
+	}
+	link, err := repo.GetShortURLByCode("", code)
+	if err != nil {
+		t.Fatalf("Failed to load short URL: %v", err)
+	}
+	err = repo.RecordClicks([]db.NewClick{
+		{ShortURLID: link.ID, IPAddress: "203.0.113.7", Country: "DE", Browser: "Firefox"},
+		{ShortURLID: link.ID, IPAddress: "203.0.113.8", Browser: "Googlebot", IsBot: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to record clicks: %v", err)
+	}
+
+	var clicks bytes.Buffer
+	if err := svc.Export(context.Background(), &user.ID, service.ExportOptions{Format: "ndjson"}, &clicks); err != nil {
+		t.Fatalf("Failed to export clicks: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(clicks.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 human click, got %d: %s", len(lines), clicks.String())
+	}
+	var click db.ExportedClick
+	if err := json.Unmarshal([]byte(lines[0]), &click); err != nil {
+		t.Fatalf("Failed to decode click: %v", err)
+	}
+	if click.ShortCode != code || click.IPAddress != "203.0.113.7" || click.Country != "DE" {
+		t.Errorf("Unexpected click: %+v", click)
+	}
+
+	var links bytes.Buffer
+	opts := service.ExportOptions{Dataset: service.DatasetLinks, From: time.Now().Add(-time.Hour)}
+	if err := svc.Export(context.Background(), &user.ID, opts, &links); err != nil {
+		t.Fatalf("Failed to export links: %v", err)
+	}
+	if !strings.Contains(links.String(), code+",,https://example.com/export,analyst,") {
+		t.Errorf("Expected %s in links export, got %s", code, links.String())
+	}
+}
+
+func TestIntegrationMigrations(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	migrations, err := db.EmbeddedMigrations()
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	migrator := db.NewMigrator(testDB, migrations)
+	ctx := context.Background()
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read status: %v", err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			t.Errorf("Expected migration %d_%s to be applied", status.Version, status.Name)
+		}
+	}
+
+	triggerExists := func() bool {
+		var exists bool
+		err := testDB.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'short_urls_set_updated_at')").Scan(&exists)
+		if err != nil {
+			t.Fatalf("Failed to look up trigger: %v", err)
+		}
+		return exists
+	}
+
+	// Roll the newest migration back and forth
+	latest := migrations[len(migrations)-1]
+	if n, err := migrator.Goto(ctx, latest.Version-1); err != nil || n != 1 {
+		t.Fatalf("Expected to roll back one migration, got %d: %v", n, err)
+	}
+	if latest.Name == "updated_at_triggers" && triggerExists() {
+		t.Errorf("Expected trigger to be dropped")
+	}
+	if n, err := migrator.Up(ctx); err != nil || n != 1 {
+		t.Fatalf("Expected to apply one migration, got %d: %v", n, err)
+	}
+	if !triggerExists() {
+		t.Errorf("Expected trigger after migrating up")
+	}
+
+	// Running again is a no-op
+	if n, err := migrator.Up(ctx); err != nil || n != 0 {
+		t.Errorf("Expected nothing to apply, got %d: %v", n, err)
+	}
+}
+
+func TestIntegrationProtectedLink(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	router := setupTestRouter(testDB)
+
+	jsonBody, err := json.Marshal(map[string]string{
+		"url":      "https://example.com/internal",
+		"password": "hunter22",
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	shortCode := response["short_code"].(string)
+
+	// Without the password there is no redirect
+	req, _ = http.NewRequest("GET", "/"+shortCode, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/"+shortCode+"/unlock", strings.NewReader("password=hunter22"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected an unlock cookie, got %v", cookies)
+	}
+
+	req, _ = http.NewRequest("GET", "/"+shortCode, nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://example.com/internal" {
+		t.Errorf("Expected redirect to https://example.com/internal, got %s", location)
+	}
+}
+
 func TestIntegrationGetStats(t *testing.T) {
 	testDB, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -281,8 +799,9 @@ func TestIntegrationRateLimiting(t *testing.T) {
 		t.Fatalf("Failed to marshal request body: %v", err)
 	}
 
-	// Make requests up to the rate limit
-	for i := 0; i < 101; i++ {
+	// Make requests until the shorten bucket is empty
+	burst := api.DefaultRateLimits.Shorten.Burst
+	for i := 0; i <= burst; i++ {
 		req, err := http.NewRequest("POST", "/api/shorten", bytes.NewBuffer(jsonBody))
 		if err != nil {
 			t.Fatalf("Failed to create request: %v", err)
@@ -293,16 +812,18 @@ func TestIntegrationRateLimiting(t *testing.T) {
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 
-		// The first 100 requests should succeed, the 101st should be rate limited
-		if i < 100 {
+		// Requests within the burst should succeed, the next one should be rate limited
+		if i < burst {
 			if w.Code != http.StatusCreated {
 				t.Errorf("Request %d: Expected status %d, got %d", i+1, http.StatusCreated, w.Code)
 			}
 		} else {
-			// The 101st request should be rate limited
 			if w.Code != http.StatusTooManyRequests {
 				t.Errorf("Expected rate limiting on request %d, got status %d", i+1, w.Code)
 			}
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("Expected a Retry-After header")
+			}
 		}
 	}
 }
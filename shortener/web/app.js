@@ -1,12 +1,109 @@
+// SHA-256 round constants
+const SHA256_K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+];
+
+function rotr(x, n) {
+    return (x >>> n) | (x << (32 - n));
+}
+
+// sha256 hashes an ASCII string and returns the digest as eight 32-bit words.
+// It runs synchronously and, unlike crypto.subtle, also works over plain HTTP.
+function sha256(ascii) {
+    const bytes = new Uint8Array(((ascii.length + 9 + 63) >> 6) << 6);
+    for (let i = 0; i < ascii.length; i++) {
+        bytes[i] = ascii.charCodeAt(i);
+    }
+    bytes[ascii.length] = 0x80;
+    const view = new DataView(bytes.buffer);
+    view.setUint32(bytes.length - 4, ascii.length * 8);
+
+    const h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+    const w = new Uint32Array(64);
+    for (let offset = 0; offset < bytes.length; offset += 64) {
+        for (let i = 0; i < 16; i++) {
+            w[i] = view.getUint32(offset + i * 4);
+        }
+        for (let i = 16; i < 64; i++) {
+            const s0 = rotr(w[i - 15], 7) ^ rotr(w[i - 15], 18) ^ (w[i - 15] >>> 3);
+            const s1 = rotr(w[i - 2], 17) ^ rotr(w[i - 2], 19) ^ (w[i - 2] >>> 10);
+            w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+        }
+
+        let [a, b, c, d, e, f, g, k] = h;
+        for (let i = 0; i < 64; i++) {
+            const t1 = (k + (rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)) + ((e & f) ^ (~e & g)) + SHA256_K[i] + w[i]) | 0;
+            const t2 = ((rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+            k = g;
+            g = f;
+            f = e;
+            e = (d + t1) | 0;
+            d = c;
+            c = b;
+            b = a;
+            a = (t1 + t2) | 0;
+        }
+        h[0] = (h[0] + a) | 0;
+        h[1] = (h[1] + b) | 0;
+        h[2] = (h[2] + c) | 0;
+        h[3] = (h[3] + d) | 0;
+        h[4] = (h[4] + e) | 0;
+        h[5] = (h[5] + f) | 0;
+        h[6] = (h[6] + g) | 0;
+        h[7] = (h[7] + k) | 0;
+    }
+    return h;
+}
+
+// leadingZeroBits counts the zero bits at the start of a digest
+function leadingZeroBits(words) {
+    let n = 0;
+    for (const word of words) {
+        if (word !== 0) {
+            return n + Math.clz32(word);
+        }
+        n += 32;
+    }
+    return n;
+}
+
+// solveChallenge finds a solution such that SHA-256(token + ":" + solution)
+// starts with the required number of zero bits. It yields to the browser
+// between rounds so the page stays responsive.
+async function solveChallenge(challenge) {
+    const prefix = challenge.token + ':';
+    for (let solution = 0; ; solution += 5000) {
+        for (let i = solution; i < solution + 5000; i++) {
+            if (leadingZeroBits(sha256(prefix + i)) >= challenge.difficulty) {
+                return String(i);
+            }
+        }
+        await new Promise(resolve => setTimeout(resolve, 0));
+    }
+}
+
 document.addEventListener('DOMContentLoaded', function() {
     const form = document.getElementById('shortenForm');
     const urlInput = document.getElementById('url');
     const customCheckbox = document.getElementById('custom');
     const customCodeField = document.getElementById('customCodeField');
     const customCodeInput = document.getElementById('customCode');
+    const expiresInSelect = document.getElementById('expiresIn');
+    const passwordInput = document.getElementById('linkPassword');
     const resultDiv = document.getElementById('result');
     const shortUrlInput = document.getElementById('shortUrl');
     const copyButton = document.getElementById('copyButton');
+    const statusText = document.getElementById('status');
+    const qrImage = document.getElementById('qrCode');
+    const qrPngLink = document.getElementById('qrPng');
+    const qrSvgLink = document.getElementById('qrSvg');
 
     // Toggle custom code field
     customCheckbox.addEventListener('change', function() {
@@ -30,22 +127,57 @@ document.addEventListener('DOMContentLoaded', function() {
             requestBody.custom_code = customCodeInput.value.trim();
         }
 
+        // Protect the link if a password was entered
+        if (passwordInput.value) {
+            requestBody.password = passwordInput.value;
+        }
+
+        // Add expiry if one was selected
+        if (expiresInSelect.value) {
+            requestBody.expires_in = parseInt(expiresInSelect.value, 10);
+        }
+
         try {
             // Make API request
-            const response = await fetch('/api/shorten', {
+            const send = (headers) => fetch('/api/shorten', {
                 method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json'
-                },
+                headers: Object.assign({ 'Content-Type': 'application/json' }, headers),
                 body: JSON.stringify(requestBody)
             });
+            let response = await send({});
+
+            // Busy clients have to solve a proof-of-work challenge first
+            for (let attempt = 0; response.status === 403 && attempt < 3; attempt++) {
+                const body = await response.json();
+                if (!body.challenge) {
+                    throw new Error(body.error || 'Failed to shorten URL');
+                }
+                statusText.textContent = 'Checking your browser, this can take a few seconds...';
+                statusText.classList.remove('hidden');
+                const solution = await solveChallenge(body.challenge);
+                response = await send({
+                    'X-Challenge-Token': body.challenge.token,
+                    'X-Challenge-Solution': solution
+                });
+            }
+            statusText.classList.add('hidden');
 
             if (!response.ok) {
-                throw new Error('Failed to shorten URL');
+                const body = await response.json().catch(() => ({}));
+                // URL policy rejections explain which rule was hit
+                throw new Error((body.code && body.details) || body.error || 'Failed to shorten URL');
             }
 
             const data = await response.json();
             shortUrlInput.value = data.full_url;
+
+            // Print-ready QR codes for the new link
+            const qrBase = '/api/qr/' + encodeURIComponent(data.short_code);
+            qrImage.src = qrBase + '?size=256';
+            qrPngLink.href = qrBase + '?size=1024';
+            qrSvgLink.href = qrBase + '?format=svg';
+            qrPngLink.download = data.short_code + '.png';
+            qrSvgLink.download = data.short_code + '.svg';
             resultDiv.classList.remove('hidden');
             
             copyButton.addEventListener('click', () => {
@@ -58,6 +190,7 @@ document.addEventListener('DOMContentLoaded', function() {
                     });
             });
         } catch (error) {
+            statusText.classList.add('hidden');
             alert('Error: ' + error.message);
         }
     });